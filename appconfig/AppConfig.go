@@ -1,6 +1,7 @@
 package appconfig
 
 import (
+	"fmt"
 	"os"
 	"os/user"
 	"path/filepath"
@@ -17,9 +18,50 @@ type AppConfig struct {
 }
 
 type FolderConfig struct {
-	Name   string         `yaml:"name"`
-	Local  ProviderConfig `yaml:"local"`
-	Remote ProviderConfig `yaml:"remote"`
+	Name      string           `yaml:"name"`
+	Local     ProviderConfig   `yaml:"local"`
+	Remote    ProviderConfig   `yaml:"remote"`
+	Retention *RetentionConfig `yaml:"retention,omitempty"`
+	// Amount of files to transfer at the same time. Defaults to 1.
+	Jobs int `yaml:"jobs,omitempty"`
+	// Gitignore style patterns of local files that are not synced, on top of the ones in .buttercupignore
+	Exclude []string `yaml:"exclude,omitempty"`
+	// Patterns of files that are synced even though an exclude pattern matches them
+	Include []string `yaml:"include,omitempty"`
+	// Record the owner and group of files, and set them when pulling. Setting them usually needs root.
+	PreserveOwner bool `yaml:"preserveOwner,omitempty"`
+	// Record extended attributes of files, and set them when pulling.
+	PreserveXattrs bool `yaml:"preserveXattrs,omitempty"`
+	// What to do with symbolic links: "follow" syncs what they point to (the default), "preserve" syncs the links themselves.
+	Symlinks string `yaml:"symlinks,omitempty"`
+	// Hide what the remote stores: blob sizes are padded and blobs get the same timestamps. Only affects blobs written from then on.
+	Privacy bool `yaml:"privacy,omitempty"`
+	// Store small files together in packs on the remote, so it doesn't show how many there are.
+	PackSmallFiles bool `yaml:"packSmallFiles,omitempty"`
+}
+
+// Amount of files to transfer at the same time. A value set on the command line (> 0) overrides the config.
+func (f FolderConfig) GetJobs(override int) int {
+	if override > 0 {
+		return override
+	}
+
+	return max(f.Jobs, 1)
+}
+
+// Which previous versions of files to keep on the remote when running `gc`.
+// A version is kept if any of the rules keeps it. Without a retention config, all versions are kept.
+type RetentionConfig struct {
+	// Keep the n most recent previous versions of each file
+	KeepLast int `yaml:"keepLast"`
+	// Keep every version that was current at some point in the last n days
+	KeepDays int `yaml:"keepDays"`
+	// Keep the version that was current at the end of each of the last n days
+	KeepDaily int `yaml:"keepDaily"`
+	// Keep the version that was current at the end of each of the last n weeks
+	KeepWeekly int `yaml:"keepWeekly"`
+	// Keep the version that was current at the end of each of the last n months
+	KeepMonthly int `yaml:"keepMonthly"`
 }
 
 type ProviderConfig struct {
@@ -28,6 +70,16 @@ type ProviderConfig struct {
 	EfsConfig  *EfsProviderConfig `yaml:"efsConfig,omitempty"`
 	S3Config   *S3ProviderConfig  `yaml:"s3Config,omitempty"`
 	ClientName string             `yaml:"-"`
+	// Ignore patterns of the folder, only set for the local
+	Exclude []string `yaml:"-"`
+	Include []string `yaml:"-"`
+	// How files on disk are handled, only set for the local
+	PreserveOwner  bool   `yaml:"-"`
+	PreserveXattrs bool   `yaml:"-"`
+	Symlinks       string `yaml:"-"`
+	// What the remote shows about the files, only set for the remote
+	Privacy        bool `yaml:"-"`
+	PackSmallFiles bool `yaml:"-"`
 }
 
 func (c ProviderConfig) GetFolderPath() string {
@@ -48,12 +100,21 @@ type FsProviderConfig struct {
 // Used as 'remote' but accessible through some file interface
 type EfsProviderConfig struct {
 	Path       string `yaml:"path"`
-	Passphrase string `yaml:"passphrase"`
+	Passphrase string `yaml:"passphrase,omitempty"`
+	// Public keys to encrypt to instead of the passphrase: age (age1...) or SSH (ssh-ed25519, ssh-rsa) keys
+	Recipients []string `yaml:"recipients,omitempty"`
+	// Public keys that can read the index but not the files, for devices that only push
+	IndexRecipients []string `yaml:"indexRecipients,omitempty"`
+	// Age identity files or unencrypted SSH private keys to decrypt with
+	Identities []string `yaml:"identities,omitempty"`
+	// Keys from before `rekey` changed them. Only used to decrypt, until the remote is re-encrypted.
+	OldPassphrase string   `yaml:"oldPassphrase,omitempty"`
+	OldIdentities []string `yaml:"oldIdentities,omitempty"`
 }
 
 // S3 File System Provider
 type S3ProviderConfig struct {
-	Passphrase     string `yaml:"passphrase"`
+	Passphrase     string `yaml:"passphrase,omitempty"`
 	AccessKey      string `yaml:"accessKey"`
 	SecretKey      string `yaml:"secretKey"`
 	BasePath       string `yaml:"basePath"`
@@ -61,6 +122,15 @@ type S3ProviderConfig struct {
 	Endpoint       string `yaml:"endpoint"`
 	ForcePathStyle bool   `yaml:"forcePathStyle"`
 	Region         string `yaml:"region"`
+	// Public keys to encrypt to instead of the passphrase: age (age1...) or SSH (ssh-ed25519, ssh-rsa) keys
+	Recipients []string `yaml:"recipients,omitempty"`
+	// Public keys that can read the index but not the files, for devices that only push
+	IndexRecipients []string `yaml:"indexRecipients,omitempty"`
+	// Age identity files or unencrypted SSH private keys to decrypt with
+	Identities []string `yaml:"identities,omitempty"`
+	// Keys from before `rekey` changed them. Only used to decrypt, until the remote is re-encrypted.
+	OldPassphrase string   `yaml:"oldPassphrase,omitempty"`
+	OldIdentities []string `yaml:"oldIdentities,omitempty"`
 }
 
 func (c *AppConfig) GetDefault() FolderConfig {
@@ -70,9 +140,7 @@ func (c *AppConfig) GetDefault() FolderConfig {
 
 	for _, folder := range c.Folders {
 		if folder.Name == c.DefaultFolder {
-			folder.Local.ClientName = c.ClientName
-			folder.Remote.ClientName = c.ClientName
-			return folder
+			return c.prepareFolder(folder)
 		}
 	}
 
@@ -82,15 +150,32 @@ func (c *AppConfig) GetDefault() FolderConfig {
 func (c *AppConfig) GetFolder(name string) FolderConfig {
 	for _, folder := range c.Folders {
 		if folder.Name == name {
-			folder.Local.ClientName = c.ClientName
-			folder.Remote.ClientName = c.ClientName
-			return folder
+			return c.prepareFolder(folder)
 		}
 	}
 
 	panic("No configuration for folder: " + name)
 }
 
+// Pass the settings of the app and the folder on to its providers, and resolve its secrets.
+func (c *AppConfig) prepareFolder(folder FolderConfig) FolderConfig {
+	folder.Local.ClientName = c.ClientName
+	folder.Remote.ClientName = c.ClientName
+	folder.Local.Exclude = folder.Exclude
+	folder.Local.Include = folder.Include
+	folder.Local.PreserveOwner = folder.PreserveOwner
+	folder.Local.PreserveXattrs = folder.PreserveXattrs
+	folder.Local.Symlinks = folder.Symlinks
+	folder.Remote.Privacy = folder.Privacy
+	folder.Remote.PackSmallFiles = folder.PackSmallFiles
+
+	err := folder.resolveSecrets()
+	if err != nil {
+		panic(fmt.Errorf("cannot resolve secrets of folder %v: %w", folder.Name, err))
+	}
+	return folder
+}
+
 func LoadFromUser() (AppConfig, error) {
 	u, err := user.Current()
 	if err != nil {
@@ -0,0 +1,195 @@
+package appconfig
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+// Secrets in the config can be a reference instead of the secret itself:
+//
+//	env:NAME                  an environment variable
+//	file:/path/to/file        the contents of a file, a leading ~/ is the home folder
+//	cmd:pass show buttercup   the output of a command
+//	keyring:service/account   a password in the keyring (Secret Service on Linux, the Keychain on macOS)
+//	raw:secret                the secret itself, for a secret that starts with one of these prefixes
+//
+// Anything else is the secret itself. Trailing newlines of files and commands are dropped.
+func ResolveSecret(value string) (string, error) {
+	kind, ref, found := strings.Cut(value, ":")
+	if !found {
+		return value, nil
+	}
+
+	switch kind {
+	case "raw":
+		return ref, nil
+	case "env":
+		secret, ok := os.LookupEnv(ref)
+		if !ok {
+			return "", fmt.Errorf("environment variable %v is not set", ref)
+		}
+		return secret, nil
+	case "file":
+		data, err := os.ReadFile(expandHome(ref))
+		if err != nil {
+			return "", fmt.Errorf("cannot read secret file: %w", err)
+		}
+		return trimNewlines(string(data)), nil
+	case "cmd":
+		return runSecretCommand(ref)
+	case "keyring":
+		return readKeyring(ref)
+	}
+
+	return value, nil
+}
+
+// Asks for a secret that isn't in the config. Replaced in tests.
+var promptSecret = func(label string) (string, error) {
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return "", fmt.Errorf("%v is not set, and there is no terminal to ask for it", label)
+	}
+
+	fmt.Fprintf(os.Stderr, "%v: ", label)
+	secret, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", fmt.Errorf("cannot read %v: %w", label, err)
+	}
+	if len(secret) == 0 {
+		return "", fmt.Errorf("%v is empty", label)
+	}
+
+	return string(secret), nil
+}
+
+// Resolve a secret, or ask for it if it isn't set and required.
+func resolveSecret(value string, required bool, label string) (string, error) {
+	if value == "" {
+		if !required {
+			return "", nil
+		}
+		return promptSecret(label)
+	}
+
+	secret, err := ResolveSecret(value)
+	if err != nil {
+		return "", fmt.Errorf("%v: %w", label, err)
+	}
+	return secret, nil
+}
+
+// Resolve the secrets of the remote of a folder. The configs are copied, so the secrets never end up in the loaded config.
+func (f *FolderConfig) resolveSecrets() error {
+	var err error
+
+	if f.Remote.EfsConfig != nil {
+		conf := *f.Remote.EfsConfig
+		//With public keys, the passphrase is only used to read old data
+		usesPassphrase := len(conf.Recipients) == 0 && len(conf.Identities) == 0
+		conf.Passphrase, err = resolveSecret(conf.Passphrase, usesPassphrase, fmt.Sprintf("Passphrase for %v", f.Name))
+		if err != nil {
+			return err
+		}
+		conf.OldPassphrase, err = resolveSecret(conf.OldPassphrase, false, fmt.Sprintf("Old passphrase for %v", f.Name))
+		if err != nil {
+			return err
+		}
+		f.Remote.EfsConfig = &conf
+	}
+
+	if f.Remote.S3Config != nil {
+		conf := *f.Remote.S3Config
+		usesPassphrase := len(conf.Recipients) == 0 && len(conf.Identities) == 0
+		conf.Passphrase, err = resolveSecret(conf.Passphrase, usesPassphrase, fmt.Sprintf("Passphrase for %v", f.Name))
+		if err != nil {
+			return err
+		}
+		conf.OldPassphrase, err = resolveSecret(conf.OldPassphrase, false, fmt.Sprintf("Old passphrase for %v", f.Name))
+		if err != nil {
+			return err
+		}
+		conf.AccessKey, err = resolveSecret(conf.AccessKey, true, fmt.Sprintf("S3 access key for %v", f.Name))
+		if err != nil {
+			return err
+		}
+		conf.SecretKey, err = resolveSecret(conf.SecretKey, true, fmt.Sprintf("S3 secret key for %v", f.Name))
+		if err != nil {
+			return err
+		}
+		f.Remote.S3Config = &conf
+	}
+
+	return nil
+}
+
+func runSecretCommand(command string) (string, error) {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", command)
+	} else {
+		cmd = exec.Command("sh", "-c", command)
+	}
+	//Lets commands like pass ask for their own passphrase
+	cmd.Stdin = os.Stdin
+	cmd.Stderr = os.Stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("secret command failed: %w", err)
+	}
+	return trimNewlines(string(out)), nil
+}
+
+// Look up a password in the keyring with the tools that come with the system, ref is "service/account".
+func readKeyring(ref string) (string, error) {
+	service, account, found := strings.Cut(ref, "/")
+	if !found || service == "" || account == "" {
+		return "", fmt.Errorf("invalid keyring reference %q, expected service/account", ref)
+	}
+
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "linux", "freebsd", "openbsd", "netbsd":
+		cmd = exec.Command("secret-tool", "lookup", "service", service, "account", account)
+	case "darwin":
+		cmd = exec.Command("security", "find-generic-password", "-s", service, "-a", account, "-w")
+	default:
+		return "", errors.New("the keyring is not supported on this platform")
+	}
+
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("cannot read %v from keyring: %w", ref, err)
+	}
+
+	secret := trimNewlines(string(out))
+	if secret == "" {
+		return "", fmt.Errorf("%v is not in the keyring", ref)
+	}
+	return secret, nil
+}
+
+func expandHome(path string) string {
+	rest, ok := strings.CutPrefix(path, "~/")
+	if !ok {
+		return path
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+	return filepath.Join(home, rest)
+}
+
+func trimNewlines(s string) string {
+	return strings.TrimRight(s, "\r\n")
+}
@@ -0,0 +1,89 @@
+package appconfig
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolveSecret(t *testing.T) {
+	t.Setenv("BUTTERCUP_TEST_SECRET", "from env")
+	secretFile := filepath.Join(t.TempDir(), "secret")
+	assert.Nil(t, os.WriteFile(secretFile, []byte("from file\n"), 0600))
+
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"plain", "plain"},
+		{"with:colon", "with:colon"},
+		{"raw:env:BUTTERCUP_TEST_SECRET", "env:BUTTERCUP_TEST_SECRET"},
+		{"raw:raw:", "raw:"},
+		{"env:BUTTERCUP_TEST_SECRET", "from env"},
+		{"file:" + secretFile, "from file"},
+	}
+	if runtime.GOOS != "windows" {
+		tests = append(tests, struct {
+			value string
+			want  string
+		}{"cmd:echo from command", "from command"})
+	}
+
+	for _, tt := range tests {
+		secret, err := ResolveSecret(tt.value)
+		assert.Nil(t, err)
+		assert.Equal(t, secret, tt.want)
+	}
+
+	for _, value := range []string{"env:BUTTERCUP_TEST_MISSING", "file:" + filepath.Join(t.TempDir(), "missing"), "cmd:exit 1", "keyring:nope"} {
+		_, err := ResolveSecret(value)
+		assert.NotNil(t, err, value)
+	}
+}
+
+func TestResolveSecrets(t *testing.T) {
+	original := promptSecret
+	defer func() { promptSecret = original }()
+	prompted := []string{}
+	promptSecret = func(label string) (string, error) {
+		prompted = append(prompted, label)
+		return "typed", nil
+	}
+	t.Setenv("BUTTERCUP_TEST_SECRET", "from env")
+
+	conf := AppConfig{
+		Folders: []FolderConfig{
+			{Name: "s3", Remote: ProviderConfig{S3Config: &S3ProviderConfig{AccessKey: "key", SecretKey: "env:BUTTERCUP_TEST_SECRET"}}},
+			{Name: "keys", Remote: ProviderConfig{EfsConfig: &EfsProviderConfig{Recipients: []string{"age1..."}}}},
+			{Name: "literal", Remote: ProviderConfig{EfsConfig: &EfsProviderConfig{Passphrase: "raw:env:not-a-reference"}}},
+		},
+	}
+
+	folder := conf.GetFolder("s3")
+	assert.Equal(t, folder.Remote.S3Config.AccessKey, "key")
+	assert.Equal(t, folder.Remote.S3Config.SecretKey, "from env")
+	assert.Equal(t, folder.Remote.S3Config.Passphrase, "typed")
+	assert.Equal(t, folder.Remote.S3Config.OldPassphrase, "")
+	assert.Equal(t, prompted, []string{"Passphrase for s3"})
+	//The loaded config keeps the references
+	assert.Equal(t, conf.Folders[0].Remote.S3Config.SecretKey, "env:BUTTERCUP_TEST_SECRET")
+	assert.Equal(t, conf.Folders[0].Remote.S3Config.Passphrase, "")
+
+	//A secret that looks like a reference can be escaped
+	folder = conf.GetFolder("literal")
+	assert.Equal(t, folder.Remote.EfsConfig.Passphrase, "env:not-a-reference")
+
+	//Public keys don't need a passphrase
+	folder = conf.GetFolder("keys")
+	assert.Equal(t, folder.Remote.EfsConfig.Passphrase, "")
+	assert.Len(t, prompted, 1)
+
+	promptSecret = func(label string) (string, error) {
+		return "", errors.New("no terminal")
+	}
+	assert.Panics(t, func() { conf.GetFolder("s3") })
+}
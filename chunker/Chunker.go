@@ -0,0 +1,137 @@
+package chunker
+
+import (
+	"errors"
+	"io"
+)
+
+// Chunk size bounds. Chunks are cut where the content says so (FastCDC),
+// so an edit in a big file only changes the chunks around the edit.
+const MinSize = 512 * 1024
+const AvgSize = 2 * 1024 * 1024
+const MaxSize = 8 * 1024 * 1024
+
+// Size of the buffer a chunker starts with, it grows up to MaxSize when the stream is bigger.
+// Most files are small, they shouldn't cost a whole MaxSize buffer each.
+const initialBufSize = 64 * 1024
+
+// Below the average size we use a stricter mask (fewer cut points), above it a looser one.
+// This normalizes the chunk sizes around AvgSize.
+var maskSmall = topBits(23)
+var maskLarge = topBits(19)
+
+var gear [256]uint64
+
+func init() {
+	//Fixed seed, chunk boundaries must be the same for every client and every version.
+	seed := uint64(0x6275747465726375)
+	for i := range gear {
+		seed = splitmix64(seed)
+		gear[i] = seed
+	}
+}
+
+func New(reader io.Reader) *Chunker {
+	return &Chunker{
+		reader: reader,
+		buf:    make([]byte, 0, initialBufSize),
+	}
+}
+
+// Splits a stream into content-defined chunks.
+type Chunker struct {
+	reader io.Reader
+	buf    []byte
+	eof    bool
+}
+
+// Returns the next chunk, or io.EOF when the stream is exhausted.
+// The returned slice is a copy that the caller owns, it stays valid after later calls.
+func (c *Chunker) Next() ([]byte, error) {
+	err := c.fill()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(c.buf) == 0 {
+		return nil, io.EOF
+	}
+
+	n := cutPoint(c.buf)
+	chunk := make([]byte, n)
+	copy(chunk, c.buf[:n])
+
+	//Move the remainder to the front
+	c.buf = c.buf[:copy(c.buf, c.buf[n:])]
+
+	return chunk, nil
+}
+
+// Fill the buffer up to MaxSize, or until the reader is exhausted.
+func (c *Chunker) fill() error {
+	for !c.eof && len(c.buf) < MaxSize {
+		if len(c.buf) == cap(c.buf) {
+			grown := make([]byte, len(c.buf), min(2*cap(c.buf), MaxSize))
+			copy(grown, c.buf)
+			c.buf = grown
+		}
+
+		n, err := c.reader.Read(c.buf[len(c.buf):cap(c.buf)])
+		c.buf = c.buf[:len(c.buf)+n]
+		if errors.Is(err, io.EOF) {
+			c.eof = true
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Find the length of the first chunk in data.
+func cutPoint(data []byte) int {
+	n := len(data)
+	if n <= MinSize {
+		return n
+	}
+	if n > MaxSize {
+		n = MaxSize
+	}
+
+	normal := AvgSize
+	if n < normal {
+		normal = n
+	}
+
+	var fp uint64
+	i := MinSize
+	for ; i < normal; i++ {
+		fp = (fp << 1) + gear[data[i]]
+		if fp&maskSmall == 0 {
+			return i + 1
+		}
+	}
+
+	for ; i < n; i++ {
+		fp = (fp << 1) + gear[data[i]]
+		if fp&maskLarge == 0 {
+			return i + 1
+		}
+	}
+
+	return n
+}
+
+// The high bits of the fingerprint depend on the last 64 bytes, the low bits only on the last few.
+func topBits(count int) uint64 {
+	return ^uint64(0) << (64 - count)
+}
+
+func splitmix64(x uint64) uint64 {
+	x += 0x9e3779b97f4a7c15
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	return x ^ (x >> 31)
+}
@@ -0,0 +1,94 @@
+package chunker
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func randomData(seed int64, size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+func chunkAll(t *testing.T, data []byte) [][]byte {
+	c := New(bytes.NewReader(data))
+	chunks := [][]byte{}
+	for {
+		chunk, err := c.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.Nil(t, err)
+		chunks = append(chunks, chunk)
+	}
+	return chunks
+}
+
+func TestChunker_Empty(t *testing.T) {
+	chunks := chunkAll(t, []byte{})
+	assert.Len(t, chunks, 0)
+}
+
+func TestChunker_Small(t *testing.T) {
+	chunks := chunkAll(t, []byte("some content"))
+	assert.Len(t, chunks, 1)
+	assert.Equal(t, string(chunks[0]), "some content")
+}
+
+func TestChunker_Reassemble(t *testing.T) {
+	data := randomData(1, 20*1024*1024)
+	chunks := chunkAll(t, data)
+
+	assert.Greater(t, len(chunks), 1)
+	for i, chunk := range chunks {
+		assert.LessOrEqual(t, len(chunk), MaxSize)
+		if i < len(chunks)-1 {
+			assert.GreaterOrEqual(t, len(chunk), MinSize)
+		}
+	}
+
+	assert.Equal(t, bytes.Join(chunks, nil), data)
+}
+
+func TestChunker_EditOnlyChangesNearbyChunks(t *testing.T) {
+	data := randomData(2, 20*1024*1024)
+	original := chunkAll(t, data)
+
+	//Insert a few bytes in the middle
+	edited := append([]byte{}, data[:10*1024*1024]...)
+	edited = append(edited, []byte("hello")...)
+	edited = append(edited, data[10*1024*1024:]...)
+	changed := chunkAll(t, edited)
+
+	known := map[string]bool{}
+	for _, chunk := range original {
+		known[string(chunk)] = true
+	}
+
+	reused := 0
+	for _, chunk := range changed {
+		if known[string(chunk)] {
+			reused++
+		}
+	}
+
+	//Everything but the chunk(s) around the edit should be reused
+	assert.GreaterOrEqual(t, reused, len(changed)-2)
+}
+
+func TestChunker_BufferGrowsWithContent(t *testing.T) {
+	c := New(bytes.NewReader(randomData(3, 1000)))
+	_, err := c.Next()
+	assert.Nil(t, err)
+	assert.Equal(t, cap(c.buf), initialBufSize)
+
+	c = New(bytes.NewReader(randomData(4, 3*MaxSize)))
+	_, err = c.Next()
+	assert.Nil(t, err)
+	assert.Equal(t, cap(c.buf), MaxSize)
+}
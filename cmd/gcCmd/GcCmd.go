@@ -0,0 +1,74 @@
+package gccmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/c00/buttercup/appconfig"
+	"github.com/c00/buttercup/fileprovider"
+	"github.com/c00/buttercup/logger"
+	"github.com/spf13/cobra"
+)
+
+var GcCmd = &cobra.Command{
+	Use:   "gc [foldername]",
+	Short: "Remove old versions and unused data from the remote",
+	Long:  "Remove versions that fall outside the retention policy of the folder, and data on the remote that is not used anymore. Without a retention policy, all versions are kept.",
+	Args:  cobra.MatchAll(cobra.MaximumNArgs(1), cobra.OnlyValidArgs),
+	Run: func(cmd *cobra.Command, args []string) {
+		conf, err := appconfig.LoadFromUser()
+		if err != nil {
+			panic(fmt.Errorf("cannot load config: %w", err))
+		}
+
+		folderName := conf.DefaultFolder
+		if len(args) == 1 {
+			folderName = args[0]
+		}
+
+		folder := conf.GetFolder(folderName)
+		logger.Log("Cleaning up remote of folder: %v...", folder.Local.GetFolderPath())
+
+		remote := fileprovider.GetProvider(folder.Remote)
+		err = gc(remote, folder.Retention)
+		remote.Close()
+		if err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+	},
+}
+
+func gc(remote fileprovider.FileProvider, policy *appconfig.RetentionConfig) error {
+	collector, ok := remote.(fileprovider.CollectingProvider)
+	if !ok {
+		return fmt.Errorf("remote does not support garbage collection")
+	}
+
+	err := remote.Lock()
+	if err != nil {
+		return fmt.Errorf("cannot lock remote: %w", err)
+	}
+
+	result, err := collector.CollectGarbage(policy)
+	if err != nil {
+		remote.Unlock()
+		return fmt.Errorf("cannot collect garbage: %w", err)
+	}
+
+	err = remote.Unlock()
+	if err != nil {
+		return fmt.Errorf("cannot unlock remote: %w", err)
+	}
+
+	if policy == nil {
+		logger.Log("No retention policy set, keeping all versions.")
+	}
+	logger.Log("Expired versions: %v", result.ExpiredVersions)
+	logger.Log("Deleted blobs: %v (of which orphaned: %v)", result.DeletedBlobs, result.OrphanedBlobs)
+	if result.MissingBlobs > 0 {
+		logger.Warn("%v blobs are in the index but missing from the remote. Files that use them cannot be restored.", result.MissingBlobs)
+	}
+
+	return nil
+}
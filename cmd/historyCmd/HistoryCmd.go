@@ -0,0 +1,78 @@
+package historycmd
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/c00/buttercup/appconfig"
+	"github.com/c00/buttercup/fileprovider"
+	"github.com/c00/buttercup/logger"
+	"github.com/spf13/cobra"
+)
+
+var folderName string
+
+func init() {
+	HistoryCmd.Flags().StringVarP(&folderName, "folder", "f", "", "name of the folder (defaults to the default folder)")
+}
+
+var HistoryCmd = &cobra.Command{
+	Use:   "history <path>",
+	Short: "List the versions of a file that are kept on the remote",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		conf, err := appconfig.LoadFromUser()
+		if err != nil {
+			panic(fmt.Errorf("cannot load config: %w", err))
+		}
+
+		if folderName == "" {
+			folderName = conf.DefaultFolder
+		}
+
+		folder := conf.GetFolder(folderName)
+		filePath := fileprovider.IndexPath(folder.Local.GetFolderPath(), args[0])
+
+		remote := fileprovider.GetProvider(folder.Remote)
+
+		versioned, ok := remote.(fileprovider.VersionedProvider)
+		if !ok {
+			logger.Error("remote of type %v does not keep versions", folder.Remote.Type)
+			os.Exit(1)
+		}
+
+		versions, err := versioned.GetVersions(filePath)
+		remote.Close()
+		if err != nil {
+			logger.Error("cannot get versions of %v: %v", filePath, err)
+			os.Exit(1)
+		}
+
+		logger.Log("Versions of %v:", filePath)
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tWRITTEN\tCLIENT\tMODIFIED\tSIZE")
+		for _, v := range versions {
+			id := fmt.Sprint(v.ID)
+			if v.ID == 0 {
+				id = "current"
+			}
+
+			size := fmt.Sprint(v.Size)
+			if v.Deleted {
+				size = "deleted"
+			}
+
+			fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\n", id, formatDate(v.Created), v.Client, formatDate(v.Updated), size)
+		}
+		w.Flush()
+	},
+}
+
+func formatDate(date time.Time) string {
+	if date.IsZero() {
+		return "unknown"
+	}
+	return date.Local().Format(time.DateTime)
+}
@@ -0,0 +1,38 @@
+package keygencmd
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"filippo.io/age"
+	"github.com/c00/buttercup/logger"
+	"github.com/spf13/cobra"
+)
+
+var KeygenCmd = &cobra.Command{
+	Use:   "keygen [file]",
+	Short: "Create an age identity file, and print its public key to use as a recipient",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		identity, err := age.GenerateX25519Identity()
+		if err != nil {
+			panic(fmt.Errorf("cannot generate identity: %w", err))
+		}
+
+		//Never overwrite an existing identity, whatever was encrypted to it would be lost
+		file, err := os.OpenFile(args[0], os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			panic(fmt.Errorf("cannot create identity file: %w", err))
+		}
+		defer file.Close()
+
+		_, err = fmt.Fprintf(file, "# created: %v\n# public key: %v\n%v\n", time.Now().Format(time.RFC3339), identity.Recipient(), identity)
+		if err != nil {
+			panic(fmt.Errorf("cannot write identity file: %w", err))
+		}
+
+		logger.Log("Identity written to %v", args[0])
+		logger.Log("Public key: %v", identity.Recipient())
+	},
+}
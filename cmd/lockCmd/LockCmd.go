@@ -0,0 +1,68 @@
+package lockcmd
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/c00/buttercup/appconfig"
+	"github.com/c00/buttercup/fileprovider"
+	"github.com/c00/buttercup/logger"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	LockCmd.AddCommand(statusCmd)
+}
+
+var LockCmd = &cobra.Command{
+	Use:   "lock",
+	Short: "Inspect the locks on a folder and its remote",
+}
+
+var statusCmd = &cobra.Command{
+	Use:   "status [foldername]",
+	Short: "Show who holds the locks on a folder and its remote",
+	Args:  cobra.MatchAll(cobra.MaximumNArgs(1), cobra.OnlyValidArgs),
+	Run: func(cmd *cobra.Command, args []string) {
+		conf, err := appconfig.LoadFromUser()
+		if err != nil {
+			panic(fmt.Errorf("cannot load config: %w", err))
+		}
+
+		folderName := conf.DefaultFolder
+		if len(args) == 1 {
+			folderName = args[0]
+		}
+
+		folder := conf.GetFolder(folderName)
+		logger.Log("Locks of folder: %v", folder.Local.GetFolderPath())
+
+		local := fileprovider.GetProvider(folder.Local)
+		printStatus("local", local)
+		local.Close()
+
+		remote := fileprovider.GetProvider(folder.Remote)
+		printStatus("remote", remote)
+		remote.Close()
+	},
+}
+
+func printStatus(name string, provider fileprovider.FileProvider) {
+	lease, locked, err := provider.LockStatus()
+	if err != nil {
+		logger.Error("%v: cannot get lock status: %v", name, err)
+		return
+	}
+
+	if !locked {
+		logger.Log("%v: not locked", name)
+		return
+	}
+
+	if lease.Expired(time.Now()) {
+		logger.Log("%v: expired lock of %v", name, lease)
+		return
+	}
+
+	logger.Log("%v: locked by %v", name, lease)
+}
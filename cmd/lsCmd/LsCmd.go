@@ -0,0 +1,116 @@
+package lscmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/c00/buttercup/appconfig"
+	"github.com/c00/buttercup/fileprovider"
+	"github.com/c00/buttercup/logger"
+	"github.com/spf13/cobra"
+)
+
+var tree bool
+var glob string
+var all bool
+
+func init() {
+	LsCmd.Flags().BoolVarP(&tree, "tree", "t", false, "show the files as a tree")
+	LsCmd.Flags().StringVarP(&glob, "glob", "g", "", "only list files that match the pattern, e.g. \"*.jpg\"")
+	LsCmd.Flags().BoolVarP(&all, "all", "a", false, "also list deleted files")
+}
+
+var LsCmd = &cobra.Command{
+	Use:   "ls [foldername] [path]",
+	Short: "List the files on the remote",
+	Long:  "List the files on the remote, as they are in its index. Only the index is downloaded and decrypted, not the files themselves.",
+	Args:  cobra.MaximumNArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		conf, err := appconfig.LoadFromUser()
+		if err != nil {
+			panic(fmt.Errorf("cannot load config: %w", err))
+		}
+
+		folderName := conf.DefaultFolder
+		if len(args) >= 1 {
+			folderName = args[0]
+		}
+		prefix := "/"
+		if len(args) == 2 {
+			prefix = args[1]
+		}
+
+		folder := conf.GetFolder(folderName)
+		remote := fileprovider.GetProvider(folder.Remote)
+		defer remote.Close()
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		if !tree {
+			fmt.Fprintln(w, "SIZE\tMODIFIED\tPATH")
+		}
+
+		//Folders of the last file, for the tree
+		dirs := []string{}
+		count := 0
+		err = fileprovider.ListFiles(remote, fileprovider.ListOptions{Prefix: prefix, Glob: glob, IncludeDeleted: all}, func(fi fileprovider.FileInfo) error {
+			count++
+			if tree {
+				dirs = printTreeLine(w, dirs, fi)
+				return nil
+			}
+			fmt.Fprintf(w, "%v\t%v\t%v\n", formatSize(fi), formatDate(fi.Updated), fi.Path)
+			return nil
+		})
+		w.Flush()
+		if err != nil {
+			logger.Error("cannot list files: %v", err)
+			remote.Close()
+			os.Exit(1)
+		}
+
+		logger.Log("%v files", count)
+	},
+}
+
+// Print a file as part of a tree, preceded by the folders that weren't printed yet. Returns the folders of the file.
+func printTreeLine(w io.Writer, printed []string, fi fileprovider.FileInfo) []string {
+	parts := strings.Split(strings.TrimPrefix(fi.Path, "/"), "/")
+	dirs := parts[:len(parts)-1]
+
+	same := 0
+	for same < len(dirs) && same < len(printed) && dirs[same] == printed[same] {
+		same++
+	}
+
+	for depth := same; depth < len(dirs); depth++ {
+		fmt.Fprintf(w, "%v%v/\t\t\n", strings.Repeat("  ", depth), dirs[depth])
+	}
+	name := parts[len(parts)-1]
+	if fi.Type == fileprovider.EntryDir {
+		name += "/"
+	}
+	fmt.Fprintf(w, "%v%v\t%v\t%v\n", strings.Repeat("  ", len(dirs)), name, formatSize(fi), formatDate(fi.Updated))
+
+	return dirs
+}
+
+func formatSize(fi fileprovider.FileInfo) string {
+	if fi.Deleted {
+		return "deleted"
+	}
+	if fi.Type != fileprovider.EntryFile {
+		return string(fi.Type)
+	}
+	return fmt.Sprint(fi.Size)
+}
+
+func formatDate(date time.Time) string {
+	if date.IsZero() {
+		return "unknown"
+	}
+	return date.Local().Format(time.DateTime)
+}
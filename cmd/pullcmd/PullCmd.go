@@ -11,33 +11,93 @@ import (
 	"github.com/spf13/cobra"
 )
 
+var jobs int
+var dryRun bool
+var output string
+
+func init() {
+	PullCmd.Flags().IntVarP(&jobs, "jobs", "j", 0, "amount of files to transfer at the same time (defaults to the folder config, or 1)")
+	PullCmd.Flags().BoolVar(&dryRun, "dry-run", false, "show what would be transferred, without changing anything")
+	PullCmd.Flags().StringVarP(&output, "output", "o", "text", "format of the dry run plan: text or json")
+}
+
 var PullCmd = &cobra.Command{
-	Use:   "pull [foldername]",
+	Use:   "pull [foldername] [-- path...]",
 	Short: "Pull latest changes from the remote",
-	Args:  cobra.MatchAll(cobra.MaximumNArgs(1), cobra.OnlyValidArgs),
+	Args: func(cmd *cobra.Command, args []string) error {
+		folderArgs, _ := splitArgs(cmd, args)
+		return cobra.MaximumNArgs(1)(cmd, folderArgs)
+	},
 	Run: func(cmd *cobra.Command, args []string) {
 		conf, err := appconfig.LoadFromUser()
 		if err != nil {
 			panic(fmt.Errorf("cannot load config: %w", err))
 		}
 
+		folderArgs, paths := splitArgs(cmd, args)
 		folderName := conf.DefaultFolder
-		if len(args) == 1 {
-			folderName = args[0]
+		if len(folderArgs) == 1 {
+			folderName = folderArgs[0]
+		}
+
+		if output != "text" && output != "json" {
+			logger.Error("unknown output format: %v", output)
+			os.Exit(1)
 		}
 
 		folder := conf.GetFolder(folderName)
-		logger.Log("Pulling folder: %v...", folder.Local.GetFolderPath())
+		var filter *fileprovider.PathFilter
+		if len(paths) > 0 {
+			filter, err = fileprovider.NewPathFilter(folder.Local.GetFolderPath(), paths)
+			if err != nil {
+				logger.Error2(err)
+				os.Exit(1)
+			}
+		}
+		//Keep the json clean
+		if !dryRun || output == "text" {
+			logger.Log("Pulling folder: %v...", folder.Local.GetFolderPath())
+		}
 
 		local := fileprovider.GetProvider(folder.Local)
 		remote := fileprovider.GetProvider(folder.Remote)
 
+		defer local.Close()
+		defer remote.Close()
+
 		syncer := syncer.New(local, remote)
+		syncer.SetJobs(folder.GetJobs(jobs))
+		syncer.SetFilter(filter)
+
+		if dryRun {
+			plan, err := syncer.PlanPull()
+			if err == nil {
+				err = plan.Write(os.Stdout, output)
+			}
+			if err != nil {
+				logger.Error2(err)
+				local.Close()
+				remote.Close()
+				os.Exit(1)
+			}
+			return
+		}
 
 		err = syncer.Pull()
 		if err != nil {
 			logger.Error(err.Error())
+			local.Close()
+			remote.Close()
 			os.Exit(1)
 		}
 	},
 }
+
+// Split the arguments into the folder name and the paths to sync, which come after "--".
+func splitArgs(cmd *cobra.Command, args []string) ([]string, []string) {
+	dash := cmd.ArgsLenAtDash()
+	if dash < 0 {
+		return args, nil
+	}
+	return args[:dash], args[dash:]
+}
@@ -0,0 +1,109 @@
+package rekeycmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/c00/buttercup/appconfig"
+	"github.com/c00/buttercup/fileprovider"
+	"github.com/c00/buttercup/logger"
+	"github.com/spf13/cobra"
+)
+
+var newDataKey bool
+
+func init() {
+	RekeyCmd.Flags().BoolVar(&newDataKey, "new-data-key", false, "also replace the data key of a remote with a passphrase, and re-encrypt everything with the new one")
+}
+
+var RekeyCmd = &cobra.Command{
+	Use:   "rekey [foldername]",
+	Short: "Re-encrypt the remote with the passphrase or recipients in the config",
+	Long:  "Re-encrypt the index and all data on the remote with the passphrase or recipients in the config. The keys it was encrypted with before go in oldPassphrase or oldIdentities. With --new-data-key, a remote with a passphrase also gets a new data key. If it is interrupted, run it again to continue where it left off.",
+	Args:  cobra.MatchAll(cobra.MaximumNArgs(1), cobra.OnlyValidArgs),
+	Run: func(cmd *cobra.Command, args []string) {
+		conf, err := appconfig.LoadFromUser()
+		if err != nil {
+			panic(fmt.Errorf("cannot load config: %w", err))
+		}
+
+		folderName := conf.DefaultFolder
+		if len(args) == 1 {
+			folderName = args[0]
+		}
+
+		folder := conf.GetFolder(folderName)
+		logger.Log("Re-encrypting remote of folder: %v...", folder.Local.GetFolderPath())
+
+		remote := fileprovider.GetProvider(folder.Remote)
+		if newDataKey {
+			err = rotateDataKey(remote)
+			remote.Close()
+			if err != nil {
+				logger.Error(err.Error())
+				os.Exit(1)
+			}
+			//Open it again, so it encrypts to the new data key
+			remote = fileprovider.GetProvider(folder.Remote)
+		}
+
+		err = rekey(remote)
+		remote.Close()
+		if err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+	},
+}
+
+func rotateDataKey(remote fileprovider.FileProvider) error {
+	rekeyer, ok := remote.(fileprovider.RekeyingProvider)
+	if !ok {
+		return fmt.Errorf("remote does not support re-encryption")
+	}
+
+	err := remote.Lock()
+	if err != nil {
+		return fmt.Errorf("cannot lock remote: %w", err)
+	}
+
+	err = rekeyer.RotateDataKey()
+	if err != nil {
+		remote.Unlock()
+		return fmt.Errorf("cannot create new data key: %w", err)
+	}
+
+	err = remote.Unlock()
+	if err != nil {
+		return fmt.Errorf("cannot unlock remote: %w", err)
+	}
+	return nil
+}
+
+func rekey(remote fileprovider.FileProvider) error {
+	rekeyer, ok := remote.(fileprovider.RekeyingProvider)
+	if !ok {
+		return fmt.Errorf("remote does not support re-encryption")
+	}
+
+	err := remote.Lock()
+	if err != nil {
+		return fmt.Errorf("cannot lock remote: %w", err)
+	}
+
+	count, err := rekeyer.Rekey()
+	if err != nil {
+		//Keep the progress so far
+		remote.Unlock()
+		return fmt.Errorf("cannot re-encrypt remote, run rekey again to continue: %w", err)
+	}
+
+	err = remote.Unlock()
+	if err != nil {
+		return fmt.Errorf("cannot unlock remote: %w", err)
+	}
+
+	logger.Log("Re-encrypted blobs: %v", count)
+	logger.Log("The remote no longer needs the old keys, they can be removed from the config.")
+	return nil
+}
@@ -0,0 +1,119 @@
+package restorecmd
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/c00/buttercup/appconfig"
+	"github.com/c00/buttercup/fileprovider"
+	"github.com/c00/buttercup/logger"
+	"github.com/spf13/cobra"
+)
+
+var folderName string
+var at string
+var force bool
+
+func init() {
+	RestoreCmd.Flags().StringVarP(&folderName, "folder", "f", "", "name of the folder (defaults to the default folder)")
+	RestoreCmd.Flags().StringVar(&at, "at", "", "point in time to restore, e.g. \"2024-06-10 14:00\" or \"2024-06-10\"")
+	RestoreCmd.Flags().BoolVar(&force, "force", false, "overwrite local changes that were not synced yet")
+	RestoreCmd.MarkFlagRequired("at")
+}
+
+var RestoreCmd = &cobra.Command{
+	Use:   "restore <path> --at <time>",
+	Short: "Restore a file to how it was on the remote at a given time",
+	Long:  "Restore a file to how it was on the remote at a given time. The restored file is written to the local folder, and will be pushed as a new version on the next sync.",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		conf, err := appconfig.LoadFromUser()
+		if err != nil {
+			panic(fmt.Errorf("cannot load config: %w", err))
+		}
+
+		atTime, err := parseTime(at)
+		if err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+
+		if folderName == "" {
+			folderName = conf.DefaultFolder
+		}
+
+		folder := conf.GetFolder(folderName)
+		filePath := fileprovider.IndexPath(folder.Local.GetFolderPath(), args[0])
+
+		local := fileprovider.GetProvider(folder.Local)
+		remote := fileprovider.GetProvider(folder.Remote)
+
+		err = restore(local, remote, filePath, atTime)
+		local.Close()
+		remote.Close()
+		if err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+	},
+}
+
+func restore(local, remote fileprovider.FileProvider, filePath string, atTime time.Time) error {
+	versioned, ok := remote.(fileprovider.VersionedProvider)
+	if !ok {
+		return fmt.Errorf("remote does not keep versions")
+	}
+
+	versions, err := versioned.GetVersions(filePath)
+	if err != nil {
+		return fmt.Errorf("cannot get versions of %v: %w", filePath, err)
+	}
+
+	version, ok := fileprovider.VersionAt(versions, atTime)
+	if !ok {
+		return fmt.Errorf("%v did not exist on the remote yet at %v", filePath, atTime.Format(time.DateTime))
+	}
+	if version.Deleted {
+		return fmt.Errorf("%v was deleted at %v", filePath, atTime.Format(time.DateTime))
+	}
+
+	err = local.Lock()
+	if err != nil {
+		return fmt.Errorf("cannot lock local: %w", err)
+	}
+	defer local.Unlock()
+
+	lfile, err := local.GetFileInfo(filePath)
+	if err == nil && !force && !lfile.Deleted && lfile.LastSynced.Before(lfile.Updated) && !lfile.SameContent(fileprovider.FileInfo{Hash: version.Hash}) {
+		return fmt.Errorf("%v has local changes that are not synced yet, use --force to overwrite them", filePath)
+	}
+
+	reader, err := versioned.RetrieveVersion(filePath, version.ID)
+	if err != nil {
+		return fmt.Errorf("cannot retrieve version: %w", err)
+	}
+	defer reader.Close()
+
+	//Dated now, so it is pushed as a new version
+	err = local.StoreFile(fileprovider.FileInfo{Path: filePath, Updated: time.Now()}, reader)
+	if err != nil {
+		return fmt.Errorf("cannot write restored file: %w", err)
+	}
+
+	logger.Log("Restored %v to the version written by %v at %v", filePath, version.Client, version.Created.Local().Format(time.DateTime))
+	return nil
+}
+
+var timeFormats = []string{time.RFC3339, time.DateTime, "2006-01-02 15:04", "2006-01-02T15:04", time.DateOnly}
+
+func parseTime(value string) (time.Time, error) {
+	for _, format := range timeFormats {
+		parsed, err := time.ParseInLocation(format, value, time.Local)
+		if err == nil {
+			return parsed, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("cannot parse time %q, use a format like \"2024-06-10 14:00\"", value)
+}
@@ -4,10 +4,20 @@ import (
 	"fmt"
 	"os"
 
+	gccmd "github.com/c00/buttercup/cmd/gcCmd"
+	historycmd "github.com/c00/buttercup/cmd/historyCmd"
 	initcmd "github.com/c00/buttercup/cmd/initCmd"
+	keygencmd "github.com/c00/buttercup/cmd/keygenCmd"
+	lockcmd "github.com/c00/buttercup/cmd/lockCmd"
+	lscmd "github.com/c00/buttercup/cmd/lsCmd"
 	"github.com/c00/buttercup/cmd/pullcmd"
 	pushcmd "github.com/c00/buttercup/cmd/pushCmd"
+	rekeycmd "github.com/c00/buttercup/cmd/rekeyCmd"
+	restorecmd "github.com/c00/buttercup/cmd/restoreCmd"
+	statuscmd "github.com/c00/buttercup/cmd/statusCmd"
 	synccmd "github.com/c00/buttercup/cmd/syncCmd"
+	unlockcmd "github.com/c00/buttercup/cmd/unlockCmd"
+	watchcmd "github.com/c00/buttercup/cmd/watchCmd"
 	"github.com/c00/buttercup/logger"
 	"github.com/spf13/cobra"
 )
@@ -23,6 +33,16 @@ func init() {
 		pushcmd.PushCmd,
 		synccmd.SyncCmd,
 		initcmd.InitCmd,
+		historycmd.HistoryCmd,
+		restorecmd.RestoreCmd,
+		gccmd.GcCmd,
+		lockcmd.LockCmd,
+		unlockcmd.UnlockCmd,
+		watchcmd.WatchCmd,
+		statuscmd.StatusCmd,
+		lscmd.LsCmd,
+		keygencmd.KeygenCmd,
+		rekeycmd.RekeyCmd,
 	)
 }
 
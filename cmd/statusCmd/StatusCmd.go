@@ -0,0 +1,73 @@
+package statuscmd
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/c00/buttercup/appconfig"
+	"github.com/c00/buttercup/fileprovider"
+	"github.com/c00/buttercup/logger"
+	"github.com/c00/buttercup/syncer"
+	"github.com/spf13/cobra"
+)
+
+var StatusCmd = &cobra.Command{
+	Use:   "status [foldername]",
+	Short: "Show the differences between the local folder and the remote",
+	Args:  cobra.MatchAll(cobra.MaximumNArgs(1), cobra.OnlyValidArgs),
+	Run: func(cmd *cobra.Command, args []string) {
+		conf, err := appconfig.LoadFromUser()
+		if err != nil {
+			panic(fmt.Errorf("cannot load config: %w", err))
+		}
+
+		folderName := conf.DefaultFolder
+		if len(args) == 1 {
+			folderName = args[0]
+		}
+
+		folder := conf.GetFolder(folderName)
+		logger.Log("Status of folder: %v", folder.Local.GetFolderPath())
+
+		local := fileprovider.GetProvider(folder.Local)
+		remote := fileprovider.GetProvider(folder.Remote)
+
+		status, err := syncer.New(local, remote).Status()
+		local.Close()
+		remote.Close()
+		if err != nil {
+			logger.Error("cannot compare local and remote: %v", err)
+			os.Exit(1)
+		}
+
+		if status.InSync() {
+			logger.Log("Everything is up-to-date (%v files)", status.UpToDate)
+			return
+		}
+
+		push := status.Filter(fileprovider.LocalNewer)
+		pull := status.Filter(fileprovider.RemoteNewer)
+		conflicts := status.Filter(fileprovider.ConflictLocalNewer, fileprovider.ConflictRemoteNewer)
+
+		printFiles("Changes to push:", push)
+		printFiles("Changes to pull:", pull)
+		printFiles("Conflicts:", conflicts)
+
+		logger.Log("%v up-to-date, %v to push, %v to pull, %v conflicts", status.UpToDate, len(push), len(pull), len(conflicts))
+	},
+}
+
+func printFiles(title string, files []syncer.FileStatus) {
+	if len(files) == 0 {
+		return
+	}
+
+	fmt.Println(title)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for _, fs := range files {
+		fmt.Fprintf(w, "  %v:\t%v\n", fs.Describe(), fs.Path)
+	}
+	w.Flush()
+	fmt.Println()
+}
@@ -0,0 +1,76 @@
+package unlockcmd
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/c00/buttercup/appconfig"
+	"github.com/c00/buttercup/fileprovider"
+	"github.com/c00/buttercup/logger"
+	"github.com/spf13/cobra"
+)
+
+var force bool
+var local bool
+
+func init() {
+	UnlockCmd.Flags().BoolVar(&force, "force", false, "remove the lock even if another client holds it")
+	UnlockCmd.Flags().BoolVar(&local, "local", false, "unlock the local folder instead of the remote")
+}
+
+var UnlockCmd = &cobra.Command{
+	Use:   "unlock [foldername]",
+	Short: "Remove a lock that was left behind",
+	Long:  "Remove a lock that was left behind by a sync that crashed or was interrupted. Without --force, only expired locks and locks of this client are removed.",
+	Args:  cobra.MatchAll(cobra.MaximumNArgs(1), cobra.OnlyValidArgs),
+	Run: func(cmd *cobra.Command, args []string) {
+		conf, err := appconfig.LoadFromUser()
+		if err != nil {
+			panic(fmt.Errorf("cannot load config: %w", err))
+		}
+
+		folderName := conf.DefaultFolder
+		if len(args) == 1 {
+			folderName = args[0]
+		}
+
+		folder := conf.GetFolder(folderName)
+		providerConf := folder.Remote
+		if local {
+			providerConf = folder.Local
+		}
+
+		provider := fileprovider.GetProvider(providerConf)
+		err = unlock(provider, conf.ClientName)
+		provider.Close()
+		if err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+	},
+}
+
+func unlock(provider fileprovider.FileProvider, clientName string) error {
+	lease, locked, err := provider.LockStatus()
+	if err != nil {
+		return fmt.Errorf("cannot get lock status: %w", err)
+	}
+
+	if !locked {
+		logger.Log("Not locked.")
+		return nil
+	}
+
+	if !force && lease.Owner != clientName && !lease.Expired(time.Now()) {
+		return fmt.Errorf("locked by %v, use --force to remove the lock anyway", lease)
+	}
+
+	err = provider.ForceUnlock()
+	if err != nil {
+		return fmt.Errorf("cannot remove lock: %w", err)
+	}
+
+	logger.Log("Removed lock of %v", lease)
+	return nil
+}
@@ -0,0 +1,97 @@
+package watchcmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/c00/buttercup/appconfig"
+	"github.com/c00/buttercup/fileprovider"
+	"github.com/c00/buttercup/logger"
+	"github.com/c00/buttercup/watcher"
+	"github.com/spf13/cobra"
+)
+
+var pollInterval time.Duration
+var debounce time.Duration
+var jobs int
+
+func init() {
+	WatchCmd.Flags().DurationVar(&pollInterval, "poll", time.Minute, "how often to check the remote for changes")
+	WatchCmd.Flags().DurationVar(&debounce, "debounce", 2*time.Second, "how long the folder has to be quiet before syncing")
+	WatchCmd.Flags().IntVarP(&jobs, "jobs", "j", 0, "amount of files to transfer at the same time (defaults to the folder config, or 1)")
+}
+
+var WatchCmd = &cobra.Command{
+	Use:   "watch [foldername...]",
+	Short: "Keep folders in sync until stopped",
+	Long:  "Watch folders for changes and sync them when files change. The remote is checked for changes of other clients periodically. Without arguments, the default folder is watched.",
+	Run: func(cmd *cobra.Command, args []string) {
+		conf, err := appconfig.LoadFromUser()
+		if err != nil {
+			panic(fmt.Errorf("cannot load config: %w", err))
+		}
+
+		folderNames := args
+		if len(folderNames) == 0 {
+			folderNames = []string{conf.DefaultFolder}
+		}
+
+		folders := []appconfig.FolderConfig{}
+		for _, name := range folderNames {
+			folders = append(folders, conf.GetFolder(name))
+		}
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		failed := false
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		for _, folder := range folders {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				err := watch(ctx, folder)
+				if err != nil {
+					logger.Error(err.Error())
+					mu.Lock()
+					failed = true
+					mu.Unlock()
+				}
+			}()
+		}
+
+		wg.Wait()
+		if failed {
+			os.Exit(1)
+		}
+	},
+}
+
+func watch(ctx context.Context, folder appconfig.FolderConfig) error {
+	path := folder.Local.GetFolderPath()
+	logger.Log("Watching folder: %v...", path)
+
+	local := fileprovider.GetProvider(folder.Local)
+	defer local.Close()
+
+	w := watcher.New(path, local, func() fileprovider.FileProvider {
+		return fileprovider.GetProvider(folder.Remote)
+	})
+	w.PollInterval = pollInterval
+	w.Debounce = debounce
+	w.Jobs = folder.GetJobs(jobs)
+
+	err := w.Run(ctx)
+	if err != nil {
+		return fmt.Errorf("cannot watch %v: %w", path, err)
+	}
+
+	logger.Log("Stopped watching folder: %v", path)
+	return nil
+}
@@ -0,0 +1,418 @@
+package fileprovider
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"slices"
+	"sync"
+
+	"github.com/c00/buttercup/chunker"
+	"github.com/c00/buttercup/modifiers"
+)
+
+// Index of a remote that keeps track of content-addressed chunks.
+// Chunks are addressed by the hash of their plaintext. That hash only lives in the (encrypted) index,
+// on the remote itself chunks are stored under random paths.
+type chunkIndex interface {
+	GetChunkPath(hash string) (string, error)
+	AddChunk(hash, storedPath string, size int64) error
+	AddPackedChunk(hash, storedPath string, offset, size int64) error
+	GetFileChunks(path string) ([]string, error)
+	SetFileChunks(path string, hashes []string) ([]string, error)
+	DeleteChunkIfUnused(hash string) (string, bool, error)
+	GetVersionChunks(id int64) ([]string, error)
+}
+
+// Where a remote keeps its encrypted blobs.
+type blobStore interface {
+	putBlob(storedPath string, content io.Reader) error
+	getBlob(storedPath string) (io.ReadCloser, error)
+	deleteBlob(storedPath string) error
+	hasBlob(storedPath string) (bool, error)
+}
+
+func newChunkStore(index chunkIndex, blobs blobStore, keys modifiers.Keys, packSmall bool) *chunkStore {
+	return &chunkStore{
+		index:     index,
+		blobs:     blobs,
+		keys:      keys,
+		packSmall: packSmall,
+		released:  map[string]bool{},
+		uploading: map[string]chan struct{}{},
+	}
+}
+
+// Splits files into chunks and stores every unique chunk only once. Safe to use from several goroutines.
+type chunkStore struct {
+	index chunkIndex
+	blobs blobStore
+	keys  modifiers.Keys
+	//Store small chunks together in packs
+	packSmall bool
+
+	mu sync.Mutex
+	//Chunks that are being uploaded right now, closed when done. Files with the same chunk wait for it instead of uploading it again.
+	uploading map[string]chan struct{}
+	//Chunks that might not be used anymore. Checked on prune()
+	released map[string]bool
+	//Blobs that are not referenced by the index anymore. Deleted on deleteQueued(), after the index is persisted.
+	queued []string
+
+	packMu sync.Mutex
+	//Small chunks that are not stored yet
+	pack *pack
+}
+
+// Use new keys for the chunks and packs that are stored from now on. Not while anything is being stored.
+func (s *chunkStore) setKeys(keys modifiers.Keys) {
+	s.keys = keys
+}
+
+// Split a stream into chunks and upload the ones that don't exist on the remote yet.
+// Returns the hashes of the chunks, in order.
+func (s *chunkStore) upload(stream io.Reader) ([]string, error) {
+	c := chunker.New(stream)
+	hashes := []string{}
+
+	for {
+		chunk, err := c.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not read chunk: %w", err)
+		}
+
+		sum := sha256.Sum256(chunk)
+		hash := hex.EncodeToString(sum[:])
+		hashes = append(hashes, hash)
+
+		err = s.ensureChunk(hash, chunk)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return hashes, nil
+}
+
+// Store a chunk, unless it is stored already or another file is storing it.
+func (s *chunkStore) ensureChunk(hash string, chunk []byte) error {
+	for {
+		s.mu.Lock()
+		done, busy := s.uploading[hash]
+		if busy {
+			s.mu.Unlock()
+			//Check again when it's done, the upload may have failed
+			<-done
+			continue
+		}
+
+		_, err := s.index.GetChunkPath(hash)
+		if err == nil {
+			//Already stored
+			s.mu.Unlock()
+			return nil
+		}
+
+		done = make(chan struct{})
+		s.uploading[hash] = done
+		s.mu.Unlock()
+
+		err = s.storeChunk(hash, chunk)
+
+		s.mu.Lock()
+		delete(s.uploading, hash)
+		close(done)
+		s.mu.Unlock()
+
+		return err
+	}
+}
+
+// Record the chunk list for a path.
+func (s *chunkStore) setChunks(filePath string, hashes []string) error {
+	released, err := s.index.SetFileChunks(filePath, hashes)
+	if err != nil {
+		return fmt.Errorf("could not update chunk list: %w", err)
+	}
+
+	s.mu.Lock()
+	s.release(released)
+	s.mu.Unlock()
+
+	return nil
+}
+
+func (s *chunkStore) storeChunk(hash string, chunk []byte) error {
+	if s.packSmall && len(chunk) < packThreshold {
+		return s.addToPack(hash, chunk)
+	}
+
+	storedPath, err := CreateRandomPath()
+	if err != nil {
+		return fmt.Errorf("cannot create store path: %w", err)
+	}
+
+	encrypted := &bytes.Buffer{}
+	err = modifiers.CompressAndEncrypt(bytes.NewReader(chunk), encrypted, s.keys)
+	if err != nil {
+		return fmt.Errorf("could not compress and encrypt: %w", err)
+	}
+
+	err = s.blobs.putBlob(storedPath, bytes.NewReader(encrypted.Bytes()))
+	if err != nil {
+		return fmt.Errorf("could not store chunk: %w", err)
+	}
+
+	err = s.index.AddChunk(hash, storedPath, int64(len(chunk)))
+	if err != nil {
+		return fmt.Errorf("could not add chunk to index: %w", err)
+	}
+
+	return nil
+}
+
+// Drop the chunk list of a file. The chunks themselves are removed on prune(), if nothing else uses them.
+func (s *chunkStore) remove(filePath string) error {
+	return s.setChunks(filePath, nil)
+}
+
+func (s *chunkStore) release(hashes []string) {
+	for _, hash := range hashes {
+		s.released[hash] = true
+	}
+}
+
+// Remove released chunks that are not used by any file or version anymore from the index, and queue their blobs for deletion.
+// This is deferred until the end of a session, so a file that is moved (deleted + created) doesn't get uploaded again.
+func (s *chunkStore) prune() error {
+	for hash := range s.released {
+		storedPath, deleted, err := s.index.DeleteChunkIfUnused(hash)
+		if err != nil {
+			return fmt.Errorf("could not check chunk usage: %w", err)
+		}
+
+		if deleted {
+			s.queueDelete(storedPath)
+		}
+
+		delete(s.released, hash)
+	}
+
+	return nil
+}
+
+func (s *chunkStore) queueDelete(storedPath string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.queued = append(s.queued, storedPath)
+}
+
+// Take blobs off the delete queue because they are in use again, e.g. by files another client stored at the same time.
+func (s *chunkStore) keep(storedPaths []string) {
+	if len(storedPaths) == 0 {
+		return
+	}
+
+	kept := map[string]bool{}
+	for _, storedPath := range storedPaths {
+		kept[storedPath] = true
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	queued := []string{}
+	for _, storedPath := range s.queued {
+		if !kept[storedPath] {
+			queued = append(queued, storedPath)
+		}
+	}
+	s.queued = queued
+}
+
+// Delete the queued blobs. Only call this once the index that doesn't reference them anymore is persisted,
+// an interrupted session then leaves orphaned blobs rather than an index that points to missing ones.
+func (s *chunkStore) deleteQueued() error {
+	s.mu.Lock()
+	queued := slices.Clone(s.queued)
+	s.mu.Unlock()
+
+	deleted := map[string]bool{}
+	var err error
+	for _, storedPath := range queued {
+		err = s.blobs.deleteBlob(storedPath)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			err = fmt.Errorf("could not delete blob: %w", err)
+			break
+		}
+		err = nil
+		deleted[storedPath] = true
+	}
+
+	//Blobs that were queued in the meantime, or that failed, stay queued
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	remaining := []string{}
+	for _, storedPath := range s.queued {
+		if !deleted[storedPath] {
+			remaining = append(remaining, storedPath)
+		}
+	}
+	s.queued = remaining
+
+	return err
+}
+
+// Add chunks that were uploaded before back to the index, if their blob still exists.
+// Restored chunks are released, so they are pruned again if no file ends up using them.
+func (s *chunkStore) restore(chunks []StoredChunk) (int, error) {
+	restored := []string{}
+	for _, chunk := range chunks {
+		_, err := s.index.GetChunkPath(chunk.Hash)
+		if err == nil {
+			continue
+		}
+
+		found, err := s.blobs.hasBlob(chunk.StoredPath)
+		if err != nil {
+			return len(restored), fmt.Errorf("could not check blob: %w", err)
+		}
+		if !found {
+			continue
+		}
+
+		err = s.index.AddChunk(chunk.Hash, chunk.StoredPath, chunk.Size)
+		if err != nil {
+			return len(restored), fmt.Errorf("could not add chunk to index: %w", err)
+		}
+		restored = append(restored, chunk.Hash)
+	}
+
+	s.mu.Lock()
+	s.release(restored)
+	s.mu.Unlock()
+
+	return len(restored), nil
+}
+
+// Get a reader that streams the chunks of a file in order.
+func (s *chunkStore) retrieve(filePath string) (io.ReadCloser, error) {
+	refs, err := s.index.GetFileChunks(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("could not get chunk list: %w", err)
+	}
+
+	return &chunkReader{store: s, refs: refs}, nil
+}
+
+// Get a reader that streams the chunks of a previous version of a file in order.
+func (s *chunkStore) retrieveVersion(id int64) (io.ReadCloser, error) {
+	refs, err := s.index.GetVersionChunks(id)
+	if err != nil {
+		return nil, fmt.Errorf("could not get chunk list: %w", err)
+	}
+
+	return &chunkReader{store: s, refs: refs}, nil
+}
+
+// Reads the chunks of a file one after the other. Only one chunk is open at a time.
+type chunkReader struct {
+	store *chunkStore
+	//Where the chunks are stored, see parseChunkRef
+	refs    []string
+	blob    io.ReadCloser
+	current io.ReadCloser
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for {
+		if r.current == nil {
+			if len(r.refs) == 0 {
+				return 0, io.EOF
+			}
+
+			err := r.open(r.refs[0])
+			if err != nil {
+				return 0, err
+			}
+			r.refs = r.refs[1:]
+		}
+
+		n, err := r.current.Read(p)
+		if errors.Is(err, io.EOF) {
+			r.closeCurrent()
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+
+		return n, err
+	}
+}
+
+func (r *chunkReader) open(ref string) error {
+	storedPath, offset, size, packed, err := parseChunkRef(ref)
+	if err != nil {
+		return err
+	}
+	if packed {
+		err = r.store.flushPackAt(storedPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	blob, err := r.store.blobs.getBlob(storedPath)
+	if err != nil {
+		return fmt.Errorf("cannot open chunk: %w", err)
+	}
+
+	reader, err := modifiers.DecryptAndDecompress(blob, r.store.keys)
+	if err != nil {
+		blob.Close()
+		return fmt.Errorf("could not decrypt and decompress chunk: %w", err)
+	}
+
+	r.blob = blob
+	r.current = reader
+	if !packed {
+		return nil
+	}
+
+	_, err = io.CopyN(io.Discard, reader, offset)
+	if err != nil {
+		r.closeCurrent()
+		return fmt.Errorf("could not find chunk in pack: %w", err)
+	}
+	r.current = struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(reader, size), reader}
+	return nil
+}
+
+func (r *chunkReader) closeCurrent() {
+	if r.current != nil {
+		r.current.Close()
+		r.current = nil
+	}
+	if r.blob != nil {
+		r.blob.Close()
+		r.blob = nil
+	}
+}
+
+func (r *chunkReader) Close() error {
+	r.closeCurrent()
+	r.refs = nil
+	return nil
+}
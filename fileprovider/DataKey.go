@@ -0,0 +1,156 @@
+package fileprovider
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+
+	"github.com/c00/buttercup/modifiers"
+)
+
+// Where a remote keeps its data keys, wrapped with the passphrase. Names are dataKeyName and nextDataKeyName.
+type dataKeyStore interface {
+	//fs.ErrNotExist if the remote has no such data key.
+	readDataKey(name string) ([]byte, error)
+	//fs.ErrExist if another client created one first.
+	createDataKey(name string, data []byte) error
+	writeDataKey(name string, data []byte) error
+	deleteDataKey(name string) error
+}
+
+// Unwrap the data keys of the remote, so the passphrase (and scrypt) is only needed once per session.
+// Only reads, a remote with a passphrase gets its data key from ensureDataKey once it is locked. Without a passphrase,
+// the data key is only used to read what was encrypted to it, if it can be unwrapped with an old passphrase.
+// While a rotation is running, everything new is encrypted to the new data key, and the old one is still used to read.
+func loadDataKey(keys modifiers.Keys, store dataKeyStore) (modifiers.Keys, error) {
+	keys, err := loadCurrentDataKey(keys, store)
+	if err != nil {
+		return keys, err
+	}
+
+	wrapped, err := store.readDataKey(nextDataKeyName)
+	if errors.Is(err, fs.ErrNotExist) {
+		return keys, nil
+	}
+	if err != nil {
+		return keys, fmt.Errorf("cannot read new data key: %w", err)
+	}
+
+	dataKey, err := keys.UnwrapDataKey(wrapped)
+	if err != nil && !keys.UsesPassphrase() {
+		return keys, nil
+	}
+	if err != nil {
+		return keys, fmt.Errorf("cannot decrypt new data key: %w", err)
+	}
+
+	return keys.WithDataKey(dataKey), nil
+}
+
+func loadCurrentDataKey(keys modifiers.Keys, store dataKeyStore) (modifiers.Keys, error) {
+	wrapped, err := store.readDataKey(dataKeyName)
+	if errors.Is(err, fs.ErrNotExist) {
+		return keys, nil
+	}
+	if err != nil {
+		return keys, fmt.Errorf("cannot read data key: %w", err)
+	}
+
+	dataKey, err := keys.UnwrapDataKey(wrapped)
+	if err != nil && !keys.UsesPassphrase() {
+		return keys, nil
+	}
+	if err != nil {
+		return keys, fmt.Errorf("cannot decrypt data key, is the passphrase right? If it was changed with rekey, put the old one in oldPassphrase: %w", err)
+	}
+
+	return keys.WithDataKey(dataKey), nil
+}
+
+// Create the data key of a remote with a passphrase that doesn't have one yet. Only while the remote is locked,
+// so commands that only read never write to it. The write is conditional all the same: if another client created
+// a data key first, that one is read and used.
+func ensureDataKey(keys modifiers.Keys, store dataKeyStore) (modifiers.Keys, error) {
+	if !keys.UsesPassphrase() || keys.HasDataKey() {
+		return keys, nil
+	}
+	return createDataKey(keys, store)
+}
+
+func createDataKey(keys modifiers.Keys, store dataKeyStore) (modifiers.Keys, error) {
+	dataKey, err := modifiers.NewDataKey()
+	if err != nil {
+		return keys, fmt.Errorf("cannot create data key: %w", err)
+	}
+
+	withDataKey := keys.WithDataKey(dataKey)
+	wrapped, err := withDataKey.WrapDataKey()
+	if err != nil {
+		return keys, fmt.Errorf("cannot wrap data key: %w", err)
+	}
+
+	err = store.createDataKey(dataKeyName, wrapped)
+	if errors.Is(err, fs.ErrExist) {
+		//Another client was first, use theirs
+		return loadCurrentDataKey(keys, store)
+	}
+	if err != nil {
+		return keys, fmt.Errorf("cannot store data key: %w", err)
+	}
+
+	return withDataKey, nil
+}
+
+// Store a new data key next to the current one. Once the remote is opened again, everything new is encrypted to it,
+// and a rekey re-encrypts the rest. The old one is replaced when the rekey finishes.
+// If a rotation was started before, that one is continued.
+func rotateDataKey(keys modifiers.Keys, store dataKeyStore) error {
+	if !keys.UsesPassphrase() {
+		return errors.New("only a remote with a passphrase has a data key")
+	}
+
+	dataKey, err := modifiers.NewDataKey()
+	if err != nil {
+		return fmt.Errorf("cannot create data key: %w", err)
+	}
+
+	wrapped, err := keys.WithDataKey(dataKey).WrapDataKey()
+	if err != nil {
+		return fmt.Errorf("cannot wrap data key: %w", err)
+	}
+
+	err = store.createDataKey(nextDataKeyName, wrapped)
+	if err != nil && !errors.Is(err, fs.ErrExist) {
+		return fmt.Errorf("cannot store data key: %w", err)
+	}
+	return nil
+}
+
+// Store the data key wrapped with the current passphrase, or remove it when the remote doesn't use a passphrase anymore.
+// A new data key from a rotation takes the place of the old one.
+// Only once nothing on the remote is encrypted to the old keys anymore, see finishRekey.
+func rewrapDataKey(keys modifiers.Keys, store dataKeyStore) error {
+	if keys.UsesPassphrase() {
+		wrapped, err := keys.WrapDataKey()
+		if err != nil {
+			return fmt.Errorf("cannot wrap data key: %w", err)
+		}
+
+		err = store.writeDataKey(dataKeyName, wrapped)
+		if err != nil {
+			return fmt.Errorf("cannot store data key: %w", err)
+		}
+	} else {
+		err := store.deleteDataKey(dataKeyName)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("cannot remove data key: %w", err)
+		}
+	}
+
+	//Goes last, until then it is needed to read what was encrypted to it
+	err := store.deleteDataKey(nextDataKeyName)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("cannot remove new data key: %w", err)
+	}
+	return nil
+}
@@ -1,15 +1,19 @@
 package fileprovider
 
 import (
+	"database/sql"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"path"
+	"path/filepath"
 	"time"
 
 	"github.com/c00/buttercup/appconfig"
 	"github.com/c00/buttercup/fileprovider/efsindex"
+	"github.com/c00/buttercup/logger"
 	"github.com/c00/buttercup/modifiers"
 )
 
@@ -18,16 +22,33 @@ func NewEfsProvider(conf appconfig.ProviderConfig) *EfsProvider {
 	if conf.EfsConfig == nil {
 		panic("efs config is not defined")
 	}
+	keys, err := modifiers.NewKeys(conf.EfsConfig.Passphrase, conf.EfsConfig.Recipients, conf.EfsConfig.IndexRecipients, conf.EfsConfig.Identities)
+	if err == nil {
+		keys, err = keys.WithOldKeys(conf.EfsConfig.OldPassphrase, conf.EfsConfig.OldIdentities)
+	}
+	if err != nil {
+		panic(fmt.Errorf("cannot load keys: %w", err))
+	}
+	keys = keys.WithPadding(conf.Privacy)
+
 	provider := &EfsProvider{
-		Path:       conf.EfsConfig.Path,
-		index:      efsindex.New(path.Join(conf.EfsConfig.Path, sqliteIndexName), conf.EfsConfig.Passphrase),
-		name:       conf.ClientName,
-		passphrase: conf.EfsConfig.Passphrase,
+		Path:    conf.EfsConfig.Path,
+		name:    conf.ClientName,
+		privacy: conf.Privacy,
 	}
 
 	os.Mkdir(provider.Path, 0700)
 
-	err := provider.index.Load()
+	provider.keys, err = loadDataKey(keys, provider)
+	if err != nil {
+		panic(fmt.Errorf("cannot load keys: %w", err))
+	}
+
+	provider.index = efsindex.New(path.Join(conf.EfsConfig.Path, sqliteIndexName), provider.keys)
+	provider.chunks = newChunkStore(provider.index, provider, provider.keys, conf.PackSmallFiles)
+	provider.locker = newLocker(provider, conf.ClientName)
+
+	err = provider.index.Load()
 	if err != nil {
 		panic(fmt.Errorf("cannot load database: %w", err))
 	}
@@ -36,10 +57,16 @@ func NewEfsProvider(conf appconfig.ProviderConfig) *EfsProvider {
 }
 
 type EfsProvider struct {
-	Path       string
-	name       string
-	passphrase string
-	index      *efsindex.EfsIndex
+	Path string
+	name string
+	//Give everything on the remote the same timestamps
+	privacy bool
+	keys    modifiers.Keys
+	index   *efsindex.EfsIndex
+	chunks  *chunkStore
+	locker  *locker
+	//A rekey re-encrypted everything, the data key is stored for the new keys on Unlock
+	rekeyed bool
 }
 
 func (p *EfsProvider) SetLastSynced(filePath string, date time.Time) error {
@@ -68,13 +95,17 @@ func (p *EfsProvider) RetrieveFile(filePath string) (io.ReadCloser, error) {
 		return nil, fmt.Errorf("file not found: %w", err)
 	}
 
-	fullPath := path.Join(p.Path, fi.StoredPath)
-	file, err := os.Open(fullPath)
+	if fi.StoredPath == "" {
+		return p.chunks.retrieve(fi.Path)
+	}
+
+	//Stored as a single blob by an older version
+	file, err := p.getBlob(fi.StoredPath)
 	if err != nil {
 		return nil, fmt.Errorf("cannot open file for retrieval: %w", err)
 	}
 
-	reader, err := modifiers.DecryptAndDecompress(file, p.passphrase)
+	reader, err := modifiers.DecryptAndDecompress(file, p.keys)
 	if err != nil {
 		return nil, fmt.Errorf("could not compress and encrypt: %w", err)
 	}
@@ -83,30 +114,44 @@ func (p *EfsProvider) RetrieveFile(filePath string) (io.ReadCloser, error) {
 
 func (p *EfsProvider) StoreFile(otherFi FileInfo, stream io.Reader) error {
 	fi, err := p.index.GetFileInfo(otherFi.Path)
-	if err != nil {
-		storedPath, err := CreateRandomPath()
-		if err != nil {
-			return fmt.Errorf("cannot create store path: %w", err)
-		}
+	exists := err == nil
+	if !exists {
+		//File not found, create the fileInfo instead
 		fi = efsindex.EfsFileInfo{
-			Path:       otherFi.Path,
-			Updated:    otherFi.Updated,
-			StoredPath: storedPath,
+			Path: otherFi.Path,
 		}
-		//File not found, create the fileInfo instead
-		err = p.index.SetFileInfo(fi)
+	}
+
+	reader := newHashingReader(stream)
+	hashes, err := p.chunks.upload(reader)
+	if err != nil {
+		return fmt.Errorf("could not store file: %w", err)
+	}
+
+	//Keep the current version around
+	if exists {
+		err = p.index.ArchiveVersion(fi.Path)
 		if err != nil {
-			return fmt.Errorf("could not store new file info: %w", err)
+			return fmt.Errorf("could not archive previous version: %w", err)
 		}
 	}
 
-	err = p.store(fi, stream)
+	err = p.chunks.setChunks(fi.Path, hashes)
 	if err != nil {
 		return fmt.Errorf("could not store file: %w", err)
 	}
 
+	fi.StoredPath = ""
 	fi.Updated = otherFi.Updated
 	fi.Deleted = false
+	fi.Hash = reader.Sum()
+	fi.Size = reader.Size()
+	fi.Client = p.name
+	fi.Created = time.Now()
+	fi.Mode = uint32(otherFi.Mode)
+	fi.Owner = otherFi.Owner
+	fi.Xattrs = otherFi.Xattrs
+	fi.Type = string(otherFi.Type)
 
 	err = p.index.SetFileInfo(fi)
 	if err != nil {
@@ -116,108 +161,405 @@ func (p *EfsProvider) StoreFile(otherFi FileInfo, stream io.Reader) error {
 	return nil
 }
 
-func (p *EfsProvider) store(fi efsindex.EfsFileInfo, stream io.Reader) error {
-	fullPath := path.Join(p.Path, fi.StoredPath)
+func (p *EfsProvider) RemoveFile(otherFi FileInfo) error {
+	fi, err := p.index.GetFileInfo(otherFi.Path)
+	if err != nil {
+		p.index.SetFileInfo(efsindex.EfsFileInfo{
+			Path:    otherFi.Path,
+			Updated: otherFi.Updated,
+			Deleted: true,
+			Client:  p.name,
+			Created: time.Now(),
+		})
+
+		return nil
+	}
+
+	//Keep the current version around
+	if !fi.Deleted {
+		err = p.index.ArchiveVersion(fi.Path)
+		if err != nil {
+			return fmt.Errorf("could not archive previous version: %w", err)
+		}
+	}
+
+	err = p.chunks.remove(fi.Path)
+	if err != nil {
+		return fmt.Errorf("could not remove file: %w", err)
+	}
+
+	fi.StoredPath = ""
+	fi.Deleted = true
+	fi.Updated = otherFi.Updated
+	fi.Client = p.name
+	fi.Created = time.Now()
+	err = p.index.SetFileInfo(fi)
+	if err != nil {
+		return fmt.Errorf("could not delete in index: %w", err)
+	}
+
+	return nil
+}
+
+func (p *EfsProvider) GetVersions(path string) ([]FileVersion, error) {
+	fi, err := p.index.GetFileInfo(path)
+	current := err == nil
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("could not get file: %w", err)
+	}
+
+	versions, err := p.index.GetVersions(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not get versions: %w", err)
+	}
+
+	//A file that was moved away only has its previous versions left
+	if !current && len(versions) == 0 {
+		return nil, fmt.Errorf("file not found: %v", path)
+	}
+
+	result := make([]FileVersion, 0, len(versions)+1)
+	if current {
+		result = append(result, FileVersion{
+			Path:    fi.Path,
+			Updated: fi.Updated,
+			Deleted: fi.Deleted,
+			Hash:    fi.Hash,
+			Size:    fi.Size,
+			Client:  fi.Client,
+			Created: fi.Created,
+		})
+	}
+
+	for _, v := range versions {
+		result = append(result, FileVersion{
+			ID:      v.ID,
+			Path:    v.Path,
+			Updated: v.Updated,
+			Deleted: v.Deleted,
+			Hash:    v.Hash,
+			Size:    v.Size,
+			Client:  v.Client,
+			Created: v.Created,
+		})
+	}
+
+	return result, nil
+}
+
+func (p *EfsProvider) RetrieveVersion(path string, id int64) (io.ReadCloser, error) {
+	if id == 0 {
+		return p.RetrieveFile(path)
+	}
+
+	v, err := p.index.GetVersion(id)
+	if err != nil {
+		return nil, fmt.Errorf("version not found: %w", err)
+	}
+
+	if v.Path != path {
+		return nil, fmt.Errorf("version %v is not a version of %v", id, path)
+	}
+
+	if v.Deleted {
+		return nil, fmt.Errorf("version %v is a deleted version", id)
+	}
+
+	if v.StoredPath == "" {
+		return p.chunks.retrieveVersion(id)
+	}
+
+	//Stored as a single blob by an older version
+	file, err := p.getBlob(v.StoredPath)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open file for retrieval: %w", err)
+	}
+
+	reader, err := modifiers.DecryptAndDecompress(file, p.keys)
+	if err != nil {
+		return nil, fmt.Errorf("could not compress and encrypt: %w", err)
+	}
+	return reader, nil
+}
+
+func (p *EfsProvider) putBlob(storedPath string, content io.Reader) error {
+	fullPath := path.Join(p.Path, storedPath)
 	os.MkdirAll(path.Dir(fullPath), 0755)
 
-	writer, err := os.OpenFile(fullPath, os.O_CREATE+os.O_RDWR, 0644)
+	writer, err := os.OpenFile(fullPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
 	if err != nil {
 		return fmt.Errorf("could not open or create local path: %w", err)
 	}
-	defer writer.Close()
 
-	err = modifiers.CompressAndEncrypt(stream, writer, p.passphrase)
+	_, err = io.Copy(writer, content)
+	//On network file systems, write errors often only show up on close
+	closeErr := writer.Close()
+	if err == nil {
+		err = closeErr
+	}
 	if err != nil {
-		return fmt.Errorf("could not compress and encrypt: %w", err)
+		return fmt.Errorf("could not write blob: %w", err)
 	}
 
-	err = os.Chtimes(fullPath, fi.Updated, fi.Updated)
+	p.hideTimes(storedPath, path.Dir(storedPath), path.Dir(path.Dir(storedPath)))
+	return nil
+}
+
+func (p *EfsProvider) getBlob(storedPath string) (io.ReadCloser, error) {
+	return os.Open(path.Join(p.Path, storedPath))
+}
+
+func (p *EfsProvider) deleteBlob(storedPath string) error {
+	err := os.Remove(path.Join(p.Path, storedPath))
+	p.hideTimes(path.Dir(storedPath), path.Dir(path.Dir(storedPath)))
+	return err
+}
+
+// The time everything on the remote gets in privacy mode.
+var neutralTime = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// Give paths on the remote the neutral time in privacy mode, so it doesn't show when anything was written.
+// Best effort, the change time can't be set and some file systems don't keep the times that are set.
+func (p *EfsProvider) hideTimes(storedPaths ...string) {
+	if !p.privacy {
+		return
+	}
+
+	for _, storedPath := range storedPaths {
+		os.Chtimes(path.Join(p.Path, storedPath), neutralTime, neutralTime)
+	}
+}
+
+// Whether a blob exists on the remote.
+func (p *EfsProvider) hasBlob(storedPath string) (bool, error) {
+	_, err := os.Stat(path.Join(p.Path, storedPath))
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Walk the remote folder for blobs.
+func (p *EfsProvider) listBlobs(fn func(storedPath string) error) error {
+	return filepath.WalkDir(p.Path, func(fullPath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+
+		relPath, err := filepath.Rel(p.Path, fullPath)
+		if err != nil {
+			return err
+		}
+		return fn(filepath.ToSlash(relPath))
+	})
+}
+
+func (p *EfsProvider) CollectGarbage(policy *appconfig.RetentionConfig) (GcResult, error) {
+	return collectGarbage(p, p.index, p.chunks, p, policy)
+}
+
+func (p *EfsProvider) Lock() error {
+	err := p.locker.lock()
 	if err != nil {
-		return fmt.Errorf("could not set new updated times: %w", err)
+		return err
 	}
 
-	//todo update permissions
+	keys, err := ensureDataKey(p.keys, p)
+	if err != nil {
+		p.locker.release()
+		return err
+	}
+	p.setKeys(keys)
 
 	return nil
 }
 
-func (p *EfsProvider) RemoveFile(otherFi FileInfo) error {
-	fi, err := p.index.GetFileInfo(otherFi.Path)
+// Use new keys for everything that is encrypted from now on.
+func (p *EfsProvider) setKeys(keys modifiers.Keys) {
+	p.keys = keys
+	p.index.SetKeys(keys)
+	p.chunks.setKeys(keys)
+}
+
+func (p *EfsProvider) Unlock() error {
+	err := p.locker.check()
 	if err != nil {
-		storedPath, err := CreateRandomPath()
+		return err
+	}
+
+	err = p.chunks.prune()
+	if err != nil {
+		return fmt.Errorf("error removing unused chunks: %w", err)
+	}
+
+	//The index can't point to a pack that isn't there
+	err = p.chunks.flushPackAndPersist(func() error {
+		err := p.index.Close()
 		if err != nil {
-			return fmt.Errorf("cannot generate random path: %w", err)
+			return fmt.Errorf("error closing db: %w", err)
 		}
-		p.index.SetFileInfo(efsindex.EfsFileInfo{
-			Path:       otherFi.Path,
-			Updated:    otherFi.Updated,
-			Deleted:    true,
-			StoredPath: storedPath,
-		})
-
 		return nil
+	})
+	if err != nil {
+		return err
 	}
+	p.chunks.keep(p.index.Revived())
 
-	fullPath := path.Join(p.Path, fi.StoredPath)
-
-	err = os.Remove(fullPath)
+	//Blobs can only go once the index doesn't point to them anymore. Leftovers are cleaned up by gc.
+	err = p.chunks.deleteQueued()
 	if err != nil {
-		if os.IsNotExist(err) {
-			return nil
+		logger.Warn("could not remove all unused chunks: %v", err)
+	}
+
+	//Only now that the persisted index doesn't need the old keys anymore
+	if p.rekeyed {
+		err = finishRekey(p.index, p.keys, p)
+		if err != nil {
+			p.locker.release()
+			return fmt.Errorf("could not finish rekey, run it again: %w", err)
 		}
-		return fmt.Errorf("could not remove file: %w", err)
+		p.rekeyed = false
 	}
 
-	fi.Deleted = true
-	fi.Updated = otherFi.Updated
-	err = p.index.SetFileInfo(fi)
+	err = p.locker.release()
+	p.hideTimes(sqliteIndexName, dataKeyName, nextDataKeyName, ".")
+	return err
+}
+
+// Persist the index so far. Blobs queued for deletion stay queued until Unlock.
+func (p *EfsProvider) Checkpoint() error {
+	err := p.locker.check()
 	if err != nil {
-		return fmt.Errorf("could not delete in index: %w", err)
+		return err
+	}
+
+	err = p.chunks.flushPackAndPersist(func() error {
+		err := p.index.Checkpoint()
+		if err != nil {
+			return fmt.Errorf("error persisting index: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
 	}
+	p.chunks.keep(p.index.Revived())
+	p.hideTimes(sqliteIndexName)
 
 	return nil
 }
 
-func (p *EfsProvider) Lock() error {
-	fullPath := path.Join(p.Path, lockfileName)
-	_, err := os.Stat(fullPath)
-	if err == nil {
-		return errors.New("cannot set lock, already locked")
+func (p *EfsProvider) Rekey() (int, error) {
+	err := p.locker.check()
+	if err != nil {
+		return 0, err
 	}
 
-	data := []byte(p.name)
-	err = os.WriteFile(fullPath, data, 0600)
+	count, err := rekey(p.index, p.chunks, p.Checkpoint)
 	if err != nil {
-		return fmt.Errorf("error setting lock: %w", err)
+		return count, err
 	}
 
-	return nil
+	p.rekeyed = true
+	return count, nil
 }
 
-func (p *EfsProvider) Unlock() error {
-	fullPath := path.Join(p.Path, lockfileName)
+func (p *EfsProvider) RotateDataKey() error {
+	err := p.locker.check()
+	if err != nil {
+		return err
+	}
 
-	data, err := os.ReadFile(fullPath)
+	return rotateDataKey(p.keys, p)
+}
+
+func (p *EfsProvider) GetStoredChunks(path string) ([]StoredChunk, error) {
+	records, err := p.index.GetFileChunkRecords(path)
 	if err != nil {
-		return fmt.Errorf("already unlocked")
+		return nil, err
 	}
 
-	if string(data) != p.name {
-		return fmt.Errorf("store locked by another client: %v", string(data))
+	chunks := make([]StoredChunk, 0, len(records))
+	for _, record := range records {
+		//Small enough to upload again, and their pack might not be stored yet
+		if record.Packed {
+			continue
+		}
+		chunks = append(chunks, StoredChunk{Hash: record.Hash, StoredPath: record.StoredPath, Size: record.Size})
 	}
+	return chunks, nil
+}
+
+func (p *EfsProvider) RestoreChunks(chunks []StoredChunk) (int, error) {
+	return p.chunks.restore(chunks)
+}
 
-	err = os.Remove(fullPath)
+func (p *EfsProvider) LockStatus() (Lease, bool, error) {
+	return p.locker.current()
+}
+
+func (p *EfsProvider) ForceUnlock() error {
+	return p.locker.forceUnlock()
+}
+
+func (p *EfsProvider) readLock() ([]byte, error) {
+	return os.ReadFile(path.Join(p.Path, lockfileName))
+}
+
+func (p *EfsProvider) createLock(data []byte) error {
+	return createLockFile(path.Join(p.Path, lockfileName), data)
+}
+
+func (p *EfsProvider) replaceLock(previous, data []byte) error {
+	return replaceLockFile(path.Join(p.Path, lockfileName), previous, data)
+}
+
+func (p *EfsProvider) renewLock(previous, data []byte) error {
+	return renewLockFile(path.Join(p.Path, lockfileName), previous, data)
+}
+
+func (p *EfsProvider) deleteLock() error {
+	return os.Remove(path.Join(p.Path, lockfileName))
+}
+
+func (p *EfsProvider) readDataKey(name string) ([]byte, error) {
+	return os.ReadFile(path.Join(p.Path, name))
+}
+
+func (p *EfsProvider) createDataKey(name string, data []byte) error {
+	return createLockFile(path.Join(p.Path, name), data)
+}
+
+func (p *EfsProvider) writeDataKey(name string, data []byte) error {
+	fullPath := path.Join(p.Path, name)
+
+	//Write next to it and rename, so the data key is never half written
+	tmpPath := fmt.Sprintf("%v.%v", fullPath, os.Getpid())
+	err := os.WriteFile(tmpPath, data, 0600)
 	if err != nil {
-		return fmt.Errorf("error removing lock file: %w", err)
+		return err
 	}
 
-	err = p.index.Close()
+	err = os.Rename(tmpPath, fullPath)
 	if err != nil {
-		return fmt.Errorf("error closing db: %w", err)
+		os.Remove(tmpPath)
+		return err
 	}
 	return nil
 }
 
+func (p *EfsProvider) deleteDataKey(name string) error {
+	return os.Remove(path.Join(p.Path, name))
+}
+
+func (p *EfsProvider) Close() error {
+	p.locker.stopHeartbeat()
+	return p.index.Discard()
+}
+
 func (p *EfsProvider) GetFileInfo(path string) (FileInfo, error) {
 	fi, err := p.index.GetFileInfo(path)
 	if err != nil {
@@ -1,12 +1,21 @@
 package fileprovider
 
 import (
+	"crypto/rand"
+	"fmt"
+	"io"
+	"io/fs"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 
+	"filippo.io/age"
 	"github.com/c00/buttercup/appconfig"
 	"github.com/c00/buttercup/internal/fstests"
 	"github.com/joho/godotenv"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestEfsProvider_RunProviderSuite(t *testing.T) {
@@ -21,3 +30,487 @@ func TestEfsProvider_RunProviderSuite(t *testing.T) {
 		})
 	})
 }
+
+func TestEfsProvider_Deduplication(t *testing.T) {
+	godotenv.Load("../.env")
+	sourcePath := os.Getenv("TEST_SOURCE_PATH")
+	fstests.SetupSourceFilesystem(sourcePath, false)
+
+	p := NewEfsProvider(appconfig.ProviderConfig{
+		Type:       TypeEfs,
+		ClientName: "client",
+		EfsConfig:  &appconfig.EfsProviderConfig{Path: sourcePath, Passphrase: "foo"},
+	})
+	assert.Nil(t, p.Lock())
+
+	content := "the same content in two places"
+	assert.Nil(t, p.StoreFile(FileInfo{Path: "/foo.txt"}, strings.NewReader(content)))
+	assert.Nil(t, p.StoreFile(FileInfo{Path: "/sub/bar.txt"}, strings.NewReader(content)))
+	assert.Equal(t, countBlobs(t, sourcePath), 1)
+
+	reader, err := p.RetrieveFile("/sub/bar.txt")
+	assert.Nil(t, err)
+	data, err := io.ReadAll(reader)
+	assert.Nil(t, err)
+	assert.Equal(t, string(data), content)
+	reader.Close()
+
+	//Still used by the other file
+	assert.Nil(t, p.RemoveFile(FileInfo{Path: "/foo.txt", Deleted: true}))
+	assert.Nil(t, p.chunks.prune())
+	assert.Equal(t, countBlobs(t, sourcePath), 1)
+
+	//Not used by a current file anymore, but kept for the version history
+	assert.Nil(t, p.RemoveFile(FileInfo{Path: "/sub/bar.txt", Deleted: true}))
+	assert.Nil(t, p.Unlock())
+	assert.Equal(t, countBlobs(t, sourcePath), 1)
+}
+
+func TestEfsProvider_ConcurrentStores(t *testing.T) {
+	godotenv.Load("../.env")
+	sourcePath := os.Getenv("TEST_SOURCE_PATH")
+	fstests.SetupSourceFilesystem(sourcePath, false)
+
+	p := NewEfsProvider(appconfig.ProviderConfig{
+		Type:       TypeEfs,
+		ClientName: "client",
+		EfsConfig:  &appconfig.EfsProviderConfig{Path: sourcePath, Passphrase: "foo"},
+	})
+	assert.Nil(t, p.Lock())
+
+	content := "the same content in many places"
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.Nil(t, p.StoreFile(FileInfo{Path: fmt.Sprintf("/file%v.txt", i)}, strings.NewReader(content)))
+		}()
+	}
+	wg.Wait()
+
+	//Uploaded only once
+	assert.Equal(t, countBlobs(t, sourcePath), 1)
+
+	for i := 0; i < 10; i++ {
+		reader, err := p.RetrieveFile(fmt.Sprintf("/file%v.txt", i))
+		assert.Nil(t, err)
+		data, err := io.ReadAll(reader)
+		assert.Nil(t, err)
+		assert.Equal(t, string(data), content)
+		reader.Close()
+	}
+
+	assert.Nil(t, p.Unlock())
+}
+
+func TestEfsProvider_Versions(t *testing.T) {
+	godotenv.Load("../.env")
+	sourcePath := os.Getenv("TEST_SOURCE_PATH")
+	fstests.SetupSourceFilesystem(sourcePath, false)
+
+	p := NewEfsProvider(appconfig.ProviderConfig{
+		Type:       TypeEfs,
+		ClientName: "client",
+		EfsConfig:  &appconfig.EfsProviderConfig{Path: sourcePath, Passphrase: "foo"},
+	})
+	assert.Nil(t, p.Lock())
+	assert.Nil(t, p.StoreFile(FileInfo{Path: "/foo.txt"}, strings.NewReader("first")))
+	assert.Nil(t, p.StoreFile(FileInfo{Path: "/foo.txt"}, strings.NewReader("second")))
+	assert.Nil(t, p.Unlock())
+
+	//The old content survives pruning
+	assert.Equal(t, countBlobs(t, sourcePath), 2)
+
+	versions, err := p.GetVersions("/foo.txt")
+	assert.Nil(t, err)
+	assert.Len(t, versions, 2)
+	assert.Equal(t, versions[0].ID, int64(0))
+	assert.Equal(t, versions[0].Client, "client")
+
+	reader, err := p.RetrieveVersion("/foo.txt", versions[1].ID)
+	assert.Nil(t, err)
+	data, err := io.ReadAll(reader)
+	assert.Nil(t, err)
+	assert.Equal(t, string(data), "first")
+	reader.Close()
+
+	assert.Nil(t, p.Close())
+}
+
+func TestEfsProvider_CollectGarbage(t *testing.T) {
+	godotenv.Load("../.env")
+	sourcePath := os.Getenv("TEST_SOURCE_PATH")
+	fstests.SetupSourceFilesystem(sourcePath, false)
+
+	p := NewEfsProvider(appconfig.ProviderConfig{
+		Type:       TypeEfs,
+		ClientName: "client",
+		EfsConfig:  &appconfig.EfsProviderConfig{Path: sourcePath, Passphrase: "foo"},
+	})
+	assert.Nil(t, p.Lock())
+	assert.Nil(t, p.StoreFile(FileInfo{Path: "/foo.txt"}, strings.NewReader("first")))
+	assert.Nil(t, p.StoreFile(FileInfo{Path: "/foo.txt"}, strings.NewReader("second")))
+	assert.Nil(t, p.Unlock())
+	assert.Equal(t, countBlobs(t, sourcePath), 2)
+
+	//Left behind by an interrupted push, and something that isn't ours
+	assert.Nil(t, p.putBlob("0123abcd/0123abcd/0123abcd", strings.NewReader("orphan")))
+	assert.Nil(t, p.putBlob("notes.txt", strings.NewReader("not a blob")))
+
+	//Without a policy, versions are kept
+	assert.Nil(t, p.Lock())
+	result, err := p.CollectGarbage(nil)
+	assert.Nil(t, err)
+	assert.Equal(t, result, GcResult{DeletedBlobs: 1, OrphanedBlobs: 1})
+	assert.Nil(t, p.Unlock())
+	assert.Equal(t, countBlobs(t, sourcePath), 3)
+
+	assert.Nil(t, p.Lock())
+	result, err = p.CollectGarbage(&appconfig.RetentionConfig{})
+	assert.Nil(t, err)
+	assert.Equal(t, result, GcResult{ExpiredVersions: 1, DeletedBlobs: 1})
+	assert.Nil(t, p.Unlock())
+	assert.Equal(t, countBlobs(t, sourcePath), 2)
+
+	reader, err := p.RetrieveFile("/foo.txt")
+	assert.Nil(t, err)
+	data, err := io.ReadAll(reader)
+	assert.Nil(t, err)
+	assert.Equal(t, string(data), "second")
+	reader.Close()
+
+	assert.Nil(t, p.Close())
+}
+
+func TestEfsProvider_Checkpoint(t *testing.T) {
+	godotenv.Load("../.env")
+	sourcePath := os.Getenv("TEST_SOURCE_PATH")
+	fstests.SetupSourceFilesystem(sourcePath, false)
+
+	conf := appconfig.ProviderConfig{
+		Type:       TypeEfs,
+		ClientName: "client",
+		EfsConfig:  &appconfig.EfsProviderConfig{Path: sourcePath, Passphrase: "foo"},
+	}
+	p := NewEfsProvider(conf)
+	assert.Nil(t, p.Lock())
+	assert.Nil(t, p.StoreFile(FileInfo{Path: "/foo.txt"}, strings.NewReader("foo")))
+	assert.Nil(t, p.Checkpoint())
+	assert.Nil(t, p.StoreFile(FileInfo{Path: "/bar.txt"}, strings.NewReader("bar")))
+	chunks, err := p.GetStoredChunks("/bar.txt")
+	assert.Nil(t, err)
+	assert.Equal(t, len(chunks), 1)
+
+	//Interrupted, only what was checkpointed made it
+	assert.Nil(t, p.Close())
+
+	p = NewEfsProvider(conf)
+	_, err = p.GetFileInfo("/foo.txt")
+	assert.Nil(t, err)
+	_, err = p.GetFileInfo("/bar.txt")
+	assert.NotNil(t, err)
+
+	//The chunk of bar.txt is still there and can be reused, a chunk whose blob is gone can't.
+	assert.Nil(t, p.ForceUnlock())
+	assert.Nil(t, p.Lock())
+	missing := StoredChunk{Hash: "missing", StoredPath: "0123abcd/0123abcd/0123abcd", Size: 1}
+	restored, err := p.RestoreChunks(append(chunks, missing))
+	assert.Nil(t, err)
+	assert.Equal(t, restored, 1)
+	restored, err = p.RestoreChunks(chunks)
+	assert.Nil(t, err)
+	assert.Equal(t, restored, 0)
+
+	assert.Nil(t, p.StoreFile(FileInfo{Path: "/bar.txt"}, strings.NewReader("bar")))
+	assert.Nil(t, p.Unlock())
+	assert.Equal(t, countBlobs(t, sourcePath), 2)
+
+	reader, err := p.RetrieveFile("/bar.txt")
+	assert.Nil(t, err)
+	data, err := io.ReadAll(reader)
+	assert.Nil(t, err)
+	assert.Equal(t, string(data), "bar")
+	reader.Close()
+
+	assert.Nil(t, p.Close())
+}
+
+func TestEfsProvider_UnusedRestoredChunksArePruned(t *testing.T) {
+	godotenv.Load("../.env")
+	sourcePath := os.Getenv("TEST_SOURCE_PATH")
+	fstests.SetupSourceFilesystem(sourcePath, false)
+
+	p := NewEfsProvider(appconfig.ProviderConfig{
+		Type:       TypeEfs,
+		ClientName: "client",
+		EfsConfig:  &appconfig.EfsProviderConfig{Path: sourcePath, Passphrase: "foo"},
+	})
+	assert.Nil(t, p.Lock())
+	assert.Nil(t, p.putBlob("0123abcd/0123abcd/0123abcd", strings.NewReader("orphan")))
+	restored, err := p.RestoreChunks([]StoredChunk{{Hash: "unused", StoredPath: "0123abcd/0123abcd/0123abcd", Size: 6}})
+	assert.Nil(t, err)
+	assert.Equal(t, restored, 1)
+	assert.Nil(t, p.Unlock())
+	assert.Equal(t, countBlobs(t, sourcePath), 0)
+
+	assert.Nil(t, p.Close())
+}
+
+func countBlobs(t *testing.T, root string) int {
+	count := 0
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && d.Name() != sqliteIndexName && d.Name() != lockfileName && d.Name() != dataKeyName && d.Name() != nextDataKeyName {
+			count++
+		}
+		return nil
+	})
+	assert.Nil(t, err)
+	return count
+}
+
+func TestEfsProvider_Recipients(t *testing.T) {
+	dir := t.TempDir()
+	device, err := age.GenerateX25519Identity()
+	assert.Nil(t, err)
+	backup, err := age.GenerateX25519Identity()
+	assert.Nil(t, err)
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "device.txt"), []byte(device.String()), 0600))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "backup.txt"), []byte(backup.String()), 0600))
+
+	conf := func(identity string) appconfig.ProviderConfig {
+		return appconfig.ProviderConfig{
+			Type:       TypeEfs,
+			ClientName: "client",
+			EfsConfig: &appconfig.EfsProviderConfig{
+				Path:            filepath.Join(dir, "remote"),
+				Recipients:      []string{device.Recipient().String()},
+				IndexRecipients: []string{backup.Recipient().String()},
+				Identities:      []string{filepath.Join(dir, identity)},
+			},
+		}
+	}
+
+	//A backup host can push, but not read what it pushed
+	p := NewEfsProvider(conf("backup.txt"))
+	assert.Nil(t, p.Lock())
+	assert.Nil(t, p.StoreFile(FileInfo{Path: "/foo.txt"}, strings.NewReader("foo")))
+	reader, err := p.RetrieveFile("/foo.txt")
+	if err == nil {
+		_, err = io.ReadAll(reader)
+		reader.Close()
+	}
+	assert.NotNil(t, err)
+	assert.Nil(t, p.Unlock())
+	assert.Nil(t, p.Close())
+
+	p = NewEfsProvider(conf("device.txt"))
+	defer p.Close()
+	reader, err = p.RetrieveFile("/foo.txt")
+	assert.Nil(t, err)
+	data, err := io.ReadAll(reader)
+	assert.Nil(t, err)
+	assert.Equal(t, string(data), "foo")
+	reader.Close()
+}
+
+func TestEfsProvider_Rekey(t *testing.T) {
+	godotenv.Load("../.env")
+	sourcePath := os.Getenv("TEST_SOURCE_PATH")
+	fstests.SetupSourceFilesystem(sourcePath, false)
+
+	device, err := age.GenerateX25519Identity()
+	assert.Nil(t, err)
+	identityFile := filepath.Join(t.TempDir(), "device.txt")
+	assert.Nil(t, os.WriteFile(identityFile, []byte(device.String()), 0600))
+
+	conf := func(efsConfig appconfig.EfsProviderConfig) appconfig.ProviderConfig {
+		efsConfig.Path = sourcePath
+		return appconfig.ProviderConfig{Type: TypeEfs, ClientName: "client", EfsConfig: &efsConfig}
+	}
+	rekey := func(efsConfig appconfig.EfsProviderConfig) int {
+		p := NewEfsProvider(conf(efsConfig))
+		defer p.Close()
+		assert.Nil(t, p.Lock())
+		count, err := p.Rekey()
+		assert.Nil(t, err)
+		assert.Nil(t, p.Unlock())
+		return count
+	}
+	storedPath := func(efsConfig appconfig.EfsProviderConfig) string {
+		p := NewEfsProvider(conf(efsConfig))
+		defer p.Close()
+		chunks, err := p.GetStoredChunks("/foo.txt")
+		assert.Nil(t, err)
+		return chunks[0].StoredPath
+	}
+
+	p := NewEfsProvider(conf(appconfig.EfsProviderConfig{Passphrase: "foo"}))
+	assert.Nil(t, p.Lock())
+	assert.Nil(t, p.StoreFile(FileInfo{Path: "/foo.txt"}, strings.NewReader("foo")))
+	assert.Nil(t, p.StoreFile(FileInfo{Path: "/bar.txt"}, strings.NewReader("bar")))
+	assert.Nil(t, p.Unlock())
+	assert.Nil(t, p.Close())
+	before := storedPath(appconfig.EfsProviderConfig{Passphrase: "foo"})
+
+	//A new passphrase only wraps the data key again
+	assert.Equal(t, rekey(appconfig.EfsProviderConfig{Passphrase: "bar", OldPassphrase: "foo"}), 0)
+	assert.Equal(t, storedPath(appconfig.EfsProviderConfig{Passphrase: "bar"}), before)
+	assert.Panics(t, func() { NewEfsProvider(conf(appconfig.EfsProviderConfig{Passphrase: "foo"})) })
+
+	//A new data key re-encrypts everything, and takes the place of the old one
+	oldKey, err := os.ReadFile(filepath.Join(sourcePath, dataKeyName))
+	assert.Nil(t, err)
+	p = NewEfsProvider(conf(appconfig.EfsProviderConfig{Passphrase: "bar"}))
+	assert.Nil(t, p.Lock())
+	assert.Nil(t, p.RotateDataKey())
+	assert.Nil(t, p.Unlock())
+	assert.Nil(t, p.Close())
+	_, err = os.Stat(filepath.Join(sourcePath, nextDataKeyName))
+	assert.Nil(t, err)
+
+	assert.Equal(t, rekey(appconfig.EfsProviderConfig{Passphrase: "bar"}), 2)
+	rotated := storedPath(appconfig.EfsProviderConfig{Passphrase: "bar"})
+	assert.NotEqual(t, rotated, before)
+	assert.Equal(t, countBlobs(t, sourcePath), 2)
+	newKey, err := os.ReadFile(filepath.Join(sourcePath, dataKeyName))
+	assert.Nil(t, err)
+	assert.NotEqual(t, newKey, oldKey)
+	_, err = os.Stat(filepath.Join(sourcePath, nextDataKeyName))
+	assert.True(t, os.IsNotExist(err))
+
+	//Moving to recipients re-encrypts everything. The data key is kept until the index that doesn't need it
+	//anymore is persisted, so a rekey that is interrupted before that still finishes when it runs again.
+	recipients := appconfig.EfsProviderConfig{Recipients: []string{device.Recipient().String()}, Identities: []string{identityFile}}
+	withOld := recipients
+	withOld.OldPassphrase = "bar"
+	p = NewEfsProvider(conf(withOld))
+	assert.Nil(t, p.Lock())
+	count, err := p.Rekey()
+	assert.Nil(t, err)
+	assert.Equal(t, count, 2)
+	assert.Nil(t, p.Checkpoint())
+	assert.Nil(t, p.ForceUnlock())
+	assert.Nil(t, p.Close())
+	_, err = os.Stat(filepath.Join(sourcePath, dataKeyName))
+	assert.Nil(t, err)
+
+	assert.Equal(t, rekey(withOld), 0)
+	assert.NotEqual(t, storedPath(recipients), rotated)
+	_, err = os.Stat(filepath.Join(sourcePath, dataKeyName))
+	assert.True(t, os.IsNotExist(err))
+
+	p = NewEfsProvider(conf(recipients))
+	defer p.Close()
+	reader, err := p.RetrieveFile("/foo.txt")
+	assert.Nil(t, err)
+	data, err := io.ReadAll(reader)
+	assert.Nil(t, err)
+	assert.Equal(t, string(data), "foo")
+	reader.Close()
+}
+
+func TestEfsProvider_DataKeyIsCreatedOnLock(t *testing.T) {
+	sourcePath := t.TempDir()
+	conf := appconfig.ProviderConfig{Type: TypeEfs, ClientName: "client", EfsConfig: &appconfig.EfsProviderConfig{Path: sourcePath, Passphrase: "foo"}}
+	keyPath := filepath.Join(sourcePath, dataKeyName)
+
+	//Opening only reads
+	first := NewEfsProvider(conf)
+	defer first.Close()
+	second := NewEfsProvider(conf)
+	defer second.Close()
+	_, err := first.GetFileInfo("/foo.txt")
+	assert.NotNil(t, err)
+	_, err = os.Stat(keyPath)
+	assert.True(t, os.IsNotExist(err))
+
+	assert.Nil(t, first.Lock())
+	wrapped, err := os.ReadFile(keyPath)
+	assert.Nil(t, err)
+	assert.Nil(t, first.StoreFile(FileInfo{Path: "/foo.txt"}, strings.NewReader("foo")))
+	assert.Nil(t, first.Unlock())
+
+	//Opened before the data key existed, it uses the one the first client created
+	assert.Nil(t, second.Lock())
+	assert.Nil(t, second.StoreFile(FileInfo{Path: "/bar.txt"}, strings.NewReader("bar")))
+	assert.Nil(t, second.Unlock())
+	current, err := os.ReadFile(keyPath)
+	assert.Nil(t, err)
+	assert.Equal(t, current, wrapped)
+
+	p := NewEfsProvider(conf)
+	defer p.Close()
+	for _, name := range []string{"foo", "bar"} {
+		reader, err := p.RetrieveFile("/" + name + ".txt")
+		assert.Nil(t, err)
+		data, err := io.ReadAll(reader)
+		assert.Nil(t, err)
+		assert.Equal(t, string(data), name)
+		reader.Close()
+	}
+}
+
+func TestEfsProvider_Privacy(t *testing.T) {
+	godotenv.Load("../.env")
+	sourcePath := os.Getenv("TEST_SOURCE_PATH")
+	fstests.SetupSourceFilesystem(sourcePath, false)
+
+	conf := appconfig.ProviderConfig{
+		Type:           TypeEfs,
+		ClientName:     "client",
+		EfsConfig:      &appconfig.EfsProviderConfig{Path: sourcePath, Passphrase: "foo"},
+		Privacy:        true,
+		PackSmallFiles: true,
+	}
+
+	big := make([]byte, 600*1024)
+	_, err := rand.Read(big)
+	assert.Nil(t, err)
+	files := map[string]string{"/foo.txt": "foo", "/bar.txt": "bar", "/baz.txt": "baz", "/big.bin": string(big)}
+
+	p := NewEfsProvider(conf)
+	assert.Nil(t, p.Lock())
+	for filePath, content := range files {
+		assert.Nil(t, p.StoreFile(FileInfo{Path: filePath}, strings.NewReader(content)))
+	}
+	//Readable before the pack is full
+	reader, err := p.RetrieveFile("/foo.txt")
+	assert.Nil(t, err)
+	data, err := io.ReadAll(reader)
+	assert.Nil(t, err)
+	assert.Equal(t, string(data), "foo")
+	reader.Close()
+	assert.Nil(t, p.Unlock())
+	assert.Nil(t, p.Close())
+
+	//The small files share a pack
+	assert.Equal(t, countBlobs(t, sourcePath), 2)
+
+	err = filepath.WalkDir(sourcePath, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		assert.True(t, info.ModTime().Equal(neutralTime), path)
+		return nil
+	})
+	assert.Nil(t, err)
+
+	p = NewEfsProvider(conf)
+	defer p.Close()
+	for filePath, content := range files {
+		reader, err := p.RetrieveFile(filePath)
+		assert.Nil(t, err)
+		data, err := io.ReadAll(reader)
+		assert.Nil(t, err)
+		assert.Equal(t, string(data), content, filePath)
+		reader.Close()
+	}
+}
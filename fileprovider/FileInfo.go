@@ -2,6 +2,7 @@ package fileprovider
 
 import (
 	"fmt"
+	"os"
 	"time"
 )
 
@@ -11,6 +12,15 @@ const LocalNewer = 3
 const ConflictRemoteNewer = 4
 const ConflictLocalNewer = 5
 
+// What kind of entry a FileInfo describes.
+type EntryType string
+
+const (
+	EntryFile    EntryType = ""
+	EntryDir     EntryType = "dir"
+	EntrySymlink EntryType = "symlink"
+)
+
 type FileInfo struct {
 	// Path to the file
 	Path string
@@ -21,12 +31,58 @@ type FileInfo struct {
 	Updated time.Time
 	// Whether the file is deleted or not
 	Deleted bool
+	// Hex encoded sha256 of the content. Empty if unknown.
+	Hash string
+	// Size of the content in bytes
+	Size int64
+	// Permission bits, including setuid, setgid and sticky. 0 if unknown.
+	Mode os.FileMode
+	// Numeric owner and group as "uid:gid". Empty if unknown.
+	Owner string
+	// Extended attributes, encoded with encodeXattrs. Empty if there are none or they are not recorded.
+	Xattrs string
+	// Regular file, (empty) directory or symbolic link.
+	// The content of a symlink is the path it points to, directories have no content.
+	Type EntryType
+}
+
+// Whether both FileInfos are known to have the same content.
+// Two deleted files are considered the same as well.
+func (fi FileInfo) SameContent(other FileInfo) bool {
+	if fi.Deleted != other.Deleted {
+		return false
+	}
+
+	if fi.Deleted {
+		return true
+	}
+
+	return fi.Type == other.Type && fi.Hash != "" && fi.Hash == other.Hash && fi.SameMeta(other)
+}
+
+// Whether both FileInfos have the same permissions, owner and extended attributes.
+// Permissions and owners that are unknown on either side are not compared.
+func (fi FileInfo) SameMeta(other FileInfo) bool {
+	if fi.Mode != 0 && other.Mode != 0 && fi.Mode != other.Mode {
+		return false
+	}
+
+	if fi.Owner != "" && other.Owner != "" && fi.Owner != other.Owner {
+		return false
+	}
+
+	return fi.Xattrs == other.Xattrs
 }
 
 // Compare a remote file with a local file
 // The goal of this function is to decide whether or not to download the file.
 // asLocal indicates whether this called from a fileInfo that comes from a local vs a remote.
 func (fi FileInfo) Compare(other FileInfo, asLocal bool) (int, error) {
+	// Identical content never needs to be transferred, no matter what the dates say.
+	if fi.SameContent(other) {
+		return UpToDate, nil
+	}
+
 	var changedLocally, changedRemotely bool
 	var local, remote FileInfo
 
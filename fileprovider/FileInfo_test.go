@@ -84,3 +84,79 @@ func TestFileInfo_CompareForPush(t *testing.T) {
 		})
 	}
 }
+
+func TestFileInfo_CompareSameContent(t *testing.T) {
+	tests := []struct {
+		name   string
+		local  FileInfo
+		remote FileInfo
+		want   int
+	}{
+		{
+			name:   "Both changed, same hash",
+			local:  FileInfo{Updated: GetDate(2), LastSynced: GetDate(0), Hash: "abc"},
+			remote: FileInfo{Updated: GetDate(5), Hash: "abc"},
+			want:   UpToDate,
+		},
+		{
+			name:   "Both changed, different hash",
+			local:  FileInfo{Updated: GetDate(2), LastSynced: GetDate(0), Hash: "abc"},
+			remote: FileInfo{Updated: GetDate(5), Hash: "def"},
+			want:   ConflictRemoteNewer,
+		},
+		{
+			name:   "Touched locally, same hash",
+			local:  FileInfo{Updated: GetDate(1), LastSynced: GetDate(0), Hash: "abc"},
+			remote: FileInfo{Updated: GetDate(0), Hash: "abc"},
+			want:   UpToDate,
+		},
+		{
+			name:   "Unknown hashes",
+			local:  FileInfo{Updated: GetDate(1), LastSynced: GetDate(0)},
+			remote: FileInfo{Updated: GetDate(0)},
+			want:   LocalNewer,
+		},
+		{
+			name:   "Deleted remotely, same hash",
+			local:  FileInfo{Updated: GetDate(0), LastSynced: GetDate(0), Hash: "abc"},
+			remote: FileInfo{Updated: GetDate(1), Hash: "abc", Deleted: true},
+			want:   RemoteNewer,
+		},
+		{
+			name:   "Permissions changed locally",
+			local:  FileInfo{Updated: GetDate(1), LastSynced: GetDate(0), Hash: "abc", Mode: 0755},
+			remote: FileInfo{Updated: GetDate(0), Hash: "abc", Mode: 0644},
+			want:   LocalNewer,
+		},
+		{
+			name:   "Permissions unknown remotely",
+			local:  FileInfo{Updated: GetDate(1), LastSynced: GetDate(0), Hash: "abc", Mode: 0755, Owner: "1000:1000"},
+			remote: FileInfo{Updated: GetDate(0), Hash: "abc"},
+			want:   UpToDate,
+		},
+		{
+			name:   "Owner changed remotely",
+			local:  FileInfo{Updated: GetDate(0), LastSynced: GetDate(0), Hash: "abc", Owner: "1000:1000"},
+			remote: FileInfo{Updated: GetDate(1), Hash: "abc", Owner: "0:0"},
+			want:   RemoteNewer,
+		},
+		{
+			name:   "Extended attributes removed locally",
+			local:  FileInfo{Updated: GetDate(1), LastSynced: GetDate(0), Hash: "abc"},
+			remote: FileInfo{Updated: GetDate(0), Hash: "abc", Xattrs: `{"user.tag":"cmVk"}`},
+			want:   LocalNewer,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.local.Compare(tt.remote, true)
+			if err != nil {
+				t.Errorf("FileInfo.Compare() error = %v", err)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("FileInfo.Compare() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,128 @@
+package fileprovider
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/c00/buttercup/fileprovider/fsindex"
+	"github.com/c00/buttercup/logger"
+)
+
+// The mode bits that are synced. File type bits are left alone.
+const syncedModeBits = os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+
+// Read the permissions of a file, and its owner and extended attributes if the folder keeps those.
+func (p *FsProvider) readMeta(fi *fsindex.FsFileInfo, fullPath string, info os.FileInfo) error {
+	//Symlinks have no permissions of their own
+	fi.Mode = 0
+	if info.Mode()&os.ModeSymlink == 0 {
+		fi.Mode = uint32(info.Mode() & syncedModeBits)
+	}
+
+	if p.preserveOwner {
+		fi.Owner = fileOwner(info)
+	}
+
+	if p.preserveXattrs {
+		attrs, err := readXattrs(fullPath)
+		if err != nil {
+			return fmt.Errorf("cannot read extended attributes of %v: %w", fullPath, err)
+		}
+		fi.Xattrs = encodeXattrs(attrs)
+	}
+
+	return nil
+}
+
+// Give a file the permissions, owner and extended attributes of another one.
+// Metadata that is unknown is left alone. Failing to set the owner or attributes is not fatal, as it often needs privileges we don't have.
+func (p *FsProvider) applyMeta(fullPath string, other FileInfo) error {
+	if other.Mode != 0 && other.Type != EntrySymlink {
+		err := os.Chmod(fullPath, other.Mode&syncedModeBits)
+		if err != nil {
+			return fmt.Errorf("could not set permissions: %w", err)
+		}
+	}
+
+	if p.preserveOwner && other.Owner != "" {
+		err := setOwner(fullPath, other.Owner)
+		if err != nil {
+			logger.Warn("%v: could not set owner: %v", other.Path, err)
+		}
+	}
+
+	if p.preserveXattrs {
+		attrs, err := decodeXattrs(other.Xattrs)
+		if err == nil {
+			err = writeXattrs(fullPath, attrs)
+		}
+		if err != nil {
+			logger.Warn("%v: could not set extended attributes: %v", other.Path, err)
+		}
+	}
+
+	return nil
+}
+
+// Whether the metadata of a file changed since it was indexed.
+// Permissions and owners that weren't known before are only recorded, so upgrading doesn't make every file look changed.
+func metaChanged(indexed, current fsindex.FsFileInfo) bool {
+	if indexed.Mode != 0 && indexed.Mode != current.Mode {
+		return true
+	}
+
+	if indexed.Owner != "" && indexed.Owner != current.Owner {
+		return true
+	}
+
+	return indexed.Xattrs != current.Xattrs
+}
+
+// Change the owner and group of a file to a "uid:gid" pair.
+func setOwner(fullPath, owner string) error {
+	uid, gid, found := strings.Cut(owner, ":")
+	if !found {
+		return fmt.Errorf("invalid owner: %v", owner)
+	}
+
+	u, err := strconv.Atoi(uid)
+	if err != nil {
+		return fmt.Errorf("invalid owner: %v", owner)
+	}
+	g, err := strconv.Atoi(gid)
+	if err != nil {
+		return fmt.Errorf("invalid owner: %v", owner)
+	}
+
+	return os.Lchown(fullPath, u, g)
+}
+
+// Encode extended attributes to store them in an index. Names are sorted, so the same attributes always give the same string.
+func encodeXattrs(attrs map[string][]byte) string {
+	if len(attrs) == 0 {
+		return ""
+	}
+
+	data, err := json.Marshal(attrs)
+	if err != nil {
+		//Can't happen for a map of byte slices
+		panic(err)
+	}
+	return string(data)
+}
+
+func decodeXattrs(encoded string) (map[string][]byte, error) {
+	attrs := map[string][]byte{}
+	if encoded == "" {
+		return attrs, nil
+	}
+
+	err := json.Unmarshal([]byte(encoded), &attrs)
+	if err != nil {
+		return nil, fmt.Errorf("invalid extended attributes: %w", err)
+	}
+	return attrs, nil
+}
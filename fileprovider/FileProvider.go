@@ -25,11 +25,18 @@ type FileProvider interface {
 
 	//Get file info for a single file
 	GetFileInfo(path string) (FileInfo, error)
-	//Get a page of FileInfos
+	//Get a page of FileInfos, ordered by path
 	GetFileInfos(limit, offset int) ([]FileInfo, error)
 
 	//Set an exclusive lock on the provider so other clients cannot write to it.
 	Lock() error
 	//Release the exclusive lock. Also persists the index to disk if needed.
 	Unlock() error
+	//Get the lease of whoever holds the lock. Returns false if the provider is not locked.
+	LockStatus() (Lease, bool, error)
+	//Remove the lock, whoever holds it.
+	ForceUnlock() error
+	//Release any resources held by the provider.
+	//Changes to a remote index that were not persisted by Unlock() are discarded.
+	Close() error
 }
@@ -0,0 +1,42 @@
+package fileprovider
+
+import (
+	"io"
+	"time"
+)
+
+// A version of a file as it was written to a remote.
+type FileVersion struct {
+	// Id of the version. The current version of a file has ID 0.
+	ID      int64
+	Path    string
+	Updated time.Time
+	Deleted bool
+	Hash    string
+	Size    int64
+	// Client that wrote the version
+	Client string
+	// When the version was written to the remote
+	Created time.Time
+}
+
+// A provider that keeps previous versions of files around.
+type VersionedProvider interface {
+	//Get all versions of a file, newest (the current one) first.
+	//For a file that was moved away, there is no current version.
+	GetVersions(path string) ([]FileVersion, error)
+	//Retrieve the content of a version of a file.
+	RetrieveVersion(path string, id int64) (io.ReadCloser, error)
+}
+
+// Find the version that was current at the given time.
+// Returns false if the file did not exist on the remote yet.
+func VersionAt(versions []FileVersion, at time.Time) (FileVersion, bool) {
+	for _, v := range versions {
+		if !v.Created.After(at) {
+			return v, true
+		}
+	}
+
+	return FileVersion{}, false
+}
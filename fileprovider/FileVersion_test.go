@@ -0,0 +1,32 @@
+package fileprovider
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVersionAt(t *testing.T) {
+	now := time.Now()
+	versions := []FileVersion{
+		{ID: 0, Created: now},
+		{ID: 2, Created: now.Add(-time.Hour)},
+		{ID: 1, Created: now.Add(-2 * time.Hour)},
+	}
+
+	v, ok := VersionAt(versions, now.Add(-90*time.Minute))
+	assert.True(t, ok)
+	assert.Equal(t, v.ID, int64(1))
+
+	v, ok = VersionAt(versions, now.Add(-time.Hour))
+	assert.True(t, ok)
+	assert.Equal(t, v.ID, int64(2))
+
+	v, ok = VersionAt(versions, now.Add(time.Minute))
+	assert.True(t, ok)
+	assert.Equal(t, v.ID, int64(0))
+
+	_, ok = VersionAt(versions, now.Add(-3*time.Hour))
+	assert.False(t, ok)
+}
@@ -1,6 +1,8 @@
 package fileprovider
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
@@ -14,17 +16,32 @@ import (
 	"github.com/c00/buttercup/fileprovider/efsindex"
 	"github.com/c00/buttercup/fileprovider/fsindex"
 	"github.com/c00/buttercup/fileprovider/s3index"
+	"github.com/c00/buttercup/internal/ignore"
 )
 
+// Ways to handle symbolic links
+const SymlinksFollow = "follow"
+const SymlinksPreserve = "preserve"
+
 func NewFsProvider(conf appconfig.ProviderConfig) *FsProvider {
 	if conf.FsConfig == nil {
 		panic("fs config is not defined")
 	}
+	if conf.Symlinks != "" && conf.Symlinks != SymlinksFollow && conf.Symlinks != SymlinksPreserve {
+		panic(fmt.Errorf("unknown symlinks option %q, use %q or %q", conf.Symlinks, SymlinksFollow, SymlinksPreserve))
+	}
 	provider := &FsProvider{
-		Path:  conf.FsConfig.Path,
-		index: fsindex.New(path.Join(conf.FsConfig.Path, sqliteIndexName)),
-		name:  conf.ClientName,
+		Path:    conf.FsConfig.Path,
+		index:   fsindex.New(path.Join(conf.FsConfig.Path, sqliteIndexName)),
+		name:    conf.ClientName,
+		exclude: conf.Exclude,
+		include: conf.Include,
+
+		preserveOwner:  conf.PreserveOwner,
+		preserveXattrs: conf.PreserveXattrs,
+		followSymlinks: conf.Symlinks != SymlinksPreserve,
 	}
+	provider.locker = newLocker(provider, conf.ClientName)
 
 	os.Mkdir(provider.Path, 0700)
 
@@ -33,7 +50,7 @@ func NewFsProvider(conf appconfig.ProviderConfig) *FsProvider {
 		panic(fmt.Errorf("cannot load database: %w", err))
 	}
 
-	err = provider.refreshDates()
+	err = provider.scan()
 	if err != nil {
 		panic(fmt.Errorf("cannot scan filesystem: %w", err))
 	}
@@ -45,11 +62,22 @@ func NewFsProvider(conf appconfig.ProviderConfig) *FsProvider {
 //Or remote storedPath in this thing if we choose not to support it.
 
 type FsProvider struct {
-	Path string
-	name string
+	Path   string
+	name   string
+	locker *locker
 	// useEncryption bool
 	// passphrase    string
 	index *fsindex.FsIndex
+	//Patterns from the folder config
+	exclude []string
+	include []string
+	//Files that are not synced, loaded on every scan
+	ignore *ignore.Matcher
+	//Metadata to keep besides permissions
+	preserveOwner  bool
+	preserveXattrs bool
+	//Sync what symlinks point to, instead of the links. Links to folders or nothing are always kept as links.
+	followSymlinks bool
 }
 
 func (p *FsProvider) SetLastSynced(filePath string, date time.Time) error {
@@ -85,6 +113,21 @@ func (r *FsProvider) MoveFile(oldPath, newPath string) error {
 
 func (p *FsProvider) RetrieveFile(filePath string) (io.ReadCloser, error) {
 	fullPath := path.Join(p.Path, filePath)
+
+	//The content of a symlink is its target, folders have none
+	if fi, err := p.getFileInfo(filePath); err == nil {
+		switch EntryType(fi.Type) {
+		case EntryDir:
+			return io.NopCloser(strings.NewReader("")), nil
+		case EntrySymlink:
+			target, err := os.Readlink(fullPath)
+			if err != nil {
+				return nil, fmt.Errorf("cannot read symlink for retrieval: %w", err)
+			}
+			return io.NopCloser(strings.NewReader(target)), nil
+		}
+	}
+
 	file, err := os.Open(fullPath)
 	if err != nil {
 		return nil, fmt.Errorf("cannot open file for retrieval: %w", err)
@@ -108,13 +151,34 @@ func (p *FsProvider) StoreFile(otherFi FileInfo, stream io.Reader) error {
 		}
 	}
 
-	err = p.store(fi, stream)
+	fi.Updated = otherFi.Updated
+	reader := newHashingReader(stream)
+	err = p.store(fi, otherFi, reader)
 	if err != nil {
 		return fmt.Errorf("could not store file: %w", err)
 	}
+	fi.Type = string(otherFi.Type)
+
+	fullPath := path.Join(p.Path, fi.Path)
 
-	fi.Updated = otherFi.Updated
 	fi.Deleted = false
+	fi.Hash = reader.Sum()
+	fi.Size = reader.Size()
+	//store() sets the modification time to the updated date
+	fi.ModTime = fi.Updated
+	stat := os.Stat
+	if otherFi.Type == EntrySymlink {
+		stat = os.Lstat
+	}
+	if info, err := stat(fullPath); err == nil {
+		fi.ModTime = info.ModTime()
+		fi.Inode = inode(info)
+		//Record what the file ended up with, so the next scan doesn't see a change
+		err = p.readMeta(&fi, fullPath, info)
+		if err != nil {
+			return err
+		}
+	}
 
 	err = p.index.SetFileInfo(fi)
 	if err != nil {
@@ -124,27 +188,173 @@ func (p *FsProvider) StoreFile(otherFi FileInfo, stream io.Reader) error {
 	return nil
 }
 
-func (p *FsProvider) store(fi fsindex.FsFileInfo, stream io.Reader) error {
+func (p *FsProvider) store(fi fsindex.FsFileInfo, other FileInfo, stream io.Reader) error {
 	fullPath := path.Join(p.Path, fi.Path)
 	os.MkdirAll(path.Dir(fullPath), 0755)
 
-	writer, err := os.OpenFile(fullPath, os.O_CREATE+os.O_RDWR, 0644)
+	err := p.makeRoom(fullPath, EntryType(fi.Type), other.Type)
 	if err != nil {
-		return fmt.Errorf("could not open or create local path: %w", err)
+		return err
 	}
 
-	_, err = io.Copy(writer, stream)
+	switch other.Type {
+	case EntryDir:
+		//Read it anyway, so it is hashed
+		_, err = io.Copy(io.Discard, stream)
+		if err != nil {
+			return fmt.Errorf("could not read folder: %w", err)
+		}
+		err = os.Mkdir(fullPath, 0755)
+		if err != nil && !os.IsExist(err) {
+			return fmt.Errorf("could not create folder: %w", err)
+		}
+		err = p.applyMeta(fullPath, other)
+		if err != nil {
+			return err
+		}
+		return os.Chtimes(fullPath, fi.Updated, fi.Updated)
+	case EntrySymlink:
+		target, err := io.ReadAll(stream)
+		if err != nil {
+			return fmt.Errorf("could not read symlink: %w", err)
+		}
+		err = os.Symlink(string(target), fullPath)
+		if err != nil {
+			return fmt.Errorf("could not create symlink: %w", err)
+		}
+		//Chtimes would change the target, the link keeps the time it was created
+		return p.applyMeta(fullPath, other)
+	}
+
+	target, err := writeTarget(fullPath)
+	if err != nil {
+		return fmt.Errorf("could not resolve local path: %w", err)
+	}
+
+	//Write next to the file and move it in place when it is complete. That also replaces files we can't write to,
+	//like the read-only ones we pulled before.
+	tempPath, err := writeTempFile(target, stream)
 	if err != nil {
-		writer.Close()
-		return fmt.Errorf("could not copy file: %w", err)
+		return err
 	}
 
-	writer.Close()
-	err = os.Chtimes(fullPath, fi.Updated, fi.Updated)
+	err = p.finishTempFile(tempPath, target, fi, other)
+	if err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+
+	return nil
+}
+
+// Give a written temporary file its metadata and move it over target.
+func (p *FsProvider) finishTempFile(tempPath, target string, fi fsindex.FsFileInfo, other FileInfo) error {
+	//Without known permissions, the file keeps the ones it had
+	if other.Mode == 0 {
+		if info, err := os.Stat(target); err == nil {
+			err = os.Chmod(tempPath, info.Mode()&syncedModeBits)
+			if err != nil {
+				return fmt.Errorf("could not set permissions: %w", err)
+			}
+		}
+	}
+
+	err := p.applyMeta(tempPath, other)
+	if err != nil {
+		return err
+	}
+
+	err = os.Chtimes(tempPath, fi.Updated, fi.Updated)
 	if err != nil {
 		return fmt.Errorf("could not set new updated times: %w", err)
 	}
 
+	err = os.Rename(tempPath, target)
+	if err != nil {
+		return fmt.Errorf("could not move file in place: %w", err)
+	}
+
+	return nil
+}
+
+// Write a stream to a new temporary file in the folder of fullPath. Returns the path of the temporary file.
+func writeTempFile(fullPath string, stream io.Reader) (string, error) {
+	suffix := make([]byte, 8)
+	_, err := rand.Read(suffix)
+	if err != nil {
+		return "", fmt.Errorf("could not generate temporary name: %w", err)
+	}
+	tempPath := path.Join(path.Dir(fullPath), tempFilePrefix+hex.EncodeToString(suffix))
+
+	writer, err := os.OpenFile(tempPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return "", fmt.Errorf("could not create temporary file: %w", err)
+	}
+
+	_, err = io.Copy(writer, stream)
+	closeErr := writer.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tempPath)
+		return "", fmt.Errorf("could not copy file: %w", err)
+	}
+
+	return tempPath, nil
+}
+
+// Where writing a file ends up. A followed symlink is written through, so what it points to is replaced.
+func writeTarget(fullPath string) (string, error) {
+	info, err := os.Lstat(fullPath)
+	if err != nil || info.Mode()&os.ModeSymlink == 0 {
+		return fullPath, nil
+	}
+
+	target, err := filepath.EvalSymlinks(fullPath)
+	if err == nil {
+		return target, nil
+	}
+
+	//The link points to nothing yet, create what it points to
+	link, err := os.Readlink(fullPath)
+	if err != nil {
+		return "", err
+	}
+	if !filepath.IsAbs(link) {
+		link = filepath.Join(filepath.Dir(fullPath), link)
+	}
+	return link, nil
+}
+
+// Remove what is in the way of storing an entry of another type. A followed symlink is written through, like before.
+func (p *FsProvider) makeRoom(fullPath string, indexed, entryType EntryType) error {
+	info, err := os.Lstat(fullPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("could not check local path: %w", err)
+	}
+
+	switch {
+	case info.IsDir():
+		if entryType == EntryDir {
+			return nil
+		}
+	case info.Mode()&os.ModeSymlink != 0:
+		if entryType == EntryFile && indexed != EntrySymlink {
+			return nil
+		}
+	case entryType == EntryFile:
+		return nil
+	}
+
+	//Only removes empty folders
+	err = os.Remove(fullPath)
+	if err != nil {
+		return fmt.Errorf("could not replace %v: %w", fullPath, err)
+	}
 	return nil
 }
 
@@ -166,7 +376,10 @@ func (p *FsProvider) RemoveFile(otherFi FileInfo) error {
 		if os.IsNotExist(err) {
 			return nil
 		}
-		return fmt.Errorf("could not remove file: %w", err)
+		//Only empty folders are synced. If something was put in it since, it stays.
+		if EntryType(fi.Type) != EntryDir || isEmptyDir(fullPath) {
+			return fmt.Errorf("could not remove file: %w", err)
+		}
 	}
 
 	fi.Deleted = true
@@ -180,43 +393,94 @@ func (p *FsProvider) RemoveFile(otherFi FileInfo) error {
 }
 
 func (p *FsProvider) Lock() error {
-	fullPath := path.Join(p.Path, lockfileName)
-	_, err := os.Stat(fullPath)
-	if err == nil {
-		return errors.New("cannot set lock, already locked")
+	return p.locker.lock()
+}
+
+func (p *FsProvider) Unlock() error {
+	err := p.locker.check()
+	if err != nil {
+		return err
 	}
 
-	data := []byte(p.name)
-	err = os.WriteFile(fullPath, data, 0600)
+	err = p.locker.release()
 	if err != nil {
-		return fmt.Errorf("error setting lock: %w", err)
+		return err
 	}
 
+	err = p.index.Close()
+	if err != nil {
+		return fmt.Errorf("error closing db: %w", err)
+	}
 	return nil
 }
 
-func (p *FsProvider) Unlock() error {
-	fullPath := path.Join(p.Path, lockfileName)
-
-	data, err := os.ReadFile(fullPath)
-	if err != nil {
-		return fmt.Errorf("already unlocked")
-	}
+func (p *FsProvider) RecordPush(entry JournalEntry) error {
+	return p.index.AddJournalEntry(fsindex.JournalEntry{Path: entry.Path, LastSynced: entry.LastSynced})
+}
 
-	if string(data) != p.name {
-		return fmt.Errorf("store locked by another client: %v", string(data))
+func (p *FsProvider) RecordChunks(chunks []StoredChunk) error {
+	records := make([]fsindex.JournalChunk, 0, len(chunks))
+	for _, chunk := range chunks {
+		records = append(records, fsindex.JournalChunk{Hash: chunk.Hash, StoredPath: chunk.StoredPath, Size: chunk.Size})
 	}
+	return p.index.AddJournalChunks(records)
+}
 
-	err = os.Remove(fullPath)
+func (p *FsProvider) GetJournal() (Journal, error) {
+	entries, chunks, err := p.index.GetJournal()
 	if err != nil {
-		return fmt.Errorf("error removing lock file: %w", err)
+		return Journal{}, fmt.Errorf("could not read journal: %w", err)
 	}
 
-	err = p.index.Close()
-	if err != nil {
-		return fmt.Errorf("error closing db: %w", err)
+	journal := Journal{}
+	for _, entry := range entries {
+		journal.Entries = append(journal.Entries, JournalEntry{Path: entry.Path, LastSynced: entry.LastSynced})
 	}
-	return nil
+	for _, chunk := range chunks {
+		journal.Chunks = append(journal.Chunks, StoredChunk{Hash: chunk.Hash, StoredPath: chunk.StoredPath, Size: chunk.Size})
+	}
+	return journal, nil
+}
+
+func (p *FsProvider) ClearJournalEntries() error {
+	return p.index.ClearJournalEntries()
+}
+
+func (p *FsProvider) ClearJournal() error {
+	return p.index.ClearJournal()
+}
+
+func (p *FsProvider) LockStatus() (Lease, bool, error) {
+	return p.locker.current()
+}
+
+func (p *FsProvider) ForceUnlock() error {
+	return p.locker.forceUnlock()
+}
+
+func (p *FsProvider) readLock() ([]byte, error) {
+	return os.ReadFile(path.Join(p.Path, lockfileName))
+}
+
+func (p *FsProvider) createLock(data []byte) error {
+	return createLockFile(path.Join(p.Path, lockfileName), data)
+}
+
+func (p *FsProvider) replaceLock(previous, data []byte) error {
+	return replaceLockFile(path.Join(p.Path, lockfileName), previous, data)
+}
+
+func (p *FsProvider) renewLock(previous, data []byte) error {
+	return renewLockFile(path.Join(p.Path, lockfileName), previous, data)
+}
+
+func (p *FsProvider) deleteLock() error {
+	return os.Remove(path.Join(p.Path, lockfileName))
+}
+
+func (p *FsProvider) Close() error {
+	p.locker.stopHeartbeat()
+	return p.index.Close()
 }
 
 // todo rename
@@ -250,62 +514,161 @@ func (p *FsProvider) GetFileInfos(limit, offset int) ([]FileInfo, error) {
 	return result, nil
 }
 
-// Update files with Updated date
-func (p *FsProvider) refreshDates() error {
-	trackingValue := time.Now().Unix()
+// Scan the folder for changes made since the last scan.
+func (p *FsProvider) Rescan() error {
+	return p.scan()
+}
+
+// Scan only the given files and folders for changes, for when a watcher already knows what changed.
+// Paths are relative to the folder and start with a slash. Paths that don't exist anymore are marked as deleted.
+func (p *FsProvider) ScanPaths(paths []string) error {
+	if len(paths) == 0 {
+		return nil
+	}
+	return p.scan(paths...)
+}
+
+// Check if a file or folder is still the way the index has it, so scanning it would find nothing new.
+// Lets a watcher tell the files buttercup just pulled apart from changes made by others. When in doubt, it is changed.
+func (p *FsProvider) IsUnchanged(filePath string) bool {
+	fullPath := path.Join(p.Path, filePath)
+	info, err := os.Lstat(fullPath)
+	if os.IsNotExist(err) {
+		fi, err := p.getFileInfo(filePath)
+		return err == nil && fi.Deleted
+	}
+	if err != nil {
+		return false
+	}
+
+	if !info.IsDir() {
+		fi, err := p.getFileInfo(filePath)
+		return err == nil && !fi.Deleted && fi.Size == info.Size() && fi.ModTime.Equal(info.ModTime())
+	}
+
+	//Folders with files in them are not in the index, the files in them are
+	if isEmptyDir(fullPath) {
+		fi, err := p.getFileInfo(filePath)
+		return err == nil && !fi.Deleted && fi.Type == string(EntryDir)
+	}
+
+	entries, err := os.ReadDir(fullPath)
+	if err != nil {
+		return false
+	}
+	for _, entry := range entries {
+		if !p.IsUnchanged(path.Join(filePath, entry.Name())) {
+			return false
+		}
+	}
+	return true
+}
+
+// Check if a file is left out of syncing by the ignore file or the folder config.
+func (p *FsProvider) Ignores(filePath string) bool {
+	return p.ignore.Ignores(filePath)
+}
+
+// Read the patterns from the ignore file, followed by the ones from the config. Includes go last so they win.
+func (p *FsProvider) loadIgnore() error {
+	patterns, err := ignore.ReadFile(path.Join(p.Path, ignoreFileName))
+	if err != nil {
+		return fmt.Errorf("cannot read %v: %w", ignoreFileName, err)
+	}
 
-	//Walk the folder
+	patterns = append(patterns, p.exclude...)
+	for _, include := range p.include {
+		patterns = append(patterns, "!"+include)
+	}
+
+	matcher, err := ignore.Parse(patterns)
+	if err != nil {
+		return err
+	}
+	p.ignore = matcher
+	return nil
+}
+
+// Compare the files on disk to the index. Only files whose size, modification time or inode changed are hashed again,
+// and only rows that changed are written.
+func (p *FsProvider) scan(paths ...string) error {
 	//Remove final slash
 	p.Path = strings.TrimSuffix(p.Path, "/")
 
-	//Read files from IO.
-	err := filepath.Walk(p.Path, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err // Handle error if there is any
-		}
+	err := p.loadIgnore()
+	if err != nil {
+		return err
+	}
 
-		// Check if the file is not a directory
-		if info.IsDir() {
-			return nil
-		}
+	scan, err := p.index.StartScan()
+	if err != nil {
+		return fmt.Errorf("cannot start scan: %w", err)
+	}
+	defer scan.Abort()
 
-		relativePath := path[len(p.Path):]
+	roots := paths
+	if len(roots) == 0 {
+		roots = []string{""}
+	}
 
-		if relativePath == "/"+sqliteIndexName || relativePath == "/"+lockfileName {
-			return nil
+	for _, root := range roots {
+		_, err := os.Lstat(p.Path + root)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if root != "" && p.ignore.Ignores(root) {
+			continue
 		}
 
-		//Check if file exists in index
-		fi, err := p.index.GetFileInfo(relativePath)
-		if err != nil {
-			//Newly created file
-			err = p.index.SetFileInfo(fsindex.FsFileInfo{
-				Path:          relativePath,
-				Updated:       info.ModTime(),
-				Deleted:       false,
-				TrackingValue: trackingValue,
-			})
+		err = filepath.Walk(p.Path+root, func(path string, info os.FileInfo, err error) error {
 			if err != nil {
-				return fmt.Errorf("could not store file info: %w", err)
+				return err // Handle error if there is any
 			}
-		} else {
-			//Set magic value
-			fi.TrackingValue = trackingValue
-			fi.Updated = info.ModTime()
-			err = p.index.SetFileInfo(fi)
-			if err != nil {
-				return fmt.Errorf("could not update file info: %w", err)
+
+			relativePath := path[len(p.Path):]
+
+			if info.IsDir() {
+				if relativePath == "" {
+					return nil
+				}
+				//Don't even look inside ignored folders
+				if p.ignore.Match(relativePath, true) {
+					return filepath.SkipDir
+				}
+				//Folders are only synced when they are empty, otherwise the files in them take care of that
+				if !isEmptyDir(path) {
+					return nil
+				}
+				return p.scanFile(scan, path, relativePath, info)
 			}
-		}
 
-		return nil
-	})
+			if p.ignore.Match(relativePath, false) {
+				return nil
+			}
 
-	if err != nil {
-		return fmt.Errorf("error walking the path: %w", err)
+			//Pipes, sockets and devices have no content to sync
+			if !info.Mode().IsRegular() && info.Mode()&os.ModeSymlink == 0 {
+				return nil
+			}
+
+			//The index (and its journal while we scan) and lock files are ours
+			if strings.HasPrefix(relativePath, "/"+sqliteIndexName) || strings.HasPrefix(relativePath, "/"+lockfileName) {
+				return nil
+			}
+
+			//A file that is still being pulled, or that was left behind by a pull that was interrupted
+			if strings.HasPrefix(info.Name(), tempFilePrefix) {
+				return nil
+			}
+
+			return p.scanFile(scan, path, relativePath, info)
+		})
+		if err != nil {
+			return fmt.Errorf("error walking the path: %w", err)
+		}
 	}
 
-	err = p.markDeleted(trackingValue)
+	err = scan.Finish(paths...)
 	if err != nil {
 		return fmt.Errorf("error marking deleted: %w", err)
 	}
@@ -313,11 +676,99 @@ func (p *FsProvider) refreshDates() error {
 	return nil
 }
 
-// Mark files with no Updated value as deleted todo
-func (p *FsProvider) markDeleted(trackingValue int64) error {
+func (p *FsProvider) scanFile(scan *fsindex.Scan, fullPath, relativePath string, info os.FileInfo) error {
+	fi, found, err := scan.Get(relativePath)
+	if err != nil {
+		return err
+	}
+
+	entryType := EntryFile
+	switch {
+	case info.IsDir():
+		entryType = EntryDir
+	case info.Mode()&os.ModeSymlink != 0:
+		entryType = EntrySymlink
+		//Links that were pulled as links stay links
+		if p.followSymlinks && EntryType(fi.Type) != EntrySymlink {
+			if target, err := os.Stat(fullPath); err == nil && target.Mode().IsRegular() {
+				entryType = EntryFile
+				info = target
+			}
+		}
+	}
+
+	ino := inode(info)
+	//Folders have no content, whatever size the filesystem gives them
+	infoSize := info.Size()
+	if entryType == EntryDir {
+		infoSize = 0
+	}
 
-	//Everything that does NOT have this tracking value, should be marked as deleted.
-	return p.index.MarkDeleted(trackingValue)
+	if !found {
+		//Newly created file
+		hash, size, err := hashEntry(fullPath, entryType)
+		if err != nil {
+			return err
+		}
+
+		fi = fsindex.FsFileInfo{
+			Path:    relativePath,
+			Updated: info.ModTime(),
+			Hash:    hash,
+			Size:    size,
+			ModTime: info.ModTime(),
+			Inode:   ino,
+			Type:    string(entryType),
+		}
+		err = p.readMeta(&fi, fullPath, info)
+		if err != nil {
+			return err
+		}
+		return scan.Set(fi)
+	}
+
+	current := fi
+	err = p.readMeta(&current, fullPath, info)
+	if err != nil {
+		return err
+	}
+
+	//An unknown inode is only recorded, not treated as a change
+	replaced := fi.Inode != 0 && fi.Inode != ino
+
+	//Only hash again if the file looks different from last time
+	if fi.Deleted || fi.Hash == "" || fi.Size != infoSize || !fi.ModTime.Equal(info.ModTime()) || replaced || fi.Type != string(entryType) {
+		hash, size, err := hashEntry(fullPath, entryType)
+		if err != nil {
+			return err
+		}
+
+		//A touch or rewriting the same bytes doesn't count as an update.
+		if fi.Deleted || hash != fi.Hash || fi.Type != string(entryType) {
+			fi.Updated = info.ModTime()
+		} else if metaChanged(fi, current) {
+			fi.Updated = time.Now()
+		}
+		fi.Deleted = false
+		fi.Hash = hash
+		fi.Size = size
+		fi.ModTime = info.ModTime()
+		fi.Inode = ino
+		fi.Type = string(entryType)
+		fi.Mode, fi.Owner, fi.Xattrs = current.Mode, current.Owner, current.Xattrs
+		return scan.Set(fi)
+	}
+
+	//Changing permissions doesn't change the modification time, it only counts as an update if they were known before
+	if metaChanged(fi, current) {
+		current.Updated = time.Now()
+	}
+	if current != fi || fi.Inode != ino {
+		current.Inode = ino
+		return scan.Set(current)
+	}
+
+	return nil
 }
 
 func fsFileInfoToFileInfo(fi fsindex.FsFileInfo) FileInfo {
@@ -326,6 +777,12 @@ func fsFileInfoToFileInfo(fi fsindex.FsFileInfo) FileInfo {
 		LastSynced: fi.LastSynced,
 		Updated:    fi.Updated,
 		Deleted:    fi.Deleted,
+		Hash:       fi.Hash,
+		Size:       fi.Size,
+		Mode:       os.FileMode(fi.Mode),
+		Owner:      fi.Owner,
+		Xattrs:     fi.Xattrs,
+		Type:       EntryType(fi.Type),
 	}
 }
 
@@ -335,6 +792,12 @@ func efsFileInfoToFileInfo(fi efsindex.EfsFileInfo) FileInfo {
 		LastSynced: fi.LastSynced,
 		Updated:    fi.Updated,
 		Deleted:    fi.Deleted,
+		Hash:       fi.Hash,
+		Size:       fi.Size,
+		Mode:       os.FileMode(fi.Mode),
+		Owner:      fi.Owner,
+		Xattrs:     fi.Xattrs,
+		Type:       EntryType(fi.Type),
 	}
 }
 
@@ -344,5 +807,34 @@ func s3FileInfoToFileInfo(fi s3index.S3FileInfo) FileInfo {
 		LastSynced: fi.LastSynced,
 		Updated:    fi.Updated,
 		Deleted:    fi.Deleted,
+		Hash:       fi.Hash,
+		Size:       fi.Size,
+		Mode:       os.FileMode(fi.Mode),
+		Owner:      fi.Owner,
+		Xattrs:     fi.Xattrs,
+		Type:       EntryType(fi.Type),
+	}
+}
+
+// Hash the content of a file, folder or symlink on disk.
+func hashEntry(fullPath string, entryType EntryType) (string, int64, error) {
+	switch entryType {
+	case EntryDir:
+		hash, size := hashBytes(nil)
+		return hash, size, nil
+	case EntrySymlink:
+		target, err := os.Readlink(fullPath)
+		if err != nil {
+			return "", 0, fmt.Errorf("cannot read symlink for hashing: %w", err)
+		}
+		hash, size := hashBytes([]byte(target))
+		return hash, size, nil
 	}
+
+	return hashFile(fullPath)
+}
+
+func isEmptyDir(fullPath string) bool {
+	entries, err := os.ReadDir(fullPath)
+	return err == nil && len(entries) == 0
 }
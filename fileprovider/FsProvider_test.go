@@ -1,11 +1,13 @@
 package fileprovider
 
 import (
+	"fmt"
 	"io"
 	"os"
 	"path"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/c00/buttercup/appconfig"
 	"github.com/c00/buttercup/internal/fstests"
@@ -97,3 +99,319 @@ func TestFsProvider_StoreFile(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, string(data), "some content")
 }
+
+func TestFsProvider_TouchIsNotAnUpdate(t *testing.T) {
+	godotenv.Load("../.env")
+	sourcePath := os.Getenv("TEST_SOURCE_PATH")
+
+	fstests.SetupSourceFilesystem(sourcePath, true)
+	conf := appconfig.ProviderConfig{
+		Type:     TypeFs,
+		FsConfig: &appconfig.FsProviderConfig{Path: sourcePath},
+	}
+
+	p := NewFsProvider(conf)
+	fi, err := p.GetFileInfo("/foo.txt")
+	assert.Nil(t, err)
+	assert.NotEmpty(t, fi.Hash)
+	assert.Nil(t, p.index.Close())
+
+	//Touch the file
+	later := fi.Updated.Add(time.Hour)
+	assert.Nil(t, os.Chtimes(path.Join(sourcePath, "foo.txt"), later, later))
+
+	p = NewFsProvider(conf)
+	touched, err := p.GetFileInfo("/foo.txt")
+	assert.Nil(t, err)
+	assert.True(t, touched.Updated.Equal(fi.Updated))
+	assert.Equal(t, touched.Hash, fi.Hash)
+	assert.Nil(t, p.index.Close())
+
+	//Actually change it
+	assert.Nil(t, os.WriteFile(path.Join(sourcePath, "foo.txt"), []byte("new content"), 0644))
+	evenLater := later.Add(time.Hour)
+	assert.Nil(t, os.Chtimes(path.Join(sourcePath, "foo.txt"), evenLater, evenLater))
+
+	p = NewFsProvider(conf)
+	changed, err := p.GetFileInfo("/foo.txt")
+	assert.Nil(t, err)
+	assert.True(t, changed.Updated.Equal(evenLater))
+	assert.NotEqual(t, changed.Hash, fi.Hash)
+	assert.Equal(t, changed.Size, int64(len("new content")))
+}
+
+func TestFsProvider_ReplacedFileIsScanned(t *testing.T) {
+	dir := t.TempDir()
+	mtime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	assert.Nil(t, os.WriteFile(path.Join(dir, "foo.txt"), []byte("aaa"), 0644))
+	assert.Nil(t, os.Chtimes(path.Join(dir, "foo.txt"), mtime, mtime))
+
+	p := NewFsProvider(appconfig.ProviderConfig{
+		Type:     TypeFs,
+		FsConfig: &appconfig.FsProviderConfig{Path: dir},
+	})
+	defer p.Close()
+
+	fi, err := p.GetFileInfo("/foo.txt")
+	assert.Nil(t, err)
+
+	//Same size and modification time, but a different file
+	assert.Nil(t, os.WriteFile(path.Join(dir, "bar.tmp"), []byte("bbb"), 0644))
+	assert.Nil(t, os.Chtimes(path.Join(dir, "bar.tmp"), mtime, mtime))
+	assert.Nil(t, os.Rename(path.Join(dir, "bar.tmp"), path.Join(dir, "foo.txt")))
+
+	assert.Nil(t, p.Rescan())
+	replaced, err := p.GetFileInfo("/foo.txt")
+	assert.Nil(t, err)
+	assert.NotEqual(t, replaced.Hash, fi.Hash)
+}
+
+func TestFsProvider_ScanPaths(t *testing.T) {
+	dir := t.TempDir()
+	assert.Nil(t, os.MkdirAll(path.Join(dir, "sub"), 0755))
+	for _, name := range []string{"foo.txt", "bar.txt", "sub/one.txt", "sub/two.txt"} {
+		assert.Nil(t, os.WriteFile(path.Join(dir, name), []byte(name), 0644))
+	}
+
+	p := NewFsProvider(appconfig.ProviderConfig{
+		Type:     TypeFs,
+		FsConfig: &appconfig.FsProviderConfig{Path: dir},
+	})
+	defer p.Close()
+
+	assert.Nil(t, os.WriteFile(path.Join(dir, "foo.txt"), []byte("changed foo"), 0644))
+	assert.Nil(t, os.WriteFile(path.Join(dir, "bar.txt"), []byte("changed bar"), 0644))
+	assert.Nil(t, os.WriteFile(path.Join(dir, "new.txt"), []byte("new"), 0644))
+	assert.Nil(t, os.RemoveAll(path.Join(dir, "sub")))
+
+	assert.Nil(t, p.ScanPaths([]string{"/foo.txt", "/new.txt", "/sub"}))
+
+	foo, err := p.GetFileInfo("/foo.txt")
+	assert.Nil(t, err)
+	assert.Equal(t, foo.Size, int64(len("changed foo")))
+
+	_, err = p.GetFileInfo("/new.txt")
+	assert.Nil(t, err)
+
+	for _, name := range []string{"/sub/one.txt", "/sub/two.txt"} {
+		fi, err := p.GetFileInfo(name)
+		assert.Nil(t, err)
+		assert.True(t, fi.Deleted, name)
+	}
+
+	//Not scanned, so not noticed yet
+	bar, err := p.GetFileInfo("/bar.txt")
+	assert.Nil(t, err)
+	assert.Equal(t, bar.Size, int64(len("bar.txt")))
+
+	assert.Nil(t, p.Rescan())
+	bar, err = p.GetFileInfo("/bar.txt")
+	assert.Nil(t, err)
+	assert.Equal(t, bar.Size, int64(len("changed bar")))
+}
+
+func TestFsProvider_Ignore(t *testing.T) {
+	dir := t.TempDir()
+	assert.Nil(t, os.MkdirAll(path.Join(dir, "node_modules/pkg"), 0755))
+	assert.Nil(t, os.WriteFile(path.Join(dir, ignoreFileName), []byte("*.swp\nnode_modules/\n"), 0644))
+	for _, name := range []string{"a.txt", "a.txt.swp", "keep.swp", ".DS_Store", "node_modules/pkg/index.js"} {
+		assert.Nil(t, os.WriteFile(path.Join(dir, name), []byte(name), 0644))
+	}
+
+	p := NewFsProvider(appconfig.ProviderConfig{
+		Type:     TypeFs,
+		FsConfig: &appconfig.FsProviderConfig{Path: dir},
+		Exclude:  []string{".DS_Store"},
+		Include:  []string{"keep.swp"},
+	})
+	defer p.Close()
+
+	files, err := p.GetFileInfos(0, 0)
+	assert.Nil(t, err)
+	paths := []string{}
+	for _, fi := range files {
+		paths = append(paths, fi.Path)
+	}
+	assert.Equal(t, paths, []string{"/" + ignoreFileName, "/a.txt", "/keep.swp"})
+
+	assert.True(t, p.Ignores("/node_modules/pkg/index.js"))
+	assert.True(t, p.Ignores("/sub/b.swp"))
+	assert.False(t, p.Ignores("/keep.swp"))
+
+	//Changes to the ignore file are picked up on the next scan
+	assert.Nil(t, os.WriteFile(path.Join(dir, ignoreFileName), []byte("node_modules/\n"), 0644))
+	assert.Nil(t, p.Rescan())
+	_, err = p.GetFileInfo("/a.txt.swp")
+	assert.Nil(t, err)
+	assert.False(t, p.Ignores("/sub/b.swp"))
+}
+
+func TestFsProvider_Permissions(t *testing.T) {
+	dir := t.TempDir()
+	assert.Nil(t, os.WriteFile(path.Join(dir, "run.sh"), []byte("echo hi"), 0755))
+
+	p := NewFsProvider(appconfig.ProviderConfig{Type: TypeFs, FsConfig: &appconfig.FsProviderConfig{Path: dir}})
+	defer p.Close()
+
+	fi, err := p.GetFileInfo("/run.sh")
+	assert.Nil(t, err)
+	assert.Equal(t, fi.Mode, os.FileMode(0755))
+	assert.Equal(t, fi.Owner, "")
+
+	//A chmod is an update, even though the content didn't change
+	assert.Nil(t, p.SetLastSynced("/run.sh", time.Now()))
+	assert.Nil(t, os.Chmod(path.Join(dir, "run.sh"), 0700))
+	assert.Nil(t, p.Rescan())
+	changed, err := p.GetFileInfo("/run.sh")
+	assert.Nil(t, err)
+	assert.Equal(t, changed.Mode, os.FileMode(0700))
+	assert.True(t, changed.LastSynced.Before(changed.Updated))
+
+	//Permissions are applied when storing
+	err = p.StoreFile(FileInfo{Path: "/other.sh", Updated: time.Now(), Mode: 0750}, strings.NewReader("echo other"))
+	assert.Nil(t, err)
+	info, err := os.Stat(path.Join(dir, "other.sh"))
+	assert.Nil(t, err)
+	assert.Equal(t, info.Mode().Perm(), os.FileMode(0750))
+	stored, err := p.GetFileInfo("/other.sh")
+	assert.Nil(t, err)
+	assert.Equal(t, stored.Mode, os.FileMode(0750))
+
+	//Unknown permissions leave the file alone
+	err = p.StoreFile(FileInfo{Path: "/other.sh", Updated: time.Now()}, strings.NewReader("echo again"))
+	assert.Nil(t, err)
+	info, err = os.Stat(path.Join(dir, "other.sh"))
+	assert.Nil(t, err)
+	assert.Equal(t, info.Mode().Perm(), os.FileMode(0750))
+}
+
+func TestFsProvider_PreserveOwnerAndXattrs(t *testing.T) {
+	dir := t.TempDir()
+	filePath := path.Join(dir, "a.txt")
+	assert.Nil(t, os.WriteFile(filePath, []byte("a"), 0644))
+	err := writeXattrs(filePath, map[string][]byte{"user.color": []byte("red")})
+	if err != nil {
+		t.Skipf("no extended attributes on this filesystem: %v", err)
+	}
+
+	p := NewFsProvider(appconfig.ProviderConfig{
+		Type:           TypeFs,
+		FsConfig:       &appconfig.FsProviderConfig{Path: dir},
+		PreserveOwner:  true,
+		PreserveXattrs: true,
+	})
+	defer p.Close()
+
+	fi, err := p.GetFileInfo("/a.txt")
+	assert.Nil(t, err)
+	assert.Equal(t, fi.Owner, fmt.Sprintf("%v:%v", os.Getuid(), os.Getgid()))
+	assert.Equal(t, fi.Xattrs, encodeXattrs(map[string][]byte{"user.color": []byte("red")}))
+
+	//Attributes are replaced when storing
+	other := FileInfo{Path: "/a.txt", Updated: time.Now(), Owner: fi.Owner, Xattrs: encodeXattrs(map[string][]byte{"user.size": []byte("big")})}
+	err = p.StoreFile(other, strings.NewReader("b"))
+	assert.Nil(t, err)
+	attrs, err := readXattrs(filePath)
+	assert.Nil(t, err)
+	assert.Equal(t, attrs, map[string][]byte{"user.size": []byte("big")})
+	stored, err := p.GetFileInfo("/a.txt")
+	assert.Nil(t, err)
+	assert.Equal(t, stored.Xattrs, other.Xattrs)
+}
+
+func TestFsProvider_EntryTypes(t *testing.T) {
+	dir := t.TempDir()
+	assert.Nil(t, os.MkdirAll(path.Join(dir, "empty"), 0755))
+	assert.Nil(t, os.MkdirAll(path.Join(dir, "full"), 0755))
+	assert.Nil(t, os.WriteFile(path.Join(dir, "full/a.txt"), []byte("a"), 0644))
+	assert.Nil(t, os.Symlink("full/a.txt", path.Join(dir, "link")))
+	assert.Nil(t, os.Symlink("nowhere", path.Join(dir, "broken")))
+
+	p := NewFsProvider(appconfig.ProviderConfig{Type: TypeFs, FsConfig: &appconfig.FsProviderConfig{Path: dir}, Symlinks: SymlinksPreserve})
+	defer p.Close()
+
+	files, err := p.GetFileInfos(0, 0)
+	assert.Nil(t, err)
+	types := map[string]EntryType{}
+	for _, fi := range files {
+		types[fi.Path] = fi.Type
+	}
+	assert.Equal(t, types, map[string]EntryType{
+		"/broken":     EntrySymlink,
+		"/empty":      EntryDir,
+		"/full/a.txt": EntryFile,
+		"/link":       EntrySymlink,
+	})
+	assert.Equal(t, retrieveString(t, p, "/link"), "full/a.txt")
+	assert.Equal(t, retrieveString(t, p, "/empty"), "")
+
+	//Storing recreates them
+	err = p.StoreFile(FileInfo{Path: "/new/link", Updated: time.Now(), Type: EntrySymlink}, strings.NewReader("../full/a.txt"))
+	assert.Nil(t, err)
+	target, err := os.Readlink(path.Join(dir, "new/link"))
+	assert.Nil(t, err)
+	assert.Equal(t, target, "../full/a.txt")
+
+	err = p.StoreFile(FileInfo{Path: "/new/dir", Updated: time.Now(), Type: EntryDir}, strings.NewReader(""))
+	assert.Nil(t, err)
+	info, err := os.Stat(path.Join(dir, "new/dir"))
+	assert.Nil(t, err)
+	assert.True(t, info.IsDir())
+
+	//Nothing changed since they were stored
+	before, err := p.GetFileInfos(0, 0)
+	assert.Nil(t, err)
+	assert.Nil(t, p.Rescan())
+	after, err := p.GetFileInfos(0, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, after, before)
+
+	//A folder that isn't empty anymore is left to its files
+	assert.Nil(t, os.WriteFile(path.Join(dir, "empty/b.txt"), []byte("b"), 0644))
+	assert.Nil(t, p.Rescan())
+	fi, err := p.GetFileInfo("/empty")
+	assert.Nil(t, err)
+	assert.True(t, fi.Deleted)
+	err = p.RemoveFile(FileInfo{Path: "/empty", Updated: time.Now(), Deleted: true})
+	assert.Nil(t, err)
+	_, err = os.Stat(path.Join(dir, "empty/b.txt"))
+	assert.Nil(t, err)
+}
+
+func TestFsProvider_FollowSymlinks(t *testing.T) {
+	dir := t.TempDir()
+	assert.Nil(t, os.WriteFile(path.Join(dir, "a.txt"), []byte("a"), 0644))
+	assert.Nil(t, os.Symlink("a.txt", path.Join(dir, "link")))
+	assert.Nil(t, os.Symlink("nowhere", path.Join(dir, "broken")))
+
+	p := NewFsProvider(appconfig.ProviderConfig{Type: TypeFs, FsConfig: &appconfig.FsProviderConfig{Path: dir}})
+	defer p.Close()
+
+	//Links to files are read as files, others are kept as links
+	fi, err := p.GetFileInfo("/link")
+	assert.Nil(t, err)
+	assert.Equal(t, fi.Type, EntryFile)
+	assert.Equal(t, retrieveString(t, p, "/link"), "a")
+	fi, err = p.GetFileInfo("/broken")
+	assert.Nil(t, err)
+	assert.Equal(t, fi.Type, EntrySymlink)
+
+	//Pulled links stay links
+	err = p.StoreFile(FileInfo{Path: "/pulled", Updated: time.Now(), Type: EntrySymlink}, strings.NewReader("a.txt"))
+	assert.Nil(t, err)
+	stored, err := p.GetFileInfo("/pulled")
+	assert.Nil(t, err)
+	assert.Nil(t, p.Rescan())
+	fi, err = p.GetFileInfo("/pulled")
+	assert.Nil(t, err)
+	assert.Equal(t, fi, stored)
+}
+
+func retrieveString(t *testing.T, p FileProvider, filePath string) string {
+	reader, err := p.RetrieveFile(filePath)
+	assert.Nil(t, err)
+	defer reader.Close()
+	data, err := io.ReadAll(reader)
+	assert.Nil(t, err)
+	return string(data)
+}
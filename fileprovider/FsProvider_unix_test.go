@@ -0,0 +1,57 @@
+//go:build unix
+
+package fileprovider
+
+import (
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/c00/buttercup/appconfig"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFsProvider_SkipsSpecialFiles(t *testing.T) {
+	dir := t.TempDir()
+	assert.Nil(t, os.WriteFile(path.Join(dir, "a.txt"), []byte("a"), 0644))
+	assert.Nil(t, syscall.Mkfifo(path.Join(dir, "fifo"), 0644))
+
+	p := NewFsProvider(appconfig.ProviderConfig{Type: TypeFs, FsConfig: &appconfig.FsProviderConfig{Path: dir}})
+	defer p.Close()
+
+	_, err := p.GetFileInfo("/a.txt")
+	assert.Nil(t, err)
+	_, err = p.GetFileInfo("/fifo")
+	assert.NotNil(t, err)
+}
+
+func TestFsProvider_ReplacesReadOnlyFiles(t *testing.T) {
+	dir := t.TempDir()
+	p := NewFsProvider(appconfig.ProviderConfig{Type: TypeFs, FsConfig: &appconfig.FsProviderConfig{Path: dir}})
+	defer p.Close()
+
+	for _, content := range []string{"first", "second"} {
+		err := p.StoreFile(FileInfo{Path: "/sub/ro.txt", Updated: time.Now(), Mode: 0444}, strings.NewReader(content))
+		assert.Nil(t, err)
+
+		data, err := os.ReadFile(path.Join(dir, "sub", "ro.txt"))
+		assert.Nil(t, err)
+		assert.Equal(t, string(data), content)
+		info, err := os.Stat(path.Join(dir, "sub", "ro.txt"))
+		assert.Nil(t, err)
+		assert.Equal(t, info.Mode().Perm(), os.FileMode(0444))
+	}
+
+	//Nothing is left behind, and a temporary file of an interrupted pull isn't picked up
+	entries, err := os.ReadDir(path.Join(dir, "sub"))
+	assert.Nil(t, err)
+	assert.Equal(t, len(entries), 1)
+
+	assert.Nil(t, os.WriteFile(path.Join(dir, "sub", tempFilePrefix+"abc"), []byte("partial"), 0644))
+	assert.Nil(t, p.Rescan())
+	_, err = p.GetFileInfo("/sub/" + tempFilePrefix + "abc")
+	assert.NotNil(t, err)
+}
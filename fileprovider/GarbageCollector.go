@@ -0,0 +1,155 @@
+package fileprovider
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/c00/buttercup/appconfig"
+	"github.com/c00/buttercup/logger"
+)
+
+// Result of cleaning up a remote.
+type GcResult struct {
+	// Previous versions that fell outside the retention policy
+	ExpiredVersions int
+	// Blobs that are not needed anymore. Deleted on Unlock()
+	DeletedBlobs int
+	// Blobs that were on the remote but not in the index. Included in DeletedBlobs.
+	OrphanedBlobs int
+	// Blobs that are in the index but not on the remote
+	MissingBlobs int
+}
+
+// A remote that can clean up old versions and blobs it doesn't need anymore.
+// Must be locked. Changes are persisted and blobs deleted on Unlock().
+type CollectingProvider interface {
+	CollectGarbage(policy *appconfig.RetentionConfig) (GcResult, error)
+}
+
+type gcIndex interface {
+	GetVersionedPaths(after string, limit int) ([]string, error)
+	DeleteVersion(id int64) (string, []string, error)
+	GetUnusedChunks() ([]string, error)
+	GetStoredPaths() ([]string, error)
+}
+
+// Lists every blob (and other file) on a remote.
+type blobLister interface {
+	listBlobs(fn func(storedPath string) error) error
+}
+
+// Paths created by CreateRandomPath(). Anything else on the remote is not ours to delete.
+var blobPathPattern = regexp.MustCompile(`^[0-9a-f]{8}/[0-9a-f]{8}/[0-9a-f]{8}$`)
+
+// Expire versions according to the retention policy, and queue unused and orphaned blobs for deletion.
+// Without a policy, all versions are kept.
+func collectGarbage(provider VersionedProvider, index gcIndex, chunks *chunkStore, blobs blobLister, policy *appconfig.RetentionConfig) (GcResult, error) {
+	result := GcResult{}
+
+	if policy != nil {
+		expired, err := expireVersions(provider, index, chunks, *policy)
+		if err != nil {
+			return result, err
+		}
+		result.ExpiredVersions = expired
+	}
+
+	//Left behind by uploads that failed halfway
+	unused, err := index.GetUnusedChunks()
+	if err != nil {
+		return result, err
+	}
+	chunks.release(unused)
+
+	err = chunks.prune()
+	if err != nil {
+		return result, fmt.Errorf("could not prune chunks: %w", err)
+	}
+
+	referenced := map[string]bool{}
+	storedPaths, err := index.GetStoredPaths()
+	if err != nil {
+		return result, err
+	}
+	for _, storedPath := range storedPaths {
+		referenced[storedPath] = true
+	}
+
+	//Already going to be deleted
+	queued := map[string]bool{}
+	for _, storedPath := range chunks.queued {
+		queued[storedPath] = true
+	}
+
+	found := map[string]bool{}
+	err = blobs.listBlobs(func(storedPath string) error {
+		if !blobPathPattern.MatchString(storedPath) {
+			return nil
+		}
+
+		found[storedPath] = true
+		if referenced[storedPath] || queued[storedPath] {
+			return nil
+		}
+
+		logger.Debug("orphaned blob: %v", storedPath)
+		chunks.queueDelete(storedPath)
+		result.OrphanedBlobs++
+		return nil
+	})
+	if err != nil {
+		return result, fmt.Errorf("could not list blobs: %w", err)
+	}
+
+	for _, storedPath := range storedPaths {
+		if !found[storedPath] {
+			logger.Warn("blob is missing from the remote: %v", storedPath)
+			result.MissingBlobs++
+		}
+	}
+
+	result.DeletedBlobs = len(chunks.queued)
+	return result, nil
+}
+
+func expireVersions(provider VersionedProvider, index gcIndex, chunks *chunkStore, policy appconfig.RetentionConfig) (int, error) {
+	now := time.Now()
+	count := 0
+	after := ""
+
+	for {
+		paths, err := index.GetVersionedPaths(after, defaultGcPageSize)
+		if err != nil {
+			return count, err
+		}
+		if len(paths) == 0 {
+			return count, nil
+		}
+
+		for _, filePath := range paths {
+			versions, err := provider.GetVersions(filePath)
+			if err != nil {
+				return count, fmt.Errorf("could not get versions of %v: %w", filePath, err)
+			}
+
+			for _, v := range ExpiredVersions(versions, policy, now) {
+				storedPath, hashes, err := index.DeleteVersion(v.ID)
+				if err != nil {
+					return count, fmt.Errorf("could not delete version %v of %v: %w", v.ID, filePath, err)
+				}
+
+				//Legacy blobs belong to a single file or version
+				if storedPath != "" {
+					chunks.queueDelete(storedPath)
+				}
+				chunks.release(hashes)
+				count++
+			}
+		}
+
+		after = paths[len(paths)-1]
+	}
+}
+
+const defaultGcPageSize = 1000
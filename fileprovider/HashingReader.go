@@ -0,0 +1,64 @@
+package fileprovider
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+)
+
+// Wraps a reader and hashes everything that is read through it.
+func newHashingReader(reader io.Reader) *hashingReader {
+	return &hashingReader{
+		reader: reader,
+		hash:   sha256.New(),
+	}
+}
+
+type hashingReader struct {
+	reader io.Reader
+	hash   hash.Hash
+	size   int64
+}
+
+func (r *hashingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.hash.Write(p[:n])
+	r.size += int64(n)
+	return n, err
+}
+
+// Hex encoded hash of everything read so far.
+func (r *hashingReader) Sum() string {
+	return hex.EncodeToString(r.hash.Sum(nil))
+}
+
+// Amount of bytes read so far.
+func (r *hashingReader) Size() int64 {
+	return r.size
+}
+
+// Hash the content of a file on disk.
+func hashFile(fullPath string) (string, int64, error) {
+	file, err := os.Open(fullPath)
+	if err != nil {
+		return "", 0, fmt.Errorf("cannot open file for hashing: %w", err)
+	}
+	defer file.Close()
+
+	reader := newHashingReader(file)
+	_, err = io.Copy(io.Discard, reader)
+	if err != nil {
+		return "", 0, fmt.Errorf("cannot read file for hashing: %w", err)
+	}
+
+	return reader.Sum(), reader.Size(), nil
+}
+
+// Hash content that is already in memory, like the target of a symlink.
+func hashBytes(data []byte) (string, int64) {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), int64(len(data))
+}
@@ -5,6 +5,10 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"slices"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/c00/buttercup/simplekeyvaluestore"
@@ -16,18 +20,25 @@ type storedFile struct {
 }
 
 func NewInMemoryProvider(clientName string) *InMemoryProvider {
-	return &InMemoryProvider{
+	provider := &InMemoryProvider{
 		store: simplekeyvaluestore.NewSimpleKeyValueStore[storedFile](),
 		index: NewIndex(),
 		name:  clientName,
 	}
+	provider.locker = newLocker(provider, clientName)
+
+	return provider
 }
 
 type InMemoryProvider struct {
 	//Name used in Locks
-	name  string
-	store simplekeyvaluestore.SimpleKeyValueStore[storedFile]
-	index FolderIndex
+	name   string
+	store  simplekeyvaluestore.SimpleKeyValueStore[storedFile]
+	index  FolderIndex
+	locker *locker
+	lockMu sync.Mutex
+	//Guards the index, files are transferred from several goroutines
+	indexMu sync.Mutex
 }
 
 func (r *InMemoryProvider) MoveFile(oldPath, newPath string) error {
@@ -40,6 +51,8 @@ func (r *InMemoryProvider) MoveFile(oldPath, newPath string) error {
 	r.store.Delete(oldPath)
 
 	//Update index
+	r.indexMu.Lock()
+	defer r.indexMu.Unlock()
 	for _, file := range r.index.Files {
 		if file.Path == oldPath {
 			file.Path = newPath
@@ -51,6 +64,9 @@ func (r *InMemoryProvider) MoveFile(oldPath, newPath string) error {
 }
 
 func (p *InMemoryProvider) SetLastSynced(filePath string, date time.Time) error {
+	p.indexMu.Lock()
+	defer p.indexMu.Unlock()
+
 	fi, err := p.getFileInfo(filePath)
 	if err != nil {
 		return fmt.Errorf("file not found: %w", err)
@@ -74,6 +90,15 @@ func (p *InMemoryProvider) StoreFile(otherFi FileInfo, stream io.Reader) error {
 		return fmt.Errorf("resource locked by other client")
 	}
 
+	reader := newHashingReader(stream)
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return fmt.Errorf("could not read stream: %w", err)
+	}
+
+	p.indexMu.Lock()
+	defer p.indexMu.Unlock()
+
 	fi, err := p.getFileInfo(otherFi.Path)
 	if err != nil {
 		//File not found, create the fileInfo instead
@@ -84,14 +109,16 @@ func (p *InMemoryProvider) StoreFile(otherFi FileInfo, stream io.Reader) error {
 		p.index.Files = append(p.index.Files, fi)
 	}
 
-	data, err := io.ReadAll(stream)
-	if err != nil {
-		return fmt.Errorf("could not read stream: %w", err)
-	}
 	p.store.Set(otherFi.Path, storedFile{data: data, updated: otherFi.Updated})
 
 	fi.Updated = otherFi.Updated
 	fi.Deleted = false
+	fi.Hash = reader.Sum()
+	fi.Size = reader.Size()
+	fi.Mode = otherFi.Mode
+	fi.Owner = otherFi.Owner
+	fi.Xattrs = otherFi.Xattrs
+	fi.Type = otherFi.Type
 
 	return nil
 }
@@ -101,6 +128,9 @@ func (p *InMemoryProvider) RemoveFile(otherFi FileInfo) error {
 		return fmt.Errorf("resource locked by other client")
 	}
 
+	p.indexMu.Lock()
+	defer p.indexMu.Unlock()
+
 	fi, err := p.getFileInfo(otherFi.Path)
 	//Create it if it doesn't exist
 	if err != nil {
@@ -118,42 +148,91 @@ func (p *InMemoryProvider) RemoveFile(otherFi FileInfo) error {
 }
 
 func (p *InMemoryProvider) canWrite() bool {
-	file, err := p.store.Get(lockfileName)
+	lease, locked, err := p.locker.current()
 	if err != nil {
-		return true
-	}
-
-	if string(file.data) != p.name {
 		return false
 	}
 
-	return true
+	return !locked || lease.Owner == p.name
 }
 
 func (p *InMemoryProvider) Lock() error {
+	return p.locker.lock()
+}
+
+func (p *InMemoryProvider) Unlock() error {
+	if !p.canWrite() {
+		lease, _, _ := p.locker.current()
+		return fmt.Errorf("store locked by another client: %v", lease)
+	}
+
+	err := p.locker.check()
+	if err != nil {
+		return err
+	}
+
+	return p.locker.release()
+}
+
+func (p *InMemoryProvider) LockStatus() (Lease, bool, error) {
+	return p.locker.current()
+}
+
+func (p *InMemoryProvider) ForceUnlock() error {
+	return p.locker.forceUnlock()
+}
+
+func (p *InMemoryProvider) readLock() ([]byte, error) {
+	file, err := p.store.Get(lockfileName)
+	if err != nil {
+		return nil, fs.ErrNotExist
+	}
+	return file.data, nil
+}
+
+func (p *InMemoryProvider) createLock(data []byte) error {
+	p.lockMu.Lock()
+	defer p.lockMu.Unlock()
+
 	if p.store.Has(lockfileName) {
-		return errors.New("cannot set lock, already locked")
+		return fs.ErrExist
 	}
 
-	data := []byte(p.name)
 	p.store.Set(lockfileName, storedFile{data: data, updated: time.Now()})
 	return nil
 }
 
-func (p *InMemoryProvider) Unlock() error {
+func (p *InMemoryProvider) replaceLock(previous, data []byte) error {
+	p.lockMu.Lock()
+	defer p.lockMu.Unlock()
+
 	file, err := p.store.Get(lockfileName)
 	if err != nil {
-		return fmt.Errorf("already unlocked")
+		return fs.ErrNotExist
 	}
-
-	if string(file.data) != p.name {
-		return fmt.Errorf("store locked by another client: %v", string(file.data))
+	if !bytes.Equal(file.data, previous) {
+		return fs.ErrExist
 	}
 
+	p.store.Set(lockfileName, storedFile{data: data, updated: time.Now()})
+	return nil
+}
+
+// The conditional replace never leaves the provider without a lock
+func (p *InMemoryProvider) renewLock(previous, data []byte) error {
+	return p.replaceLock(previous, data)
+}
+
+func (p *InMemoryProvider) deleteLock() error {
 	p.store.Delete(lockfileName)
 	return nil
 }
 
+func (p *InMemoryProvider) Close() error {
+	p.locker.stopHeartbeat()
+	return nil
+}
+
 func (p *InMemoryProvider) getFileInfo(path string) (*FileInfo, error) {
 	//todo make this cache?
 	for _, v := range p.index.Files {
@@ -166,6 +245,9 @@ func (p *InMemoryProvider) getFileInfo(path string) (*FileInfo, error) {
 }
 
 func (p *InMemoryProvider) GetFileInfo(path string) (FileInfo, error) {
+	p.indexMu.Lock()
+	defer p.indexMu.Unlock()
+
 	fi, err := p.getFileInfo(path)
 	if err != nil {
 		return FileInfo{}, err
@@ -174,6 +256,9 @@ func (p *InMemoryProvider) GetFileInfo(path string) (FileInfo, error) {
 }
 
 func (p *InMemoryProvider) GetFileInfos(limit, offset int) ([]FileInfo, error) {
+	p.indexMu.Lock()
+	defer p.indexMu.Unlock()
+
 	if limit == 0 {
 		limit = len(p.index.Files)
 	}
@@ -187,6 +272,11 @@ func (p *InMemoryProvider) GetFileInfos(limit, offset int) ([]FileInfo, error) {
 		return []FileInfo{}, nil
 	}
 
+	//Same ordering as the sqlite indexes
+	slices.SortStableFunc(p.index.Files, func(a *FileInfo, b *FileInfo) int {
+		return strings.Compare(a.Path, b.Path)
+	})
+
 	slice := p.index.Files[offset:endIndex]
 	result := make([]FileInfo, 0, len(slice))
 	for _, file := range slice {
@@ -0,0 +1,20 @@
+package fileprovider
+
+import (
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Convert a path given by a user into a path as it is used in the indexes (e.g. "/sub/file.txt").
+// The input can be relative to the folder root, or an absolute path inside the local folder.
+func IndexPath(folderPath, input string) string {
+	cleaned := filepath.ToSlash(filepath.Clean(input))
+	root := filepath.ToSlash(filepath.Clean(folderPath))
+
+	if folderPath != "" && strings.HasPrefix(cleaned, strings.TrimSuffix(root, "/")+"/") {
+		cleaned = cleaned[len(strings.TrimSuffix(root, "/")):]
+	}
+
+	return path.Join("/", cleaned)
+}
@@ -0,0 +1,27 @@
+package fileprovider
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIndexPath(t *testing.T) {
+	tests := []struct {
+		folder string
+		input  string
+		want   string
+	}{
+		{folder: "/home/joe/Buttercup", input: "foo.txt", want: "/foo.txt"},
+		{folder: "/home/joe/Buttercup", input: "/foo.txt", want: "/foo.txt"},
+		{folder: "/home/joe/Buttercup", input: "sub/../other/foo.txt", want: "/other/foo.txt"},
+		{folder: "/home/joe/Buttercup", input: "/home/joe/Buttercup/sub/foo.txt", want: "/sub/foo.txt"},
+		{folder: "/home/joe/Buttercup/", input: "/home/joe/Buttercup/sub/foo.txt", want: "/sub/foo.txt"},
+		{folder: "/home/joe/Buttercup", input: "/home/joe/Buttercup-other/foo.txt", want: "/home/joe/Buttercup-other/foo.txt"},
+		{folder: "", input: "foo.txt", want: "/foo.txt"},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, IndexPath(tt.folder, tt.input), tt.input)
+	}
+}
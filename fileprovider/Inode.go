@@ -0,0 +1,17 @@
+//go:build unix
+
+package fileprovider
+
+import (
+	"os"
+	"syscall"
+)
+
+// The inode of a file, so replacing a file with another one of the same size and modification time is noticed.
+func inode(info os.FileInfo) int64 {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0
+	}
+	return int64(stat.Ino)
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package fileprovider
+
+import "os"
+
+// Not available on this platform, files are compared by size and modification time only.
+func inode(info os.FileInfo) int64 {
+	return 0
+}
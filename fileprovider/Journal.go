@@ -0,0 +1,46 @@
+package fileprovider
+
+import "time"
+
+// A chunk that is stored on a remote.
+type StoredChunk struct {
+	Hash       string
+	StoredPath string
+	Size       int64
+}
+
+// A file that was being pushed, with its lastSynced date from before the push.
+type JournalEntry struct {
+	Path       string
+	LastSynced time.Time
+}
+
+// What a push did since the remote index was last persisted.
+type Journal struct {
+	Entries []JournalEntry
+	Chunks  []StoredChunk
+}
+
+// A local provider that keeps a journal of what is being pushed, so an interrupted push can be resumed.
+type JournalingProvider interface {
+	//Record that a file is about to be pushed.
+	RecordPush(entry JournalEntry) error
+	//Record chunks that were uploaded to the remote.
+	RecordChunks(chunks []StoredChunk) error
+	GetJournal() (Journal, error)
+	//Forget the files in the journal, once their lastSynced dates are restored.
+	ClearJournalEntries() error
+	//Forget the journal, once the remote index has the changes.
+	ClearJournal() error
+}
+
+// A remote provider that can persist its index halfway through a session.
+type CheckpointingProvider interface {
+	//Persist the index without releasing the lock.
+	Checkpoint() error
+	//Get the chunks a file is stored in. Chunks in packs are left out, those are uploaded again.
+	GetStoredChunks(path string) ([]StoredChunk, error)
+	//Add chunks that were uploaded in a session that was interrupted back to the index, so they don't have to be uploaded again.
+	//Chunks whose blob is gone are skipped. Returns how many chunks were restored.
+	RestoreChunks(chunks []StoredChunk) (int, error)
+}
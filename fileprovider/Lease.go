@@ -0,0 +1,79 @@
+package fileprovider
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// How long a lock is valid without being renewed. Locks are renewed while they are held,
+// so a client that crashes leaves a lock that others can take over after this long.
+const leaseDuration = time.Minute
+
+// Contents of a lock file.
+type Lease struct {
+	// Random id of this lease, so a client can tell its own lease apart from a newer one.
+	ID string `json:"id"`
+	// Client name of the owner
+	Owner    string    `json:"owner"`
+	Host     string    `json:"host"`
+	Pid      int       `json:"pid"`
+	Acquired time.Time `json:"acquired"`
+	Expires  time.Time `json:"expires"`
+}
+
+func newLease(owner string) (Lease, error) {
+	randBytes := make([]byte, 8)
+	_, err := rand.Read(randBytes)
+	if err != nil {
+		return Lease{}, fmt.Errorf("cannot get random bytes: %w", err)
+	}
+
+	host, _ := os.Hostname()
+	now := time.Now()
+
+	return Lease{
+		ID:       hex.EncodeToString(randBytes),
+		Owner:    owner,
+		Host:     host,
+		Pid:      os.Getpid(),
+		Acquired: now,
+		Expires:  now.Add(leaseDuration),
+	}, nil
+}
+
+// Read a lock file. Lock files written by older versions only contain the client name, and never expire.
+func parseLease(data []byte) Lease {
+	lease := Lease{}
+	err := json.Unmarshal(data, &lease)
+	if err != nil {
+		return Lease{Owner: string(data)}
+	}
+	return lease
+}
+
+func (l Lease) marshal() ([]byte, error) {
+	return json.Marshal(l)
+}
+
+// Whether the owner stopped renewing the lease.
+func (l Lease) Expired(now time.Time) bool {
+	if l.Expires.IsZero() {
+		return false
+	}
+	return now.After(l.Expires)
+}
+
+func (l Lease) String() string {
+	if l.Expires.IsZero() {
+		return fmt.Sprintf("%v (lock without expiry)", l.Owner)
+	}
+
+	return fmt.Sprintf("%v (pid %v on %v), since %v, expires %v",
+		l.Owner, l.Pid, l.Host,
+		l.Acquired.Local().Format(time.DateTime), l.Expires.Local().Format(time.DateTime),
+	)
+}
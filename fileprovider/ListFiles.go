@@ -0,0 +1,81 @@
+package fileprovider
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+const listPageSize = 1000
+
+// Which files ListFiles returns.
+type ListOptions struct {
+	//Only files in this folder (or this file). Empty or "/" for everything.
+	Prefix string
+	//Only files that match this pattern (see path.Match). Patterns without a slash are matched against the file name,
+	//others against the whole path.
+	Glob string
+	//Also return deleted files
+	IncludeDeleted bool
+}
+
+// Walk the index of a provider and call fn for every file that matches the options, in path order.
+func ListFiles(provider FileProvider, opts ListOptions, fn func(fi FileInfo) error) error {
+	prefix := IndexPath("", opts.Prefix)
+	if opts.Glob != "" {
+		//Catch bad patterns before walking the whole index
+		_, err := path.Match(opts.Glob, "")
+		if err != nil {
+			return fmt.Errorf("invalid pattern: %w", err)
+		}
+	}
+
+	for offset := 0; ; offset += listPageSize {
+		page, err := provider.GetFileInfos(listPageSize, offset)
+		if err != nil {
+			return fmt.Errorf("could not get files: %w", err)
+		}
+		if len(page) == 0 {
+			return nil
+		}
+
+		for _, fi := range page {
+			//Paths with the prefix are all next to each other
+			if fi.Path > prefix && !strings.HasPrefix(fi.Path, prefix) {
+				return nil
+			}
+			if !matchesPrefix(fi.Path, prefix) || !matchesGlob(fi.Path, opts.Glob) {
+				continue
+			}
+			if fi.Deleted && !opts.IncludeDeleted {
+				continue
+			}
+
+			err = fn(fi)
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func matchesPrefix(filePath, prefix string) bool {
+	if prefix == "/" || filePath == prefix {
+		return true
+	}
+	return strings.HasPrefix(filePath, prefix+"/")
+}
+
+func matchesGlob(filePath, glob string) bool {
+	if glob == "" {
+		return true
+	}
+
+	name := filePath
+	if !strings.Contains(glob, "/") {
+		name = path.Base(filePath)
+	}
+
+	matched, _ := path.Match(glob, name)
+	return matched
+}
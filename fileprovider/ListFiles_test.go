@@ -0,0 +1,36 @@
+package fileprovider
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestListFiles(t *testing.T) {
+	p := NewInMemoryProvider("client")
+	for _, path := range []string{"/a.txt", "/photos/2024/b.jpg", "/photos/c.txt", "/photos-old/d.jpg", "/photos/e.jpg"} {
+		assert.Nil(t, p.StoreFile(FileInfo{Path: path}, strings.NewReader(path)))
+	}
+	assert.Nil(t, p.RemoveFile(FileInfo{Path: "/photos/e.jpg"}))
+
+	list := func(opts ListOptions) []string {
+		paths := []string{}
+		err := ListFiles(p, opts, func(fi FileInfo) error {
+			paths = append(paths, fi.Path)
+			return nil
+		})
+		assert.Nil(t, err)
+		return paths
+	}
+
+	assert.Equal(t, list(ListOptions{}), []string{"/a.txt", "/photos-old/d.jpg", "/photos/2024/b.jpg", "/photos/c.txt"})
+	assert.Equal(t, list(ListOptions{Prefix: "photos/"}), []string{"/photos/2024/b.jpg", "/photos/c.txt"})
+	assert.Equal(t, list(ListOptions{Prefix: "/photos", IncludeDeleted: true}), []string{"/photos/2024/b.jpg", "/photos/c.txt", "/photos/e.jpg"})
+	assert.Equal(t, list(ListOptions{Glob: "*.jpg"}), []string{"/photos-old/d.jpg", "/photos/2024/b.jpg"})
+	assert.Equal(t, list(ListOptions{Glob: "/photos/*"}), []string{"/photos/c.txt"})
+	assert.Equal(t, list(ListOptions{Prefix: "/a.txt"}), []string{"/a.txt"})
+
+	err := ListFiles(p, ListOptions{Glob: "["}, func(fi FileInfo) error { return nil })
+	assert.NotNil(t, err)
+}
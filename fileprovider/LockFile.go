@@ -0,0 +1,113 @@
+package fileprovider
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+)
+
+// Create a lock file on a filesystem. O_EXCL makes this fail if another client created it first.
+func createLockFile(fullPath string, data []byte) error {
+	file, err := os.OpenFile(fullPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(data)
+	if err != nil {
+		file.Close()
+		os.Remove(fullPath)
+		return fmt.Errorf("cannot write lock file: %w", err)
+	}
+
+	return file.Close()
+}
+
+// Replace a lock file on a filesystem if it still contains previous. Used to take over an expired lease.
+// The lock is first renamed to a name of our own. Only one client can rename it, so only one client can take over a stale lock.
+// The new lock is then created with O_EXCL, in case another client created one in the meantime.
+func replaceLockFile(fullPath string, previous, data []byte) error {
+	current, err := os.ReadFile(fullPath)
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(current, previous) {
+		return fmt.Errorf("lock file changed: %w", fs.ErrExist)
+	}
+
+	tombstonePath, err := lockFileSibling(fullPath, "stale")
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(fullPath, tombstonePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("lock file changed: %w", fs.ErrExist)
+	}
+	if err != nil {
+		return fmt.Errorf("cannot move lock file: %w", err)
+	}
+
+	moved, err := os.ReadFile(tombstonePath)
+	os.Remove(tombstonePath)
+	if err != nil {
+		return fmt.Errorf("cannot read moved lock file: %w", err)
+	}
+
+	if !bytes.Equal(moved, previous) {
+		//Another client replaced it right before, put theirs back
+		err = createLockFile(fullPath, moved)
+		if err != nil {
+			return fmt.Errorf("lock file changed, and the new one could not be put back: %w", errors.Join(fs.ErrExist, err))
+		}
+		return fmt.Errorf("lock file changed: %w", fs.ErrExist)
+	}
+
+	return createLockFile(fullPath, data)
+}
+
+// Renew a lease we hold, if the lock file still contains previous. The new lease is written next to the lock file and
+// renamed over it, so there is never a moment without a lock file in which another client could create one.
+func renewLockFile(fullPath string, previous, data []byte) error {
+	current, err := os.ReadFile(fullPath)
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(current, previous) {
+		return fmt.Errorf("lock file changed: %w", fs.ErrExist)
+	}
+
+	tmpPath, err := lockFileSibling(fullPath, "renew")
+	if err != nil {
+		return err
+	}
+
+	err = os.WriteFile(tmpPath, data, 0600)
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("cannot write lock file: %w", err)
+	}
+
+	err = os.Rename(tmpPath, fullPath)
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("cannot replace lock file: %w", err)
+	}
+	return nil
+}
+
+// A random name next to the lock file, that no other client uses.
+func lockFileSibling(fullPath, kind string) (string, error) {
+	suffix := make([]byte, 8)
+	_, err := rand.Read(suffix)
+	if err != nil {
+		return "", fmt.Errorf("cannot create name for %v lock file: %w", kind, err)
+	}
+	return fmt.Sprintf("%v.%v-%v", fullPath, kind, hex.EncodeToString(suffix)), nil
+}
@@ -0,0 +1,85 @@
+package fileprovider
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLockFile_CreateIsExclusive(t *testing.T) {
+	fullPath := path.Join(t.TempDir(), lockfileName)
+
+	var wins atomic.Int32
+	wg := sync.WaitGroup{}
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := createLockFile(fullPath, []byte("lease"))
+			if err == nil {
+				wins.Add(1)
+			} else {
+				assert.ErrorIs(t, err, fs.ErrExist)
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, wins.Load(), int32(1))
+}
+
+func TestLockFile_Replace(t *testing.T) {
+	fullPath := path.Join(t.TempDir(), lockfileName)
+
+	err := replaceLockFile(fullPath, []byte("first"), []byte("second"))
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+
+	assert.Nil(t, createLockFile(fullPath, []byte("first")))
+	assert.Nil(t, replaceLockFile(fullPath, []byte("first"), []byte("second")))
+
+	//Someone else replaced it in the meantime
+	err = replaceLockFile(fullPath, []byte("first"), []byte("third"))
+	assert.ErrorIs(t, err, fs.ErrExist)
+
+	data, err := os.ReadFile(fullPath)
+	assert.Nil(t, err)
+	assert.Equal(t, string(data), "second")
+}
+
+func TestLockFile_TakeoverIsExclusive(t *testing.T) {
+	fullPath := path.Join(t.TempDir(), lockfileName)
+	assert.Nil(t, createLockFile(fullPath, []byte("stale")))
+
+	var wins atomic.Int32
+	var winner atomic.Value
+	wg := sync.WaitGroup{}
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			data := fmt.Sprintf("lease %v", i)
+			err := replaceLockFile(fullPath, []byte("stale"), []byte(data))
+			if err == nil {
+				wins.Add(1)
+				winner.Store(data)
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, wins.Load(), int32(1))
+	data, err := os.ReadFile(fullPath)
+	assert.Nil(t, err)
+	assert.Equal(t, string(data), winner.Load())
+
+	//No tombstones are left behind
+	entries, err := os.ReadDir(path.Dir(fullPath))
+	assert.Nil(t, err)
+	assert.Len(t, entries, 1)
+}
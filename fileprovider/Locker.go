@@ -0,0 +1,262 @@
+package fileprovider
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"sync"
+	"time"
+
+	"github.com/c00/buttercup/logger"
+)
+
+// Where a provider keeps its lock file.
+type lockStore interface {
+	//Returns an error wrapping fs.ErrNotExist if there is no lock.
+	readLock() ([]byte, error)
+	//Create the lock file. Fails with an error wrapping fs.ErrExist if it already exists.
+	createLock(data []byte) error
+	//Replace the lock file, only if it still contains previous. Fails with an error wrapping fs.ErrExist otherwise.
+	replaceLock(previous, data []byte) error
+	//Like replaceLock, for a lease we hold. There must never be a moment without a lock file.
+	renewLock(previous, data []byte) error
+	deleteLock() error
+}
+
+func newLocker(store lockStore, owner string) *locker {
+	return &locker{
+		store: store,
+		owner: owner,
+	}
+}
+
+// Takes out a lease on a provider and renews it until it is released.
+// Acquiring and renewing are atomic as far as the lockStore is. After writing, the lock is read back
+// to catch stores that silently ignore the conditions.
+type locker struct {
+	store lockStore
+	owner string
+	//How long to wait before reading back a written lock. For stores that are not read-after-write consistent.
+	settle time.Duration
+
+	mu       sync.Mutex
+	held     *Lease
+	heldData []byte
+	lost     bool
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// Get the current lease. Returns false if the provider is not locked.
+func (l *locker) current() (Lease, bool, error) {
+	lease, _, locked, err := l.read()
+	return lease, locked, err
+}
+
+func (l *locker) read() (Lease, []byte, bool, error) {
+	data, err := l.store.readLock()
+	if errors.Is(err, fs.ErrNotExist) {
+		return Lease{}, nil, false, nil
+	}
+	if err != nil {
+		return Lease{}, nil, false, fmt.Errorf("cannot read lock: %w", err)
+	}
+
+	return parseLease(data), data, true, nil
+}
+
+func (l *locker) lock() error {
+	existing, existingData, locked, err := l.read()
+	if err != nil {
+		return err
+	}
+
+	if locked && !existing.Expired(time.Now()) {
+		return fmt.Errorf("cannot set lock, already locked by %v", existing)
+	}
+
+	lease, err := newLease(l.owner)
+	if err != nil {
+		return err
+	}
+
+	data, err := lease.marshal()
+	if err != nil {
+		return fmt.Errorf("cannot encode lock: %w", err)
+	}
+
+	if locked {
+		logger.Warn("taking over expired lock of %v", existing)
+		err = l.store.replaceLock(existingData, data)
+	} else {
+		err = l.store.createLock(data)
+	}
+	if errors.Is(err, fs.ErrExist) {
+		return errors.New("cannot set lock, another client got there first")
+	}
+	if err != nil {
+		return fmt.Errorf("error setting lock: %w", err)
+	}
+
+	err = l.verify(lease)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	l.held = &lease
+	l.heldData = data
+	l.lost = false
+	l.stop = make(chan struct{})
+	l.done = make(chan struct{})
+	go l.heartbeat(l.stop, l.done)
+	l.mu.Unlock()
+
+	return nil
+}
+
+// Check that we still hold the lock.
+func (l *locker) check() error {
+	l.mu.Lock()
+	held, lost := l.held, l.lost
+	l.mu.Unlock()
+
+	if held == nil {
+		return errors.New("already unlocked")
+	}
+	if lost {
+		return errors.New("lock was lost while it was held")
+	}
+
+	lease, locked, err := l.current()
+	if err != nil {
+		return err
+	}
+	if !locked {
+		return errors.New("lock was removed while it was held")
+	}
+	if lease.ID != held.ID {
+		return fmt.Errorf("store locked by another client: %v", lease)
+	}
+
+	return nil
+}
+
+// Stop renewing and remove the lock.
+func (l *locker) release() error {
+	l.stopHeartbeat()
+
+	err := l.store.deleteLock()
+	if err != nil {
+		return fmt.Errorf("error removing lock file: %w", err)
+	}
+
+	l.mu.Lock()
+	l.held = nil
+	l.heldData = nil
+	l.mu.Unlock()
+
+	return nil
+}
+
+// Remove the lock, whoever holds it.
+func (l *locker) forceUnlock() error {
+	_, locked, err := l.current()
+	if err != nil {
+		return err
+	}
+	if !locked {
+		return errors.New("not locked")
+	}
+
+	return l.release()
+}
+
+// Whether this client may write: the provider is either not locked, or locked by this client.
+func (l *locker) canWrite() bool {
+	lease, locked, err := l.current()
+	if err != nil {
+		return false
+	}
+
+	return !locked || lease.Owner == l.owner
+}
+
+// Read back a lock we just wrote, to make sure no other client overwrote it.
+func (l *locker) verify(lease Lease) error {
+	if l.settle > 0 {
+		time.Sleep(l.settle)
+	}
+
+	current, locked, err := l.current()
+	if err != nil {
+		return fmt.Errorf("cannot verify lock: %w", err)
+	}
+	if !locked || current.ID != lease.ID {
+		return errors.New("cannot set lock, another client got there first")
+	}
+
+	return nil
+}
+
+func (l *locker) stopHeartbeat() {
+	l.mu.Lock()
+	stop, done := l.stop, l.done
+	l.stop, l.done = nil, nil
+	l.mu.Unlock()
+
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+}
+
+// Renew the lease until stopped. Gives up if someone else took over the lock.
+func (l *locker) heartbeat(stop, done chan struct{}) {
+	defer close(done)
+
+	ticker := time.NewTicker(leaseDuration / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			err := l.renew()
+			if err != nil {
+				logger.Warn("cannot renew lock: %v", err)
+				l.mu.Lock()
+				l.lost = true
+				l.mu.Unlock()
+				return
+			}
+		}
+	}
+}
+
+func (l *locker) renew() error {
+	l.mu.Lock()
+	held, heldData := *l.held, l.heldData
+	l.mu.Unlock()
+
+	held.Expires = time.Now().Add(leaseDuration)
+	data, err := held.marshal()
+	if err != nil {
+		return fmt.Errorf("cannot encode lock: %w", err)
+	}
+
+	err = l.store.renewLock(heldData, data)
+	if errors.Is(err, fs.ErrExist) || errors.Is(err, fs.ErrNotExist) {
+		return errors.New("lock was taken over")
+	}
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	l.held = &held
+	l.heldData = data
+	l.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,150 @@
+package fileprovider
+
+import (
+	"testing"
+	"time"
+
+	"github.com/c00/buttercup/appconfig"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLocker_Status(t *testing.T) {
+	p := NewInMemoryProvider("client")
+
+	_, locked, err := p.LockStatus()
+	assert.Nil(t, err)
+	assert.False(t, locked)
+
+	assert.Nil(t, p.Lock())
+	lease, locked, err := p.LockStatus()
+	assert.Nil(t, err)
+	assert.True(t, locked)
+	assert.Equal(t, lease.Owner, "client")
+	assert.True(t, lease.Expires.After(time.Now()))
+
+	//Renewing pushes the expiry forward
+	assert.Nil(t, p.locker.renew())
+	renewed, _, err := p.LockStatus()
+	assert.Nil(t, err)
+	assert.Equal(t, renewed.ID, lease.ID)
+	assert.False(t, renewed.Expires.Before(lease.Expires))
+
+	assert.Nil(t, p.Unlock())
+	_, locked, err = p.LockStatus()
+	assert.Nil(t, err)
+	assert.False(t, locked)
+}
+
+func TestLocker_TakeOverExpired(t *testing.T) {
+	p := NewInMemoryProvider("client")
+
+	stale, err := newLease("crashed-client")
+	assert.Nil(t, err)
+	stale.Expires = time.Now().Add(-time.Second)
+	data, err := stale.marshal()
+	assert.Nil(t, err)
+	assert.Nil(t, p.createLock(data))
+
+	assert.Nil(t, p.Lock())
+	lease, _, err := p.LockStatus()
+	assert.Nil(t, err)
+	assert.Equal(t, lease.Owner, "client")
+	assert.Nil(t, p.Unlock())
+}
+
+func TestLocker_LegacyLockDoesNotExpire(t *testing.T) {
+	p := NewInMemoryProvider("client")
+	assert.Nil(t, p.createLock([]byte("old-client")))
+
+	lease, locked, err := p.LockStatus()
+	assert.Nil(t, err)
+	assert.True(t, locked)
+	assert.Equal(t, lease.Owner, "old-client")
+
+	assert.NotNil(t, p.Lock())
+
+	assert.Nil(t, p.ForceUnlock())
+	assert.NotNil(t, p.ForceUnlock(), "not locked anymore")
+	assert.Nil(t, p.Lock())
+	assert.Nil(t, p.Unlock())
+}
+
+func TestLocker_LostLock(t *testing.T) {
+	p := NewInMemoryProvider("client")
+	other := newLocker(p, "client")
+
+	assert.Nil(t, p.Lock())
+
+	//Someone force unlocks and takes over
+	assert.Nil(t, other.forceUnlock())
+	assert.Nil(t, other.lock())
+
+	assert.NotNil(t, p.locker.renew())
+	assert.NotNil(t, p.Unlock())
+
+	assert.Nil(t, other.check())
+	assert.Nil(t, other.release())
+}
+
+func TestLocker_OnlyOneWins(t *testing.T) {
+	p := NewInMemoryProvider("client")
+
+	lockers := []*locker{}
+	for i := 0; i < 10; i++ {
+		lockers = append(lockers, newLocker(p, "client"))
+	}
+
+	results := make(chan error, len(lockers))
+	for _, l := range lockers {
+		go func() {
+			results <- l.lock()
+		}()
+	}
+
+	wins := 0
+	for range lockers {
+		if <-results == nil {
+			wins++
+		}
+	}
+	assert.Equal(t, wins, 1)
+
+	for _, l := range lockers {
+		l.stopHeartbeat()
+	}
+}
+
+func TestLocker_RenewNeverUnlocks(t *testing.T) {
+	p := NewFsProvider(appconfig.ProviderConfig{Type: TypeFs, FsConfig: &appconfig.FsProviderConfig{Path: t.TempDir()}})
+	defer p.Close()
+
+	owner := newLocker(p, "owner")
+	assert.Nil(t, owner.lock())
+	//Renewed by hand below
+	owner.stopHeartbeat()
+
+	other := newLocker(p, "other")
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 500; i++ {
+			assert.Nil(t, owner.renew())
+		}
+	}()
+
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		err := other.lock()
+		if !assert.NotNil(t, err, "took over a lease that is held") {
+			other.release()
+			break
+		}
+	}
+
+	assert.Nil(t, owner.check())
+	assert.Nil(t, owner.release())
+}
@@ -0,0 +1,18 @@
+//go:build unix
+
+package fileprovider
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// The numeric owner and group of a file as "uid:gid".
+func fileOwner(info os.FileInfo) string {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return ""
+	}
+	return fmt.Sprintf("%d:%d", stat.Uid, stat.Gid)
+}
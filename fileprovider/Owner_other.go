@@ -0,0 +1,10 @@
+//go:build !unix
+
+package fileprovider
+
+import "os"
+
+// Not available on this platform, owners are not recorded.
+func fileOwner(info os.FileInfo) string {
+	return ""
+}
@@ -0,0 +1,121 @@
+package fileprovider
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/c00/buttercup/chunker"
+	"github.com/c00/buttercup/modifiers"
+)
+
+// Chunks smaller than this are packed together. Only the last chunk of a file can be this small,
+// so these are small files and the ends of bigger ones.
+const packThreshold = chunker.MinSize
+
+// A pack is stored once it holds this much.
+const packSize = chunker.AvgSize
+
+// Small chunks that are stored together as a single blob, so the remote doesn't show how many small files there are.
+// A pack is encrypted as a whole, its chunks are found by their offset in the decrypted pack.
+type pack struct {
+	storedPath string
+	data       bytes.Buffer
+}
+
+// Add a chunk to the current pack, and store the pack once it is full. The chunk is added to the index right away,
+// so the index has to be persisted with flushPackAndPersist().
+func (s *chunkStore) addToPack(hash string, chunk []byte) error {
+	s.packMu.Lock()
+	defer s.packMu.Unlock()
+
+	if s.pack == nil {
+		storedPath, err := CreateRandomPath()
+		if err != nil {
+			return fmt.Errorf("cannot create store path: %w", err)
+		}
+		s.pack = &pack{storedPath: storedPath}
+	}
+
+	err := s.index.AddPackedChunk(hash, s.pack.storedPath, int64(s.pack.data.Len()), int64(len(chunk)))
+	if err != nil {
+		return fmt.Errorf("could not add chunk to index: %w", err)
+	}
+	s.pack.data.Write(chunk)
+
+	if s.pack.data.Len() < packSize {
+		return nil
+	}
+	return s.storePack()
+}
+
+// Store the current pack, even if it isn't full, and then persist the index. No chunk is packed in between,
+// so the persisted index never points to a pack that isn't stored.
+func (s *chunkStore) flushPackAndPersist(persist func() error) error {
+	s.packMu.Lock()
+	defer s.packMu.Unlock()
+
+	err := s.storePack()
+	if err != nil {
+		return err
+	}
+	return persist()
+}
+
+// Store the current pack if it is the one at storedPath, so chunks that were just added can be read.
+func (s *chunkStore) flushPackAt(storedPath string) error {
+	s.packMu.Lock()
+	defer s.packMu.Unlock()
+
+	if s.pack == nil || s.pack.storedPath != storedPath {
+		return nil
+	}
+	return s.storePack()
+}
+
+// Must hold packMu. A pack that fails to store is kept, and tried again on the next flush.
+func (s *chunkStore) storePack() error {
+	if s.pack == nil {
+		return nil
+	}
+
+	encrypted := &bytes.Buffer{}
+	err := modifiers.CompressAndEncrypt(bytes.NewReader(s.pack.data.Bytes()), encrypted, s.keys)
+	if err != nil {
+		return fmt.Errorf("could not compress and encrypt pack: %w", err)
+	}
+
+	err = s.blobs.putBlob(s.pack.storedPath, encrypted)
+	if err != nil {
+		return fmt.Errorf("could not store pack: %w", err)
+	}
+
+	s.pack = nil
+	return nil
+}
+
+// Split a chunk ref from the index into the stored path, and the offset and size of the chunk if it is in a pack.
+// Refs of packed chunks are "storedpath#offset+size".
+func parseChunkRef(ref string) (storedPath string, offset, size int64, packed bool, err error) {
+	storedPath, location, packed := strings.Cut(ref, "#")
+	if !packed {
+		return storedPath, 0, 0, false, nil
+	}
+
+	offsetPart, sizePart, found := strings.Cut(location, "+")
+	if !found {
+		return "", 0, 0, false, fmt.Errorf("invalid chunk ref %q", ref)
+	}
+
+	offset, err = strconv.ParseInt(offsetPart, 10, 64)
+	if err != nil {
+		return "", 0, 0, false, fmt.Errorf("invalid chunk ref %q: %w", ref, err)
+	}
+	size, err = strconv.ParseInt(sizePart, 10, 64)
+	if err != nil {
+		return "", 0, 0, false, fmt.Errorf("invalid chunk ref %q: %w", ref, err)
+	}
+
+	return storedPath, offset, size, true, nil
+}
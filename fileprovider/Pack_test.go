@@ -0,0 +1,98 @@
+package fileprovider
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/c00/buttercup/modifiers"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseChunkRef(t *testing.T) {
+	storedPath, _, _, packed, err := parseChunkRef("aa/bb/cc")
+	assert.Nil(t, err)
+	assert.Equal(t, storedPath, "aa/bb/cc")
+	assert.False(t, packed)
+
+	storedPath, offset, size, packed, err := parseChunkRef("aa/bb/cc#1024+42")
+	assert.Nil(t, err)
+	assert.Equal(t, storedPath, "aa/bb/cc")
+	assert.Equal(t, offset, int64(1024))
+	assert.Equal(t, size, int64(42))
+	assert.True(t, packed)
+
+	for _, ref := range []string{"aa/bb/cc#1024", "aa/bb/cc#x+42", "aa/bb/cc#1024+"} {
+		_, _, _, _, err = parseChunkRef(ref)
+		assert.NotNil(t, err, ref)
+	}
+}
+
+// Only keeps track of packed chunks.
+type packIndex struct {
+	chunkIndex
+	mu     sync.Mutex
+	packed map[string]string
+}
+
+func (i *packIndex) AddPackedChunk(hash, storedPath string, offset, size int64) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.packed[hash] = storedPath
+	return nil
+}
+
+type memBlobs struct {
+	blobStore
+	mu    sync.Mutex
+	blobs map[string][]byte
+}
+
+func (b *memBlobs) putBlob(storedPath string, content io.Reader) error {
+	data, err := io.ReadAll(content)
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.blobs[storedPath] = data
+	return nil
+}
+
+func TestFlushPackAndPersist(t *testing.T) {
+	keys, err := modifiers.PassphraseKeys("foo")
+	assert.Nil(t, err)
+	dataKey, err := modifiers.NewDataKey()
+	assert.Nil(t, err)
+	keys = keys.WithDataKey(dataKey)
+
+	index := &packIndex{packed: map[string]string{}}
+	blobs := &memBlobs{blobs: map[string][]byte{}}
+	s := newChunkStore(index, blobs, keys, true)
+
+	assert.Nil(t, s.addToPack("first", []byte("small chunk")))
+
+	//A file that is pushed while the index is persisted has to wait, or it would end up in a pack that isn't stored
+	added := make(chan error)
+	err = s.flushPackAndPersist(func() error {
+		go func() { added <- s.addToPack("second", []byte("another small chunk")) }()
+		time.Sleep(50 * time.Millisecond)
+
+		index.mu.Lock()
+		defer index.mu.Unlock()
+		blobs.mu.Lock()
+		defer blobs.mu.Unlock()
+		for hash, storedPath := range index.packed {
+			if _, found := blobs.blobs[storedPath]; !found {
+				return fmt.Errorf("%v is in a pack that isn't stored", hash)
+			}
+		}
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Nil(t, <-added)
+	assert.Len(t, index.packed, 2)
+}
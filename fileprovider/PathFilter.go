@@ -0,0 +1,65 @@
+package fileprovider
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// A provider that leaves some of its files out of syncing.
+type IgnoringProvider interface {
+	Ignores(path string) bool
+}
+
+// Matches index paths against paths and patterns given by a user. A path matches the file itself and everything below it.
+// Patterns (see path.Match) without a slash match file and folder names, others match the path from the folder root.
+// A nil filter matches everything.
+type PathFilter struct {
+	prefixes []string
+	globs    []string
+}
+
+// Create a filter from paths and patterns. Paths can be relative to the folder root, or absolute paths inside the local folder.
+func NewPathFilter(folderPath string, patterns []string) (*PathFilter, error) {
+	filter := &PathFilter{}
+	for _, pattern := range patterns {
+		if !strings.ContainsAny(pattern, "*?[") {
+			filter.prefixes = append(filter.prefixes, IndexPath(folderPath, pattern))
+			continue
+		}
+
+		if strings.Contains(pattern, "/") {
+			pattern = IndexPath(folderPath, pattern)
+		}
+		_, err := path.Match(pattern, "")
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %v: %w", pattern, err)
+		}
+		filter.globs = append(filter.globs, pattern)
+	}
+
+	return filter, nil
+}
+
+func (f *PathFilter) Match(filePath string) bool {
+	if f == nil {
+		return true
+	}
+
+	for _, prefix := range f.prefixes {
+		if matchesPrefix(filePath, prefix) {
+			return true
+		}
+	}
+
+	for _, glob := range f.globs {
+		//Also match when a folder the file is in matches
+		for p := filePath; p != "/"; p = path.Dir(p) {
+			if matchesGlob(p, glob) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,34 @@
+package fileprovider
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPathFilter(t *testing.T) {
+	filter, err := NewPathFilter("/home/user/buttercup", []string{"docs", "/home/user/buttercup/notes.txt", "*.jpg", "photos/2024*"})
+	assert.Nil(t, err)
+
+	for path, match := range map[string]bool{
+		"/docs":                  true,
+		"/docs/a.txt":            true,
+		"/docs-old/a.txt":        false,
+		"/notes.txt":             true,
+		"/other/notes.txt":       false,
+		"/a.jpg":                 true,
+		"/sub/b.jpg":             true,
+		"/photos/2024/c.txt":     true,
+		"/photos/2024-06/d.txt":  true,
+		"/photos/2023/e.txt":     false,
+		"/archive/photos/2024/f": false,
+	} {
+		assert.Equal(t, filter.Match(path), match, path)
+	}
+
+	var none *PathFilter
+	assert.True(t, none.Match("/anything"))
+
+	_, err = NewPathFilter("", []string{"[*"})
+	assert.NotNil(t, err)
+}
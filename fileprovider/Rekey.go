@@ -0,0 +1,192 @@
+package fileprovider
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/c00/buttercup/logger"
+	"github.com/c00/buttercup/modifiers"
+)
+
+// How often a rekey persists its progress.
+const rekeyCheckpointInterval = time.Minute
+
+// How many stored paths are fetched from the index at a time.
+const rekeyBatchSize = 100
+
+// A remote that can re-encrypt everything it stores with its current keys, after the passphrase or recipients changed.
+// Must be locked. Progress is persisted along the way, an interrupted rekey continues where it left off when it is started again.
+type RekeyingProvider interface {
+	//Re-encrypt every blob. The index is re-encrypted and the data key is stored for the new keys on Unlock.
+	//Returns how many blobs were re-encrypted.
+	Rekey() (int, error)
+	//Start using a new data key, on a remote with a passphrase. Open the remote again and Rekey to re-encrypt
+	//everything with it.
+	RotateDataKey() error
+}
+
+type rekeyIndex interface {
+	StartRekey() (int, error)
+	GetRekeyPaths(limit int) ([]string, error)
+	ReplaceStoredPath(oldPath, newPath string) error
+	FinishRekey() error
+	Close() error
+}
+
+// Re-encrypt the queued blobs. Every blob is written to a new path, and the old one is only deleted once the
+// index that points to the new one is persisted. An interrupted rekey never leaves the index pointing to a half written blob.
+// Blobs that are encrypted to the data key already are left alone, with a passphrase only the data key needs to be wrapped again.
+// That happens in finishRekey, once the index is persisted.
+func rekey(index rekeyIndex, chunks *chunkStore, checkpoint func() error) (int, error) {
+	total, err := index.StartRekey()
+	if err != nil {
+		return 0, fmt.Errorf("could not start rekey: %w", err)
+	}
+
+	done := 0
+	lastCheckpoint := time.Now()
+	for {
+		storedPaths, err := index.GetRekeyPaths(rekeyBatchSize)
+		if err != nil {
+			return done, err
+		}
+		if len(storedPaths) == 0 {
+			break
+		}
+
+		for _, storedPath := range storedPaths {
+			newPath, err := chunks.reencrypt(storedPath)
+			if err != nil {
+				return done, fmt.Errorf("could not re-encrypt %v: %w", storedPath, err)
+			}
+
+			err = index.ReplaceStoredPath(storedPath, newPath)
+			if err != nil {
+				return done, err
+			}
+
+			if newPath != storedPath {
+				chunks.queueDelete(storedPath)
+				done++
+			}
+		}
+
+		if time.Since(lastCheckpoint) < rekeyCheckpointInterval {
+			continue
+		}
+
+		err = checkpoint()
+		if err != nil {
+			return done, fmt.Errorf("could not persist progress: %w", err)
+		}
+		err = chunks.deleteQueued()
+		if err != nil {
+			logger.Warn("could not remove all old blobs: %v", err)
+		}
+		lastCheckpoint = time.Now()
+		logger.Info("re-encrypted %v of %v blobs", done, total)
+	}
+
+	return done, nil
+}
+
+// Store the data key for the current keys, and end the rekey in the index. Must only run after the index that
+// rekey() re-encrypted everything in is persisted: until then the remote can still need the old data key.
+// If this is interrupted, the rekey is still running in the index, and running it again gets here without re-encrypting anything.
+func finishRekey(index rekeyIndex, keys modifiers.Keys, dataKeys dataKeyStore) error {
+	err := rewrapDataKey(keys, dataKeys)
+	if err != nil {
+		return err
+	}
+
+	err = index.FinishRekey()
+	if err != nil {
+		return err
+	}
+
+	err = index.Close()
+	if err != nil {
+		return fmt.Errorf("error closing db: %w", err)
+	}
+	return nil
+}
+
+// Decrypt a blob and encrypt it again with the current keys, under a new path.
+// Blobs that are missing or encrypted with the current keys already keep their path.
+func (s *chunkStore) reencrypt(storedPath string) (string, error) {
+	found, err := s.blobs.hasBlob(storedPath)
+	if err != nil {
+		return "", fmt.Errorf("could not check blob: %w", err)
+	}
+	if !found {
+		logger.Warn("blob is missing from the remote: %v", storedPath)
+		return storedPath, nil
+	}
+
+	current, err := s.isCurrent(storedPath)
+	if err != nil {
+		return "", err
+	}
+	if current {
+		return storedPath, nil
+	}
+
+	blob, err := s.blobs.getBlob(storedPath)
+	if err != nil {
+		return "", fmt.Errorf("cannot open blob: %w", err)
+	}
+	defer blob.Close()
+
+	reader, err := modifiers.DecryptAndDecompress(blob, s.keys)
+	if err != nil {
+		return "", fmt.Errorf("could not decrypt and decompress: %w", err)
+	}
+	defer reader.Close()
+
+	encrypt := func(w io.Writer) error {
+		return modifiers.CompressAndEncrypt(reader, w, s.keys)
+	}
+
+	//Files stored as a single blob by older versions can be big, don't upload them from the start again if this is interrupted
+	resumer, ok := s.blobs.(resumingBlobStore)
+	if ok {
+		newPath, err := resumer.putReencrypted(storedPath, s.keys, encrypt)
+		if err != nil {
+			return "", fmt.Errorf("could not store blob: %w", err)
+		}
+		return newPath, nil
+	}
+
+	newPath, err := CreateRandomPath()
+	if err != nil {
+		return "", fmt.Errorf("cannot create store path: %w", err)
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(encrypt(pw))
+	}()
+
+	err = s.blobs.putBlob(newPath, pr)
+	pr.CloseWithError(err)
+	if err != nil {
+		return "", fmt.Errorf("could not store blob: %w", err)
+	}
+
+	return newPath, nil
+}
+
+func (s *chunkStore) isCurrent(storedPath string) (bool, error) {
+	blob, err := s.blobs.getBlob(storedPath)
+	if err != nil {
+		return false, fmt.Errorf("cannot open blob: %w", err)
+	}
+	defer blob.Close()
+
+	current, err := s.keys.IsCurrent(blob)
+	if err != nil {
+		return false, fmt.Errorf("cannot read blob: %w", err)
+	}
+	return current, nil
+}
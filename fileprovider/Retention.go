@@ -0,0 +1,61 @@
+package fileprovider
+
+import (
+	"time"
+
+	"github.com/c00/buttercup/appconfig"
+)
+
+// Get the previous versions of a file that are not kept by the retention policy.
+// Versions are ordered newest first, starting with the current version, the way VersionedProvider.GetVersions returns them.
+// The newest version is never expired.
+func ExpiredVersions(versions []FileVersion, policy appconfig.RetentionConfig, now time.Time) []FileVersion {
+	keep := make([]bool, len(versions))
+
+	for i := 1; i < len(versions) && i <= policy.KeepLast; i++ {
+		keep[i] = true
+	}
+
+	if policy.KeepDays > 0 {
+		since := now.AddDate(0, 0, -policy.KeepDays)
+		for i := 1; i < len(versions); i++ {
+			//A version was current until the next one was written
+			if versions[i-1].Created.After(since) {
+				keep[i] = true
+			}
+		}
+	}
+
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	for d := 0; d < policy.KeepDaily; d++ {
+		keepCurrentAt(versions, keep, today.AddDate(0, 0, 1-d))
+	}
+
+	for w := 0; w < policy.KeepWeekly; w++ {
+		keepCurrentAt(versions, keep, today.AddDate(0, 0, 1-7*w))
+	}
+
+	thisMonth := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+	for m := 0; m < policy.KeepMonthly; m++ {
+		keepCurrentAt(versions, keep, thisMonth.AddDate(0, 1-m, 0))
+	}
+
+	expired := []FileVersion{}
+	for i := 1; i < len(versions); i++ {
+		if !keep[i] {
+			expired = append(expired, versions[i])
+		}
+	}
+
+	return expired
+}
+
+// Mark the version that was current just before the given time.
+func keepCurrentAt(versions []FileVersion, keep []bool, end time.Time) {
+	for i, v := range versions {
+		if v.Created.Before(end) {
+			keep[i] = true
+			return
+		}
+	}
+}
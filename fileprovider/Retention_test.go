@@ -0,0 +1,47 @@
+package fileprovider
+
+import (
+	"testing"
+	"time"
+
+	"github.com/c00/buttercup/appconfig"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExpiredVersions(t *testing.T) {
+	now := time.Date(2024, 6, 10, 12, 0, 0, 0, time.UTC)
+	versions := []FileVersion{
+		{ID: 0, Created: now.Add(-time.Hour)},
+		{ID: 6, Created: now.Add(-2 * time.Hour)},
+		{ID: 5, Created: now.Add(-3 * time.Hour)},
+		{ID: 4, Created: now.AddDate(0, 0, -1).Add(-time.Minute)},
+		{ID: 3, Created: now.AddDate(0, 0, -1).Add(-time.Hour)},
+		{ID: 2, Created: now.AddDate(0, 0, -10)},
+		{ID: 1, Created: now.AddDate(0, -3, 0)},
+	}
+
+	ids := func(versions []FileVersion) []int64 {
+		result := []int64{}
+		for _, v := range versions {
+			result = append(result, v.ID)
+		}
+		return result
+	}
+
+	//No rules, only the current version stays
+	assert.Equal(t, ids(ExpiredVersions(versions, appconfig.RetentionConfig{}, now)), []int64{6, 5, 4, 3, 2, 1})
+
+	assert.Equal(t, ids(ExpiredVersions(versions, appconfig.RetentionConfig{KeepLast: 2}, now)), []int64{4, 3, 2, 1})
+
+	//Version 3 was replaced more than a day ago
+	assert.Equal(t, ids(ExpiredVersions(versions, appconfig.RetentionConfig{KeepDays: 1}, now)), []int64{3, 2, 1})
+
+	//Today is already covered by the current version, yesterday ended with version 4
+	assert.Equal(t, ids(ExpiredVersions(versions, appconfig.RetentionConfig{KeepDaily: 2}, now)), []int64{6, 5, 3, 2, 1})
+
+	assert.Equal(t, ids(ExpiredVersions(versions, appconfig.RetentionConfig{KeepWeekly: 2}, now)), []int64{6, 5, 4, 3, 1})
+
+	assert.Equal(t, ids(ExpiredVersions(versions, appconfig.RetentionConfig{KeepMonthly: 3}, now)), []int64{6, 5, 4, 3})
+
+	assert.Len(t, ExpiredVersions(versions[:1], appconfig.RetentionConfig{}, now), 0)
+}
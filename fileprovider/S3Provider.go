@@ -1,16 +1,18 @@
 package fileprovider
 
 import (
+	"bytes"
+	"database/sql"
 	"errors"
 	"fmt"
 	"io"
-	"os"
-	"strings"
+	"io/fs"
 	"time"
 
 	"github.com/c00/buttercup/appconfig"
 	s3client "github.com/c00/buttercup/fileprovider/s3client"
 	"github.com/c00/buttercup/fileprovider/s3index"
+	"github.com/c00/buttercup/logger"
 	"github.com/c00/buttercup/modifiers"
 )
 
@@ -20,16 +22,36 @@ func NewS3Provider(conf appconfig.ProviderConfig) *S3Provider {
 		panic("efs config is not defined")
 	}
 
+	keys, err := modifiers.NewKeys(conf.S3Config.Passphrase, conf.S3Config.Recipients, conf.S3Config.IndexRecipients, conf.S3Config.Identities)
+	if err == nil {
+		keys, err = keys.WithOldKeys(conf.S3Config.OldPassphrase, conf.S3Config.OldIdentities)
+	}
+	if err != nil {
+		panic(fmt.Errorf("cannot load keys: %w", err))
+	}
+	keys = keys.WithPadding(conf.Privacy)
+
 	s3 := s3client.New(*conf.S3Config)
 
 	provider := &S3Provider{
-		index:    s3index.New(s3, conf.S3Config.Passphrase),
 		name:     conf.ClientName,
 		config:   *conf.S3Config,
 		s3client: s3,
+		spool:    newUploadSpool(*conf.S3Config),
+	}
+
+	provider.keys, err = loadDataKey(keys, provider)
+	if err != nil {
+		panic(fmt.Errorf("cannot load keys: %w", err))
 	}
 
-	err := provider.index.Load()
+	provider.index = s3index.New(s3, provider.keys)
+	provider.chunks = newChunkStore(provider.index, provider, provider.keys, conf.PackSmallFiles)
+	provider.locker = newLocker(provider, conf.ClientName)
+	//Not every S3 compatible provider supports conditional writes, give a competing write time to land before checking.
+	provider.locker.settle = time.Second
+
+	err = provider.index.Load()
 	if err != nil {
 		panic(fmt.Errorf("cannot load database: %w", err))
 	}
@@ -40,8 +62,14 @@ func NewS3Provider(conf appconfig.ProviderConfig) *S3Provider {
 type S3Provider struct {
 	name     string
 	config   appconfig.S3ProviderConfig
+	keys     modifiers.Keys
 	index    *s3index.S3Index
 	s3client *s3client.S3Client
+	chunks   *chunkStore
+	locker   *locker
+	spool    *uploadSpool
+	//A rekey re-encrypted everything, the data key is stored for the new keys on Unlock
+	rekeyed bool
 }
 
 func (p *S3Provider) SetLastSynced(filePath string, date time.Time) error {
@@ -70,12 +98,17 @@ func (p *S3Provider) RetrieveFile(filePath string) (io.ReadCloser, error) {
 		return nil, fmt.Errorf("file not found: %w", err)
 	}
 
-	file, err := p.s3client.DownloadFile(fi.StoredPath)
+	if fi.StoredPath == "" {
+		return p.chunks.retrieve(fi.Path)
+	}
+
+	//Stored as a single blob by an older version
+	file, err := p.getBlob(fi.StoredPath)
 	if err != nil {
 		return nil, fmt.Errorf("cannot open file for retrieval: %w", err)
 	}
 
-	reader, err := modifiers.DecryptAndDecompress(file, p.config.Passphrase)
+	reader, err := modifiers.DecryptAndDecompress(file, p.keys)
 	if err != nil {
 		return nil, fmt.Errorf("could not compress and encrypt: %w", err)
 	}
@@ -84,30 +117,44 @@ func (p *S3Provider) RetrieveFile(filePath string) (io.ReadCloser, error) {
 
 func (p *S3Provider) StoreFile(otherFi FileInfo, stream io.Reader) error {
 	fi, err := p.index.GetFileInfo(otherFi.Path)
-	if err != nil {
-		storedPath, err := CreateRandomPath()
-		if err != nil {
-			return fmt.Errorf("cannot create store path: %w", err)
-		}
+	exists := err == nil
+	if !exists {
+		//File not found, create the fileInfo instead
 		fi = s3index.S3FileInfo{
-			Path:       otherFi.Path,
-			Updated:    otherFi.Updated,
-			StoredPath: storedPath,
+			Path: otherFi.Path,
 		}
-		//File not found, create the fileInfo instead
-		err = p.index.SetFileInfo(fi)
+	}
+
+	reader := newHashingReader(stream)
+	hashes, err := p.chunks.upload(reader)
+	if err != nil {
+		return fmt.Errorf("could not store file: %w", err)
+	}
+
+	//Keep the current version around
+	if exists {
+		err = p.index.ArchiveVersion(fi.Path)
 		if err != nil {
-			return fmt.Errorf("could not store new file info: %w", err)
+			return fmt.Errorf("could not archive previous version: %w", err)
 		}
 	}
 
-	err = p.store(fi, stream)
+	err = p.chunks.setChunks(fi.Path, hashes)
 	if err != nil {
 		return fmt.Errorf("could not store file: %w", err)
 	}
 
+	fi.StoredPath = ""
 	fi.Updated = otherFi.Updated
 	fi.Deleted = false
+	fi.Hash = reader.Sum()
+	fi.Size = reader.Size()
+	fi.Client = p.name
+	fi.Created = time.Now()
+	fi.Mode = uint32(otherFi.Mode)
+	fi.Owner = otherFi.Owner
+	fi.Xattrs = otherFi.Xattrs
+	fi.Type = string(otherFi.Type)
 
 	err = p.index.SetFileInfo(fi)
 	if err != nil {
@@ -117,106 +164,397 @@ func (p *S3Provider) StoreFile(otherFi FileInfo, stream io.Reader) error {
 	return nil
 }
 
-func (p *S3Provider) store(fi s3index.S3FileInfo, stream io.Reader) error {
-	tmpFile, err := os.CreateTemp("", "staged-")
+func (p *S3Provider) RemoveFile(otherFi FileInfo) error {
+	fi, err := p.index.GetFileInfo(otherFi.Path)
 	if err != nil {
-		return fmt.Errorf("could not create temp file: %w", err)
+		p.index.SetFileInfo(s3index.S3FileInfo{
+			Path:    otherFi.Path,
+			Updated: otherFi.Updated,
+			Deleted: true,
+			Client:  p.name,
+			Created: time.Now(),
+		})
+
+		return nil
 	}
-	defer tmpFile.Close()
-	defer os.Remove(tmpFile.Name())
 
-	err = modifiers.CompressAndEncrypt(stream, tmpFile, p.config.Passphrase)
-	if err != nil {
-		return fmt.Errorf("could not compress and encrypt: %w", err)
+	//Keep the current version around
+	if !fi.Deleted {
+		err = p.index.ArchiveVersion(fi.Path)
+		if err != nil {
+			return fmt.Errorf("could not archive previous version: %w", err)
+		}
 	}
 
-	_, err = tmpFile.Seek(0, 0)
+	err = p.chunks.remove(fi.Path)
 	if err != nil {
-		return fmt.Errorf("could not reset head to 0: %w", err)
+		return fmt.Errorf("could not remove file: %w", err)
 	}
 
-	err = p.s3client.UploadFile(fi.StoredPath, tmpFile)
+	fi.StoredPath = ""
+	fi.Deleted = true
+	fi.Updated = otherFi.Updated
+	fi.Client = p.name
+	fi.Created = time.Now()
+	err = p.index.SetFileInfo(fi)
 	if err != nil {
-		return fmt.Errorf("could not upload to s3: %w", err)
+		return fmt.Errorf("could not delete in index: %w", err)
 	}
 
 	return nil
 }
 
-func (p *S3Provider) RemoveFile(otherFi FileInfo) error {
-	fi, err := p.index.GetFileInfo(otherFi.Path)
+func (p *S3Provider) GetVersions(path string) ([]FileVersion, error) {
+	fi, err := p.index.GetFileInfo(path)
+	current := err == nil
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("could not get file: %w", err)
+	}
+
+	versions, err := p.index.GetVersions(path)
 	if err != nil {
-		storedPath, err := CreateRandomPath()
-		if err != nil {
-			return fmt.Errorf("cannot generate random path: %w", err)
-		}
-		p.index.SetFileInfo(s3index.S3FileInfo{
-			Path:       otherFi.Path,
-			Updated:    otherFi.Updated,
-			Deleted:    true,
-			StoredPath: storedPath,
+		return nil, fmt.Errorf("could not get versions: %w", err)
+	}
+
+	//A file that was moved away only has its previous versions left
+	if !current && len(versions) == 0 {
+		return nil, fmt.Errorf("file not found: %v", path)
+	}
+
+	result := make([]FileVersion, 0, len(versions)+1)
+	if current {
+		result = append(result, FileVersion{
+			Path:    fi.Path,
+			Updated: fi.Updated,
+			Deleted: fi.Deleted,
+			Hash:    fi.Hash,
+			Size:    fi.Size,
+			Client:  fi.Client,
+			Created: fi.Created,
 		})
+	}
 
-		return nil
+	for _, v := range versions {
+		result = append(result, FileVersion{
+			ID:      v.ID,
+			Path:    v.Path,
+			Updated: v.Updated,
+			Deleted: v.Deleted,
+			Hash:    v.Hash,
+			Size:    v.Size,
+			Client:  v.Client,
+			Created: v.Created,
+		})
+	}
+
+	return result, nil
+}
+
+func (p *S3Provider) RetrieveVersion(path string, id int64) (io.ReadCloser, error) {
+	if id == 0 {
+		return p.RetrieveFile(path)
 	}
 
-	err = p.s3client.DeleteFile(fi.StoredPath)
+	v, err := p.index.GetVersion(id)
 	if err != nil {
-		return fmt.Errorf("could not delete file from s3: %w", err)
+		return nil, fmt.Errorf("version not found: %w", err)
 	}
 
-	fi.Deleted = true
-	fi.Updated = otherFi.Updated
-	err = p.index.SetFileInfo(fi)
+	if v.Path != path {
+		return nil, fmt.Errorf("version %v is not a version of %v", id, path)
+	}
+
+	if v.Deleted {
+		return nil, fmt.Errorf("version %v is a deleted version", id)
+	}
+
+	if v.StoredPath == "" {
+		return p.chunks.retrieveVersion(id)
+	}
+
+	//Stored as a single blob by an older version
+	file, err := p.getBlob(v.StoredPath)
 	if err != nil {
-		return fmt.Errorf("could not delete in index: %w", err)
+		return nil, fmt.Errorf("cannot open file for retrieval: %w", err)
 	}
 
+	reader, err := modifiers.DecryptAndDecompress(file, p.keys)
+	if err != nil {
+		return nil, fmt.Errorf("could not compress and encrypt: %w", err)
+	}
+	return reader, nil
+}
+
+func (p *S3Provider) putBlob(storedPath string, content io.Reader) error {
+	err := p.s3client.UploadFile(storedPath, content)
+	if err != nil {
+		return fmt.Errorf("could not upload to s3: %w", err)
+	}
 	return nil
 }
 
-// todo am I checking for locks?
+func (p *S3Provider) putReencrypted(storedPath string, keys modifiers.Keys, encrypt func(w io.Writer) error) (string, error) {
+	return p.spool.put(storedPath, keys, encrypt, p.s3client.ResumeUpload)
+}
+
+func (p *S3Provider) getBlob(storedPath string) (io.ReadCloser, error) {
+	return p.s3client.DownloadFile(storedPath)
+}
+
+func (p *S3Provider) deleteBlob(storedPath string) error {
+	return p.s3client.DeleteFile(storedPath)
+}
+
+func (p *S3Provider) hasBlob(storedPath string) (bool, error) {
+	return p.s3client.HasFile(storedPath)
+}
+
+func (p *S3Provider) listBlobs(fn func(storedPath string) error) error {
+	return p.s3client.ListFiles(fn)
+}
+
+func (p *S3Provider) CollectGarbage(policy *appconfig.RetentionConfig) (GcResult, error) {
+	return collectGarbage(p, p.index, p.chunks, p, policy)
+}
+
 func (p *S3Provider) Lock() error {
-	_, err := p.s3client.DownloadFile(lockfileName)
-	if err == nil {
-		return errors.New("cannot set lock, already locked")
+	err := p.locker.lock()
+	if err != nil {
+		return err
 	}
 
-	err = p.s3client.UploadFile(lockfileName, strings.NewReader(p.name))
+	keys, err := ensureDataKey(p.keys, p)
 	if err != nil {
-		return fmt.Errorf("error setting lock: %w", err)
+		p.locker.release()
+		return err
 	}
+	p.setKeys(keys)
 
 	return nil
 }
 
+// Use new keys for everything that is encrypted from now on.
+func (p *S3Provider) setKeys(keys modifiers.Keys) {
+	p.keys = keys
+	p.index.SetKeys(keys)
+	p.chunks.setKeys(keys)
+}
+
 func (p *S3Provider) Unlock() error {
-	lockfileData, err := p.s3client.DownloadFile(lockfileName)
+	err := p.locker.check()
 	if err != nil {
-		return errors.New("cannot unlock, already unlocked")
+		return err
 	}
 
-	data, err := io.ReadAll(lockfileData)
+	err = p.chunks.prune()
 	if err != nil {
-		return fmt.Errorf("cannot read lockfile stream: %w", err)
+		return fmt.Errorf("error removing unused chunks: %w", err)
 	}
 
-	if string(data) != p.name {
-		return fmt.Errorf("store locked by another client: %v", string(data))
+	//The index can't point to a pack that isn't there
+	err = p.chunks.flushPackAndPersist(func() error {
+		err := p.index.Close()
+		if err != nil {
+			return fmt.Errorf("error closing db: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
 	}
+	p.chunks.keep(p.index.Revived())
 
-	err = p.s3client.DeleteFile(lockfileName)
+	//Blobs can only go once the index doesn't point to them anymore. Leftovers are cleaned up by gc.
+	err = p.chunks.deleteQueued()
 	if err != nil {
-		return fmt.Errorf("error removing lock file: %w", err)
+		logger.Warn("could not remove all unused chunks: %v", err)
 	}
 
-	err = p.index.Close()
+	//Only now that the persisted index doesn't need the old keys anymore
+	if p.rekeyed {
+		err = finishRekey(p.index, p.keys, p)
+		if err != nil {
+			p.locker.release()
+			return fmt.Errorf("could not finish rekey, run it again: %w", err)
+		}
+		p.rekeyed = false
+
+		//Left behind by uploads that were interrupted and not continued, like when the keys changed in between
+		err = p.spool.clear()
+		if err != nil {
+			logger.Warn("could not remove spooled uploads: %v", err)
+		}
+	}
+
+	return p.locker.release()
+}
+
+// Persist the index so far. Blobs queued for deletion stay queued until Unlock.
+func (p *S3Provider) Checkpoint() error {
+	err := p.locker.check()
 	if err != nil {
-		return fmt.Errorf("error closing db: %w", err)
+		return err
 	}
+
+	err = p.chunks.flushPackAndPersist(func() error {
+		err := p.index.Checkpoint()
+		if err != nil {
+			return fmt.Errorf("error persisting index: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	p.chunks.keep(p.index.Revived())
+
 	return nil
 }
 
+func (p *S3Provider) Rekey() (int, error) {
+	err := p.locker.check()
+	if err != nil {
+		return 0, err
+	}
+
+	count, err := rekey(p.index, p.chunks, p.Checkpoint)
+	if err != nil {
+		return count, err
+	}
+
+	p.rekeyed = true
+	return count, nil
+}
+
+func (p *S3Provider) RotateDataKey() error {
+	err := p.locker.check()
+	if err != nil {
+		return err
+	}
+
+	return rotateDataKey(p.keys, p)
+}
+
+func (p *S3Provider) GetStoredChunks(path string) ([]StoredChunk, error) {
+	records, err := p.index.GetFileChunkRecords(path)
+	if err != nil {
+		return nil, err
+	}
+
+	chunks := make([]StoredChunk, 0, len(records))
+	for _, record := range records {
+		//Small enough to upload again, and their pack might not be stored yet
+		if record.Packed {
+			continue
+		}
+		chunks = append(chunks, StoredChunk{Hash: record.Hash, StoredPath: record.StoredPath, Size: record.Size})
+	}
+	return chunks, nil
+}
+
+func (p *S3Provider) RestoreChunks(chunks []StoredChunk) (int, error) {
+	return p.chunks.restore(chunks)
+}
+
+func (p *S3Provider) LockStatus() (Lease, bool, error) {
+	return p.locker.current()
+}
+
+func (p *S3Provider) ForceUnlock() error {
+	return p.locker.forceUnlock()
+}
+
+func (p *S3Provider) readLock() ([]byte, error) {
+	reader, err := p.s3client.DownloadFile(lockfileName)
+	if s3client.IsNotFound(err) {
+		return nil, fs.ErrNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	return io.ReadAll(reader)
+}
+
+func (p *S3Provider) createLock(data []byte) error {
+	_, err := p.s3client.CreateFile(lockfileName, bytes.NewReader(data))
+	if errors.Is(err, s3client.ErrPreconditionFailed) {
+		return fmt.Errorf("lock exists: %w", fs.ErrExist)
+	}
+	return err
+}
+
+func (p *S3Provider) replaceLock(previous, data []byte) error {
+	reader, etag, err := p.s3client.DownloadFileWithETag(lockfileName)
+	if s3client.IsNotFound(err) {
+		return fs.ErrNotExist
+	}
+	if err != nil {
+		return err
+	}
+
+	current, err := io.ReadAll(reader)
+	reader.Close()
+	if err != nil {
+		return fmt.Errorf("cannot read lock: %w", err)
+	}
+
+	if !bytes.Equal(current, previous) {
+		return fmt.Errorf("lock changed: %w", fs.ErrExist)
+	}
+
+	//Conditional on the ETag, so a write by another client in between is not overwritten
+	_, err = p.s3client.ReplaceFile(lockfileName, bytes.NewReader(data), etag)
+	if errors.Is(err, s3client.ErrPreconditionFailed) {
+		return fmt.Errorf("lock changed: %w", fs.ErrExist)
+	}
+	return err
+}
+
+// The conditional replace never leaves the provider without a lock
+func (p *S3Provider) renewLock(previous, data []byte) error {
+	return p.replaceLock(previous, data)
+}
+
+func (p *S3Provider) deleteLock() error {
+	return p.s3client.DeleteFile(lockfileName)
+}
+
+func (p *S3Provider) readDataKey(name string) ([]byte, error) {
+	reader, err := p.s3client.DownloadFile(name)
+	if s3client.IsNotFound(err) {
+		return nil, fs.ErrNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	return io.ReadAll(reader)
+}
+
+func (p *S3Provider) createDataKey(name string, data []byte) error {
+	_, err := p.s3client.CreateFile(name, bytes.NewReader(data))
+	if errors.Is(err, s3client.ErrPreconditionFailed) {
+		return fmt.Errorf("data key exists: %w", fs.ErrExist)
+	}
+	return err
+}
+
+func (p *S3Provider) writeDataKey(name string, data []byte) error {
+	return p.s3client.UploadFile(name, bytes.NewReader(data))
+}
+
+func (p *S3Provider) deleteDataKey(name string) error {
+	return p.s3client.DeleteFile(name)
+}
+
+func (p *S3Provider) Close() error {
+	p.locker.stopHeartbeat()
+	return p.index.Discard()
+}
+
 func (p *S3Provider) GetFileInfo(path string) (FileInfo, error) {
 	fi, err := p.index.GetFileInfo(path)
 	if err != nil {
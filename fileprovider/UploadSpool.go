@@ -0,0 +1,190 @@
+package fileprovider
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/c00/buttercup/appconfig"
+	"github.com/c00/buttercup/fileprovider/s3client"
+	"github.com/c00/buttercup/logger"
+	"github.com/c00/buttercup/modifiers"
+)
+
+// A blob store that can continue an interrupted upload of a re-encrypted blob, instead of starting it over.
+type resumingBlobStore interface {
+	//Store what encrypt writes for keys under a new path, and return that path. If an earlier call for storedPath with
+	//the same keys was interrupted, its upload is continued and encrypt isn't called again.
+	putReencrypted(storedPath string, keys modifiers.Keys, encrypt func(w io.Writer) error) (string, error)
+}
+
+// Keeps re-encrypted blobs on the local disk until their upload is done.
+// Encrypting again gives different bytes, so without the spooled copy the parts that were already uploaded are of no use.
+type uploadSpool struct {
+	dir string
+}
+
+// Where the uploads to a remote are spooled. In the user cache folder, so a reboot doesn't lose them.
+func newUploadSpool(conf appconfig.S3ProviderConfig) *uploadSpool {
+	base, err := os.UserCacheDir()
+	if err != nil {
+		base = os.TempDir()
+	}
+
+	sum := sha256.Sum256([]byte(conf.Endpoint + "\n" + conf.Bucket + "\n" + conf.BasePath))
+	return &uploadSpool{dir: filepath.Join(base, "buttercup", "uploads", hex.EncodeToString(sum[:8]))}
+}
+
+// What is known about the upload of a spooled blob.
+type spoolState struct {
+	NewPath string `json:"newPath"`
+	//Fingerprint of the keys the blob is encrypted for
+	Keys   string                  `json:"keys"`
+	Upload *s3client.PendingUpload `json:"upload,omitempty"`
+}
+
+// Spool what encrypt writes and upload it to a new path with upload. Continues an interrupted earlier call for the same storedPath,
+// if it was encrypted for the same keys. Keys without a fingerprint always start over.
+func (s *uploadSpool) put(storedPath string, keys modifiers.Keys, encrypt func(w io.Writer) error, upload func(newPath string, content io.Reader, journal s3client.UploadJournal) error) (string, error) {
+	sum := sha256.Sum256([]byte(storedPath))
+	name := hex.EncodeToString(sum[:])
+	entry := &spoolEntry{statePath: filepath.Join(s.dir, name+".json")}
+	blobPath := filepath.Join(s.dir, name+".blob")
+
+	found, err := entry.load()
+	found = found && entry.state.Keys != "" && entry.state.Keys == keys.Fingerprint()
+	if err == nil && found {
+		_, err = os.Stat(blobPath)
+		found = err == nil
+		if errors.Is(err, fs.ErrNotExist) {
+			err = nil
+		}
+	}
+	if err != nil {
+		return "", fmt.Errorf("cannot read spooled upload: %w", err)
+	}
+
+	if found {
+		logger.Info("continuing the upload of %v", storedPath)
+	} else {
+		newPath, err := CreateRandomPath()
+		if err != nil {
+			return "", fmt.Errorf("cannot create store path: %w", err)
+		}
+
+		err = spoolBlob(blobPath, encrypt)
+		if err != nil {
+			return "", err
+		}
+
+		entry.state = spoolState{NewPath: newPath, Keys: keys.Fingerprint()}
+		err = entry.save()
+		if err != nil {
+			return "", err
+		}
+	}
+
+	file, err := os.Open(blobPath)
+	if err != nil {
+		return "", fmt.Errorf("cannot open spooled blob: %w", err)
+	}
+	err = upload(entry.state.NewPath, file, entry)
+	file.Close()
+	if err != nil {
+		return "", err
+	}
+
+	//Only the blob has to go, without it the state is ignored
+	err = os.Remove(blobPath)
+	if err != nil {
+		logger.Warn("could not remove spooled blob: %v", err)
+	}
+	os.Remove(entry.statePath)
+
+	return entry.state.NewPath, nil
+}
+
+// Remove everything that is spooled. For when the blobs aren't needed anymore, like after a rekey.
+func (s *uploadSpool) clear() error {
+	return os.RemoveAll(s.dir)
+}
+
+// Write what encrypt writes to path. The file only gets its name once it is complete.
+func spoolBlob(path string, encrypt func(w io.Writer) error) error {
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return fmt.Errorf("cannot create spool folder: %w", err)
+	}
+
+	tmpFile, err := os.CreateTemp(filepath.Dir(path), ".spool-*.tmp")
+	if err != nil {
+		return fmt.Errorf("cannot create spool file: %w", err)
+	}
+	defer os.Remove(tmpFile.Name())
+
+	err = encrypt(tmpFile)
+	closeErr := tmpFile.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("cannot spool blob: %w", err)
+	}
+
+	return os.Rename(tmpFile.Name(), path)
+}
+
+// The state of a single spooled upload, also the journal of its multipart upload.
+type spoolEntry struct {
+	statePath string
+	state     spoolState
+}
+
+func (e *spoolEntry) load() (bool, error) {
+	data, err := os.ReadFile(e.statePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	err = json.Unmarshal(data, &e.state)
+	if err != nil {
+		//Half written, start over
+		return false, nil
+	}
+	return true, nil
+}
+
+func (e *spoolEntry) save() error {
+	data, err := json.Marshal(e.state)
+	if err != nil {
+		return err
+	}
+
+	tmpPath := e.statePath + ".tmp"
+	err = os.WriteFile(tmpPath, data, 0600)
+	if err != nil {
+		return fmt.Errorf("cannot write upload state: %w", err)
+	}
+	return os.Rename(tmpPath, e.statePath)
+}
+
+func (e *spoolEntry) GetUpload() (s3client.PendingUpload, bool, error) {
+	if e.state.Upload == nil {
+		return s3client.PendingUpload{}, false, nil
+	}
+	return *e.state.Upload, true, nil
+}
+
+func (e *spoolEntry) SaveUpload(upload s3client.PendingUpload) error {
+	e.state.Upload = &upload
+	return e.save()
+}
@@ -0,0 +1,92 @@
+package fileprovider
+
+import (
+	"errors"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/c00/buttercup/fileprovider/s3client"
+	"github.com/c00/buttercup/modifiers"
+	"github.com/stretchr/testify/assert"
+)
+
+func spoolKeys(t *testing.T) modifiers.Keys {
+	keys, err := modifiers.PassphraseKeys("foo")
+	assert.Nil(t, err)
+	dataKey, err := modifiers.NewDataKey()
+	assert.Nil(t, err)
+	return keys.WithDataKey(dataKey)
+}
+
+func TestUploadSpool_ContinuesInterruptedUpload(t *testing.T) {
+	spool := &uploadSpool{dir: t.TempDir()}
+	keys := spoolKeys(t)
+
+	encrypted := 0
+	encrypt := func(w io.Writer) error {
+		encrypted++
+		_, err := w.Write([]byte("ciphertext"))
+		return err
+	}
+
+	//Interrupted after it started a multipart upload
+	var firstPath string
+	_, err := spool.put("old/blob", keys, encrypt, func(newPath string, content io.Reader, journal s3client.UploadJournal) error {
+		firstPath = newPath
+		assert.Nil(t, journal.SaveUpload(s3client.PendingUpload{UploadID: "upload", Parts: []s3client.UploadedPart{{Number: 1, ETag: "etag"}}}))
+		return errors.New("connection reset")
+	})
+	assert.NotNil(t, err)
+
+	//Continued with the same bytes, the same path and the recorded upload
+	newPath, err := spool.put("old/blob", keys, encrypt, func(newPath string, content io.Reader, journal s3client.UploadJournal) error {
+		data, err := io.ReadAll(content)
+		assert.Nil(t, err)
+		assert.Equal(t, string(data), "ciphertext")
+
+		upload, found, err := journal.GetUpload()
+		assert.Nil(t, err)
+		assert.True(t, found)
+		assert.Equal(t, upload.UploadID, "upload")
+		assert.Equal(t, upload.Parts, []s3client.UploadedPart{{Number: 1, ETag: "etag"}})
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, newPath, firstPath)
+	assert.Equal(t, encrypted, 1)
+
+	//Nothing is left behind
+	entries, err := os.ReadDir(spool.dir)
+	assert.Nil(t, err)
+	assert.Equal(t, len(entries), 0)
+}
+
+func TestUploadSpool_OtherKeysStartOver(t *testing.T) {
+	spool := &uploadSpool{dir: t.TempDir()}
+
+	encrypted := 0
+	encrypt := func(w io.Writer) error {
+		encrypted++
+		_, err := w.Write([]byte("ciphertext"))
+		return err
+	}
+
+	var firstPath string
+	_, err := spool.put("old/blob", spoolKeys(t), encrypt, func(newPath string, content io.Reader, journal s3client.UploadJournal) error {
+		firstPath = newPath
+		return errors.New("connection reset")
+	})
+	assert.NotNil(t, err)
+
+	//The spooled blob is encrypted for the keys from before
+	newPath, err := spool.put("old/blob", spoolKeys(t), encrypt, func(newPath string, content io.Reader, journal s3client.UploadJournal) error {
+		_, found, err := journal.GetUpload()
+		assert.Nil(t, err)
+		assert.False(t, found)
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.NotEqual(t, newPath, firstPath)
+	assert.Equal(t, encrypted, 2)
+}
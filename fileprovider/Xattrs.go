@@ -0,0 +1,108 @@
+//go:build linux || darwin
+
+package fileprovider
+
+import (
+	"bytes"
+	"errors"
+	"runtime"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// Whether an attribute is synced. On Linux only the user namespace is, the others belong to the system (like SELinux labels).
+func syncedXattr(name string) bool {
+	return runtime.GOOS != "linux" || strings.HasPrefix(name, "user.")
+}
+
+// Read the extended attributes of a file.
+func readXattrs(fullPath string) (map[string][]byte, error) {
+	names, err := listXattrs(fullPath)
+	if err != nil {
+		return nil, err
+	}
+
+	attrs := map[string][]byte{}
+	for _, name := range names {
+		value, err := getXattr(fullPath, name)
+		if err != nil {
+			//Removed since it was listed
+			continue
+		}
+		attrs[name] = value
+	}
+
+	return attrs, nil
+}
+
+// Make the extended attributes of a file match attrs. Attributes that are not in attrs are removed.
+func writeXattrs(fullPath string, attrs map[string][]byte) error {
+	names, err := listXattrs(fullPath)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		if _, ok := attrs[name]; ok {
+			continue
+		}
+		err = unix.Lremovexattr(fullPath, name)
+		if err != nil {
+			return err
+		}
+	}
+
+	var errs []error
+	for name, value := range attrs {
+		err = unix.Lsetxattr(fullPath, name, value, 0)
+		if err != nil {
+			//Keep going, attributes from another platform may not be allowed here
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func listXattrs(fullPath string) ([]string, error) {
+	size, err := unix.Llistxattr(fullPath, nil)
+	if errors.Is(err, unix.ENOTSUP) {
+		//The filesystem has no extended attributes
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if size == 0 {
+		return nil, nil
+	}
+
+	buf := make([]byte, size)
+	size, err = unix.Llistxattr(fullPath, buf)
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for _, name := range bytes.Split(buf[:size], []byte{0}) {
+		if len(name) > 0 && syncedXattr(string(name)) {
+			names = append(names, string(name))
+		}
+	}
+	return names, nil
+}
+
+func getXattr(fullPath, name string) ([]byte, error) {
+	size, err := unix.Lgetxattr(fullPath, name, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	value := make([]byte, size)
+	size, err = unix.Lgetxattr(fullPath, name, value)
+	if err != nil {
+		return nil, err
+	}
+	return value[:size], nil
+}
@@ -0,0 +1,17 @@
+//go:build !(linux || darwin)
+
+package fileprovider
+
+import "errors"
+
+// Not available on this platform, files have no extended attributes.
+func readXattrs(fullPath string) (map[string][]byte, error) {
+	return nil, nil
+}
+
+func writeXattrs(fullPath string, attrs map[string][]byte) error {
+	if len(attrs) > 0 {
+		return errors.New("extended attributes are not supported on this platform")
+	}
+	return nil
+}
@@ -2,3 +2,11 @@ package fileprovider
 
 const lockfileName = ".buttercup-lock-file"
 const sqliteIndexName = ".buttercup-index.db"
+const dataKeyName = ".buttercup-key"
+const ignoreFileName = ".buttercupignore"
+
+// Files are written to a temporary file with this prefix first, and moved in place when they are complete.
+const tempFilePrefix = ".buttercup-tmp-"
+
+// A data key that a rotation started with, until a rekey replaces the old one with it.
+const nextDataKeyName = ".buttercup-key-next"
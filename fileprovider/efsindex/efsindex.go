@@ -2,14 +2,20 @@ package efsindex
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
 	"database/sql"
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path"
+	"sync"
 	"time"
 
+	"github.com/c00/buttercup/fileprovider/indexmerge"
+	"github.com/c00/buttercup/internal/migrate"
+	"github.com/c00/buttercup/logger"
 	"github.com/c00/buttercup/modifiers"
 	_ "github.com/mattn/go-sqlite3"
 )
@@ -21,17 +27,65 @@ type EfsFileInfo struct {
 	Deleted       bool
 	StoredPath    string
 	TrackingValue int64
+	// Hex encoded sha256 of the content
+	Hash string
+	Size int64
+	// Client that wrote this version of the file
+	Client string
+	// When this version was written to the remote
+	Created time.Time
+	// Permission bits. 0 if unknown.
+	Mode uint32
+	// Owner and group as "uid:gid". Empty if unknown.
+	Owner string
+	// Encoded extended attributes
+	Xattrs string
+	// Empty for files, "dir" or "symlink" otherwise
+	Type string
 }
 
-func New(path string, passphrase string) *EfsIndex {
-	return &EfsIndex{encryptedPath: path, passphrase: passphrase}
+// A content-addressed chunk and where it is stored
+type EfsChunk struct {
+	Hash       string
+	StoredPath string
+	Size       int64
+	// Stored in a pack with other small chunks
+	Packed bool
+}
+
+// A previous version of a file
+type EfsFileVersion struct {
+	ID         int64
+	Path       string
+	Updated    time.Time
+	Deleted    bool
+	StoredPath string
+	Hash       string
+	Size       int64
+	Client     string
+	Created    time.Time
+}
+
+func New(path string, keys modifiers.Keys) *EfsIndex {
+	return &EfsIndex{encryptedPath: path, keys: keys}
+}
+
+// Use new keys, like a data key that was created after the index was loaded. The index is encrypted with them when it is persisted.
+func (i *EfsIndex) SetKeys(keys modifiers.Keys) {
+	i.keys = keys
 }
 
 type EfsIndex struct {
 	encryptedPath   string
 	unencryptedPath string
-	passphrase      string
+	keys            modifiers.Keys
 	db              *sql.DB
+	//Guards loading the db, providers are used from several goroutines
+	loadMu sync.Mutex
+	//Hash of the encrypted index when it was loaded, to detect changes by other clients.
+	fingerprint string
+	//Stored paths that came back into use by merging
+	revived []string
 }
 
 func (i *EfsIndex) MarkDeleted(trackingValue int64) error {
@@ -61,6 +115,11 @@ func (i *EfsIndex) DeleteFileInfo(path string) error {
 		return fmt.Errorf("error deleting fileinfo: %w", err)
 	}
 
+	_, err = i.db.Exec(`DELETE FROM filechunk WHERE path = ?`, path)
+	if err != nil {
+		return fmt.Errorf("error deleting file chunks: %w", err)
+	}
+
 	return nil
 }
 
@@ -70,9 +129,9 @@ func (i *EfsIndex) GetFileInfo(path string) (EfsFileInfo, error) {
 		return EfsFileInfo{}, err
 	}
 
-	row := i.db.QueryRow(`SELECT path, lastsynced, updated, deleted, storedpath, trackingvalue FROM fileinfo WHERE path = ?`, path)
+	row := i.db.QueryRow(`SELECT path, lastsynced, updated, deleted, storedpath, trackingvalue, hash, size, client, created, mode, owner, xattrs, type FROM fileinfo WHERE path = ?`, path)
 	fi := EfsFileInfo{}
-	err = row.Scan(&fi.Path, &fi.LastSynced, &fi.Updated, &fi.Deleted, &fi.StoredPath, &fi.TrackingValue)
+	err = row.Scan(&fi.Path, &fi.LastSynced, &fi.Updated, &fi.Deleted, &fi.StoredPath, &fi.TrackingValue, &fi.Hash, &fi.Size, &fi.Client, &fi.Created, &fi.Mode, &fi.Owner, &fi.Xattrs, &fi.Type)
 	if err != nil {
 		return EfsFileInfo{}, fmt.Errorf("error querying database: %w", err)
 	}
@@ -87,15 +146,23 @@ func (i *EfsIndex) SetFileInfo(fi EfsFileInfo) error {
 	}
 
 	_, err = i.db.Exec(
-		`INSERT INTO fileinfo (path, lastsynced, updated, deleted, storedpath, trackingvalue)
-		 VALUES (?, ?, ?, ?, ?, ?)
+		`INSERT INTO fileinfo (path, lastsynced, updated, deleted, storedpath, trackingvalue, hash, size, client, created, mode, owner, xattrs, type)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 		 ON CONFLICT(Path) DO UPDATE SET 
 			lastsynced = excluded.lastsynced,
 			updated = excluded.updated,
 			deleted = excluded.deleted,
 			storedpath = excluded.storedpath,
-			trackingvalue = excluded.trackingvalue;`,
-		fi.Path, fi.LastSynced, fi.Updated, fi.Deleted, fi.StoredPath, fi.TrackingValue,
+			trackingvalue = excluded.trackingvalue,
+			hash = excluded.hash,
+			size = excluded.size,
+			client = excluded.client,
+			created = excluded.created,
+			mode = excluded.mode,
+			owner = excluded.owner,
+			xattrs = excluded.xattrs,
+			type = excluded.type;`,
+		fi.Path, fi.LastSynced, fi.Updated, fi.Deleted, fi.StoredPath, fi.TrackingValue, fi.Hash, fi.Size, fi.Client, fi.Created, fi.Mode, fi.Owner, fi.Xattrs, fi.Type,
 	)
 	if err != nil {
 		return fmt.Errorf("cannot insert: %w", err)
@@ -120,6 +187,11 @@ func (i *EfsIndex) UpdatePath(oldPath, newPath string) error {
 	if count, _ := res.RowsAffected(); count == 0 {
 		return errors.New("no rows updated")
 	}
+
+	_, err = i.db.Exec("UPDATE filechunk SET path = ? WHERE path = ?", newPath, oldPath)
+	if err != nil {
+		return fmt.Errorf("could not update chunk paths: %w", err)
+	}
 	return nil
 }
 
@@ -133,7 +205,7 @@ func (i *EfsIndex) GetPage(offset, limit int) ([]EfsFileInfo, error) {
 		limit = -1
 	}
 
-	sql := "SELECT path, lastsynced, updated, deleted, storedpath, trackingvalue FROM fileinfo LIMIT ?"
+	sql := "SELECT path, lastsynced, updated, deleted, storedpath, trackingvalue, hash, size, client, created, mode, owner, xattrs, type FROM fileinfo ORDER BY path LIMIT ?"
 	values := []any{limit}
 
 	if offset > 0 {
@@ -145,12 +217,13 @@ func (i *EfsIndex) GetPage(offset, limit int) ([]EfsFileInfo, error) {
 	if err != nil {
 		return nil, fmt.Errorf("could not get rows: %w", err)
 	}
+	defer rows.Close()
 
 	results := []EfsFileInfo{}
 
 	for rows.Next() {
 		fi := EfsFileInfo{}
-		err = rows.Scan(&fi.Path, &fi.LastSynced, &fi.Updated, &fi.Deleted, &fi.StoredPath, &fi.TrackingValue)
+		err = rows.Scan(&fi.Path, &fi.LastSynced, &fi.Updated, &fi.Deleted, &fi.StoredPath, &fi.TrackingValue, &fi.Hash, &fi.Size, &fi.Client, &fi.Created, &fi.Mode, &fi.Owner, &fi.Xattrs, &fi.Type)
 		if err != nil {
 			return nil, fmt.Errorf("error scanning rows: %w", err)
 		}
@@ -161,6 +234,586 @@ func (i *EfsIndex) GetPage(offset, limit int) ([]EfsFileInfo, error) {
 	return results, nil
 }
 
+// Get the stored path of a chunk by its content hash
+func (i *EfsIndex) GetChunkPath(hash string) (string, error) {
+	err := i.Load()
+	if err != nil {
+		return "", err
+	}
+
+	var storedPath string
+	err = i.db.QueryRow(`SELECT storedpath FROM chunk WHERE hash = ?`, hash).Scan(&storedPath)
+	if err != nil {
+		return "", fmt.Errorf("error querying database: %w", err)
+	}
+
+	return storedPath, nil
+}
+
+func (i *EfsIndex) AddChunk(hash, storedPath string, size int64) error {
+	err := i.Load()
+	if err != nil {
+		return err
+	}
+
+	_, err = i.db.Exec(`INSERT INTO chunk (hash, storedpath, size) VALUES (?, ?, ?) ON CONFLICT(hash) DO NOTHING`, hash, storedPath, size)
+	if err != nil {
+		return fmt.Errorf("cannot insert chunk: %w", err)
+	}
+
+	return nil
+}
+
+// Add a chunk that is stored in a pack, at offset in the decrypted pack.
+func (i *EfsIndex) AddPackedChunk(hash, storedPath string, offset, size int64) error {
+	err := i.Load()
+	if err != nil {
+		return err
+	}
+
+	_, err = i.db.Exec(`INSERT INTO chunk (hash, storedpath, size, packoffset) VALUES (?, ?, ?, ?) ON CONFLICT(hash) DO NOTHING`, hash, storedPath, size, offset)
+	if err != nil {
+		return fmt.Errorf("cannot insert chunk: %w", err)
+	}
+
+	return nil
+}
+
+// Where a chunk is stored. For chunks in a pack that is "storedpath#offset+size".
+func chunkRef(storedPath string, packOffset sql.NullInt64, size int64) string {
+	if !packOffset.Valid {
+		return storedPath
+	}
+	return fmt.Sprintf("%v#%v+%v", storedPath, packOffset.Int64, size)
+}
+
+// Get the distinct chunks of a file, with where they are stored.
+func (i *EfsIndex) GetFileChunkRecords(path string) ([]EfsChunk, error) {
+	err := i.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := i.db.Query(`SELECT DISTINCT c.hash, c.storedpath, c.size, c.packoffset IS NOT NULL FROM filechunk f JOIN chunk c ON c.hash = f.hash WHERE f.path = ?`, path)
+	if err != nil {
+		return nil, fmt.Errorf("could not get chunks: %w", err)
+	}
+	defer rows.Close()
+
+	results := []EfsChunk{}
+	for rows.Next() {
+		chunk := EfsChunk{}
+		err = rows.Scan(&chunk.Hash, &chunk.StoredPath, &chunk.Size, &chunk.Packed)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning rows: %w", err)
+		}
+		results = append(results, chunk)
+	}
+
+	return results, rows.Err()
+}
+
+// Get where the chunks of a file are stored, in order. See chunkRef.
+func (i *EfsIndex) GetFileChunks(path string) ([]string, error) {
+	err := i.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := i.db.Query(`SELECT c.storedpath, c.packoffset, c.size FROM filechunk f JOIN chunk c ON c.hash = f.hash WHERE f.path = ? ORDER BY f.seq`, path)
+	if err != nil {
+		return nil, fmt.Errorf("could not get chunks: %w", err)
+	}
+	defer rows.Close()
+
+	results := []string{}
+	for rows.Next() {
+		var storedPath string
+		var packOffset sql.NullInt64
+		var size int64
+		err = rows.Scan(&storedPath, &packOffset, &size)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning rows: %w", err)
+		}
+		results = append(results, chunkRef(storedPath, packOffset, size))
+	}
+
+	return results, rows.Err()
+}
+
+// Replace the chunk list of a file.
+// Returns the hashes that were used by the old list but not by the new one.
+func (i *EfsIndex) SetFileChunks(path string, hashes []string) ([]string, error) {
+	err := i.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := i.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("cannot start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`SELECT hash FROM filechunk WHERE path = ?`, path)
+	if err != nil {
+		return nil, fmt.Errorf("could not get chunks: %w", err)
+	}
+	old := map[string]bool{}
+	for rows.Next() {
+		var hash string
+		err = rows.Scan(&hash)
+		if err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("error scanning rows: %w", err)
+		}
+		old[hash] = true
+	}
+	rows.Close()
+
+	_, err = tx.Exec(`DELETE FROM filechunk WHERE path = ?`, path)
+	if err != nil {
+		return nil, fmt.Errorf("could not delete chunks: %w", err)
+	}
+
+	for seq, hash := range hashes {
+		_, err = tx.Exec(`INSERT INTO filechunk (path, seq, hash) VALUES (?, ?, ?)`, path, seq, hash)
+		if err != nil {
+			return nil, fmt.Errorf("cannot insert file chunk: %w", err)
+		}
+		delete(old, hash)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("cannot commit: %w", err)
+	}
+
+	released := make([]string, 0, len(old))
+	for hash := range old {
+		released = append(released, hash)
+	}
+	return released, nil
+}
+
+// Delete a chunk if no file or version uses it anymore.
+// Returns the stored path of the chunk and whether its blob can be deleted, which is not the case for packs that other chunks are still in.
+func (i *EfsIndex) DeleteChunkIfUnused(hash string) (string, bool, error) {
+	err := i.Load()
+	if err != nil {
+		return "", false, err
+	}
+
+	var storedPath string
+	err = i.db.QueryRow(`SELECT storedpath FROM chunk WHERE hash = ?
+		 AND NOT EXISTS (SELECT 1 FROM filechunk WHERE hash = ?)
+		 AND NOT EXISTS (SELECT 1 FROM versionchunk WHERE hash = ?)`,
+		hash, hash, hash,
+	).Scan(&storedPath)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, fmt.Errorf("error querying database: %w", err)
+	}
+
+	_, err = i.db.Exec(`DELETE FROM chunk WHERE hash = ?`, hash)
+	if err != nil {
+		return "", false, fmt.Errorf("could not delete chunk: %w", err)
+	}
+
+	//A pack can only go once all of its chunks are gone
+	var shared bool
+	err = i.db.QueryRow(`SELECT EXISTS (SELECT 1 FROM chunk WHERE storedpath = ?)`, storedPath).Scan(&shared)
+	if err != nil {
+		return "", false, fmt.Errorf("error querying database: %w", err)
+	}
+
+	return storedPath, !shared, nil
+}
+
+// Copy the current state of a file into its version history, including its chunk list.
+// Does nothing if the file is not in the index.
+func (i *EfsIndex) ArchiveVersion(path string) error {
+	err := i.Load()
+	if err != nil {
+		return err
+	}
+
+	tx, err := i.db.Begin()
+	if err != nil {
+		return fmt.Errorf("cannot start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(
+		`INSERT INTO fileversion (path, updated, deleted, storedpath, hash, size, client, created)
+		 SELECT path, updated, deleted, storedpath, hash, size, client, created FROM fileinfo WHERE path = ?`,
+		path,
+	)
+	if err != nil {
+		return fmt.Errorf("cannot insert version: %w", err)
+	}
+
+	if count, _ := res.RowsAffected(); count == 0 {
+		return nil
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("cannot get version id: %w", err)
+	}
+
+	_, err = tx.Exec(`INSERT INTO versionchunk (version, seq, hash) SELECT ?, seq, hash FROM filechunk WHERE path = ?`, id, path)
+	if err != nil {
+		return fmt.Errorf("cannot insert version chunks: %w", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("cannot commit: %w", err)
+	}
+
+	return nil
+}
+
+// Get the previous versions of a file, newest first.
+func (i *EfsIndex) GetVersions(path string) ([]EfsFileVersion, error) {
+	err := i.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := i.db.Query(`SELECT id, path, updated, deleted, storedpath, hash, size, client, created FROM fileversion WHERE path = ? ORDER BY id DESC`, path)
+	if err != nil {
+		return nil, fmt.Errorf("could not get versions: %w", err)
+	}
+	defer rows.Close()
+
+	results := []EfsFileVersion{}
+	for rows.Next() {
+		v := EfsFileVersion{}
+		err = rows.Scan(&v.ID, &v.Path, &v.Updated, &v.Deleted, &v.StoredPath, &v.Hash, &v.Size, &v.Client, &v.Created)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning rows: %w", err)
+		}
+		results = append(results, v)
+	}
+
+	return results, rows.Err()
+}
+
+func (i *EfsIndex) GetVersion(id int64) (EfsFileVersion, error) {
+	err := i.Load()
+	if err != nil {
+		return EfsFileVersion{}, err
+	}
+
+	row := i.db.QueryRow(`SELECT id, path, updated, deleted, storedpath, hash, size, client, created FROM fileversion WHERE id = ?`, id)
+	v := EfsFileVersion{}
+	err = row.Scan(&v.ID, &v.Path, &v.Updated, &v.Deleted, &v.StoredPath, &v.Hash, &v.Size, &v.Client, &v.Created)
+	if err != nil {
+		return EfsFileVersion{}, fmt.Errorf("error querying database: %w", err)
+	}
+
+	return v, nil
+}
+
+// Get where the chunks of a version are stored, in order. See chunkRef.
+func (i *EfsIndex) GetVersionChunks(id int64) ([]string, error) {
+	err := i.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := i.db.Query(`SELECT c.storedpath, c.packoffset, c.size FROM versionchunk v JOIN chunk c ON c.hash = v.hash WHERE v.version = ? ORDER BY v.seq`, id)
+	if err != nil {
+		return nil, fmt.Errorf("could not get chunks: %w", err)
+	}
+	defer rows.Close()
+
+	results := []string{}
+	for rows.Next() {
+		var storedPath string
+		var packOffset sql.NullInt64
+		var size int64
+		err = rows.Scan(&storedPath, &packOffset, &size)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning rows: %w", err)
+		}
+		results = append(results, chunkRef(storedPath, packOffset, size))
+	}
+
+	return results, rows.Err()
+}
+
+// Get the paths that have previous versions, in path order. Pages by path, so deleting versions while paging is fine.
+func (i *EfsIndex) GetVersionedPaths(after string, limit int) ([]string, error) {
+	err := i.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := i.db.Query(`SELECT DISTINCT path FROM fileversion WHERE path > ? ORDER BY path LIMIT ?`, after, limit)
+	if err != nil {
+		return nil, fmt.Errorf("could not get versioned paths: %w", err)
+	}
+	defer rows.Close()
+
+	results := []string{}
+	for rows.Next() {
+		var path string
+		err = rows.Scan(&path)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning rows: %w", err)
+		}
+		results = append(results, path)
+	}
+
+	return results, rows.Err()
+}
+
+// Delete a previous version of a file.
+// Returns the stored path of a version that was stored as a single blob, and the hashes of the chunks it used.
+func (i *EfsIndex) DeleteVersion(id int64) (string, []string, error) {
+	err := i.Load()
+	if err != nil {
+		return "", nil, err
+	}
+
+	tx, err := i.db.Begin()
+	if err != nil {
+		return "", nil, fmt.Errorf("cannot start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var storedPath string
+	err = tx.QueryRow(`SELECT storedpath FROM fileversion WHERE id = ?`, id).Scan(&storedPath)
+	if err != nil {
+		return "", nil, fmt.Errorf("version not found: %w", err)
+	}
+
+	rows, err := tx.Query(`SELECT DISTINCT hash FROM versionchunk WHERE version = ?`, id)
+	if err != nil {
+		return "", nil, fmt.Errorf("could not get chunks: %w", err)
+	}
+	hashes := []string{}
+	for rows.Next() {
+		var hash string
+		err = rows.Scan(&hash)
+		if err != nil {
+			rows.Close()
+			return "", nil, fmt.Errorf("error scanning rows: %w", err)
+		}
+		hashes = append(hashes, hash)
+	}
+	rows.Close()
+
+	_, err = tx.Exec(`DELETE FROM versionchunk WHERE version = ?`, id)
+	if err != nil {
+		return "", nil, fmt.Errorf("cannot delete version chunks: %w", err)
+	}
+
+	_, err = tx.Exec(`DELETE FROM fileversion WHERE id = ?`, id)
+	if err != nil {
+		return "", nil, fmt.Errorf("cannot delete version: %w", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return "", nil, fmt.Errorf("cannot commit: %w", err)
+	}
+
+	return storedPath, hashes, nil
+}
+
+// Get the hashes of chunks that are not used by any file or version.
+// These are left behind when storing a file fails halfway.
+func (i *EfsIndex) GetUnusedChunks() ([]string, error) {
+	err := i.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := i.db.Query(`SELECT hash FROM chunk c
+		WHERE NOT EXISTS (SELECT 1 FROM filechunk f WHERE f.hash = c.hash)
+		AND NOT EXISTS (SELECT 1 FROM versionchunk v WHERE v.hash = c.hash)`)
+	if err != nil {
+		return nil, fmt.Errorf("could not get unused chunks: %w", err)
+	}
+	defer rows.Close()
+
+	results := []string{}
+	for rows.Next() {
+		var hash string
+		err = rows.Scan(&hash)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning rows: %w", err)
+		}
+		results = append(results, hash)
+	}
+
+	return results, rows.Err()
+}
+
+// Get every stored path the index refers to: chunks, and files or versions stored as a single blob.
+func (i *EfsIndex) GetStoredPaths() ([]string, error) {
+	err := i.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := i.db.Query(`SELECT storedpath FROM chunk
+		UNION SELECT storedpath FROM fileinfo WHERE storedpath != ''
+		UNION SELECT storedpath FROM fileversion WHERE storedpath != ''`)
+	if err != nil {
+		return nil, fmt.Errorf("could not get stored paths: %w", err)
+	}
+	defer rows.Close()
+
+	results := []string{}
+	for rows.Next() {
+		var storedPath string
+		err = rows.Scan(&storedPath)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning rows: %w", err)
+		}
+		results = append(results, storedPath)
+	}
+
+	return results, rows.Err()
+}
+
+// Queue every stored path for re-encryption, unless a rekey that was interrupted is still running. Returns how many are queued.
+// A rekey runs until FinishRekey, so one that re-encrypted everything but didn't finish has nothing queued.
+func (i *EfsIndex) StartRekey() (int, error) {
+	err := i.Load()
+	if err != nil {
+		return 0, err
+	}
+
+	var queued int
+	err = i.db.QueryRow(`SELECT count(*) FROM rekey`).Scan(&queued)
+	if err != nil {
+		return 0, fmt.Errorf("could not count queued paths: %w", err)
+	}
+	if queued > 0 {
+		return queued, nil
+	}
+
+	var running int
+	err = i.db.QueryRow(`SELECT count(*) FROM rekeyrun`).Scan(&running)
+	if err != nil {
+		return 0, fmt.Errorf("could not check running rekey: %w", err)
+	}
+	if running > 0 {
+		return 0, nil
+	}
+
+	res, err := i.db.Exec(`INSERT INTO rekey (storedpath) SELECT storedpath FROM chunk
+		UNION SELECT storedpath FROM fileinfo WHERE storedpath != ''
+		UNION SELECT storedpath FROM fileversion WHERE storedpath != ''`)
+	if err != nil {
+		return 0, fmt.Errorf("could not queue stored paths: %w", err)
+	}
+
+	count, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = i.db.Exec(`INSERT INTO rekeyrun (id) VALUES (1)`)
+	if err != nil {
+		return 0, fmt.Errorf("could not start rekey: %w", err)
+	}
+
+	return int(count), nil
+}
+
+// End a rekey, so the next one queues everything again.
+func (i *EfsIndex) FinishRekey() error {
+	err := i.Load()
+	if err != nil {
+		return err
+	}
+
+	_, err = i.db.Exec(`DELETE FROM rekeyrun`)
+	if err != nil {
+		return fmt.Errorf("could not finish rekey: %w", err)
+	}
+
+	return nil
+}
+
+// Get stored paths that still need to be re-encrypted.
+func (i *EfsIndex) GetRekeyPaths(limit int) ([]string, error) {
+	err := i.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := i.db.Query(`SELECT storedpath FROM rekey ORDER BY storedpath LIMIT ?`, limit)
+	if err != nil {
+		return nil, fmt.Errorf("could not get queued paths: %w", err)
+	}
+	defer rows.Close()
+
+	results := []string{}
+	for rows.Next() {
+		var storedPath string
+		err = rows.Scan(&storedPath)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning rows: %w", err)
+		}
+		results = append(results, storedPath)
+	}
+
+	return results, rows.Err()
+}
+
+// Point everything that is stored at oldPath to newPath, and take it off the rekey queue.
+func (i *EfsIndex) ReplaceStoredPath(oldPath, newPath string) error {
+	err := i.Load()
+	if err != nil {
+		return err
+	}
+
+	for _, table := range []string{"chunk", "fileinfo", "fileversion"} {
+		_, err = i.db.Exec(`UPDATE `+table+` SET storedpath = ? WHERE storedpath = ?`, newPath, oldPath)
+		if err != nil {
+			return fmt.Errorf("could not update stored path: %w", err)
+		}
+	}
+
+	_, err = i.db.Exec(`DELETE FROM rekey WHERE storedpath = ?`, oldPath)
+	if err != nil {
+		return fmt.Errorf("could not dequeue stored path: %w", err)
+	}
+
+	return nil
+}
+
+// Persist the index without closing it, so a session that is interrupted later doesn't lose the changes made so far.
+// What is persisted becomes the new base for merging.
+func (i *EfsIndex) Checkpoint() error {
+	err := i.Load()
+	if err != nil {
+		return err
+	}
+
+	err = i.persist()
+	if err != nil {
+		return err
+	}
+
+	err = copyFile(i.unencryptedPath, i.basePath())
+	if err != nil {
+		return fmt.Errorf("cannot keep base copy of index: %w", err)
+	}
+
+	return nil
+}
+
 func (i *EfsIndex) Close() error {
 	if i.db == nil {
 		return nil
@@ -173,10 +826,9 @@ func (i *EfsIndex) Close() error {
 
 	i.db = nil
 
-	//encrypt
-	err = modifiers.CompressAndEncryptFile(i.unencryptedPath, i.encryptedPath, i.passphrase)
+	err = i.persist()
 	if err != nil {
-		return fmt.Errorf("cannot encrypt index: %w", err)
+		return err
 	}
 
 	//delete unencrypted index
@@ -184,11 +836,133 @@ func (i *EfsIndex) Close() error {
 	if err != nil {
 		return fmt.Errorf("cannot cleanup unencrypted index: %w", err)
 	}
+	os.Remove(i.basePath())
+
+	return nil
+}
+
+// Encrypt and write the index. If another client changed it since it was loaded, their changes are merged in first.
+func (i *EfsIndex) persist() error {
+	for attempt := 1; ; attempt++ {
+		current, err := fingerprintFile(i.encryptedPath)
+		if err != nil {
+			return fmt.Errorf("cannot check index: %w", err)
+		}
+
+		if current == i.fingerprint {
+			break
+		}
+
+		if attempt > maxMergeAttempts {
+			return errors.New("index keeps being changed by another client")
+		}
+
+		logger.Warn("remote index was changed by another client, merging")
+		err = i.merge(current)
+		if err != nil {
+			return fmt.Errorf("cannot merge index: %w", err)
+		}
+	}
+
+	//Write next to it and rename, so the index is never half written
+	tmpFile, err := os.CreateTemp(path.Dir(i.encryptedPath), ".buttercup-index-*.tmp")
+	if err != nil {
+		return fmt.Errorf("could not create temp file: %w", err)
+	}
+	tmpFile.Close()
+
+	err = modifiers.CompressAndEncryptFile(i.unencryptedPath, tmpFile.Name(), i.keys.ForIndex())
+	if err != nil {
+		os.Remove(tmpFile.Name())
+		return fmt.Errorf("cannot encrypt index: %w", err)
+	}
+
+	err = os.Rename(tmpFile.Name(), i.encryptedPath)
+	if err != nil {
+		os.Remove(tmpFile.Name())
+		return fmt.Errorf("cannot replace index: %w", err)
+	}
+
+	i.fingerprint, err = fingerprintFile(i.encryptedPath)
+	if err != nil {
+		return fmt.Errorf("cannot check index: %w", err)
+	}
+
+	return nil
+}
+
+// Merge the changes another client made into ours. The index they wrote becomes the new base.
+func (i *EfsIndex) merge(fingerprint string) error {
+	//Removed from the remote, ours replaces it
+	if fingerprint == "" {
+		i.fingerprint = ""
+		return nil
+	}
+
+	theirsPath := i.unencryptedPath + "-theirs"
+	os.Remove(theirsPath)
+	defer os.Remove(theirsPath)
+
+	err := modifiers.DecryptAndDecompressFile(i.encryptedPath, theirsPath, i.keys)
+	if err != nil {
+		return fmt.Errorf("error decrypting index file: %w", err)
+	}
+
+	revived, err := indexmerge.Merge(i.unencryptedPath, i.basePath(), theirsPath, prepare)
+	if err != nil {
+		return err
+	}
+	i.revived = append(i.revived, revived...)
+
+	err = os.Rename(theirsPath, i.basePath())
+	if err != nil {
+		return fmt.Errorf("cannot update base: %w", err)
+	}
+
+	i.fingerprint = fingerprint
+	return nil
+}
+
+// Stored paths that are in use again after merging changes of another client.
+// Blobs queued for deletion with these paths must be kept.
+func (i *EfsIndex) Revived() []string {
+	revived := i.revived
+	i.revived = nil
+	return revived
+}
+
+// Copy of the index as it was loaded, used as the common ancestor when merging.
+func (i *EfsIndex) basePath() string {
+	return i.unencryptedPath + "-base"
+}
+
+// Close the db without persisting it, and remove the unencrypted copy.
+func (i *EfsIndex) Discard() error {
+	if i.db != nil {
+		err := i.db.Close()
+		if err != nil {
+			return fmt.Errorf("cannot close db: %w", err)
+		}
+		i.db = nil
+	}
+
+	if i.unencryptedPath == "" {
+		return nil
+	}
+
+	os.Remove(i.basePath())
+	err := os.Remove(i.unencryptedPath)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("cannot cleanup unencrypted index: %w", err)
+	}
 
 	return nil
 }
 
 func (i *EfsIndex) Load() error {
+	i.loadMu.Lock()
+	defer i.loadMu.Unlock()
+
 	if i.db != nil {
 		return nil
 	}
@@ -204,25 +978,89 @@ func (i *EfsIndex) Load() error {
 		i.unencryptedPath = path.Join(os.TempDir(), "buttercup-"+randStr+".db")
 	}
 
-	_, err := os.Stat(i.encryptedPath)
-	if err == nil {
+	os.Remove(i.basePath())
+	fingerprint, err := fingerprintFile(i.encryptedPath)
+	if err != nil {
+		return fmt.Errorf("cannot check index: %w", err)
+	}
+
+	if fingerprint != "" {
 		//Decrypt the db
-		err := modifiers.DecryptAndDecompressFile(i.encryptedPath, i.unencryptedPath, i.passphrase)
+		err := modifiers.DecryptAndDecompressFile(i.encryptedPath, i.unencryptedPath, i.keys)
 		if err != nil {
 			return fmt.Errorf("error decrypting index file: %w", err)
 		}
+
+		err = copyFile(i.unencryptedPath, i.basePath())
+		if err != nil {
+			return fmt.Errorf("cannot keep base copy of index: %w", err)
+		}
 	}
+	i.fingerprint = fingerprint
 
 	//create connection
 	conn, err := sql.Open("sqlite3", i.unencryptedPath)
 	if err != nil {
 		return fmt.Errorf("cannot connect to sqlite db: %w", err)
 	}
+	//sqlite doesn't handle concurrent writers, so everything goes through one connection
+	conn.SetMaxOpenConns(1)
 	i.db = conn
 
-	_, err = conn.Exec(createScript)
+	return prepare(conn)
+}
+
+// Bring a database up to the current schema.
+func prepare(conn *sql.DB) error {
+	_, err := conn.Exec(createScript)
 	if err != nil {
 		return fmt.Errorf("cannot run create script: %w", err)
 	}
+
+	err = migrate.Run(conn, migrations)
+	if err != nil {
+		return fmt.Errorf("cannot migrate db: %w", err)
+	}
 	return nil
 }
+
+// Hex encoded sha256 of a file, or an empty string if it doesn't exist.
+func fingerprintFile(filePath string) (string, error) {
+	file, err := os.Open(filePath)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	_, err = io.Copy(hash, file)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func copyFile(src, dst string) error {
+	reader, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	writer, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(writer, reader)
+	if err != nil {
+		writer.Close()
+		return err
+	}
+
+	return writer.Close()
+}
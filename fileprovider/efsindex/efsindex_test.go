@@ -7,8 +7,10 @@ import (
 	"os"
 	"path"
 	"testing"
+	"time"
 
 	"github.com/c00/buttercup/logger"
+	"github.com/c00/buttercup/modifiers"
 	"github.com/joho/godotenv"
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/stretchr/testify/assert"
@@ -21,7 +23,7 @@ func createDb() (string, *EfsIndex) {
 	dbPath := path.Join(os.Getenv("TEST_CONF_PATH"), fmt.Sprintf("buttercup-test-%v.db", nr))
 	logger.Debug("db path: %v", dbPath)
 	os.Remove(dbPath)
-	db := New(dbPath, "foo")
+	db := New(dbPath, testKeys)
 	err := db.Load()
 	if err != nil {
 		panic("db cannot be openeed: " + err.Error())
@@ -76,6 +78,10 @@ func TestExisting(t *testing.T) {
 	fi := EfsFileInfo{
 		Path:       "/foo.txt",
 		StoredPath: "some/encrypted/path",
+		Mode:       0755,
+		Owner:      "1000:1000",
+		Xattrs:     `{"user.color":"cmVk"}`,
+		Type:       "symlink",
 	}
 
 	err := db.SetFileInfo(fi)
@@ -83,7 +89,7 @@ func TestExisting(t *testing.T) {
 
 	assert.Nil(t, db.Close())
 
-	newDb := New(dbPath, "foo")
+	newDb := New(dbPath, testKeys)
 	defer newDb.Close()
 
 	gotten, err := newDb.GetFileInfo("/foo.txt")
@@ -136,9 +142,299 @@ func TestMarkDeleted(t *testing.T) {
 	assert.True(t, fi.Deleted)
 }
 
+func TestChunks(t *testing.T) {
+	dbPath, db := createDb()
+	defer cleanupDb(dbPath, db)
+
+	assert.Nil(t, db.AddChunk("aaa", "stored/a", 10))
+	assert.Nil(t, db.AddChunk("bbb", "stored/b", 10))
+	//Adding twice is fine
+	assert.Nil(t, db.AddChunk("aaa", "stored/other", 10))
+
+	storedPath, err := db.GetChunkPath("aaa")
+	assert.Nil(t, err)
+	assert.Equal(t, storedPath, "stored/a")
+
+	_, err = db.GetChunkPath("ccc")
+	assert.NotNil(t, err)
+
+	released, err := db.SetFileChunks("/foo.txt", []string{"bbb", "aaa", "bbb"})
+	assert.Nil(t, err)
+	assert.Len(t, released, 0)
+
+	paths, err := db.GetFileChunks("/foo.txt")
+	assert.Nil(t, err)
+	assert.Equal(t, paths, []string{"stored/b", "stored/a", "stored/b"})
+
+	released, err = db.SetFileChunks("/foo.txt", []string{"aaa"})
+	assert.Nil(t, err)
+	assert.Equal(t, released, []string{"bbb"})
+
+	//Only unused chunks get deleted
+	_, deleted, err := db.DeleteChunkIfUnused("aaa")
+	assert.Nil(t, err)
+	assert.False(t, deleted)
+
+	storedPath, deleted, err = db.DeleteChunkIfUnused("bbb")
+	assert.Nil(t, err)
+	assert.True(t, deleted)
+	assert.Equal(t, storedPath, "stored/b")
+
+	//Chunks move with their file
+	assert.Nil(t, db.SetFileInfo(getFileInfo("/foo.txt")))
+	assert.Nil(t, db.UpdatePath("/foo.txt", "/bar.txt"))
+	paths, err = db.GetFileChunks("/bar.txt")
+	assert.Nil(t, err)
+	assert.Equal(t, paths, []string{"stored/a"})
+}
+
+func TestPackedChunks(t *testing.T) {
+	dbPath, db := createDb()
+	defer cleanupDb(dbPath, db)
+
+	assert.Nil(t, db.AddPackedChunk("aaa", "stored/pack", 0, 10))
+	assert.Nil(t, db.AddPackedChunk("bbb", "stored/pack", 10, 5))
+	assert.Nil(t, db.AddChunk("ccc", "stored/c", 600))
+
+	_, err := db.SetFileChunks("/foo.txt", []string{"ccc", "bbb"})
+	assert.Nil(t, err)
+	_, err = db.SetFileChunks("/bar.txt", []string{"aaa"})
+	assert.Nil(t, err)
+
+	paths, err := db.GetFileChunks("/foo.txt")
+	assert.Nil(t, err)
+	assert.Equal(t, paths, []string{"stored/c", "stored/pack#10+5"})
+
+	records, err := db.GetFileChunkRecords("/bar.txt")
+	assert.Nil(t, err)
+	assert.Equal(t, records, []EfsChunk{{Hash: "aaa", StoredPath: "stored/pack", Size: 10, Packed: true}})
+
+	//The pack stays until none of its chunks are used
+	_, err = db.SetFileChunks("/foo.txt", nil)
+	assert.Nil(t, err)
+	storedPath, deleted, err := db.DeleteChunkIfUnused("bbb")
+	assert.Nil(t, err)
+	assert.False(t, deleted)
+	assert.Equal(t, storedPath, "stored/pack")
+
+	_, err = db.SetFileChunks("/bar.txt", nil)
+	assert.Nil(t, err)
+	storedPath, deleted, err = db.DeleteChunkIfUnused("aaa")
+	assert.Nil(t, err)
+	assert.True(t, deleted)
+	assert.Equal(t, storedPath, "stored/pack")
+}
+
+func TestVersions(t *testing.T) {
+	dbPath, db := createDb()
+	defer cleanupDb(dbPath, db)
+
+	//Nothing to archive yet
+	assert.Nil(t, db.ArchiveVersion("/foo.txt"))
+
+	assert.Nil(t, db.AddChunk("aaa", "stored/a", 10))
+	assert.Nil(t, db.AddChunk("bbb", "stored/b", 10))
+
+	assert.Nil(t, db.SetFileInfo(EfsFileInfo{Path: "/foo.txt", Hash: "first", Client: "one"}))
+	_, err := db.SetFileChunks("/foo.txt", []string{"aaa", "bbb"})
+	assert.Nil(t, err)
+	assert.Nil(t, db.ArchiveVersion("/foo.txt"))
+
+	assert.Nil(t, db.SetFileInfo(EfsFileInfo{Path: "/foo.txt", Hash: "second", Client: "two"}))
+	released, err := db.SetFileChunks("/foo.txt", []string{"aaa"})
+	assert.Nil(t, err)
+	assert.Equal(t, released, []string{"bbb"})
+	assert.Nil(t, db.ArchiveVersion("/foo.txt"))
+
+	versions, err := db.GetVersions("/foo.txt")
+	assert.Nil(t, err)
+	assert.Len(t, versions, 2)
+	assert.Equal(t, versions[0].Hash, "second")
+	assert.Equal(t, versions[1].Hash, "first")
+	assert.Equal(t, versions[1].Client, "one")
+
+	v, err := db.GetVersion(versions[1].ID)
+	assert.Nil(t, err)
+	assert.Equal(t, v, versions[1])
+
+	paths, err := db.GetVersionChunks(versions[1].ID)
+	assert.Nil(t, err)
+	assert.Equal(t, paths, []string{"stored/a", "stored/b"})
+
+	//Chunks that are only used by an old version are kept
+	_, deleted, err := db.DeleteChunkIfUnused("bbb")
+	assert.Nil(t, err)
+	assert.False(t, deleted)
+}
+
+func TestDeleteVersion(t *testing.T) {
+	dbPath, db := createDb()
+	defer cleanupDb(dbPath, db)
+
+	assert.Nil(t, db.AddChunk("aaa", "stored/a", 10))
+	assert.Nil(t, db.AddChunk("bbb", "stored/b", 10))
+	assert.Nil(t, db.AddChunk("ccc", "stored/c", 10))
+
+	assert.Nil(t, db.SetFileInfo(EfsFileInfo{Path: "/foo.txt", StoredPath: "stored/legacy"}))
+	assert.Nil(t, db.ArchiveVersion("/foo.txt"))
+	assert.Nil(t, db.SetFileInfo(EfsFileInfo{Path: "/foo.txt"}))
+	_, err := db.SetFileChunks("/foo.txt", []string{"aaa", "bbb"})
+	assert.Nil(t, err)
+	assert.Nil(t, db.ArchiveVersion("/foo.txt"))
+	assert.Nil(t, db.SetFileInfo(EfsFileInfo{Path: "/bar.txt"}))
+	assert.Nil(t, db.ArchiveVersion("/bar.txt"))
+
+	paths, err := db.GetVersionedPaths("", 10)
+	assert.Nil(t, err)
+	assert.Equal(t, paths, []string{"/bar.txt", "/foo.txt"})
+
+	paths, err = db.GetVersionedPaths("/bar.txt", 10)
+	assert.Nil(t, err)
+	assert.Equal(t, paths, []string{"/foo.txt"})
+
+	storedPaths, err := db.GetStoredPaths()
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, storedPaths, []string{"stored/a", "stored/b", "stored/c", "stored/legacy"})
+
+	unused, err := db.GetUnusedChunks()
+	assert.Nil(t, err)
+	assert.Equal(t, unused, []string{"ccc"})
+
+	versions, err := db.GetVersions("/foo.txt")
+	assert.Nil(t, err)
+	assert.Len(t, versions, 2)
+
+	storedPath, hashes, err := db.DeleteVersion(versions[1].ID)
+	assert.Nil(t, err)
+	assert.Equal(t, storedPath, "stored/legacy")
+	assert.Len(t, hashes, 0)
+
+	storedPath, hashes, err = db.DeleteVersion(versions[0].ID)
+	assert.Nil(t, err)
+	assert.Equal(t, storedPath, "")
+	assert.ElementsMatch(t, hashes, []string{"aaa", "bbb"})
+
+	_, _, err = db.DeleteVersion(versions[0].ID)
+	assert.NotNil(t, err)
+
+	//Still used by the current file
+	unused, err = db.GetUnusedChunks()
+	assert.Nil(t, err)
+	assert.Equal(t, unused, []string{"ccc"})
+}
+
+func TestMergeOnClose(t *testing.T) {
+	dbPath, db := createDb()
+	defer cleanupDb(dbPath, db)
+
+	assert.Nil(t, db.AddChunk("aaa", "stored/a", 10))
+	assert.Nil(t, db.SetFileInfo(EfsFileInfo{Path: "/shared.txt", Hash: "base", Created: time.Now().Add(-time.Hour)}))
+	assert.Nil(t, db.SetFileInfo(EfsFileInfo{Path: "/theirs.txt", Hash: "base"}))
+	assert.Nil(t, db.Close())
+
+	//Two clients load the same index
+	ours := New(dbPath, testKeys)
+	assert.Nil(t, ours.Load())
+	theirs := New(dbPath, testKeys)
+	assert.Nil(t, theirs.Load())
+
+	assert.Nil(t, theirs.AddChunk("bbb", "stored/b", 10))
+	assert.Nil(t, theirs.SetFileInfo(EfsFileInfo{Path: "/new-theirs.txt", Hash: "b"}))
+	_, err := theirs.SetFileChunks("/new-theirs.txt", []string{"bbb"})
+	assert.Nil(t, err)
+	assert.Nil(t, theirs.SetFileInfo(EfsFileInfo{Path: "/theirs.txt", Hash: "changed"}))
+	assert.Nil(t, theirs.ArchiveVersion("/shared.txt"))
+	assert.Nil(t, theirs.SetFileInfo(EfsFileInfo{Path: "/shared.txt", Hash: "theirs", Created: time.Now().Add(-time.Minute)}))
+	assert.Nil(t, theirs.Close())
+
+	assert.Nil(t, ours.SetFileInfo(EfsFileInfo{Path: "/new-ours.txt", Hash: "a"}))
+	assert.Nil(t, ours.ArchiveVersion("/shared.txt"))
+	assert.Nil(t, ours.SetFileInfo(EfsFileInfo{Path: "/shared.txt", Hash: "ours", Created: time.Now()}))
+	assert.Nil(t, ours.Close())
+	assert.Equal(t, ours.Revived(), []string{"stored/b"})
+
+	merged := New(dbPath, testKeys)
+	defer merged.Discard()
+
+	infos, err := merged.GetPage(0, 100)
+	assert.Nil(t, err)
+	hashes := map[string]string{}
+	for _, fi := range infos {
+		hashes[fi.Path] = fi.Hash
+	}
+	assert.Equal(t, hashes, map[string]string{
+		"/new-ours.txt":   "a",
+		"/new-theirs.txt": "b",
+		"/theirs.txt":     "changed",
+		//Written last
+		"/shared.txt": "ours",
+	})
+
+	paths, err := merged.GetFileChunks("/new-theirs.txt")
+	assert.Nil(t, err)
+	assert.Equal(t, paths, []string{"stored/b"})
+
+	//Both archived the base version, and their version is kept as well
+	versions, err := merged.GetVersions("/shared.txt")
+	assert.Nil(t, err)
+	assert.Len(t, versions, 3)
+	assert.Equal(t, versions[0].Hash, "theirs")
+}
+
+func TestRekey(t *testing.T) {
+	dbPath, db := createDb()
+	defer cleanupDb(dbPath, db)
+
+	assert.Nil(t, db.AddChunk("aaa", "stored/a", 10))
+	assert.Nil(t, db.AddChunk("bbb", "stored/b", 10))
+	fi := getFileInfo("/legacy.txt")
+	fi.StoredPath = "stored/legacy"
+	assert.Nil(t, db.SetFileInfo(fi))
+
+	queued, err := db.StartRekey()
+	assert.Nil(t, err)
+	assert.Equal(t, queued, 3)
+
+	paths, err := db.GetRekeyPaths(2)
+	assert.Nil(t, err)
+	assert.Equal(t, paths, []string{"stored/a", "stored/b"})
+
+	assert.Nil(t, db.ReplaceStoredPath("stored/a", "stored/new-a"))
+	assert.Nil(t, db.ReplaceStoredPath("stored/legacy", "stored/new-legacy"))
+
+	storedPath, err := db.GetChunkPath("aaa")
+	assert.Nil(t, err)
+	assert.Equal(t, storedPath, "stored/new-a")
+	fi, err = db.GetFileInfo("/legacy.txt")
+	assert.Nil(t, err)
+	assert.Equal(t, fi.StoredPath, "stored/new-legacy")
+
+	//Starting again continues with what is left
+	queued, err = db.StartRekey()
+	assert.Nil(t, err)
+	assert.Equal(t, queued, 1)
+	paths, err = db.GetRekeyPaths(10)
+	assert.Nil(t, err)
+	assert.Equal(t, paths, []string{"stored/b"})
+
+	//Until it is finished, a rekey that re-encrypted everything has nothing left
+	assert.Nil(t, db.ReplaceStoredPath("stored/b", "stored/new-b"))
+	queued, err = db.StartRekey()
+	assert.Nil(t, err)
+	assert.Equal(t, queued, 0)
+
+	//Once finished, everything is queued again
+	assert.Nil(t, db.FinishRekey())
+	queued, err = db.StartRekey()
+	assert.Nil(t, err)
+	assert.Equal(t, queued, 3)
+}
+
 func getFileInfo(path string) EfsFileInfo {
 	return EfsFileInfo{
 		Path:       path,
 		StoredPath: "some/encrypted/path",
 	}
 }
+
+var testKeys, _ = modifiers.PassphraseKeys("foo")
@@ -7,3 +7,24 @@ const createScript = `CREATE TABLE IF NOT EXISTS fileinfo (
 	deleted BOOLEAN NOT NULL,
 	trackingvalue INTEGER NULL
 );`
+
+// Schema changes on top of createScript. Only ever append to this list.
+var migrations = []string{
+	`ALTER TABLE fileinfo ADD COLUMN hash TEXT NOT NULL DEFAULT '';`,
+	`ALTER TABLE fileinfo ADD COLUMN size INTEGER NOT NULL DEFAULT 0;`,
+	`ALTER TABLE fileinfo ADD COLUMN modtime DATETIME NOT NULL DEFAULT '0001-01-01 00:00:00+00:00';`,
+	`ALTER TABLE fileinfo ADD COLUMN inode INTEGER NOT NULL DEFAULT 0;`,
+	`CREATE TABLE journal (
+		path TEXT PRIMARY KEY NOT NULL,
+		lastsynced DATETIME NOT NULL
+	);`,
+	`CREATE TABLE journalchunk (
+		hash TEXT PRIMARY KEY NOT NULL,
+		storedpath TEXT NOT NULL,
+		size INTEGER NOT NULL
+	);`,
+	`ALTER TABLE fileinfo ADD COLUMN mode INTEGER NOT NULL DEFAULT 0;`,
+	`ALTER TABLE fileinfo ADD COLUMN owner TEXT NOT NULL DEFAULT '';`,
+	`ALTER TABLE fileinfo ADD COLUMN xattrs TEXT NOT NULL DEFAULT '';`,
+	`ALTER TABLE fileinfo ADD COLUMN type TEXT NOT NULL DEFAULT '';`,
+}
@@ -4,8 +4,10 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"sync"
 	"time"
 
+	"github.com/c00/buttercup/internal/migrate"
 	_ "github.com/mattn/go-sqlite3"
 )
 
@@ -15,6 +17,21 @@ type FsFileInfo struct {
 	Updated       time.Time
 	Deleted       bool
 	TrackingValue int64
+	// Hex encoded sha256 of the content
+	Hash string
+	Size int64
+	// Modification time on disk when the file was last hashed
+	ModTime time.Time
+	// Inode of the file when it was last hashed. 0 if unknown.
+	Inode int64
+	// Permission bits. 0 if unknown.
+	Mode uint32
+	// Owner and group as "uid:gid". Empty if unknown.
+	Owner string
+	// Encoded extended attributes
+	Xattrs string
+	// Empty for files, "dir" or "symlink" otherwise
+	Type string
 }
 
 func New(path string) *FsIndex {
@@ -24,6 +41,8 @@ func New(path string) *FsIndex {
 type FsIndex struct {
 	path string
 	db   *sql.DB
+	//Guards loading the db, providers are used from several goroutines
+	loadMu sync.Mutex
 }
 
 func (i *FsIndex) MarkDeleted(trackingValue int64) error {
@@ -62,9 +81,9 @@ func (i *FsIndex) GetFileInfo(path string) (FsFileInfo, error) {
 		return FsFileInfo{}, err
 	}
 
-	row := i.db.QueryRow(`SELECT path, lastsynced, updated, deleted, trackingvalue FROM fileinfo WHERE path = ?`, path)
+	row := i.db.QueryRow(`SELECT path, lastsynced, updated, deleted, trackingvalue, hash, size, modtime, inode, mode, owner, xattrs, type FROM fileinfo WHERE path = ?`, path)
 	fi := FsFileInfo{}
-	err = row.Scan(&fi.Path, &fi.LastSynced, &fi.Updated, &fi.Deleted, &fi.TrackingValue)
+	err = row.Scan(&fi.Path, &fi.LastSynced, &fi.Updated, &fi.Deleted, &fi.TrackingValue, &fi.Hash, &fi.Size, &fi.ModTime, &fi.Inode, &fi.Mode, &fi.Owner, &fi.Xattrs, &fi.Type)
 	if err != nil {
 		return FsFileInfo{}, fmt.Errorf("error querying database: %w", err)
 	}
@@ -79,14 +98,22 @@ func (i *FsIndex) SetFileInfo(fi FsFileInfo) error {
 	}
 
 	_, err = i.db.Exec(
-		`INSERT INTO fileinfo (path, lastsynced, updated, deleted, trackingvalue)
-		 VALUES (?, ?, ?, ?, ?)
+		`INSERT INTO fileinfo (path, lastsynced, updated, deleted, trackingvalue, hash, size, modtime, inode, mode, owner, xattrs, type)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 		 ON CONFLICT(Path) DO UPDATE SET 
 			lastsynced = excluded.lastsynced,
 			updated = excluded.updated,
 			deleted = excluded.deleted,
-			trackingvalue = excluded.trackingvalue;`,
-		fi.Path, fi.LastSynced, fi.Updated, fi.Deleted, fi.TrackingValue,
+			trackingvalue = excluded.trackingvalue,
+			hash = excluded.hash,
+			size = excluded.size,
+			modtime = excluded.modtime,
+			inode = excluded.inode,
+			mode = excluded.mode,
+			owner = excluded.owner,
+			xattrs = excluded.xattrs,
+			type = excluded.type;`,
+		fi.Path, fi.LastSynced, fi.Updated, fi.Deleted, fi.TrackingValue, fi.Hash, fi.Size, fi.ModTime, fi.Inode, fi.Mode, fi.Owner, fi.Xattrs, fi.Type,
 	)
 	if err != nil {
 		return fmt.Errorf("cannot insert: %w", err)
@@ -124,7 +151,7 @@ func (i *FsIndex) GetPage(offset, limit int) ([]FsFileInfo, error) {
 		limit = -1
 	}
 
-	sql := "SELECT path, lastsynced, updated, deleted, trackingvalue FROM fileinfo LIMIT ?"
+	sql := "SELECT path, lastsynced, updated, deleted, trackingvalue, hash, size, modtime, inode, mode, owner, xattrs, type FROM fileinfo ORDER BY path LIMIT ?"
 	values := []any{limit}
 
 	if offset > 0 {
@@ -136,12 +163,13 @@ func (i *FsIndex) GetPage(offset, limit int) ([]FsFileInfo, error) {
 	if err != nil {
 		return nil, fmt.Errorf("could not get rows: %w", err)
 	}
+	defer rows.Close()
 
 	results := []FsFileInfo{}
 
 	for rows.Next() {
 		fi := FsFileInfo{}
-		err = rows.Scan(&fi.Path, &fi.LastSynced, &fi.Updated, &fi.Deleted, &fi.TrackingValue)
+		err = rows.Scan(&fi.Path, &fi.LastSynced, &fi.Updated, &fi.Deleted, &fi.TrackingValue, &fi.Hash, &fi.Size, &fi.ModTime, &fi.Inode, &fi.Mode, &fi.Owner, &fi.Xattrs, &fi.Type)
 		if err != nil {
 			return nil, fmt.Errorf("error scanning rows: %w", err)
 		}
@@ -167,6 +195,9 @@ func (i *FsIndex) Close() error {
 }
 
 func (i *FsIndex) Load() error {
+	i.loadMu.Lock()
+	defer i.loadMu.Unlock()
+
 	if i.db != nil {
 		return nil
 	}
@@ -176,11 +207,18 @@ func (i *FsIndex) Load() error {
 	if err != nil {
 		return fmt.Errorf("cannot connect to sqlite db: %w", err)
 	}
+	//sqlite doesn't handle concurrent writers, so everything goes through one connection
+	conn.SetMaxOpenConns(1)
 	i.db = conn
 
 	_, err = conn.Exec(createScript)
 	if err != nil {
 		return fmt.Errorf("cannot run create script: %w", err)
 	}
+
+	err = migrate.Run(conn, migrations)
+	if err != nil {
+		return fmt.Errorf("cannot migrate db: %w", err)
+	}
 	return nil
 }
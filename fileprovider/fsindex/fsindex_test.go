@@ -2,6 +2,7 @@ package fsindex
 
 import (
 	"testing"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/stretchr/testify/assert"
@@ -11,7 +12,11 @@ func TestBasics(t *testing.T) {
 	db := New(":memory:")
 
 	fi := FsFileInfo{
-		Path: "/foo.txt",
+		Path:   "/foo.txt",
+		Mode:   0644,
+		Owner:  "0:0",
+		Xattrs: `{"user.color":"cmVk"}`,
+		Type:   "dir",
 	}
 
 	err := db.SetFileInfo(fi)
@@ -49,6 +54,8 @@ func TestGetPage(t *testing.T) {
 	infos, err := db.GetPage(0, 0)
 	assert.Nil(t, err)
 	assert.Len(t, infos, 3)
+	assert.Equal(t, infos[0].Path, "/Ankle.txt")
+	assert.Equal(t, infos[2].Path, "/Clarinet.txt")
 
 	infos, err = db.GetPage(1, 1)
 	assert.Nil(t, err)
@@ -87,3 +94,77 @@ func getFileInfo(path string) FsFileInfo {
 		Path: path,
 	}
 }
+
+func TestScan(t *testing.T) {
+	db := New(t.TempDir() + "/index.db")
+	defer db.Close()
+
+	assert.Nil(t, db.SetFileInfo(FsFileInfo{Path: "/keep.txt", Hash: "a"}))
+	assert.Nil(t, db.SetFileInfo(FsFileInfo{Path: "/gone.txt", Hash: "b"}))
+	assert.Nil(t, db.SetFileInfo(FsFileInfo{Path: "/dir/gone.txt", Hash: "c"}))
+	assert.Nil(t, db.SetFileInfo(FsFileInfo{Path: "/director.txt", Hash: "d"}))
+
+	//Only scan /dir, files outside of it are left alone
+	scan, err := db.StartScan()
+	assert.Nil(t, err)
+	_, found, err := scan.Get("/dir/new.txt")
+	assert.Nil(t, err)
+	assert.False(t, found)
+	assert.Nil(t, scan.Set(FsFileInfo{Path: "/dir/new.txt", Hash: "e"}))
+	assert.Nil(t, scan.Finish("/dir"))
+
+	for path, deleted := range map[string]bool{"/keep.txt": false, "/gone.txt": false, "/dir/gone.txt": true, "/dir/new.txt": false, "/director.txt": false} {
+		fi, err := db.GetFileInfo(path)
+		assert.Nil(t, err)
+		assert.Equal(t, fi.Deleted, deleted, path)
+	}
+
+	//Scan everything
+	scan, err = db.StartScan()
+	assert.Nil(t, err)
+	fi, found, err := scan.Get("/keep.txt")
+	assert.Nil(t, err)
+	assert.True(t, found)
+	assert.Equal(t, fi.Hash, "a")
+	assert.Nil(t, scan.Finish())
+	assert.Nil(t, scan.Abort())
+
+	for path, deleted := range map[string]bool{"/keep.txt": false, "/gone.txt": true, "/dir/new.txt": true, "/director.txt": true} {
+		fi, err := db.GetFileInfo(path)
+		assert.Nil(t, err)
+		assert.Equal(t, fi.Deleted, deleted, path)
+	}
+}
+
+func TestJournal(t *testing.T) {
+	db := New(t.TempDir() + "/index.db")
+	defer db.Close()
+
+	first := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	second := time.Date(2024, 1, 2, 12, 0, 0, 0, time.UTC)
+
+	assert.Nil(t, db.AddJournalEntry(JournalEntry{Path: "/foo.txt", LastSynced: first}))
+	//The date from before the first attempt is kept
+	assert.Nil(t, db.AddJournalEntry(JournalEntry{Path: "/foo.txt", LastSynced: second}))
+	assert.Nil(t, db.AddJournalChunks([]JournalChunk{{Hash: "a", StoredPath: "aa/aa", Size: 1}, {Hash: "b", StoredPath: "bb/bb", Size: 2}}))
+	assert.Nil(t, db.AddJournalChunks([]JournalChunk{{Hash: "a", StoredPath: "aa/aa", Size: 1}}))
+
+	entries, chunks, err := db.GetJournal()
+	assert.Nil(t, err)
+	assert.Equal(t, len(entries), 1)
+	assert.Equal(t, entries[0].Path, "/foo.txt")
+	assert.True(t, entries[0].LastSynced.Equal(first))
+	assert.Equal(t, chunks, []JournalChunk{{Hash: "a", StoredPath: "aa/aa", Size: 1}, {Hash: "b", StoredPath: "bb/bb", Size: 2}})
+
+	assert.Nil(t, db.ClearJournalEntries())
+	entries, chunks, err = db.GetJournal()
+	assert.Nil(t, err)
+	assert.Equal(t, len(entries), 0)
+	assert.Equal(t, len(chunks), 2)
+
+	assert.Nil(t, db.ClearJournal())
+	entries, chunks, err = db.GetJournal()
+	assert.Nil(t, err)
+	assert.Equal(t, len(entries), 0)
+	assert.Equal(t, len(chunks), 0)
+}
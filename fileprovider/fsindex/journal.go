@@ -0,0 +1,148 @@
+package fsindex
+
+import (
+	"fmt"
+	"time"
+)
+
+// A file that was being pushed, with its lastSynced date from before the push.
+type JournalEntry struct {
+	Path       string
+	LastSynced time.Time
+}
+
+// A chunk that was uploaded to the remote during a push.
+type JournalChunk struct {
+	Hash       string
+	StoredPath string
+	Size       int64
+}
+
+// Record that a file is about to be pushed. If the file is in the journal already, the earlier entry is kept.
+func (i *FsIndex) AddJournalEntry(entry JournalEntry) error {
+	err := i.Load()
+	if err != nil {
+		return err
+	}
+
+	_, err = i.db.Exec(`INSERT OR IGNORE INTO journal (path, lastsynced) VALUES (?, ?)`, entry.Path, entry.LastSynced)
+	if err != nil {
+		return fmt.Errorf("cannot insert journal entry: %w", err)
+	}
+
+	return nil
+}
+
+// Record chunks that were uploaded.
+func (i *FsIndex) AddJournalChunks(chunks []JournalChunk) error {
+	err := i.Load()
+	if err != nil {
+		return err
+	}
+
+	tx, err := i.db.Begin()
+	if err != nil {
+		return fmt.Errorf("cannot start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	for _, chunk := range chunks {
+		_, err = tx.Exec(`INSERT OR IGNORE INTO journalchunk (hash, storedpath, size) VALUES (?, ?, ?)`, chunk.Hash, chunk.StoredPath, chunk.Size)
+		if err != nil {
+			return fmt.Errorf("cannot insert journal chunk: %w", err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Get the files and chunks in the journal.
+func (i *FsIndex) GetJournal() ([]JournalEntry, []JournalChunk, error) {
+	err := i.Load()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	//One at a time, there is only one connection
+	entries, err := i.getJournalEntries()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	chunks, err := i.getJournalChunks()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return entries, chunks, nil
+}
+
+func (i *FsIndex) getJournalEntries() ([]JournalEntry, error) {
+	rows, err := i.db.Query(`SELECT path, lastsynced FROM journal ORDER BY path`)
+	if err != nil {
+		return nil, fmt.Errorf("could not get journal: %w", err)
+	}
+	defer rows.Close()
+
+	entries := []JournalEntry{}
+	for rows.Next() {
+		entry := JournalEntry{}
+		err = rows.Scan(&entry.Path, &entry.LastSynced)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning rows: %w", err)
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, rows.Err()
+}
+
+func (i *FsIndex) getJournalChunks() ([]JournalChunk, error) {
+	rows, err := i.db.Query(`SELECT hash, storedpath, size FROM journalchunk ORDER BY hash`)
+	if err != nil {
+		return nil, fmt.Errorf("could not get journal chunks: %w", err)
+	}
+	defer rows.Close()
+
+	chunks := []JournalChunk{}
+	for rows.Next() {
+		chunk := JournalChunk{}
+		err = rows.Scan(&chunk.Hash, &chunk.StoredPath, &chunk.Size)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning rows: %w", err)
+		}
+		chunks = append(chunks, chunk)
+	}
+
+	return chunks, rows.Err()
+}
+
+// Forget the files in the journal, but keep the chunks.
+func (i *FsIndex) ClearJournalEntries() error {
+	err := i.Load()
+	if err != nil {
+		return err
+	}
+
+	_, err = i.db.Exec(`DELETE FROM journal`)
+	if err != nil {
+		return fmt.Errorf("cannot clear journal: %w", err)
+	}
+
+	return nil
+}
+
+// Forget everything in the journal, once the remote index has the changes.
+func (i *FsIndex) ClearJournal() error {
+	err := i.Load()
+	if err != nil {
+		return err
+	}
+
+	_, err = i.db.Exec(`DELETE FROM journal; DELETE FROM journalchunk;`)
+	if err != nil {
+		return fmt.Errorf("cannot clear journal: %w", err)
+	}
+
+	return nil
+}
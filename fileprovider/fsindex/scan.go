@@ -0,0 +1,147 @@
+package fsindex
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Start comparing the index to the filesystem. Everything happens in one transaction,
+// only files that changed are written, and files that were not seen are marked as deleted when the scan is finished.
+func (i *FsIndex) StartScan() (*Scan, error) {
+	err := i.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := i.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("cannot start transaction: %w", err)
+	}
+
+	s := &Scan{tx: tx}
+	err = s.prepare()
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+type Scan struct {
+	tx     *sql.Tx
+	get    *sql.Stmt
+	set    *sql.Stmt
+	seen   *sql.Stmt
+	closed bool
+}
+
+func (s *Scan) prepare() error {
+	_, err := s.tx.Exec(`CREATE TEMP TABLE IF NOT EXISTS seen (path TEXT PRIMARY KEY NOT NULL)`)
+	if err != nil {
+		return fmt.Errorf("cannot create seen table: %w", err)
+	}
+	_, err = s.tx.Exec(`DELETE FROM temp.seen`)
+	if err != nil {
+		return fmt.Errorf("cannot clear seen table: %w", err)
+	}
+
+	s.get, err = s.tx.Prepare(`SELECT path, lastsynced, updated, deleted, trackingvalue, hash, size, modtime, inode, mode, owner, xattrs, type FROM fileinfo WHERE path = ?`)
+	if err != nil {
+		return fmt.Errorf("cannot prepare query: %w", err)
+	}
+
+	s.set, err = s.tx.Prepare(`INSERT INTO fileinfo (path, lastsynced, updated, deleted, trackingvalue, hash, size, modtime, inode, mode, owner, xattrs, type)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(path) DO UPDATE SET
+			updated = excluded.updated,
+			deleted = excluded.deleted,
+			hash = excluded.hash,
+			size = excluded.size,
+			modtime = excluded.modtime,
+			inode = excluded.inode,
+			mode = excluded.mode,
+			owner = excluded.owner,
+			xattrs = excluded.xattrs,
+			type = excluded.type;`)
+	if err != nil {
+		return fmt.Errorf("cannot prepare insert: %w", err)
+	}
+
+	s.seen, err = s.tx.Prepare(`INSERT OR IGNORE INTO temp.seen (path) VALUES (?)`)
+	if err != nil {
+		return fmt.Errorf("cannot prepare insert: %w", err)
+	}
+
+	return nil
+}
+
+// Get the indexed info of a file, and mark it as seen. Returns false if the file is not in the index yet.
+func (s *Scan) Get(path string) (FsFileInfo, bool, error) {
+	_, err := s.seen.Exec(path)
+	if err != nil {
+		return FsFileInfo{}, false, fmt.Errorf("cannot mark as seen: %w", err)
+	}
+
+	fi := FsFileInfo{}
+	err = s.get.QueryRow(path).Scan(&fi.Path, &fi.LastSynced, &fi.Updated, &fi.Deleted, &fi.TrackingValue, &fi.Hash, &fi.Size, &fi.ModTime, &fi.Inode, &fi.Mode, &fi.Owner, &fi.Xattrs, &fi.Type)
+	if errors.Is(err, sql.ErrNoRows) {
+		return FsFileInfo{}, false, nil
+	}
+	if err != nil {
+		return FsFileInfo{}, false, fmt.Errorf("error querying database: %w", err)
+	}
+
+	return fi, true, nil
+}
+
+// Store a new or changed file. Leaves lastsynced alone for files that are already indexed.
+func (s *Scan) Set(fi FsFileInfo) error {
+	_, err := s.set.Exec(fi.Path, fi.LastSynced, fi.Updated, fi.Deleted, fi.TrackingValue, fi.Hash, fi.Size, fi.ModTime, fi.Inode, fi.Mode, fi.Owner, fi.Xattrs, fi.Type)
+	if err != nil {
+		return fmt.Errorf("cannot store file info: %w", err)
+	}
+
+	return nil
+}
+
+// Mark the files under the scanned paths that were not seen as deleted, and commit.
+// Scanned paths are files or folders relative to the root, starting with a slash. With no paths, the whole folder was scanned.
+func (s *Scan) Finish(scanned ...string) error {
+	where := "deleted = 0 AND path NOT IN (SELECT path FROM temp.seen)"
+	values := []any{}
+
+	if len(scanned) > 0 {
+		conditions := []string{}
+		for _, p := range scanned {
+			p = strings.TrimSuffix(p, "/")
+			conditions = append(conditions, "path = ? OR substr(path, 1, ?) = ?")
+			values = append(values, p, len(p)+1, p+"/")
+		}
+		where += " AND (" + strings.Join(conditions, " OR ") + ")"
+	}
+
+	_, err := s.tx.Exec("UPDATE fileinfo SET deleted = 1, updated = DATETIME(lastsynced, '+1 second') WHERE "+where, values...)
+	if err != nil {
+		return fmt.Errorf("could not set deleted files: %w", err)
+	}
+
+	s.closed = true
+	err = s.tx.Commit()
+	if err != nil {
+		return fmt.Errorf("cannot commit scan: %w", err)
+	}
+
+	return nil
+}
+
+// Undo the scan. Does nothing if it was already finished.
+func (s *Scan) Abort() error {
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	return s.tx.Rollback()
+}
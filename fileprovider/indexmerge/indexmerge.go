@@ -0,0 +1,335 @@
+package indexmerge
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/c00/buttercup/logger"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Three-way merge of remote indexes, for when another client changed the remote index while we were working on our copy.
+// ours is our changed copy and is updated in place, base is the index as we loaded it, and theirs is the index as it is on the remote now.
+// prepare brings a database up to the current schema. Returns the stored paths that ours refers to after the merge but didn't before,
+// so blobs that were queued for deletion can be kept.
+//
+// Files changed by only one side keep that change. When both changed the same file, the most recently written version wins
+// and the other one is added to the version history. Versions and chunks added by either side are kept.
+func Merge(oursPath, basePath, theirsPath string, prepare func(*sql.DB) error) ([]string, error) {
+	for _, dbPath := range []string{basePath, theirsPath} {
+		err := prepareFile(dbPath, prepare)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	db, err := sql.Open("sqlite3", oursPath)
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to sqlite db: %w", err)
+	}
+	defer db.Close()
+
+	//Attached databases only exist on the connection that attached them
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("cannot get connection: %w", err)
+	}
+	defer conn.Close()
+
+	_, err = conn.ExecContext(context.Background(), `ATTACH DATABASE ? AS base`, basePath)
+	if err != nil {
+		return nil, fmt.Errorf("cannot attach base: %w", err)
+	}
+	_, err = conn.ExecContext(context.Background(), `ATTACH DATABASE ? AS theirs`, theirsPath)
+	if err != nil {
+		return nil, fmt.Errorf("cannot attach theirs: %w", err)
+	}
+
+	before, err := storedPaths(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := conn.BeginTx(context.Background(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("cannot start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	m := merger{tx: tx}
+	for _, step := range []func() error{m.chunks, m.versions, m.files, m.cleanupChunks} {
+		err = step()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("cannot commit: %w", err)
+	}
+
+	after, err := storedPaths(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	known := map[string]bool{}
+	for _, storedPath := range before {
+		known[storedPath] = true
+	}
+
+	revived := []string{}
+	for _, storedPath := range after {
+		if !known[storedPath] {
+			revived = append(revived, storedPath)
+		}
+	}
+
+	return revived, nil
+}
+
+func prepareFile(dbPath string, prepare func(*sql.DB) error) error {
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		return fmt.Errorf("cannot connect to sqlite db: %w", err)
+	}
+	defer db.Close()
+
+	err = prepare(db)
+	if err != nil {
+		return fmt.Errorf("cannot prepare %v: %w", dbPath, err)
+	}
+
+	return nil
+}
+
+type querier interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+}
+
+func storedPaths(q querier) ([]string, error) {
+	return queryStrings(q, `SELECT storedpath FROM main.chunk
+		UNION SELECT storedpath FROM main.fileinfo WHERE storedpath != ''
+		UNION SELECT storedpath FROM main.fileversion WHERE storedpath != ''`)
+}
+
+func queryStrings(q querier, query string, args ...any) ([]string, error) {
+	rows, err := q.QueryContext(context.Background(), query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("query failed: %w", err)
+	}
+	defer rows.Close()
+
+	results := []string{}
+	for rows.Next() {
+		var value string
+		err = rows.Scan(&value)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning rows: %w", err)
+		}
+		results = append(results, value)
+	}
+
+	return results, rows.Err()
+}
+
+type merger struct {
+	tx *sql.Tx
+}
+
+func (m merger) exec(query string, args ...any) error {
+	_, err := m.tx.Exec(query, args...)
+	if err != nil {
+		return fmt.Errorf("merge failed: %w", err)
+	}
+	return nil
+}
+
+// Add the chunks they uploaded. Remember which ones we had, for cleanupChunks.
+func (m merger) chunks() error {
+	err := m.exec(`CREATE TEMP TABLE ourchunk AS SELECT hash FROM main.chunk`)
+	if err != nil {
+		return err
+	}
+
+	return m.exec(`INSERT OR IGNORE INTO main.chunk (hash, storedpath, size, packoffset) SELECT hash, storedpath, size, packoffset FROM theirs.chunk`)
+}
+
+// Add the versions they archived, and drop the ones they expired.
+func (m merger) versions() error {
+	added, err := queryStrings(m.tx, `SELECT id FROM theirs.fileversion WHERE id NOT IN (SELECT id FROM base.fileversion) ORDER BY id`)
+	if err != nil {
+		return err
+	}
+
+	//Version ids are only unique per index, so theirs get new ones
+	for _, id := range added {
+		res, err := m.tx.Exec(`INSERT INTO main.fileversion (path, updated, deleted, storedpath, hash, size, client, created)
+			SELECT path, updated, deleted, storedpath, hash, size, client, created FROM theirs.fileversion WHERE id = ?`, id)
+		if err != nil {
+			return fmt.Errorf("cannot add version: %w", err)
+		}
+
+		newID, err := res.LastInsertId()
+		if err != nil {
+			return fmt.Errorf("cannot get version id: %w", err)
+		}
+
+		err = m.exec(`INSERT INTO main.versionchunk (version, seq, hash) SELECT ?, seq, hash FROM theirs.versionchunk WHERE version = ?`, newID, id)
+		if err != nil {
+			return err
+		}
+	}
+
+	expired := `SELECT id FROM base.fileversion WHERE id NOT IN (SELECT id FROM theirs.fileversion)`
+	err = m.exec(`DELETE FROM main.versionchunk WHERE version IN (` + expired + `)`)
+	if err != nil {
+		return err
+	}
+
+	return m.exec(`DELETE FROM main.fileversion WHERE id IN (` + expired + `)`)
+}
+
+// Take over the files they changed, unless we changed them as well.
+func (m merger) files() error {
+	changed, err := queryStrings(m.tx, `SELECT path FROM (SELECT * FROM theirs.fileinfo EXCEPT SELECT * FROM base.fileinfo)
+		UNION SELECT path FROM (SELECT * FROM base.fileinfo EXCEPT SELECT * FROM theirs.fileinfo)`)
+	if err != nil {
+		return err
+	}
+
+	for _, filePath := range changed {
+		err = m.file(filePath)
+		if err != nil {
+			return fmt.Errorf("cannot merge %v: %w", filePath, err)
+		}
+	}
+
+	return nil
+}
+
+func (m merger) file(filePath string) error {
+	var changedByUs bool
+	err := m.tx.QueryRow(`SELECT EXISTS (SELECT * FROM main.fileinfo WHERE path = ?1 EXCEPT SELECT * FROM base.fileinfo WHERE path = ?1)
+		OR EXISTS (SELECT * FROM base.fileinfo WHERE path = ?1 EXCEPT SELECT * FROM main.fileinfo WHERE path = ?1)`, filePath).Scan(&changedByUs)
+	if err != nil {
+		return fmt.Errorf("cannot compare: %w", err)
+	}
+
+	if !changedByUs {
+		return m.takeTheirs(filePath)
+	}
+
+	ours, err := m.row("main", filePath)
+	if err != nil {
+		return err
+	}
+	theirs, err := m.row("theirs", filePath)
+	if err != nil {
+		return err
+	}
+
+	if ours.sameContent(theirs) {
+		return nil
+	}
+
+	logger.Warn("%v was changed by another client at the same time, keeping both versions", filePath)
+
+	if theirs.created.After(ours.created) {
+		err = m.archive("main", filePath)
+		if err != nil {
+			return err
+		}
+		return m.takeTheirs(filePath)
+	}
+
+	return m.archive("theirs", filePath)
+}
+
+func (m merger) takeTheirs(filePath string) error {
+	for _, query := range []string{
+		`DELETE FROM main.fileinfo WHERE path = ?`,
+		`DELETE FROM main.filechunk WHERE path = ?`,
+		`INSERT INTO main.fileinfo SELECT * FROM theirs.fileinfo WHERE path = ?`,
+		`INSERT INTO main.filechunk SELECT * FROM theirs.filechunk WHERE path = ?`,
+	} {
+		err := m.exec(query, filePath)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Add the current version of a file in schema to our version history.
+func (m merger) archive(schema, filePath string) error {
+	res, err := m.tx.Exec(`INSERT INTO main.fileversion (path, updated, deleted, storedpath, hash, size, client, created)
+		SELECT path, updated, deleted, storedpath, hash, size, client, created FROM `+schema+`.fileinfo WHERE path = ?`, filePath)
+	if err != nil {
+		return fmt.Errorf("cannot archive version: %w", err)
+	}
+
+	if count, _ := res.RowsAffected(); count == 0 {
+		return nil
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("cannot get version id: %w", err)
+	}
+
+	return m.exec(`INSERT INTO main.versionchunk (version, seq, hash) SELECT ?, seq, hash FROM `+schema+`.filechunk WHERE path = ?`, id, filePath)
+}
+
+type fileRow struct {
+	exists     bool
+	deleted    bool
+	storedPath string
+	hash       string
+	created    time.Time
+}
+
+func (r fileRow) sameContent(other fileRow) bool {
+	return r.exists == other.exists && r.deleted == other.deleted && r.storedPath == other.storedPath && r.hash == other.hash
+}
+
+func (m merger) row(schema, filePath string) (fileRow, error) {
+	r := fileRow{exists: true}
+	err := m.tx.QueryRow(`SELECT deleted, storedpath, hash, created FROM `+schema+`.fileinfo WHERE path = ?`, filePath).
+		Scan(&r.deleted, &r.storedPath, &r.hash, &r.created)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fileRow{}, nil
+	}
+	if err != nil {
+		return fileRow{}, fmt.Errorf("cannot get file: %w", err)
+	}
+
+	return r, nil
+}
+
+// Drop chunks nobody uses anymore, that we didn't have before or that they pruned.
+func (m merger) cleanupChunks() error {
+	unused := `hash NOT IN (SELECT hash FROM main.filechunk) AND hash NOT IN (SELECT hash FROM main.versionchunk)`
+	prunedByThem := `hash IN (SELECT hash FROM base.chunk EXCEPT SELECT hash FROM theirs.chunk)`
+
+	err := m.exec(`DELETE FROM main.chunk WHERE ` + unused + ` AND (hash NOT IN (SELECT hash FROM temp.ourchunk) OR ` + prunedByThem + `)`)
+	if err != nil {
+		return err
+	}
+
+	var missing int
+	err = m.tx.QueryRow(`SELECT count(*) FROM main.chunk WHERE ` + prunedByThem).Scan(&missing)
+	if err != nil {
+		return fmt.Errorf("cannot count chunks: %w", err)
+	}
+	if missing > 0 {
+		logger.Warn("%v chunks that are still in use were removed by another client, run gc to find the affected files", missing)
+	}
+
+	return m.exec(`DROP TABLE temp.ourchunk`)
+}
@@ -0,0 +1,290 @@
+package s3client
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/c00/buttercup/logger"
+)
+
+// Files bigger than this are uploaded in parts, and downloaded with ranged requests of this size.
+const partSize = 16 * 1024 * 1024
+
+// Amount of parts that are transferred at the same time, per file.
+const partConcurrency = 4
+
+// How often a single part is tried before giving up on the whole file.
+const maxPartAttempts = 3
+
+// S3 doesn't allow more parts than this.
+const maxParts = 10000
+
+// Size of the buffer a read starts with, it grows up to partSize when there is more.
+const firstReadSize = 64 * 1024
+
+// Upload a stream. Small files are uploaded in one request, bigger ones in parts, so they don't have to be
+// written somewhere first and a failed part is retried on its own instead of starting over.
+// Without a journal, an upload that fails is aborted. With one, the upload is kept and recorded in the journal,
+// and the next upload with that journal continues it. See ResumeUpload.
+// optFns are applied to the request that creates the file (the PutObject or the CompleteMultipartUpload).
+// Returns the ETag of the new file.
+func (c *S3Client) upload(key string, content io.Reader, journal UploadJournal, optFns ...func(*s3.Options)) (string, error) {
+	client, err := c.getClient()
+	if err != nil {
+		return "", err
+	}
+
+	first, last, err := readPart(content)
+	if err != nil {
+		return "", fmt.Errorf("could not read content: %w", err)
+	}
+
+	if last {
+		result, err := client.PutObject(context.Background(), &s3.PutObjectInput{
+			Body:   bytes.NewReader(first),
+			Bucket: &c.config.Bucket,
+			Key:    &key,
+		}, optFns...)
+		if err != nil {
+			return "", err
+		}
+		return aws.ToString(result.ETag), nil
+	}
+
+	pending, uploaded, err := c.startUpload(client, key, journal)
+	if err != nil {
+		return "", err
+	}
+	uploadID := aws.String(pending.UploadID)
+
+	put := func(number int32, data []byte) (string, error) {
+		sum := md5.Sum(data)
+		result, err := client.UploadPart(context.Background(), &s3.UploadPartInput{
+			Body:          bytes.NewReader(data),
+			Bucket:        &c.config.Bucket,
+			Key:           &key,
+			UploadId:      uploadID,
+			PartNumber:    aws.Int32(number),
+			ContentLength: aws.Int64(int64(len(data))),
+			ContentMD5:    aws.String(base64.StdEncoding.EncodeToString(sum[:])),
+		})
+		if err != nil {
+			return "", err
+		}
+		return aws.ToString(result.ETag), nil
+	}
+	if journal != nil {
+		put = resumePut(journal, pending, uploaded, put)
+	}
+
+	parts, err := uploadParts(first, content, put)
+	var completed *s3.CompleteMultipartUploadOutput
+	if err == nil {
+		completed, err = client.CompleteMultipartUpload(context.Background(), &s3.CompleteMultipartUploadInput{
+			Bucket:          &c.config.Bucket,
+			Key:             &key,
+			UploadId:        uploadID,
+			MultipartUpload: &types.CompletedMultipartUpload{Parts: parts},
+		}, optFns...)
+	}
+	if err != nil && journal == nil {
+		//Don't leave the parts lying around, they are billed until they are removed
+		_, abortErr := client.AbortMultipartUpload(context.Background(), &s3.AbortMultipartUploadInput{
+			Bucket:   &c.config.Bucket,
+			Key:      &key,
+			UploadId: uploadID,
+		})
+		if abortErr != nil {
+			logger.Warn("could not abort multipart upload of %v: %v", key, abortErr)
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return aws.ToString(completed.ETag), nil
+}
+
+// Continue the multipart upload in the journal, or start a new one and record it.
+// Returns the upload, and the ETags of the parts that S3 still has of it.
+func (c *S3Client) startUpload(client *s3.Client, key string, journal UploadJournal) (PendingUpload, map[int32]string, error) {
+	if journal != nil {
+		pending, found, err := journal.GetUpload()
+		if err != nil {
+			return PendingUpload{}, nil, fmt.Errorf("could not read upload journal: %w", err)
+		}
+		if found {
+			uploaded, err := c.listParts(client, key, pending.UploadID)
+			if err == nil {
+				logger.Debug("continuing multipart upload of %v, %v parts are uploaded", key, len(uploaded))
+				return pending, uploaded, nil
+			}
+			//Completed, aborted, or cleaned up by a lifecycle rule
+			logger.Debug("could not continue multipart upload of %v, starting over: %v", key, err)
+		}
+	}
+
+	created, err := client.CreateMultipartUpload(context.Background(), &s3.CreateMultipartUploadInput{
+		Bucket: &c.config.Bucket,
+		Key:    &key,
+	})
+	if err != nil {
+		return PendingUpload{}, nil, fmt.Errorf("could not start multipart upload: %w", err)
+	}
+
+	pending := PendingUpload{UploadID: aws.ToString(created.UploadId)}
+	if journal != nil {
+		err = journal.SaveUpload(pending)
+		if err != nil {
+			return PendingUpload{}, nil, fmt.Errorf("could not record upload: %w", err)
+		}
+	}
+	return pending, map[int32]string{}, nil
+}
+
+// Get the ETags of the parts of a multipart upload, by part number.
+func (c *S3Client) listParts(client *s3.Client, key, uploadID string) (map[int32]string, error) {
+	uploaded := map[int32]string{}
+	paginator := s3.NewListPartsPaginator(client, &s3.ListPartsInput{
+		Bucket:   &c.config.Bucket,
+		Key:      &key,
+		UploadId: &uploadID,
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(context.Background())
+		if err != nil {
+			return nil, err
+		}
+		for _, part := range page.Parts {
+			uploaded[aws.ToInt32(part.PartNumber)] = aws.ToString(part.ETag)
+		}
+	}
+
+	return uploaded, nil
+}
+
+// Read up to partSize bytes. Returns true if the stream ended.
+// The buffer grows with what is read, so small files don't cost a whole part of memory.
+func readPart(r io.Reader) ([]byte, bool, error) {
+	buf := make([]byte, 0, firstReadSize)
+	for len(buf) < partSize {
+		if len(buf) == cap(buf) {
+			grown := make([]byte, len(buf), min(2*cap(buf), partSize))
+			copy(grown, buf)
+			buf = grown
+		}
+
+		n, err := r.Read(buf[len(buf):cap(buf)])
+		buf = buf[:len(buf)+n]
+		if errors.Is(err, io.EOF) {
+			return buf, true, nil
+		}
+		if err != nil {
+			return nil, false, err
+		}
+	}
+
+	return buf, false, nil
+}
+
+// Upload the stream in parts, partConcurrency at a time. first is the first part, already read from content.
+// put uploads a single part and returns its ETag. Failed parts are tried again, up to maxPartAttempts times.
+// Returns the uploaded parts in order.
+func uploadParts(first []byte, content io.Reader, put func(number int32, data []byte) (string, error)) ([]types.CompletedPart, error) {
+	var (
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+		firstErr error
+		parts    []types.CompletedPart
+	)
+
+	failed := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return firstErr != nil
+	}
+
+	//Bounds the amount of parts in memory
+	slots := make(chan struct{}, partConcurrency)
+
+	data, last := first, false
+	for number := int32(1); ; number++ {
+		if number > maxParts {
+			wg.Wait()
+			return nil, fmt.Errorf("file is too big, it needs more than %v parts", maxParts)
+		}
+
+		slots <- struct{}{}
+		if failed() {
+			break
+		}
+
+		wg.Add(1)
+		go func(number int32, data []byte) {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			etag, err := putPart(number, data, put)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if firstErr == nil {
+					firstErr = fmt.Errorf("could not upload part %v: %w", number, err)
+				}
+				return
+			}
+			parts = append(parts, types.CompletedPart{ETag: aws.String(etag), PartNumber: aws.Int32(number)})
+		}(number, data)
+
+		if last {
+			break
+		}
+
+		var err error
+		data, last, err = readPart(content)
+		if err != nil {
+			wg.Wait()
+			return nil, fmt.Errorf("could not read content: %w", err)
+		}
+		//The stream ended exactly at a part boundary
+		if len(data) == 0 {
+			break
+		}
+	}
+
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	//Parts finish in any order, but have to be completed in order
+	slices.SortFunc(parts, func(a, b types.CompletedPart) int {
+		return int(aws.ToInt32(a.PartNumber) - aws.ToInt32(b.PartNumber))
+	})
+	return parts, nil
+}
+
+func putPart(number int32, data []byte, put func(number int32, data []byte) (string, error)) (string, error) {
+	var err error
+	for attempt := 1; attempt <= maxPartAttempts; attempt++ {
+		var etag string
+		etag, err = put(number, data)
+		if err == nil {
+			return etag, nil
+		}
+		logger.Debug("part %v failed (attempt %v of %v): %v", number, attempt, maxPartAttempts, err)
+	}
+
+	return "", err
+}
@@ -0,0 +1,197 @@
+package s3client
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"maps"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeParts struct {
+	mu       sync.Mutex
+	parts    map[int32][]byte
+	attempts map[int32]int
+	//Parts that fail this many times before succeeding
+	failures int
+}
+
+func (f *fakeParts) put(number int32, data []byte) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.attempts[number]++
+	if f.attempts[number] <= f.failures {
+		return "", errors.New("connection reset")
+	}
+
+	f.parts[number] = bytes.Clone(data)
+	return fmt.Sprintf("etag-%v", number), nil
+}
+
+func TestUploadParts(t *testing.T) {
+	content := makeContent(partSize*3 + 10)
+	f := &fakeParts{parts: map[int32][]byte{}, attempts: map[int32]int{}, failures: 1}
+
+	reader := bytes.NewReader(content)
+	first, last, err := readPart(reader)
+	assert.Nil(t, err)
+	assert.False(t, last)
+
+	parts, err := uploadParts(first, reader, f.put)
+	assert.Nil(t, err)
+	assert.Equal(t, len(parts), 4)
+
+	joined := []byte{}
+	for i, part := range parts {
+		number := aws.ToInt32(part.PartNumber)
+		assert.Equal(t, number, int32(i+1))
+		assert.Equal(t, aws.ToString(part.ETag), fmt.Sprintf("etag-%v", number))
+		joined = append(joined, f.parts[number]...)
+	}
+	assert.True(t, bytes.Equal(joined, content))
+}
+
+func TestUploadParts_ExactBoundary(t *testing.T) {
+	content := makeContent(partSize * 2)
+	f := &fakeParts{parts: map[int32][]byte{}, attempts: map[int32]int{}}
+
+	reader := bytes.NewReader(content)
+	first, _, err := readPart(reader)
+	assert.Nil(t, err)
+
+	parts, err := uploadParts(first, reader, f.put)
+	assert.Nil(t, err)
+	assert.Equal(t, len(parts), 2)
+}
+
+func TestUploadParts_GivesUp(t *testing.T) {
+	content := makeContent(partSize * 2)
+	f := &fakeParts{parts: map[int32][]byte{}, attempts: map[int32]int{}, failures: maxPartAttempts}
+
+	reader := bytes.NewReader(content)
+	first, _, err := readPart(reader)
+	assert.Nil(t, err)
+
+	_, err = uploadParts(first, reader, f.put)
+	assert.NotNil(t, err)
+}
+
+func TestReadPart(t *testing.T) {
+	tests := []struct {
+		name     string
+		size     int
+		wantLen  int
+		wantLast bool
+	}{
+		{"empty", 0, 0, true},
+		{"small", 100, 100, true},
+		{"grows", firstReadSize*3 + 1, firstReadSize*3 + 1, true},
+		{"exact", partSize, partSize, false},
+		{"bigger", partSize + 1, partSize, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			content := makeContent(tt.size)
+			data, last, err := readPart(bytes.NewReader(content))
+			assert.Nil(t, err)
+			assert.Equal(t, len(data), tt.wantLen)
+			assert.Equal(t, last, tt.wantLast)
+			assert.True(t, bytes.Equal(data, content[:tt.wantLen]))
+			assert.True(t, cap(data) <= max(firstReadSize, 2*tt.wantLen))
+		})
+	}
+}
+
+type memoryJournal struct {
+	upload *PendingUpload
+}
+
+func (j *memoryJournal) GetUpload() (PendingUpload, bool, error) {
+	if j.upload == nil {
+		return PendingUpload{}, false, nil
+	}
+	return *j.upload, true, nil
+}
+
+func (j *memoryJournal) SaveUpload(upload PendingUpload) error {
+	j.upload = &upload
+	return nil
+}
+
+// Stores parts like S3 does, with the MD5 as ETag.
+type fakeBucket struct {
+	mu    sync.Mutex
+	parts map[int32]string
+	puts  []int32
+	//Part that fails every time
+	broken int32
+}
+
+func (b *fakeBucket) put(number int32, data []byte) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.puts = append(b.puts, number)
+	if number == b.broken {
+		return "", errors.New("connection reset")
+	}
+
+	sum := md5.Sum(data)
+	b.parts[number] = `"` + hex.EncodeToString(sum[:]) + `"`
+	return b.parts[number], nil
+}
+
+func TestResumePut(t *testing.T) {
+	content := makeContent(partSize*3 + 10)
+	journal := &memoryJournal{}
+	journal.SaveUpload(PendingUpload{UploadID: "upload"})
+	bucket := &fakeBucket{parts: map[int32]string{}, broken: 2}
+
+	reader := bytes.NewReader(content)
+	first, _, err := readPart(reader)
+	assert.Nil(t, err)
+	_, err = uploadParts(first, reader, resumePut(journal, *journal.upload, map[int32]string{}, bucket.put))
+	assert.NotNil(t, err)
+	assert.Equal(t, journal.upload.UploadID, "upload")
+	recorded := map[int32]bool{}
+	for _, part := range journal.upload.Parts {
+		recorded[part.Number] = true
+		assert.Equal(t, part.ETag, bucket.parts[part.Number])
+	}
+	assert.True(t, recorded[1])
+	assert.False(t, recorded[2])
+
+	//Continuing only uploads the parts that aren't there yet
+	bucket.broken = 0
+	bucket.puts = nil
+	listed := maps.Clone(bucket.parts)
+	reader = bytes.NewReader(content)
+	first, _, err = readPart(reader)
+	assert.Nil(t, err)
+	parts, err := uploadParts(first, reader, resumePut(journal, *journal.upload, listed, bucket.put))
+	assert.Nil(t, err)
+	assert.Equal(t, len(parts), 4)
+	for _, number := range bucket.puts {
+		assert.False(t, recorded[number])
+	}
+	assert.Equal(t, len(bucket.puts), 4-len(recorded))
+	assert.Equal(t, len(journal.upload.Parts), 4)
+
+	//Parts with other content are uploaded again
+	changed := bytes.Clone(content)
+	changed[0]++
+	bucket.puts = nil
+	reader = bytes.NewReader(changed)
+	first, _, err = readPart(reader)
+	assert.Nil(t, err)
+	_, err = uploadParts(first, reader, resumePut(journal, *journal.upload, maps.Clone(bucket.parts), bucket.put))
+	assert.Nil(t, err)
+	assert.Equal(t, bucket.puts, []int32{1})
+}
@@ -0,0 +1,201 @@
+package s3client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/c00/buttercup/logger"
+)
+
+// Download a file along with its ETag. The first partSize bytes are requested first. If the file is bigger,
+// the rest is fetched with parallel ranged requests while the caller reads.
+func (c *S3Client) download(key string) (io.ReadCloser, string, error) {
+	client, err := c.getClient()
+	if err != nil {
+		return nil, "", err
+	}
+
+	result, err := client.GetObject(context.Background(), &s3.GetObjectInput{
+		Bucket: &c.config.Bucket,
+		Key:    &key,
+		Range:  aws.String(fmt.Sprintf("bytes=0-%v", partSize-1)),
+	})
+	if isInvalidRange(err) {
+		//Empty files have no byte 0
+		result, err = client.GetObject(context.Background(), &s3.GetObjectInput{
+			Bucket: &c.config.Bucket,
+			Key:    &key,
+		})
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	etag := aws.ToString(result.ETag)
+
+	//Providers that ignore the range send the whole file
+	size, ok := parseContentRangeSize(aws.ToString(result.ContentRange))
+	if !ok || size <= partSize {
+		return result.Body, etag, nil
+	}
+
+	fetch := func(ctx context.Context, start, end int64) ([]byte, error) {
+		part, err := client.GetObject(ctx, &s3.GetObjectInput{
+			Bucket: &c.config.Bucket,
+			Key:    &key,
+			Range:  aws.String(fmt.Sprintf("bytes=%v-%v", start, end)),
+			//The file must not change between parts
+			IfMatch: aws.String(etag),
+		})
+		if err != nil {
+			return nil, err
+		}
+		defer part.Body.Close()
+
+		return io.ReadAll(part.Body)
+	}
+
+	return newRangeReader(result.Body, partSize, size, fetch), etag, nil
+}
+
+// Get the total size from a Content-Range header like "bytes 0-99/1234".
+func parseContentRangeSize(contentRange string) (int64, bool) {
+	_, total, found := strings.Cut(contentRange, "/")
+	if !found || total == "*" {
+		return 0, false
+	}
+
+	size, err := strconv.ParseInt(total, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+
+	return size, true
+}
+
+func isInvalidRange(err error) bool {
+	var respErr *awshttp.ResponseError
+	return errors.As(err, &respErr) && respErr.HTTPStatusCode() == http.StatusRequestedRangeNotSatisfiable
+}
+
+type rangeResult struct {
+	data []byte
+	err  error
+}
+
+// Reads a file in order, while the next parts are fetched in the background.
+// At most partConcurrency parts are fetched or waiting to be read at a time.
+func newRangeReader(first io.ReadCloser, offset, size int64, fetch func(ctx context.Context, start, end int64) ([]byte, error)) *rangeReader {
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &rangeReader{
+		ctx:     ctx,
+		cancel:  cancel,
+		current: first,
+		next:    offset,
+		size:    size,
+		fetch:   fetch,
+	}
+	r.schedule()
+
+	return r
+}
+
+type rangeReader struct {
+	ctx     context.Context
+	cancel  context.CancelFunc
+	current io.ReadCloser
+	//Offset of the first byte that isn't fetched yet
+	next    int64
+	size    int64
+	fetch   func(ctx context.Context, start, end int64) ([]byte, error)
+	pending []chan rangeResult
+}
+
+func (r *rangeReader) Read(p []byte) (int, error) {
+	for {
+		if r.current != nil {
+			n, err := r.current.Read(p)
+			if errors.Is(err, io.EOF) {
+				r.current.Close()
+				r.current = nil
+				if n > 0 {
+					return n, nil
+				}
+				continue
+			}
+			return n, err
+		}
+
+		if len(r.pending) == 0 {
+			return 0, io.EOF
+		}
+
+		result := <-r.pending[0]
+		r.pending = r.pending[1:]
+		if result.err != nil {
+			return 0, result.err
+		}
+
+		r.current = io.NopCloser(bytes.NewReader(result.data))
+		r.schedule()
+	}
+}
+
+// Start fetching parts until partConcurrency are pending.
+func (r *rangeReader) schedule() {
+	for len(r.pending) < partConcurrency && r.next < r.size {
+		start := r.next
+		end := min(start+partSize, r.size) - 1
+		r.next = end + 1
+
+		//Buffered, so the goroutine finishes even if nobody reads the result
+		results := make(chan rangeResult, 1)
+		r.pending = append(r.pending, results)
+
+		go func() {
+			data, err := r.fetchPart(start, end)
+			results <- rangeResult{data: data, err: err}
+		}()
+	}
+}
+
+func (r *rangeReader) fetchPart(start, end int64) ([]byte, error) {
+	var err error
+	for attempt := 1; attempt <= maxPartAttempts; attempt++ {
+		var data []byte
+		data, err = r.fetch(r.ctx, start, end)
+		if err == nil && int64(len(data)) != end-start+1 {
+			err = fmt.Errorf("expected %v bytes, got %v", end-start+1, len(data))
+		}
+		if err == nil {
+			return data, nil
+		}
+		if r.ctx.Err() != nil {
+			return nil, r.ctx.Err()
+		}
+		logger.Debug("bytes %v-%v failed (attempt %v of %v): %v", start, end, attempt, maxPartAttempts, err)
+	}
+
+	return nil, fmt.Errorf("could not download bytes %v-%v: %w", start, end, err)
+}
+
+// Stop fetching. Parts that are in flight are cancelled.
+func (r *rangeReader) Close() error {
+	r.cancel()
+	r.pending = nil
+	if r.current != nil {
+		err := r.current.Close()
+		r.current = nil
+		return err
+	}
+	return nil
+}
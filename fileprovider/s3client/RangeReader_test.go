@@ -0,0 +1,69 @@
+package s3client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func makeContent(size int) []byte {
+	content := make([]byte, size)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+	return content
+}
+
+func TestRangeReader_ReadsInOrder(t *testing.T) {
+	content := makeContent(partSize*5 + 123)
+
+	var mu sync.Mutex
+	fetched := map[int64]int{}
+	fetch := func(ctx context.Context, start, end int64) ([]byte, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		fetched[start]++
+		//The first attempt of every part fails
+		if fetched[start] == 1 {
+			return nil, errors.New("connection reset")
+		}
+		return content[start : end+1], nil
+	}
+
+	r := newRangeReader(io.NopCloser(bytes.NewReader(content[:partSize])), partSize, int64(len(content)), fetch)
+	data, err := io.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Nil(t, r.Close())
+	assert.True(t, bytes.Equal(data, content))
+	assert.Equal(t, len(fetched), 5)
+}
+
+func TestRangeReader_GivesUp(t *testing.T) {
+	content := makeContent(partSize * 2)
+	fetch := func(ctx context.Context, start, end int64) ([]byte, error) {
+		//Short reads count as failures
+		return content[start:end], nil
+	}
+
+	r := newRangeReader(io.NopCloser(bytes.NewReader(content[:partSize])), partSize, int64(len(content)), fetch)
+	_, err := io.ReadAll(r)
+	assert.NotNil(t, err)
+	assert.Nil(t, r.Close())
+}
+
+func TestParseContentRangeSize(t *testing.T) {
+	size, ok := parseContentRangeSize("bytes 0-99/1234")
+	assert.True(t, ok)
+	assert.Equal(t, size, int64(1234))
+
+	_, ok = parseContentRangeSize("bytes 0-99/*")
+	assert.False(t, ok)
+
+	_, ok = parseContentRangeSize("")
+	assert.False(t, ok)
+}
@@ -0,0 +1,89 @@
+package s3client
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/c00/buttercup/logger"
+)
+
+// A multipart upload that was started, with the parts that were uploaded so far.
+type PendingUpload struct {
+	UploadID string         `json:"uploadId"`
+	Parts    []UploadedPart `json:"parts"`
+}
+
+type UploadedPart struct {
+	Number int32  `json:"number"`
+	ETag   string `json:"etag"`
+}
+
+// Keeps track of a single multipart upload outside of the process, so it can be continued after an interruption.
+type UploadJournal interface {
+	//The upload that was started before, if any.
+	GetUpload() (PendingUpload, bool, error)
+	SaveUpload(upload PendingUpload) error
+}
+
+// Upload a file in a way that can be continued when it is interrupted. The upload and its parts are recorded in the journal,
+// and calling this again with the same journal only uploads the parts that S3 doesn't have yet.
+// The content has to be the same bytes every time, parts are compared by their MD5.
+// The journal can be thrown away once this succeeds.
+func (c *S3Client) ResumeUpload(filepath string, content io.Reader, journal UploadJournal) error {
+	_, err := c.upload(path.Join(c.config.BasePath, filepath), content, journal)
+	if err != nil {
+		return fmt.Errorf("upload to s3 failed: %w", err)
+	}
+
+	return nil
+}
+
+// Wrap put so parts that S3 has already are skipped, and the parts that are uploaded are recorded in the journal.
+// uploaded has the ETags of the parts S3 has, only the ones that were recorded and match the data are skipped.
+func resumePut(journal UploadJournal, pending PendingUpload, uploaded map[int32]string, put func(number int32, data []byte) (string, error)) func(number int32, data []byte) (string, error) {
+	var mu sync.Mutex
+	recorded := map[int32]string{}
+	for _, part := range pending.Parts {
+		recorded[part.Number] = part.ETag
+	}
+
+	return func(number int32, data []byte) (string, error) {
+		mu.Lock()
+		etag, found := uploaded[number]
+		found = found && recorded[number] == etag
+		mu.Unlock()
+
+		//The ETag of a part is the MD5 of its content, unless the bucket encrypts with KMS. Then the part is uploaded again.
+		sum := md5.Sum(data)
+		if found && strings.Trim(etag, `"`) == hex.EncodeToString(sum[:]) {
+			return etag, nil
+		}
+
+		etag, err := put(number, data)
+		if err != nil {
+			return "", err
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		recorded[number] = etag
+		pending.Parts = pending.Parts[:0:0]
+		for number, etag := range recorded {
+			pending.Parts = append(pending.Parts, UploadedPart{Number: number, ETag: etag})
+		}
+		slices.SortFunc(pending.Parts, func(a, b UploadedPart) int { return int(a.Number - b.Number) })
+
+		err = journal.SaveUpload(pending)
+		if err != nil {
+			//Not fatal, the part is uploaded again if this upload is interrupted
+			logger.Warn("could not record part %v: %v", number, err)
+		}
+		return etag, nil
+	}
+}
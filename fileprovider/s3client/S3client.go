@@ -5,13 +5,17 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net/http"
 	"path"
+	"strings"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
 	awsConfig "github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
 
 	"github.com/c00/buttercup/appconfig"
 )
@@ -50,18 +54,7 @@ func (c *S3Client) getClient() (*s3.Client, error) {
 }
 
 func (c *S3Client) UploadFile(filepath string, content io.Reader) error {
-	client, err := c.getClient()
-	if err != nil {
-		return err
-	}
-
-	key := path.Join(c.config.BasePath, filepath)
-
-	_, err = client.PutObject(context.Background(), &s3.PutObjectInput{
-		Body:   content,
-		Bucket: &c.config.Bucket,
-		Key:    &key,
-	})
+	_, err := c.upload(path.Join(c.config.BasePath, filepath), content, nil)
 	if err != nil {
 		return fmt.Errorf("upload to s3 failed: %w", err)
 	}
@@ -70,22 +63,8 @@ func (c *S3Client) UploadFile(filepath string, content io.Reader) error {
 }
 
 func (c *S3Client) DownloadFile(filepath string) (io.ReadCloser, error) {
-	client, err := c.getClient()
-	if err != nil {
-		return nil, err
-	}
-
-	key := path.Join(c.config.BasePath, filepath)
-
-	result, err := client.GetObject(context.Background(), &s3.GetObjectInput{
-		Bucket: &c.config.Bucket,
-		Key:    &key,
-	})
-	if err != nil {
-		return nil, err
-	}
-
-	return result.Body, nil
+	reader, _, err := c.download(path.Join(c.config.BasePath, filepath))
+	return reader, err
 }
 
 func (c *S3Client) DeleteFile(filepath string) error {
@@ -160,3 +139,109 @@ func (c *S3Client) HasFile(filepath string) (bool, error) {
 	}
 	return true, nil
 }
+
+// Call fn for every file in the base path. The path passed to fn is relative to the base path.
+func (c *S3Client) ListFiles(fn func(filepath string) error) error {
+	client, err := c.getClient()
+	if err != nil {
+		return err
+	}
+
+	prefix := ""
+	if c.config.BasePath != "" {
+		prefix = strings.TrimSuffix(c.config.BasePath, "/") + "/"
+	}
+
+	paginator := s3.NewListObjectsV2Paginator(client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(c.config.Bucket),
+		Prefix: aws.String(prefix),
+	})
+
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(context.Background())
+		if err != nil {
+			return fmt.Errorf("could not list items: %w", err)
+		}
+
+		for _, object := range page.Contents {
+			err = fn(strings.TrimPrefix(aws.ToString(object.Key), prefix))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Whether an error means the file does not exist.
+func IsNotFound(err error) bool {
+	var noSuchKey *types.NoSuchKey
+	var notFound *types.NotFound
+	return errors.As(err, &noSuchKey) || errors.As(err, &notFound)
+}
+
+// Returned when a conditional write fails because the file changed or already exists.
+var ErrPreconditionFailed = errors.New("precondition failed")
+
+// Upload a file only if it doesn't exist yet, and return its ETag. Fails with ErrPreconditionFailed if it does.
+// Providers that don't support conditional writes ignore the condition and overwrite the file.
+func (c *S3Client) CreateFile(filepath string, content io.Reader) (string, error) {
+	return c.conditionalUpload(filepath, content, "If-None-Match", "*")
+}
+
+// Upload a file only if it still has the given ETag, and return its new ETag. Fails with ErrPreconditionFailed if it changed.
+// Providers that don't support conditional writes ignore the condition and overwrite the file.
+func (c *S3Client) ReplaceFile(filepath string, content io.Reader, etag string) (string, error) {
+	return c.conditionalUpload(filepath, content, "If-Match", etag)
+}
+
+func (c *S3Client) conditionalUpload(filepath string, content io.Reader, header, value string) (string, error) {
+	//Not in the PutObjectInput of this sdk version, so set the header directly.
+	etag, err := c.upload(path.Join(c.config.BasePath, filepath), content, nil, s3.WithAPIOptions(smithyhttp.AddHeaderValue(header, value)))
+	if isPreconditionFailed(err) {
+		return "", ErrPreconditionFailed
+	}
+	if err != nil {
+		return "", fmt.Errorf("upload to s3 failed: %w", err)
+	}
+
+	return etag, nil
+}
+
+// Download a file along with its ETag.
+func (c *S3Client) DownloadFileWithETag(filepath string) (io.ReadCloser, string, error) {
+	return c.download(path.Join(c.config.BasePath, filepath))
+}
+
+func isPreconditionFailed(err error) bool {
+	var respErr *awshttp.ResponseError
+	if !errors.As(err, &respErr) {
+		return false
+	}
+
+	//409 is returned when a conflicting conditional write is in progress
+	status := respErr.HTTPStatusCode()
+	return status == http.StatusPreconditionFailed || status == http.StatusConflict
+}
+
+// Get the ETag of a file, or an empty string if it doesn't exist.
+func (c *S3Client) GetETag(filepath string) (string, error) {
+	client, err := c.getClient()
+	if err != nil {
+		return "", err
+	}
+
+	result, err := client.HeadObject(context.Background(), &s3.HeadObjectInput{
+		Bucket: aws.String(c.config.Bucket),
+		Key:    aws.String(path.Join(c.config.BasePath, filepath)),
+	})
+	if IsNotFound(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("could not head item: %w", err)
+	}
+
+	return aws.ToString(result.ETag), nil
+}
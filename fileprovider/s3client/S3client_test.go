@@ -98,3 +98,31 @@ func TestS3Client_HasFile(t *testing.T) {
 	assert.Nil(t, err)
 	assert.False(t, has)
 }
+
+func TestS3Client_ListFiles(t *testing.T) {
+	godotenv.Load("../../.env")
+
+	client := New(appconfig.S3ProviderConfig{
+		Passphrase:     "foobar",
+		AccessKey:      os.Getenv("TEST_S3_ACCESS_KEY"),
+		SecretKey:      os.Getenv("TEST_S3_SECRET_KEY"),
+		Endpoint:       os.Getenv("TEST_S3_ENDPOINT"),
+		Region:         os.Getenv("TEST_S3_REGION"),
+		Bucket:         os.Getenv("TEST_S3_BUCKET"),
+		BasePath:       "automated",
+		ForcePathStyle: true,
+	})
+
+	assert.Nil(t, client.UploadFile("/listfolder/foo.txt", strings.NewReader("some content")))
+	defer client.DeleteFolder("/listfolder")
+
+	found := false
+	err := client.ListFiles(func(filepath string) error {
+		if filepath == "listfolder/foo.txt" {
+			found = true
+		}
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.True(t, found)
+}
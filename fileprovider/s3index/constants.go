@@ -1,5 +1,8 @@
 package s3index
 
+// How often to retry persisting the index when another client keeps changing it.
+const maxMergeAttempts = 5
+
 const createScript = `CREATE TABLE IF NOT EXISTS fileinfo (
 	path TEXT PRIMARY KEY NOT NULL,
 	lastsynced DATETIME NOT NULL,
@@ -8,3 +11,53 @@ const createScript = `CREATE TABLE IF NOT EXISTS fileinfo (
 	storedpath TEXT NOT NULL,
 	trackingvalue INTEGER NULL
 );`
+
+// Schema changes on top of createScript. Only ever append to this list.
+var migrations = []string{
+	`ALTER TABLE fileinfo ADD COLUMN hash TEXT NOT NULL DEFAULT '';`,
+	`ALTER TABLE fileinfo ADD COLUMN size INTEGER NOT NULL DEFAULT 0;`,
+	`CREATE TABLE chunk (
+		hash TEXT PRIMARY KEY NOT NULL,
+		storedpath TEXT NOT NULL,
+		size INTEGER NOT NULL
+	);`,
+	`CREATE TABLE filechunk (
+		path TEXT NOT NULL,
+		seq INTEGER NOT NULL,
+		hash TEXT NOT NULL,
+		PRIMARY KEY (path, seq)
+	);`,
+	`CREATE INDEX filechunk_hash ON filechunk (hash);`,
+	`ALTER TABLE fileinfo ADD COLUMN client TEXT NOT NULL DEFAULT '';`,
+	`ALTER TABLE fileinfo ADD COLUMN created DATETIME NOT NULL DEFAULT '0001-01-01 00:00:00+00:00';`,
+	`CREATE TABLE fileversion (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		path TEXT NOT NULL,
+		updated DATETIME NOT NULL,
+		deleted BOOLEAN NOT NULL,
+		storedpath TEXT NOT NULL,
+		hash TEXT NOT NULL,
+		size INTEGER NOT NULL,
+		client TEXT NOT NULL,
+		created DATETIME NOT NULL
+	);`,
+	`CREATE INDEX fileversion_path ON fileversion (path);`,
+	`CREATE TABLE versionchunk (
+		version INTEGER NOT NULL,
+		seq INTEGER NOT NULL,
+		hash TEXT NOT NULL,
+		PRIMARY KEY (version, seq)
+	);`,
+	`CREATE INDEX versionchunk_hash ON versionchunk (hash);`,
+	`ALTER TABLE fileinfo ADD COLUMN mode INTEGER NOT NULL DEFAULT 0;`,
+	`ALTER TABLE fileinfo ADD COLUMN owner TEXT NOT NULL DEFAULT '';`,
+	`ALTER TABLE fileinfo ADD COLUMN xattrs TEXT NOT NULL DEFAULT '';`,
+	`ALTER TABLE fileinfo ADD COLUMN type TEXT NOT NULL DEFAULT '';`,
+	`CREATE TABLE rekey (
+		storedpath TEXT PRIMARY KEY NOT NULL
+	);`,
+	`ALTER TABLE chunk ADD COLUMN packoffset INTEGER NULL;`,
+	`CREATE TABLE rekeyrun (
+		id INTEGER PRIMARY KEY CHECK (id = 1)
+	);`,
+}
@@ -9,9 +9,13 @@ import (
 	"io"
 	"os"
 	"path"
+	"sync"
 	"time"
 
+	"github.com/c00/buttercup/fileprovider/indexmerge"
 	"github.com/c00/buttercup/fileprovider/s3client"
+	"github.com/c00/buttercup/internal/migrate"
+	"github.com/c00/buttercup/logger"
 	"github.com/c00/buttercup/modifiers"
 	_ "github.com/mattn/go-sqlite3"
 )
@@ -25,17 +29,77 @@ type S3FileInfo struct {
 	Deleted       bool
 	StoredPath    string
 	TrackingValue int64
+	// Hex encoded sha256 of the content
+	Hash string
+	Size int64
+	// Client that wrote this version of the file
+	Client string
+	// When this version was written to the remote
+	Created time.Time
+	// Permission bits. 0 if unknown.
+	Mode uint32
+	// Owner and group as "uid:gid". Empty if unknown.
+	Owner string
+	// Encoded extended attributes
+	Xattrs string
+	// Empty for files, "dir" or "symlink" otherwise
+	Type string
 }
 
-func New(s3client *s3client.S3Client, passphrase string) *S3Index {
-	return &S3Index{s3client: s3client, passphrase: passphrase}
+// A content-addressed chunk and where it is stored
+type S3Chunk struct {
+	Hash       string
+	StoredPath string
+	Size       int64
+	// Stored in a pack with other small chunks
+	Packed bool
+}
+
+// A previous version of a file
+type S3FileVersion struct {
+	ID         int64
+	Path       string
+	Updated    time.Time
+	Deleted    bool
+	StoredPath string
+	Hash       string
+	Size       int64
+	Client     string
+	Created    time.Time
+}
+
+func New(s3client *s3client.S3Client, keys modifiers.Keys) *S3Index {
+	return newIndex(s3client, keys)
+}
+
+func newIndex(store indexStore, keys modifiers.Keys) *S3Index {
+	return &S3Index{s3client: store, keys: keys}
+}
+
+// Use new keys, like a data key that was created after the index was loaded. The index is encrypted with them when it is persisted.
+func (i *S3Index) SetKeys(keys modifiers.Keys) {
+	i.keys = keys
+}
+
+// Where the encrypted index is kept. The S3 client, or something in memory in tests.
+type indexStore interface {
+	DownloadFileWithETag(filepath string) (io.ReadCloser, string, error)
+	GetETag(filepath string) (string, error)
+	CreateFile(filepath string, content io.Reader) (string, error)
+	ReplaceFile(filepath string, content io.Reader, etag string) (string, error)
 }
 
 type S3Index struct {
 	unencryptedPath string
-	passphrase      string
+	keys            modifiers.Keys
 	db              *sql.DB
-	s3client        *s3client.S3Client
+	s3client        indexStore
+	//Guards loading the db, providers are used from several goroutines
+	loadMu sync.Mutex
+	//ETag of the index when it was loaded, to detect changes by other clients.
+	etag string
+	//Stored paths that came back into use by merging
+	revived []string
 }
 
 func (i *S3Index) MarkDeleted(trackingValue int64) error {
@@ -65,6 +129,11 @@ func (i *S3Index) DeleteFileInfo(path string) error {
 		return fmt.Errorf("error deleting fileinfo: %w", err)
 	}
 
+	_, err = i.db.Exec(`DELETE FROM filechunk WHERE path = ?`, path)
+	if err != nil {
+		return fmt.Errorf("error deleting file chunks: %w", err)
+	}
+
 	return nil
 }
 
@@ -74,9 +143,9 @@ func (i *S3Index) GetFileInfo(path string) (S3FileInfo, error) {
 		return S3FileInfo{}, err
 	}
 
-	row := i.db.QueryRow(`SELECT path, lastsynced, updated, deleted, storedpath, trackingvalue FROM fileinfo WHERE path = ?`, path)
+	row := i.db.QueryRow(`SELECT path, lastsynced, updated, deleted, storedpath, trackingvalue, hash, size, client, created, mode, owner, xattrs, type FROM fileinfo WHERE path = ?`, path)
 	fi := S3FileInfo{}
-	err = row.Scan(&fi.Path, &fi.LastSynced, &fi.Updated, &fi.Deleted, &fi.StoredPath, &fi.TrackingValue)
+	err = row.Scan(&fi.Path, &fi.LastSynced, &fi.Updated, &fi.Deleted, &fi.StoredPath, &fi.TrackingValue, &fi.Hash, &fi.Size, &fi.Client, &fi.Created, &fi.Mode, &fi.Owner, &fi.Xattrs, &fi.Type)
 	if err != nil {
 		return S3FileInfo{}, fmt.Errorf("error querying database: %w", err)
 	}
@@ -91,15 +160,23 @@ func (i *S3Index) SetFileInfo(fi S3FileInfo) error {
 	}
 
 	_, err = i.db.Exec(
-		`INSERT INTO fileinfo (path, lastsynced, updated, deleted, storedpath, trackingvalue)
-		 VALUES (?, ?, ?, ?, ?, ?)
+		`INSERT INTO fileinfo (path, lastsynced, updated, deleted, storedpath, trackingvalue, hash, size, client, created, mode, owner, xattrs, type)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 		 ON CONFLICT(Path) DO UPDATE SET 
 			lastsynced = excluded.lastsynced,
 			updated = excluded.updated,
 			deleted = excluded.deleted,
 			storedpath = excluded.storedpath,
-			trackingvalue = excluded.trackingvalue;`,
-		fi.Path, fi.LastSynced, fi.Updated, fi.Deleted, fi.StoredPath, fi.TrackingValue,
+			trackingvalue = excluded.trackingvalue,
+			hash = excluded.hash,
+			size = excluded.size,
+			client = excluded.client,
+			created = excluded.created,
+			mode = excluded.mode,
+			owner = excluded.owner,
+			xattrs = excluded.xattrs,
+			type = excluded.type;`,
+		fi.Path, fi.LastSynced, fi.Updated, fi.Deleted, fi.StoredPath, fi.TrackingValue, fi.Hash, fi.Size, fi.Client, fi.Created, fi.Mode, fi.Owner, fi.Xattrs, fi.Type,
 	)
 	if err != nil {
 		return fmt.Errorf("cannot insert: %w", err)
@@ -124,6 +201,11 @@ func (i *S3Index) UpdatePath(oldPath, newPath string) error {
 	if count, _ := res.RowsAffected(); count == 0 {
 		return errors.New("no rows updated")
 	}
+
+	_, err = i.db.Exec("UPDATE filechunk SET path = ? WHERE path = ?", newPath, oldPath)
+	if err != nil {
+		return fmt.Errorf("could not update chunk paths: %w", err)
+	}
 	return nil
 }
 
@@ -137,7 +219,7 @@ func (i *S3Index) GetPage(offset, limit int) ([]S3FileInfo, error) {
 		limit = -1
 	}
 
-	sql := "SELECT path, lastsynced, updated, deleted, storedpath, trackingvalue FROM fileinfo LIMIT ?"
+	sql := "SELECT path, lastsynced, updated, deleted, storedpath, trackingvalue, hash, size, client, created, mode, owner, xattrs, type FROM fileinfo ORDER BY path LIMIT ?"
 	values := []any{limit}
 
 	if offset > 0 {
@@ -149,12 +231,13 @@ func (i *S3Index) GetPage(offset, limit int) ([]S3FileInfo, error) {
 	if err != nil {
 		return nil, fmt.Errorf("could not get rows: %w", err)
 	}
+	defer rows.Close()
 
 	results := []S3FileInfo{}
 
 	for rows.Next() {
 		fi := S3FileInfo{}
-		err = rows.Scan(&fi.Path, &fi.LastSynced, &fi.Updated, &fi.Deleted, &fi.StoredPath, &fi.TrackingValue)
+		err = rows.Scan(&fi.Path, &fi.LastSynced, &fi.Updated, &fi.Deleted, &fi.StoredPath, &fi.TrackingValue, &fi.Hash, &fi.Size, &fi.Client, &fi.Created, &fi.Mode, &fi.Owner, &fi.Xattrs, &fi.Type)
 		if err != nil {
 			return nil, fmt.Errorf("error scanning rows: %w", err)
 		}
@@ -165,6 +248,586 @@ func (i *S3Index) GetPage(offset, limit int) ([]S3FileInfo, error) {
 	return results, nil
 }
 
+// Get the stored path of a chunk by its content hash
+func (i *S3Index) GetChunkPath(hash string) (string, error) {
+	err := i.Load()
+	if err != nil {
+		return "", err
+	}
+
+	var storedPath string
+	err = i.db.QueryRow(`SELECT storedpath FROM chunk WHERE hash = ?`, hash).Scan(&storedPath)
+	if err != nil {
+		return "", fmt.Errorf("error querying database: %w", err)
+	}
+
+	return storedPath, nil
+}
+
+func (i *S3Index) AddChunk(hash, storedPath string, size int64) error {
+	err := i.Load()
+	if err != nil {
+		return err
+	}
+
+	_, err = i.db.Exec(`INSERT INTO chunk (hash, storedpath, size) VALUES (?, ?, ?) ON CONFLICT(hash) DO NOTHING`, hash, storedPath, size)
+	if err != nil {
+		return fmt.Errorf("cannot insert chunk: %w", err)
+	}
+
+	return nil
+}
+
+// Add a chunk that is stored in a pack, at offset in the decrypted pack.
+func (i *S3Index) AddPackedChunk(hash, storedPath string, offset, size int64) error {
+	err := i.Load()
+	if err != nil {
+		return err
+	}
+
+	_, err = i.db.Exec(`INSERT INTO chunk (hash, storedpath, size, packoffset) VALUES (?, ?, ?, ?) ON CONFLICT(hash) DO NOTHING`, hash, storedPath, size, offset)
+	if err != nil {
+		return fmt.Errorf("cannot insert chunk: %w", err)
+	}
+
+	return nil
+}
+
+// Where a chunk is stored. For chunks in a pack that is "storedpath#offset+size".
+func chunkRef(storedPath string, packOffset sql.NullInt64, size int64) string {
+	if !packOffset.Valid {
+		return storedPath
+	}
+	return fmt.Sprintf("%v#%v+%v", storedPath, packOffset.Int64, size)
+}
+
+// Get the distinct chunks of a file, with where they are stored.
+func (i *S3Index) GetFileChunkRecords(path string) ([]S3Chunk, error) {
+	err := i.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := i.db.Query(`SELECT DISTINCT c.hash, c.storedpath, c.size, c.packoffset IS NOT NULL FROM filechunk f JOIN chunk c ON c.hash = f.hash WHERE f.path = ?`, path)
+	if err != nil {
+		return nil, fmt.Errorf("could not get chunks: %w", err)
+	}
+	defer rows.Close()
+
+	results := []S3Chunk{}
+	for rows.Next() {
+		chunk := S3Chunk{}
+		err = rows.Scan(&chunk.Hash, &chunk.StoredPath, &chunk.Size, &chunk.Packed)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning rows: %w", err)
+		}
+		results = append(results, chunk)
+	}
+
+	return results, rows.Err()
+}
+
+// Get where the chunks of a file are stored, in order. See chunkRef.
+func (i *S3Index) GetFileChunks(path string) ([]string, error) {
+	err := i.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := i.db.Query(`SELECT c.storedpath, c.packoffset, c.size FROM filechunk f JOIN chunk c ON c.hash = f.hash WHERE f.path = ? ORDER BY f.seq`, path)
+	if err != nil {
+		return nil, fmt.Errorf("could not get chunks: %w", err)
+	}
+	defer rows.Close()
+
+	results := []string{}
+	for rows.Next() {
+		var storedPath string
+		var packOffset sql.NullInt64
+		var size int64
+		err = rows.Scan(&storedPath, &packOffset, &size)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning rows: %w", err)
+		}
+		results = append(results, chunkRef(storedPath, packOffset, size))
+	}
+
+	return results, rows.Err()
+}
+
+// Replace the chunk list of a file.
+// Returns the hashes that were used by the old list but not by the new one.
+func (i *S3Index) SetFileChunks(path string, hashes []string) ([]string, error) {
+	err := i.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := i.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("cannot start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`SELECT hash FROM filechunk WHERE path = ?`, path)
+	if err != nil {
+		return nil, fmt.Errorf("could not get chunks: %w", err)
+	}
+	old := map[string]bool{}
+	for rows.Next() {
+		var hash string
+		err = rows.Scan(&hash)
+		if err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("error scanning rows: %w", err)
+		}
+		old[hash] = true
+	}
+	rows.Close()
+
+	_, err = tx.Exec(`DELETE FROM filechunk WHERE path = ?`, path)
+	if err != nil {
+		return nil, fmt.Errorf("could not delete chunks: %w", err)
+	}
+
+	for seq, hash := range hashes {
+		_, err = tx.Exec(`INSERT INTO filechunk (path, seq, hash) VALUES (?, ?, ?)`, path, seq, hash)
+		if err != nil {
+			return nil, fmt.Errorf("cannot insert file chunk: %w", err)
+		}
+		delete(old, hash)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("cannot commit: %w", err)
+	}
+
+	released := make([]string, 0, len(old))
+	for hash := range old {
+		released = append(released, hash)
+	}
+	return released, nil
+}
+
+// Delete a chunk if no file or version uses it anymore.
+// Returns the stored path of the chunk and whether its blob can be deleted, which is not the case for packs that other chunks are still in.
+func (i *S3Index) DeleteChunkIfUnused(hash string) (string, bool, error) {
+	err := i.Load()
+	if err != nil {
+		return "", false, err
+	}
+
+	var storedPath string
+	err = i.db.QueryRow(`SELECT storedpath FROM chunk WHERE hash = ?
+		 AND NOT EXISTS (SELECT 1 FROM filechunk WHERE hash = ?)
+		 AND NOT EXISTS (SELECT 1 FROM versionchunk WHERE hash = ?)`,
+		hash, hash, hash,
+	).Scan(&storedPath)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, fmt.Errorf("error querying database: %w", err)
+	}
+
+	_, err = i.db.Exec(`DELETE FROM chunk WHERE hash = ?`, hash)
+	if err != nil {
+		return "", false, fmt.Errorf("could not delete chunk: %w", err)
+	}
+
+	//A pack can only go once all of its chunks are gone
+	var shared bool
+	err = i.db.QueryRow(`SELECT EXISTS (SELECT 1 FROM chunk WHERE storedpath = ?)`, storedPath).Scan(&shared)
+	if err != nil {
+		return "", false, fmt.Errorf("error querying database: %w", err)
+	}
+
+	return storedPath, !shared, nil
+}
+
+// Copy the current state of a file into its version history, including its chunk list.
+// Does nothing if the file is not in the index.
+func (i *S3Index) ArchiveVersion(path string) error {
+	err := i.Load()
+	if err != nil {
+		return err
+	}
+
+	tx, err := i.db.Begin()
+	if err != nil {
+		return fmt.Errorf("cannot start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(
+		`INSERT INTO fileversion (path, updated, deleted, storedpath, hash, size, client, created)
+		 SELECT path, updated, deleted, storedpath, hash, size, client, created FROM fileinfo WHERE path = ?`,
+		path,
+	)
+	if err != nil {
+		return fmt.Errorf("cannot insert version: %w", err)
+	}
+
+	if count, _ := res.RowsAffected(); count == 0 {
+		return nil
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("cannot get version id: %w", err)
+	}
+
+	_, err = tx.Exec(`INSERT INTO versionchunk (version, seq, hash) SELECT ?, seq, hash FROM filechunk WHERE path = ?`, id, path)
+	if err != nil {
+		return fmt.Errorf("cannot insert version chunks: %w", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("cannot commit: %w", err)
+	}
+
+	return nil
+}
+
+// Get the previous versions of a file, newest first.
+func (i *S3Index) GetVersions(path string) ([]S3FileVersion, error) {
+	err := i.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := i.db.Query(`SELECT id, path, updated, deleted, storedpath, hash, size, client, created FROM fileversion WHERE path = ? ORDER BY id DESC`, path)
+	if err != nil {
+		return nil, fmt.Errorf("could not get versions: %w", err)
+	}
+	defer rows.Close()
+
+	results := []S3FileVersion{}
+	for rows.Next() {
+		v := S3FileVersion{}
+		err = rows.Scan(&v.ID, &v.Path, &v.Updated, &v.Deleted, &v.StoredPath, &v.Hash, &v.Size, &v.Client, &v.Created)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning rows: %w", err)
+		}
+		results = append(results, v)
+	}
+
+	return results, rows.Err()
+}
+
+func (i *S3Index) GetVersion(id int64) (S3FileVersion, error) {
+	err := i.Load()
+	if err != nil {
+		return S3FileVersion{}, err
+	}
+
+	row := i.db.QueryRow(`SELECT id, path, updated, deleted, storedpath, hash, size, client, created FROM fileversion WHERE id = ?`, id)
+	v := S3FileVersion{}
+	err = row.Scan(&v.ID, &v.Path, &v.Updated, &v.Deleted, &v.StoredPath, &v.Hash, &v.Size, &v.Client, &v.Created)
+	if err != nil {
+		return S3FileVersion{}, fmt.Errorf("error querying database: %w", err)
+	}
+
+	return v, nil
+}
+
+// Get where the chunks of a version are stored, in order. See chunkRef.
+func (i *S3Index) GetVersionChunks(id int64) ([]string, error) {
+	err := i.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := i.db.Query(`SELECT c.storedpath, c.packoffset, c.size FROM versionchunk v JOIN chunk c ON c.hash = v.hash WHERE v.version = ? ORDER BY v.seq`, id)
+	if err != nil {
+		return nil, fmt.Errorf("could not get chunks: %w", err)
+	}
+	defer rows.Close()
+
+	results := []string{}
+	for rows.Next() {
+		var storedPath string
+		var packOffset sql.NullInt64
+		var size int64
+		err = rows.Scan(&storedPath, &packOffset, &size)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning rows: %w", err)
+		}
+		results = append(results, chunkRef(storedPath, packOffset, size))
+	}
+
+	return results, rows.Err()
+}
+
+// Get the paths that have previous versions, in path order. Pages by path, so deleting versions while paging is fine.
+func (i *S3Index) GetVersionedPaths(after string, limit int) ([]string, error) {
+	err := i.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := i.db.Query(`SELECT DISTINCT path FROM fileversion WHERE path > ? ORDER BY path LIMIT ?`, after, limit)
+	if err != nil {
+		return nil, fmt.Errorf("could not get versioned paths: %w", err)
+	}
+	defer rows.Close()
+
+	results := []string{}
+	for rows.Next() {
+		var path string
+		err = rows.Scan(&path)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning rows: %w", err)
+		}
+		results = append(results, path)
+	}
+
+	return results, rows.Err()
+}
+
+// Delete a previous version of a file.
+// Returns the stored path of a version that was stored as a single blob, and the hashes of the chunks it used.
+func (i *S3Index) DeleteVersion(id int64) (string, []string, error) {
+	err := i.Load()
+	if err != nil {
+		return "", nil, err
+	}
+
+	tx, err := i.db.Begin()
+	if err != nil {
+		return "", nil, fmt.Errorf("cannot start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var storedPath string
+	err = tx.QueryRow(`SELECT storedpath FROM fileversion WHERE id = ?`, id).Scan(&storedPath)
+	if err != nil {
+		return "", nil, fmt.Errorf("version not found: %w", err)
+	}
+
+	rows, err := tx.Query(`SELECT DISTINCT hash FROM versionchunk WHERE version = ?`, id)
+	if err != nil {
+		return "", nil, fmt.Errorf("could not get chunks: %w", err)
+	}
+	hashes := []string{}
+	for rows.Next() {
+		var hash string
+		err = rows.Scan(&hash)
+		if err != nil {
+			rows.Close()
+			return "", nil, fmt.Errorf("error scanning rows: %w", err)
+		}
+		hashes = append(hashes, hash)
+	}
+	rows.Close()
+
+	_, err = tx.Exec(`DELETE FROM versionchunk WHERE version = ?`, id)
+	if err != nil {
+		return "", nil, fmt.Errorf("cannot delete version chunks: %w", err)
+	}
+
+	_, err = tx.Exec(`DELETE FROM fileversion WHERE id = ?`, id)
+	if err != nil {
+		return "", nil, fmt.Errorf("cannot delete version: %w", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return "", nil, fmt.Errorf("cannot commit: %w", err)
+	}
+
+	return storedPath, hashes, nil
+}
+
+// Get the hashes of chunks that are not used by any file or version.
+// These are left behind when storing a file fails halfway.
+func (i *S3Index) GetUnusedChunks() ([]string, error) {
+	err := i.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := i.db.Query(`SELECT hash FROM chunk c
+		WHERE NOT EXISTS (SELECT 1 FROM filechunk f WHERE f.hash = c.hash)
+		AND NOT EXISTS (SELECT 1 FROM versionchunk v WHERE v.hash = c.hash)`)
+	if err != nil {
+		return nil, fmt.Errorf("could not get unused chunks: %w", err)
+	}
+	defer rows.Close()
+
+	results := []string{}
+	for rows.Next() {
+		var hash string
+		err = rows.Scan(&hash)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning rows: %w", err)
+		}
+		results = append(results, hash)
+	}
+
+	return results, rows.Err()
+}
+
+// Get every stored path the index refers to: chunks, and files or versions stored as a single blob.
+func (i *S3Index) GetStoredPaths() ([]string, error) {
+	err := i.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := i.db.Query(`SELECT storedpath FROM chunk
+		UNION SELECT storedpath FROM fileinfo WHERE storedpath != ''
+		UNION SELECT storedpath FROM fileversion WHERE storedpath != ''`)
+	if err != nil {
+		return nil, fmt.Errorf("could not get stored paths: %w", err)
+	}
+	defer rows.Close()
+
+	results := []string{}
+	for rows.Next() {
+		var storedPath string
+		err = rows.Scan(&storedPath)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning rows: %w", err)
+		}
+		results = append(results, storedPath)
+	}
+
+	return results, rows.Err()
+}
+
+// Queue every stored path for re-encryption, unless a rekey that was interrupted is still running. Returns how many are queued.
+// A rekey runs until FinishRekey, so one that re-encrypted everything but didn't finish has nothing queued.
+func (i *S3Index) StartRekey() (int, error) {
+	err := i.Load()
+	if err != nil {
+		return 0, err
+	}
+
+	var queued int
+	err = i.db.QueryRow(`SELECT count(*) FROM rekey`).Scan(&queued)
+	if err != nil {
+		return 0, fmt.Errorf("could not count queued paths: %w", err)
+	}
+	if queued > 0 {
+		return queued, nil
+	}
+
+	var running int
+	err = i.db.QueryRow(`SELECT count(*) FROM rekeyrun`).Scan(&running)
+	if err != nil {
+		return 0, fmt.Errorf("could not check running rekey: %w", err)
+	}
+	if running > 0 {
+		return 0, nil
+	}
+
+	res, err := i.db.Exec(`INSERT INTO rekey (storedpath) SELECT storedpath FROM chunk
+		UNION SELECT storedpath FROM fileinfo WHERE storedpath != ''
+		UNION SELECT storedpath FROM fileversion WHERE storedpath != ''`)
+	if err != nil {
+		return 0, fmt.Errorf("could not queue stored paths: %w", err)
+	}
+
+	count, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = i.db.Exec(`INSERT INTO rekeyrun (id) VALUES (1)`)
+	if err != nil {
+		return 0, fmt.Errorf("could not start rekey: %w", err)
+	}
+
+	return int(count), nil
+}
+
+// End a rekey, so the next one queues everything again.
+func (i *S3Index) FinishRekey() error {
+	err := i.Load()
+	if err != nil {
+		return err
+	}
+
+	_, err = i.db.Exec(`DELETE FROM rekeyrun`)
+	if err != nil {
+		return fmt.Errorf("could not finish rekey: %w", err)
+	}
+
+	return nil
+}
+
+// Get stored paths that still need to be re-encrypted.
+func (i *S3Index) GetRekeyPaths(limit int) ([]string, error) {
+	err := i.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := i.db.Query(`SELECT storedpath FROM rekey ORDER BY storedpath LIMIT ?`, limit)
+	if err != nil {
+		return nil, fmt.Errorf("could not get queued paths: %w", err)
+	}
+	defer rows.Close()
+
+	results := []string{}
+	for rows.Next() {
+		var storedPath string
+		err = rows.Scan(&storedPath)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning rows: %w", err)
+		}
+		results = append(results, storedPath)
+	}
+
+	return results, rows.Err()
+}
+
+// Point everything that is stored at oldPath to newPath, and take it off the rekey queue.
+func (i *S3Index) ReplaceStoredPath(oldPath, newPath string) error {
+	err := i.Load()
+	if err != nil {
+		return err
+	}
+
+	for _, table := range []string{"chunk", "fileinfo", "fileversion"} {
+		_, err = i.db.Exec(`UPDATE `+table+` SET storedpath = ? WHERE storedpath = ?`, newPath, oldPath)
+		if err != nil {
+			return fmt.Errorf("could not update stored path: %w", err)
+		}
+	}
+
+	_, err = i.db.Exec(`DELETE FROM rekey WHERE storedpath = ?`, oldPath)
+	if err != nil {
+		return fmt.Errorf("could not dequeue stored path: %w", err)
+	}
+
+	return nil
+}
+
+// Persist the index without closing it, so a session that is interrupted later doesn't lose the changes made so far.
+// What is persisted becomes the new base for merging.
+func (i *S3Index) Checkpoint() error {
+	err := i.Load()
+	if err != nil {
+		return err
+	}
+
+	err = i.persist()
+	if err != nil {
+		return err
+	}
+
+	err = copyFile(i.unencryptedPath, i.basePath())
+	if err != nil {
+		return fmt.Errorf("cannot keep base copy of index: %w", err)
+	}
+
+	return nil
+}
+
 func (i *S3Index) Close() error {
 	if i.db == nil {
 		return nil
@@ -177,32 +840,185 @@ func (i *S3Index) Close() error {
 
 	i.db = nil
 
-	tmpFile, err := os.CreateTemp("", "enc-")
+	err = i.persist()
 	if err != nil {
-		return fmt.Errorf("could not create temp file: %w", err)
+		return err
 	}
-	defer tmpFile.Close()
 
-	//encrypt
-	err = modifiers.CompressAndEncryptFile(i.unencryptedPath, tmpFile.Name(), i.passphrase)
+	//delete unencrypted index
+	err = os.Remove(i.unencryptedPath)
 	if err != nil {
-		return fmt.Errorf("cannot encrypt index: %w", err)
+		return fmt.Errorf("cannot cleanup unencrypted index: %w", err)
 	}
+	os.Remove(i.basePath())
+
+	return nil
+}
+
+// Encrypt and upload the index. The upload is conditional on the ETag it was loaded with.
+// If another client changed it in the meantime, their changes are merged in first.
+func (i *S3Index) persist() error {
+	for attempt := 1; ; attempt++ {
+		if attempt > maxMergeAttempts {
+			return errors.New("index keeps being changed by another client")
+		}
+
+		//Also catches changes on providers that ignore the upload condition
+		current, err := i.s3client.GetETag(sqliteIndexName)
+		if err != nil {
+			return fmt.Errorf("cannot check index: %w", err)
+		}
+
+		if current == i.etag {
+			err = i.upload()
+			if !errors.Is(err, s3client.ErrPreconditionFailed) {
+				return err
+			}
+		}
+
+		logger.Warn("remote index was changed by another client, merging")
+		err = i.merge()
+		if err != nil {
+			return fmt.Errorf("cannot merge index: %w", err)
+		}
+	}
+}
 
-	_, err = tmpFile.Seek(0, 0)
+func (i *S3Index) upload() error {
+	file, err := os.Open(i.unencryptedPath)
 	if err != nil {
-		return fmt.Errorf("could not reset head to 0: %w", err)
+		return fmt.Errorf("cannot open unencrypted index: %w", err)
 	}
+	defer file.Close()
+
+	//Encrypt while uploading, big indexes are uploaded in parts
+	reader, writer := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		err := modifiers.CompressAndEncrypt(file, writer, i.keys.ForIndex())
+		if err != nil {
+			err = fmt.Errorf("cannot encrypt index: %w", err)
+		}
+		writer.CloseWithError(err)
+	}()
+	defer func() {
+		//Stops the encryption if the upload failed
+		reader.Close()
+		<-done
+	}()
 
 	//push to s3
-	err = i.s3client.UploadFile(sqliteIndexName, tmpFile)
+	var etag string
+	if i.etag == "" {
+		etag, err = i.s3client.CreateFile(sqliteIndexName, reader)
+	} else {
+		etag, err = i.s3client.ReplaceFile(sqliteIndexName, reader, i.etag)
+	}
+	if errors.Is(err, s3client.ErrPreconditionFailed) {
+		return err
+	}
 	if err != nil {
 		return fmt.Errorf("cannot upload index: %w", err)
 	}
 
-	//delete unencrypted index
-	err = os.Remove(i.unencryptedPath)
+	i.etag = etag
+	return nil
+}
+
+// Merge the changes another client made into ours. The index they wrote becomes the new base.
+func (i *S3Index) merge() error {
+	theirsPath := i.unencryptedPath + "-theirs"
+	os.Remove(theirsPath)
+	defer os.Remove(theirsPath)
+
+	etag, err := i.download(theirsPath)
+	if err != nil {
+		return err
+	}
+
+	//Removed from the remote, ours replaces it
+	if etag == "" {
+		i.etag = ""
+		return nil
+	}
+
+	revived, err := indexmerge.Merge(i.unencryptedPath, i.basePath(), theirsPath, prepare)
+	if err != nil {
+		return err
+	}
+	i.revived = append(i.revived, revived...)
+
+	err = os.Rename(theirsPath, i.basePath())
 	if err != nil {
+		return fmt.Errorf("cannot update base: %w", err)
+	}
+
+	i.etag = etag
+	return nil
+}
+
+// Download and decrypt the index to a file. Returns the ETag, or an empty string if there is no index yet.
+func (i *S3Index) download(target string) (string, error) {
+	encryptedData, etag, err := i.s3client.DownloadFileWithETag(sqliteIndexName)
+	if s3client.IsNotFound(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("cannot download index: %w", err)
+	}
+	defer encryptedData.Close()
+
+	decryptedData, err := modifiers.DecryptAndDecompress(encryptedData, i.keys)
+	if err != nil {
+		return "", fmt.Errorf("cannot decrypt index: %w", err)
+	}
+	defer decryptedData.Close()
+
+	file, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return "", fmt.Errorf("cannot open unencrypted index: %w", err)
+	}
+	defer file.Close()
+
+	_, err = io.Copy(file, decryptedData)
+	if err != nil {
+		return "", fmt.Errorf("could not write index to file: %w", err)
+	}
+
+	return etag, nil
+}
+
+// Stored paths that are in use again after merging changes of another client.
+// Blobs queued for deletion with these paths must be kept.
+func (i *S3Index) Revived() []string {
+	revived := i.revived
+	i.revived = nil
+	return revived
+}
+
+// Copy of the index as it was loaded, used as the common ancestor when merging.
+func (i *S3Index) basePath() string {
+	return i.unencryptedPath + "-base"
+}
+
+// Close the db without persisting it, and remove the unencrypted copy.
+func (i *S3Index) Discard() error {
+	if i.db != nil {
+		err := i.db.Close()
+		if err != nil {
+			return fmt.Errorf("cannot close db: %w", err)
+		}
+		i.db = nil
+	}
+
+	if i.unencryptedPath == "" {
+		return nil
+	}
+
+	os.Remove(i.basePath())
+	err := os.Remove(i.unencryptedPath)
+	if err != nil && !os.IsNotExist(err) {
 		return fmt.Errorf("cannot cleanup unencrypted index: %w", err)
 	}
 
@@ -210,6 +1026,9 @@ func (i *S3Index) Close() error {
 }
 
 func (i *S3Index) Load() error {
+	i.loadMu.Lock()
+	defer i.loadMu.Unlock()
+
 	if i.db != nil {
 		return nil
 	}
@@ -225,36 +1044,63 @@ func (i *S3Index) Load() error {
 		i.unencryptedPath = path.Join(os.TempDir(), "buttercup-"+randStr+".db")
 	}
 
-	encryptedData, err := i.s3client.DownloadFile(sqliteIndexName)
-	if err == nil {
-		defer encryptedData.Close()
-		decryptedData, err := modifiers.DecryptAndDecompress(encryptedData, i.passphrase)
-		if err != nil {
-			return fmt.Errorf("cannot decrypt index: %w", err)
-		}
-		defer decryptedData.Close()
-
-		file, err := os.OpenFile(i.unencryptedPath, os.O_CREATE|os.O_RDWR, 0600)
-		if err != nil {
-			return fmt.Errorf("cannot open unencrypted index: %w", err)
-		}
+	os.Remove(i.basePath())
+	etag, err := i.download(i.unencryptedPath)
+	if err != nil {
+		return err
+	}
 
-		_, err = io.Copy(file, decryptedData)
+	if etag != "" {
+		err = copyFile(i.unencryptedPath, i.basePath())
 		if err != nil {
-			return fmt.Errorf("could not write index to file: %w", err)
+			return fmt.Errorf("cannot keep base copy of index: %w", err)
 		}
 	}
+	i.etag = etag
 
 	//create connection
 	conn, err := sql.Open("sqlite3", i.unencryptedPath)
 	if err != nil {
 		return fmt.Errorf("cannot connect to sqlite db: %w", err)
 	}
+	//sqlite doesn't handle concurrent writers, so everything goes through one connection
+	conn.SetMaxOpenConns(1)
 	i.db = conn
 
-	_, err = conn.Exec(createScript)
+	return prepare(conn)
+}
+
+// Bring a database up to the current schema.
+func prepare(conn *sql.DB) error {
+	_, err := conn.Exec(createScript)
 	if err != nil {
 		return fmt.Errorf("cannot run create script: %w", err)
 	}
+
+	err = migrate.Run(conn, migrations)
+	if err != nil {
+		return fmt.Errorf("cannot migrate db: %w", err)
+	}
 	return nil
 }
+
+func copyFile(src, dst string) error {
+	reader, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	writer, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(writer, reader)
+	if err != nil {
+		writer.Close()
+		return err
+	}
+
+	return writer.Close()
+}
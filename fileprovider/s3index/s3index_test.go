@@ -1,18 +1,28 @@
 package s3index
 
 import (
+	"bytes"
+	"fmt"
+	"io"
 	"os"
+	"sync"
 	"testing"
 
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/c00/buttercup/appconfig"
 	"github.com/c00/buttercup/fileprovider/s3client"
+	"github.com/c00/buttercup/modifiers"
 	"github.com/joho/godotenv"
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/stretchr/testify/assert"
 )
 
+// Uses S3 when an endpoint is configured, and an in-memory store otherwise.
 func createDb() *S3Index {
 	godotenv.Load("../../.env")
+	if os.Getenv("TEST_S3_ENDPOINT") == "" {
+		return newIndex(newMemStore(), testKeys)
+	}
 
 	s3client := s3client.New(appconfig.S3ProviderConfig{
 		Passphrase:     "foobar",
@@ -25,7 +35,7 @@ func createDb() *S3Index {
 		ForcePathStyle: true,
 	})
 
-	index := New(s3client, "foo")
+	index := New(s3client, testKeys)
 	s3client.DeleteFolder("")
 
 	return index
@@ -83,7 +93,7 @@ func TestExisting(t *testing.T) {
 
 	assert.Nil(t, db.Close())
 
-	newDb := New(db.s3client, "foo")
+	newDb := newIndex(db.s3client, testKeys)
 	defer newDb.Close()
 
 	gotten, err := newDb.GetFileInfo("/foo.txt")
@@ -146,3 +156,62 @@ func getFileInfo(path string) S3FileInfo {
 		StoredPath: "some/encrypted/path",
 	}
 }
+
+var testKeys, _ = modifiers.PassphraseKeys("foo")
+
+// Keeps files in memory, with the same conditional writes as S3.
+type memStore struct {
+	mu    sync.Mutex
+	files map[string][]byte
+	etags map[string]string
+	count int
+}
+
+func newMemStore() *memStore {
+	return &memStore{files: map[string][]byte{}, etags: map[string]string{}}
+}
+
+func (m *memStore) DownloadFileWithETag(filepath string) (io.ReadCloser, string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	data, ok := m.files[filepath]
+	if !ok {
+		return nil, "", &types.NoSuchKey{}
+	}
+	return io.NopCloser(bytes.NewReader(data)), m.etags[filepath], nil
+}
+
+func (m *memStore) GetETag(filepath string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.etags[filepath], nil
+}
+
+func (m *memStore) CreateFile(filepath string, content io.Reader) (string, error) {
+	return m.write(filepath, content, func(current string) bool { return current == "" })
+}
+
+func (m *memStore) ReplaceFile(filepath string, content io.Reader, etag string) (string, error) {
+	return m.write(filepath, content, func(current string) bool { return current == etag })
+}
+
+func (m *memStore) write(filepath string, content io.Reader, condition func(current string) bool) (string, error) {
+	data, err := io.ReadAll(content)
+	if err != nil {
+		return "", err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !condition(m.etags[filepath]) {
+		return "", s3client.ErrPreconditionFailed
+	}
+
+	m.count++
+	m.files[filepath] = data
+	m.etags[filepath] = fmt.Sprintf("etag-%v", m.count)
+	return m.etags[filepath], nil
+}
@@ -0,0 +1,178 @@
+package ignore
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Matches paths against gitignore style patterns. The last pattern that matches a path decides,
+// patterns that start with ! include paths that earlier patterns excluded.
+type Matcher struct {
+	rules []rule
+}
+
+type rule struct {
+	re      *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+// Parse patterns, one per line as they appear in an ignore file. Empty lines and lines starting with # are skipped.
+func Parse(patterns []string) (*Matcher, error) {
+	m := &Matcher{}
+	for _, pattern := range patterns {
+		r, ok, err := parseRule(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+		if ok {
+			m.rules = append(m.rules, r)
+		}
+	}
+
+	return m, nil
+}
+
+// Read the patterns in an ignore file. A file that doesn't exist has no patterns.
+func ReadFile(filePath string) ([]string, error) {
+	file, err := os.Open(filePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	lines := []string{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+
+	return lines, scanner.Err()
+}
+
+func parseRule(pattern string) (rule, bool, error) {
+	r := rule{}
+
+	pattern = strings.TrimRight(pattern, " \t\r")
+	if pattern == "" || strings.HasPrefix(pattern, "#") {
+		return r, false, nil
+	}
+
+	if strings.HasPrefix(pattern, "!") {
+		r.negate = true
+		pattern = pattern[1:]
+	} else if strings.HasPrefix(pattern, `\`) {
+		//Escaped # or !
+		pattern = pattern[1:]
+	}
+
+	if strings.HasSuffix(pattern, "/") {
+		r.dirOnly = true
+		pattern = strings.TrimSuffix(pattern, "/")
+	}
+
+	//Patterns with a slash are relative to the root, others match at any depth
+	anchored := strings.Contains(pattern, "/")
+	pattern = strings.TrimPrefix(pattern, "/")
+	if pattern == "" {
+		return r, false, nil
+	}
+
+	expr := "^"
+	if !anchored {
+		expr += "(?:.*/)?"
+	}
+	expr += translate(pattern) + "$"
+
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return r, false, err
+	}
+	r.re = re
+
+	return r, true, nil
+}
+
+// Turn a glob into a regular expression. ** matches any number of folders.
+func translate(pattern string) string {
+	var b strings.Builder
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch {
+		case strings.HasPrefix(pattern[i:], "**/"):
+			b.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(pattern[i:], "**"):
+			b.WriteString(".*")
+			i++
+		case c == '*':
+			b.WriteString("[^/]*")
+		case c == '?':
+			b.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(pattern[i+1:], ']')
+			if end < 0 {
+				b.WriteString(`\[`)
+				continue
+			}
+			class := pattern[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+			i += end + 1
+		case c == '\\' && i+1 < len(pattern):
+			i++
+			b.WriteString(regexp.QuoteMeta(string(pattern[i])))
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+
+	return b.String()
+}
+
+// Check a single path, without looking at the folders it is in. Paths are relative to the root, like "/sub/file.txt".
+func (m *Matcher) Match(filePath string, isDir bool) bool {
+	if m == nil {
+		return false
+	}
+
+	filePath = strings.TrimPrefix(filePath, "/")
+	ignored := false
+	for _, r := range m.rules {
+		if r.dirOnly && !isDir {
+			continue
+		}
+		if r.re.MatchString(filePath) {
+			ignored = !r.negate
+		}
+	}
+
+	return ignored
+}
+
+// Check if a file is ignored, either itself or because a folder it is in is ignored.
+// Like with git, a file in an ignored folder can't be included again.
+func (m *Matcher) Ignores(filePath string) bool {
+	if m == nil {
+		return false
+	}
+
+	parts := strings.Split(strings.TrimPrefix(filePath, "/"), "/")
+	for i := 1; i < len(parts); i++ {
+		if m.Match(strings.Join(parts[:i], "/"), true) {
+			return true
+		}
+	}
+
+	return m.Match(filePath, false)
+}
@@ -0,0 +1,68 @@
+package ignore
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIgnores(t *testing.T) {
+	m, err := Parse([]string{
+		"# editor files",
+		"*.swp",
+		".DS_Store",
+		"node_modules/",
+		"/build",
+		"docs/**/*.tmp",
+		"logs/*",
+		"!logs/keep.log",
+		"",
+		`\#notes`,
+		"file[0-9].txt",
+		"!important.swp",
+	})
+	assert.Nil(t, err)
+
+	for path, ignored := range map[string]bool{
+		"/a.txt":                         false,
+		"/a.swp":                         true,
+		"/sub/.a.txt.swp":                true,
+		"/important.swp":                 false,
+		"/.DS_Store":                     true,
+		"/photos/.DS_Store":              true,
+		"/node_modules/x/index.js":       true,
+		"/app/node_modules/index.js":     true,
+		"/node_modules":                  false,
+		"/build/out.bin":                 true,
+		"/src/build/out.bin":             false,
+		"/docs/a.tmp":                    true,
+		"/docs/x/y/a.tmp":                true,
+		"/other/a.tmp":                   false,
+		"/logs/today.log":                true,
+		"/logs/keep.log":                 false,
+		"/#notes":                        true,
+		"/file1.txt":                     true,
+		"/fileA.txt":                     false,
+		"/logs/deeper/keep.log":          true,
+		"/node_modules_backup/readme.md": false,
+	} {
+		assert.Equal(t, m.Ignores(path), ignored, path)
+	}
+
+	var none *Matcher
+	assert.False(t, none.Ignores("/a.swp"))
+}
+
+func TestReadFile(t *testing.T) {
+	dir := t.TempDir()
+	lines, err := ReadFile(filepath.Join(dir, ".buttercupignore"))
+	assert.Nil(t, err)
+	assert.Equal(t, len(lines), 0)
+
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, ".buttercupignore"), []byte("*.swp\n\n.git/\n"), 0644))
+	lines, err = ReadFile(filepath.Join(dir, ".buttercupignore"))
+	assert.Nil(t, err)
+	assert.Equal(t, lines, []string{"*.swp", "", ".git/"})
+}
@@ -0,0 +1,32 @@
+package migrate
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// Run the migrations that have not been applied to the database yet.
+// The amount of applied migrations is tracked in the sqlite user_version pragma,
+// so migrations should only ever be appended to.
+func Run(db *sql.DB, migrations []string) error {
+	var version int
+	err := db.QueryRow("PRAGMA user_version").Scan(&version)
+	if err != nil {
+		return fmt.Errorf("cannot get schema version: %w", err)
+	}
+
+	for i := version; i < len(migrations); i++ {
+		_, err = db.Exec(migrations[i])
+		if err != nil {
+			return fmt.Errorf("cannot run migration %v: %w", i+1, err)
+		}
+
+		//Pragmas don't take parameters
+		_, err = db.Exec(fmt.Sprintf("PRAGMA user_version = %d", i+1))
+		if err != nil {
+			return fmt.Errorf("cannot set schema version: %w", err)
+		}
+	}
+
+	return nil
+}
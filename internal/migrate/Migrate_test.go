@@ -0,0 +1,30 @@
+package migrate
+
+import (
+	"database/sql"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRun(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	assert.Nil(t, err)
+	db.SetMaxOpenConns(1)
+
+	_, err = db.Exec("CREATE TABLE foo (id INTEGER)")
+	assert.Nil(t, err)
+
+	migrations := []string{"ALTER TABLE foo ADD COLUMN bar TEXT"}
+	assert.Nil(t, Run(db, migrations))
+
+	//Running again should not apply the same migration twice
+	assert.Nil(t, Run(db, migrations))
+
+	migrations = append(migrations, "ALTER TABLE foo ADD COLUMN baz TEXT")
+	assert.Nil(t, Run(db, migrations))
+
+	_, err = db.Exec("INSERT INTO foo (id, bar, baz) VALUES (1, 'a', 'b')")
+	assert.Nil(t, err)
+}
@@ -0,0 +1,103 @@
+package modifiers
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"filippo.io/age"
+)
+
+// Create a random data key.
+func NewDataKey() (*age.X25519Identity, error) {
+	return age.GenerateX25519Identity()
+}
+
+// Whether everything is encrypted with a passphrase, which means a data key can be used instead.
+func (k Keys) UsesPassphrase() bool {
+	return k.passphrase != nil
+}
+
+// Whether there is a data key to decrypt with.
+func (k Keys) HasDataKey() bool {
+	return k.dataKey != nil
+}
+
+// Use a data key. With a passphrase, everything is encrypted to the data key from now on.
+// Otherwise it is only used to decrypt what was encrypted to it before.
+func (k Keys) WithDataKey(dataKey *age.X25519Identity) Keys {
+	k.dataKey = dataKey
+	//Tried first, the passphrase is only needed for things from before there was a data key
+	k.identities = append([]age.Identity{dataKey}, k.identities...)
+	if k.UsesPassphrase() {
+		k.recipients = []age.Recipient{dataKey.Recipient()}
+	}
+	return k
+}
+
+// Encrypt the data key with the passphrase, to store it on the remote.
+func (k Keys) WrapDataKey() ([]byte, error) {
+	if !k.UsesPassphrase() || k.dataKey == nil {
+		return nil, errors.New("no data key to wrap")
+	}
+
+	out := &bytes.Buffer{}
+	writer, err := age.Encrypt(out, k.passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = io.WriteString(writer, k.dataKey.String())
+	if err != nil {
+		return nil, err
+	}
+
+	err = writer.Close()
+	if err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// Decrypt a data key that was wrapped with WrapDataKey().
+func (k Keys) UnwrapDataKey(wrapped []byte) (*age.X25519Identity, error) {
+	if !k.CanDecrypt() {
+		return nil, errors.New("no identity to decrypt with")
+	}
+
+	reader, err := age.Decrypt(bytes.NewReader(wrapped), k.identities...)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	dataKey, err := age.ParseX25519Identity(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid data key: %w", err)
+	}
+	return dataKey, nil
+}
+
+// Whether the input is already encrypted the way these keys encrypt now. Only the header is read.
+// Without a passphrase there is no way to tell, so that's always false.
+func (k Keys) IsCurrent(input io.Reader) (bool, error) {
+	if !k.UsesPassphrase() || k.dataKey == nil {
+		return false, nil
+	}
+
+	_, err := age.Decrypt(input, k.dataKey)
+	var noMatch *age.NoIdentityMatchError
+	if errors.As(err, &noMatch) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,65 @@
+package modifiers
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDataKey(t *testing.T) {
+	keys, err := PassphraseKeys("foo")
+	assert.Nil(t, err)
+	old := encrypt(t, keys, "old")
+
+	dataKey, err := NewDataKey()
+	assert.Nil(t, err)
+	keys = keys.WithDataKey(dataKey)
+	assert.True(t, keys.HasDataKey())
+
+	//New things are encrypted to the data key, old ones can still be read with the passphrase
+	data := encrypt(t, keys, "new")
+	assert.Equal(t, decrypt(t, keys, data), "new")
+	assert.Equal(t, decrypt(t, keys, old), "old")
+
+	current, err := keys.IsCurrent(bytes.NewReader(data))
+	assert.Nil(t, err)
+	assert.True(t, current)
+	current, err = keys.IsCurrent(bytes.NewReader(old))
+	assert.Nil(t, err)
+	assert.False(t, current)
+
+	//Only the passphrase unwraps the data key
+	wrapped, err := keys.WrapDataKey()
+	assert.Nil(t, err)
+	same, err := PassphraseKeys("foo")
+	assert.Nil(t, err)
+	unwrapped, err := same.UnwrapDataKey(wrapped)
+	assert.Nil(t, err)
+	assert.Equal(t, decrypt(t, same.WithDataKey(unwrapped), data), "new")
+
+	other, err := PassphraseKeys("bar")
+	assert.Nil(t, err)
+	_, err = other.UnwrapDataKey(wrapped)
+	assert.NotNil(t, err)
+}
+
+func TestDataKey_Recipients(t *testing.T) {
+	device, deviceFile := writeAgeIdentity(t, t.TempDir(), "device.txt")
+	keys, err := NewKeys("", []string{device.Recipient().String()}, nil, []string{deviceFile})
+	assert.Nil(t, err)
+	assert.False(t, keys.UsesPassphrase())
+
+	//Without a passphrase the data key is only used to decrypt
+	dataKey, err := NewDataKey()
+	assert.Nil(t, err)
+	withDataKey := keys.WithDataKey(dataKey)
+	data := encrypt(t, withDataKey, "new")
+	assert.Equal(t, decrypt(t, keys, data), "new")
+
+	_, err = withDataKey.WrapDataKey()
+	assert.NotNil(t, err)
+	current, err := withDataKey.IsCurrent(bytes.NewReader(data))
+	assert.Nil(t, err)
+	assert.False(t, current)
+}
@@ -0,0 +1,200 @@
+package modifiers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"filippo.io/age"
+	"filippo.io/age/agessh"
+	"golang.org/x/crypto/ssh"
+)
+
+// Who things are encrypted to, and what this device decrypts them with.
+type Keys struct {
+	recipients []age.Recipient
+	//Can read the index, but not the files
+	indexRecipients []age.Recipient
+	identities      []age.Identity
+	//Wraps the data key, when encrypting with a passphrase
+	passphrase age.Recipient
+	//Random key that everything is encrypted to instead of the passphrase, so scrypt only runs once
+	dataKey *age.X25519Identity
+	//Pad everything that is encrypted, to hide the exact sizes
+	padded bool
+}
+
+// Keys for a passphrase that is shared by all devices.
+func PassphraseKeys(passphrase string) (Keys, error) {
+	recipient, err := age.NewScryptRecipient(passphrase)
+	if err != nil {
+		return Keys{}, err
+	}
+	identity, err := age.NewScryptIdentity(passphrase)
+	if err != nil {
+		return Keys{}, err
+	}
+
+	return Keys{recipients: []age.Recipient{recipient}, identities: []age.Identity{identity}, passphrase: recipient}, nil
+}
+
+// Keys for public key encryption. Recipients are age (age1...) or SSH (ssh-ed25519, ssh-rsa) public keys,
+// identities are paths to age identity files or unencrypted SSH private keys.
+// A passphrase can be given as well, to keep reading what was encrypted with it before. Nothing new is encrypted with it.
+func NewKeys(passphrase string, recipients, indexRecipients, identityFiles []string) (Keys, error) {
+	if len(recipients) == 0 && len(indexRecipients) == 0 && len(identityFiles) == 0 {
+		return PassphraseKeys(passphrase)
+	}
+
+	keys := Keys{}
+	for _, r := range recipients {
+		recipient, err := ParseRecipient(r)
+		if err != nil {
+			return Keys{}, err
+		}
+		keys.recipients = append(keys.recipients, recipient)
+	}
+
+	for _, r := range indexRecipients {
+		recipient, err := ParseRecipient(r)
+		if err != nil {
+			return Keys{}, err
+		}
+		keys.indexRecipients = append(keys.indexRecipients, recipient)
+	}
+
+	for _, path := range identityFiles {
+		identities, err := ReadIdentityFile(path)
+		if err != nil {
+			return Keys{}, err
+		}
+		keys.identities = append(keys.identities, identities...)
+	}
+
+	if passphrase != "" {
+		identity, err := age.NewScryptIdentity(passphrase)
+		if err != nil {
+			return Keys{}, err
+		}
+		keys.identities = append(keys.identities, identity)
+	}
+
+	return keys, nil
+}
+
+// Also decrypt with a passphrase and identity files, like the ones that were used before the keys changed.
+func (k Keys) WithOldKeys(passphrase string, identityFiles []string) (Keys, error) {
+	identities := append([]age.Identity{}, k.identities...)
+	for _, path := range identityFiles {
+		old, err := ReadIdentityFile(path)
+		if err != nil {
+			return Keys{}, err
+		}
+		identities = append(identities, old...)
+	}
+
+	if passphrase != "" {
+		identity, err := age.NewScryptIdentity(passphrase)
+		if err != nil {
+			return Keys{}, err
+		}
+		identities = append(identities, identity)
+	}
+
+	k.identities = identities
+	return k, nil
+}
+
+// Keys for the index, which can also be read by the index recipients.
+func (k Keys) ForIndex() Keys {
+	k.recipients = append(append([]age.Recipient{}, k.recipients...), k.indexRecipients...)
+	return k
+}
+
+// Pad what is encrypted with these keys. See PaddedSize.
+func (k Keys) WithPadding(padded bool) Keys {
+	k.padded = padded
+	return k
+}
+
+func (k Keys) Padded() bool {
+	return k.padded
+}
+
+// Identifies who is encrypted to, so something encrypted earlier can be checked against the keys of now.
+// Empty if a recipient can't be told apart from others, like a passphrase without a data key or an SSH key.
+func (k Keys) Fingerprint() string {
+	h := sha256.New()
+	for _, r := range k.recipients {
+		named, ok := r.(fmt.Stringer)
+		if !ok {
+			return ""
+		}
+		fmt.Fprintln(h, named.String())
+	}
+	fmt.Fprintln(h, k.padded)
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Whether this device can decrypt anything.
+func (k Keys) CanDecrypt() bool {
+	return len(k.identities) > 0
+}
+
+// Parse an age or SSH public key.
+func ParseRecipient(s string) (age.Recipient, error) {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, "ssh-") {
+		recipient, err := agessh.ParseRecipient(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid SSH recipient %q: %w", s, err)
+		}
+		return recipient, nil
+	}
+
+	recipient, err := age.ParseX25519Recipient(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid recipient %q: %w", s, err)
+	}
+	return recipient, nil
+}
+
+// Read the identities in an age identity file, or an unencrypted SSH private key. A leading ~ is the home folder.
+func ReadIdentityFile(path string) ([]age.Identity, error) {
+	if rest, ok := strings.CutPrefix(path, "~/"); ok {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, fmt.Errorf("cannot find home folder: %w", err)
+		}
+		path = filepath.Join(home, rest)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read identity file: %w", err)
+	}
+
+	if bytes.Contains(data, []byte("-----BEGIN")) {
+		identity, err := agessh.ParseIdentity(data)
+		var missing *ssh.PassphraseMissingError
+		if errors.As(err, &missing) {
+			return nil, fmt.Errorf("%v: SSH keys with a passphrase are not supported, use an age identity instead", path)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%v: invalid SSH key: %w", path, err)
+		}
+		return []age.Identity{identity}, nil
+	}
+
+	identities, err := age.ParseIdentities(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%v: invalid identity file: %w", path, err)
+	}
+	return identities, nil
+}
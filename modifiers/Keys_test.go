@@ -0,0 +1,136 @@
+package modifiers
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestKeys_Recipients(t *testing.T) {
+	dir := t.TempDir()
+	device, deviceFile := writeAgeIdentity(t, dir, "device.txt")
+	backup, backupFile := writeAgeIdentity(t, dir, "backup.txt")
+	sshPublic, sshFile := writeSSHKey(t, dir)
+
+	recipients := []string{device.Recipient().String(), sshPublic}
+	indexRecipients := []string{backup.Recipient().String()}
+
+	keys, err := NewKeys("", recipients, indexRecipients, []string{deviceFile})
+	assert.Nil(t, err)
+	sshKeys, err := NewKeys("", recipients, indexRecipients, []string{sshFile})
+	assert.Nil(t, err)
+	writeOnly, err := NewKeys("", recipients, indexRecipients, []string{backupFile})
+	assert.Nil(t, err)
+
+	//Files can be read by every recipient, but not by the index recipients
+	data := encrypt(t, keys, "secret")
+	assert.Equal(t, decrypt(t, keys, data), "secret")
+	assert.Equal(t, decrypt(t, sshKeys, data), "secret")
+	_, err = DecryptAndDecompress(bytes.NewReader(data), writeOnly)
+	assert.NotNil(t, err)
+
+	//The index can be read by everyone
+	index := encrypt(t, writeOnly.ForIndex(), "index")
+	assert.Equal(t, decrypt(t, keys, index), "index")
+	assert.Equal(t, decrypt(t, writeOnly, index), "index")
+
+	//Without identities, nothing can be decrypted
+	noIdentities, err := NewKeys("", recipients, nil, nil)
+	assert.Nil(t, err)
+	assert.False(t, noIdentities.CanDecrypt())
+	_, err = DecryptAndDecompress(bytes.NewReader(data), noIdentities)
+	assert.NotNil(t, err)
+}
+
+func TestKeys_Passphrase(t *testing.T) {
+	device, deviceFile := writeAgeIdentity(t, t.TempDir(), "device.txt")
+
+	old, err := PassphraseKeys("foo")
+	assert.Nil(t, err)
+	data := encrypt(t, old, "old")
+
+	//The passphrase still reads what was encrypted with it, new things go to the recipients
+	keys, err := NewKeys("foo", []string{device.Recipient().String()}, nil, []string{deviceFile})
+	assert.Nil(t, err)
+	assert.Equal(t, decrypt(t, keys, data), "old")
+
+	data = encrypt(t, keys, "new")
+	_, err = DecryptAndDecompress(bytes.NewReader(data), old)
+	assert.NotNil(t, err)
+	assert.Equal(t, decrypt(t, keys, data), "new")
+}
+
+func TestKeys_Invalid(t *testing.T) {
+	_, err := NewKeys("", []string{"age1nope"}, nil, nil)
+	assert.NotNil(t, err)
+
+	_, err = NewKeys("", nil, nil, []string{filepath.Join(t.TempDir(), "missing.txt")})
+	assert.NotNil(t, err)
+}
+
+func writeAgeIdentity(t *testing.T, dir, name string) (*age.X25519Identity, string) {
+	identity, err := age.GenerateX25519Identity()
+	assert.Nil(t, err)
+	path := filepath.Join(dir, name)
+	assert.Nil(t, os.WriteFile(path, []byte(identity.String()+"\n"), 0600))
+	return identity, path
+}
+
+func writeSSHKey(t *testing.T, dir string) (string, string) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+	block, err := ssh.MarshalPrivateKey(private, "")
+	assert.Nil(t, err)
+	path := filepath.Join(dir, "id_ed25519")
+	assert.Nil(t, os.WriteFile(path, pem.EncodeToMemory(block), 0600))
+
+	sshPublic, err := ssh.NewPublicKey(public)
+	assert.Nil(t, err)
+	return string(ssh.MarshalAuthorizedKey(sshPublic)), path
+}
+
+func encrypt(t *testing.T, keys Keys, content string) []byte {
+	out := &bytes.Buffer{}
+	assert.Nil(t, CompressAndEncrypt(bytes.NewReader([]byte(content)), out, keys))
+	return out.Bytes()
+}
+
+func decrypt(t *testing.T, keys Keys, data []byte) string {
+	reader, err := DecryptAndDecompress(bytes.NewReader(data), keys)
+	if !assert.Nil(t, err) {
+		return ""
+	}
+	defer reader.Close()
+	content, err := io.ReadAll(reader)
+	assert.Nil(t, err)
+	return string(content)
+}
+
+func TestKeys_Fingerprint(t *testing.T) {
+	device, _ := writeAgeIdentity(t, t.TempDir(), "device.txt")
+	keys, err := NewKeys("", []string{device.Recipient().String()}, nil, nil)
+	assert.Nil(t, err)
+	same, err := NewKeys("", []string{device.Recipient().String()}, nil, nil)
+	assert.Nil(t, err)
+
+	assert.NotEqual(t, keys.Fingerprint(), "")
+	assert.Equal(t, keys.Fingerprint(), same.Fingerprint())
+	assert.NotEqual(t, keys.Fingerprint(), keys.WithPadding(true).Fingerprint())
+
+	//A passphrase can't be told apart, until there is a data key
+	passphrase, err := PassphraseKeys("foo")
+	assert.Nil(t, err)
+	assert.Equal(t, passphrase.Fingerprint(), "")
+	dataKey, err := NewDataKey()
+	assert.Nil(t, err)
+	assert.NotEqual(t, passphrase.WithDataKey(dataKey).Fingerprint(), "")
+}
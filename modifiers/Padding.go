@@ -0,0 +1,71 @@
+package modifiers
+
+import (
+	"encoding/binary"
+	"io"
+	"math/bits"
+)
+
+// Anything smaller is padded to this size, so small files all look the same.
+const minPaddedSize = 4096
+
+// Biggest padding that fits in one skippable frame.
+const maxFrameSize = 1<<32 - 1
+
+// The size to pad n bytes to. Sizes are rounded up with Padmé, which hides all but the most significant bits of the size
+// and adds at most 6% (less for bigger sizes).
+func PaddedSize(n int64) int64 {
+	n = max(n, minPaddedSize)
+
+	e := bits.Len64(uint64(n)) - 1
+	s := bits.Len64(uint64(e))
+	mask := int64(1)<<(e-s) - 1
+	return (n + mask) &^ mask
+}
+
+// Pad a zstd stream of size bytes with skippable frames, which decoders ignore.
+func writePadding(w io.Writer, size int64) error {
+	//Every frame has an 8 byte header
+	padding := PaddedSize(size+8) - size - 8
+
+	for {
+		frameSize := min(padding, maxFrameSize)
+		header := make([]byte, 8)
+		binary.LittleEndian.PutUint32(header[0:4], 0x184D2A50)
+		binary.LittleEndian.PutUint32(header[4:8], uint32(frameSize))
+
+		_, err := w.Write(header)
+		if err != nil {
+			return err
+		}
+
+		_, err = io.CopyN(w, zeroReader{}, frameSize)
+		if err != nil {
+			return err
+		}
+
+		padding -= frameSize
+		if padding < 8 {
+			return nil
+		}
+		padding -= 8
+	}
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+type countingWriter struct {
+	writer io.Writer
+	n      int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.writer.Write(p)
+	w.n += int64(n)
+	return n, err
+}
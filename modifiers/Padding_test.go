@@ -0,0 +1,74 @@
+package modifiers
+
+import (
+	"crypto/rand"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPaddedSize(t *testing.T) {
+	assert.Equal(t, PaddedSize(0), int64(4096))
+	assert.Equal(t, PaddedSize(4096), int64(4096))
+	assert.Equal(t, PaddedSize(4097), int64(4352))
+	assert.Equal(t, PaddedSize(100_000), int64(100_352))
+	assert.Equal(t, PaddedSize(2_000_000), int64(2_031_616))
+
+	for _, n := range []int64{5000, 12345, 1 << 20, 3_000_001, 1 << 33} {
+		padded := PaddedSize(n)
+		assert.GreaterOrEqual(t, padded, n)
+		assert.LessOrEqual(t, float64(padded), float64(n)*1.07)
+	}
+}
+
+func TestPadding(t *testing.T) {
+	keys, err := PassphraseKeys("foo")
+	assert.Nil(t, err)
+	padded := keys.WithPadding(true)
+
+	//Random data doesn't compress, so the sizes only differ by the padding
+	content := make([]byte, 10_000)
+	_, err = rand.Read(content)
+	assert.Nil(t, err)
+
+	plain := encrypt(t, keys, string(content))
+	data := encrypt(t, padded, string(content))
+	assert.Equal(t, decrypt(t, padded, data), string(content))
+	assert.Equal(t, decrypt(t, keys, data), string(content))
+	assert.Greater(t, len(data), len(plain))
+
+	//Similar sizes end up the same size
+	other := encrypt(t, padded, string(content[:9_900]))
+	assert.Equal(t, len(other), len(data))
+
+	//Small things all look the same
+	small := encrypt(t, padded, "a")
+	empty := encrypt(t, padded, "")
+	assert.Equal(t, len(small), len(empty))
+	assert.Equal(t, decrypt(t, keys, empty), "")
+}
+
+// Fails once more than limit bytes are written.
+type limitedWriter struct {
+	limit   int
+	written int
+}
+
+func (w *limitedWriter) Write(p []byte) (int, error) {
+	if w.written+len(p) > w.limit {
+		return 0, errors.New("disk full")
+	}
+	w.written += len(p)
+	return len(p), nil
+}
+
+func TestPadding_LastChunkErrorIsReturned(t *testing.T) {
+	keys, err := PassphraseKeys("foo")
+	assert.Nil(t, err)
+
+	//The header fits, the padded content is only written when the last chunk is
+	err = CompressAndEncrypt(strings.NewReader("small"), &limitedWriter{limit: 1024}, keys.WithPadding(true))
+	assert.NotNil(t, err)
+}
@@ -1,6 +1,7 @@
 package modifiers
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -9,7 +10,7 @@ import (
 	"github.com/klauspost/compress/zstd"
 )
 
-func CompressAndEncryptFile(input, output, passphrase string) error {
+func CompressAndEncryptFile(input, output string, keys Keys) error {
 	reader, err := os.Open(input)
 	if err != nil {
 		return fmt.Errorf("cannot open input path: %w", err)
@@ -20,37 +21,62 @@ func CompressAndEncryptFile(input, output, passphrase string) error {
 	if err != nil {
 		return fmt.Errorf("cannot open output path: %w", err)
 	}
-	defer writer.Close()
 
-	err = CompressAndEncrypt(reader, writer, passphrase)
+	err = CompressAndEncrypt(reader, writer, keys)
 	if err != nil {
+		writer.Close()
 		return fmt.Errorf("cannot encrypt: %w", err)
 	}
+
+	err = writer.Close()
+	if err != nil {
+		return fmt.Errorf("cannot write output path: %w", err)
+	}
 	return nil
 }
 
-// todo write tests.
-func CompressAndEncrypt(input io.Reader, output io.Writer, password string) error {
-	recipient, err := age.NewScryptRecipient(password)
+// Compress the input and encrypt it to the recipients of the keys. With padding, the compressed data is padded
+// so the size of the output only tells roughly how big it is.
+func CompressAndEncrypt(input io.Reader, output io.Writer, keys Keys) error {
+	if len(keys.recipients) == 0 {
+		return errors.New("no recipients to encrypt to")
+	}
+	encryptedWriter, err := age.Encrypt(output, keys.recipients...)
 	if err != nil {
 		return err
 	}
-	encryptedWriter, err := age.Encrypt(output, recipient)
+	closed := false
+	defer func() {
+		if !closed {
+			encryptedWriter.Close()
+		}
+	}()
+
+	counter := &countingWriter{writer: encryptedWriter}
+	compressionWriter, err := zstd.NewWriter(counter)
 	if err != nil {
 		return err
 	}
-	defer encryptedWriter.Close()
 
-	compressionWriter, err := zstd.NewWriter(encryptedWriter)
+	_, err = io.Copy(compressionWriter, input)
 	if err != nil {
+		compressionWriter.Close()
 		return err
 	}
-	defer compressionWriter.Close()
 
-	_, err = io.Copy(compressionWriter, input)
+	err = compressionWriter.Close()
 	if err != nil {
 		return err
 	}
 
-	return nil
+	if keys.padded {
+		err = writePadding(encryptedWriter, counter.n)
+		if err != nil {
+			return err
+		}
+	}
+
+	//Writes the last chunk, with the end of the padding
+	closed = true
+	return encryptedWriter.Close()
 }
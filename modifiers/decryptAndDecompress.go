@@ -1,6 +1,7 @@
 package modifiers
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -9,13 +10,13 @@ import (
 	"github.com/klauspost/compress/zstd"
 )
 
-func DecryptAndDecompressFile(inputPath, outputPath, passphrase string) error {
+func DecryptAndDecompressFile(inputPath, outputPath string, keys Keys) error {
 	file, err := os.Open(inputPath)
 	if err != nil {
 		return fmt.Errorf("cannot open input file: %w", err)
 	}
 
-	reader, err := DecryptAndDecompress(file, passphrase)
+	reader, err := DecryptAndDecompress(file, keys)
 	if err != nil {
 		return fmt.Errorf("cannot get reader: %w", err)
 	}
@@ -35,13 +36,16 @@ func DecryptAndDecompressFile(inputPath, outputPath, passphrase string) error {
 	return nil
 }
 
-// todo write tests.
-func DecryptAndDecompress(input io.Reader, password string) (io.ReadCloser, error) {
-	identity, err := age.NewScryptIdentity(password)
-	if err != nil {
-		return nil, err
+// Decrypt the input with the identities of the keys, and decompress it.
+func DecryptAndDecompress(input io.Reader, keys Keys) (io.ReadCloser, error) {
+	if !keys.CanDecrypt() {
+		return nil, errors.New("no identity to decrypt with, this device can only write")
+	}
+	decryptedReader, err := age.Decrypt(input, keys.identities...)
+	var noMatch *age.NoIdentityMatchError
+	if errors.As(err, &noMatch) {
+		return nil, fmt.Errorf("not encrypted to any of our identities: %w", err)
 	}
-	decryptedReader, err := age.Decrypt(input, identity)
 	if err != nil {
 		return nil, err
 	}
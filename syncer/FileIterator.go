@@ -0,0 +1,177 @@
+package syncer
+
+import (
+	"fmt"
+
+	"github.com/c00/buttercup/fileprovider"
+)
+
+const defaultPageSize = 1000
+
+// Walks the index of a provider one page at a time, in path order.
+// The provider may be written to while iterating. Rows inserted before the cursor shift
+// the offsets forward, so paths that were already returned are skipped when they show up again.
+func newFileIterator(provider fileprovider.FileProvider, pageSize int) *fileIterator {
+	return &fileIterator{
+		provider: provider,
+		pageSize: pageSize,
+	}
+}
+
+type fileIterator struct {
+	provider fileprovider.FileProvider
+	pageSize int
+	offset   int
+	page     []fileprovider.FileInfo
+	pos      int
+	lastPath string
+	started  bool
+	done     bool
+}
+
+// Returns the current FileInfo, or nil when the index is exhausted.
+func (it *fileIterator) Peek() (*fileprovider.FileInfo, error) {
+	for !it.done {
+		for it.pos < len(it.page) {
+			fi := &it.page[it.pos]
+			if it.started && fi.Path <= it.lastPath {
+				//Already seen, the index shifted under us.
+				it.pos++
+				continue
+			}
+			return fi, nil
+		}
+
+		err := it.loadPage()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return nil, nil
+}
+
+// Moves past the current FileInfo.
+func (it *fileIterator) Next() {
+	if it.pos >= len(it.page) {
+		return
+	}
+
+	it.lastPath = it.page[it.pos].Path
+	it.started = true
+	it.pos++
+}
+
+func (it *fileIterator) loadPage() error {
+	page, err := it.provider.GetFileInfos(it.pageSize, it.offset)
+	if err != nil {
+		return fmt.Errorf("could not get page: %w", err)
+	}
+
+	it.offset += len(page)
+	it.page = page
+	it.pos = 0
+
+	if len(page) == 0 {
+		it.done = true
+	}
+
+	return nil
+}
+
+// Walk the local and remote index side by side, in path order. When pulling, fn gets every remote file along with the
+// local file with the same path, or nil if there is none. When pushing, it is the other way around.
+// Files that are ignored or don't match the filter are skipped.
+func (s *Syncer) walk(direction Direction, fn func(file fileprovider.FileInfo, other *fileprovider.FileInfo)) error {
+	primary, secondary := newFileIterator(s.local, s.pageSize), newFileIterator(s.remote, s.pageSize)
+	primaryName, secondaryName := "local", "remote"
+	if direction == DirectionPull {
+		primary, secondary = secondary, primary
+		primaryName, secondaryName = secondaryName, primaryName
+	}
+
+	for {
+		file, err := primary.Peek()
+		if err != nil {
+			return fmt.Errorf("could not get %v files: %w", primaryName, err)
+		}
+		if file == nil {
+			return nil
+		}
+
+		other, err := secondary.Peek()
+		if err != nil {
+			return fmt.Errorf("could not get %v files: %w", secondaryName, err)
+		}
+
+		//Only on the other side, nothing to do
+		if other != nil && other.Path < file.Path {
+			secondary.Next()
+			continue
+		}
+
+		//Copy before advancing, the iterator may load a new page.
+		f := *file
+		primary.Next()
+
+		if other == nil || other.Path > f.Path {
+			if s.selected(f.Path) {
+				fn(f, nil)
+			}
+			continue
+		}
+
+		o := *other
+		secondary.Next()
+		if s.selected(f.Path) {
+			fn(f, &o)
+		}
+	}
+}
+
+// Walk the local and remote index side by side, in path order. fn gets every path that is in either index,
+// with the local and the remote file. One of them is nil if the path is only on one side.
+// Paths that are ignored or don't match the filter are skipped.
+func (s *Syncer) walkAll(fn func(lfile, rfile *fileprovider.FileInfo)) error {
+	visit := func(lfile, rfile *fileprovider.FileInfo) {
+		fi := lfile
+		if fi == nil {
+			fi = rfile
+		}
+		if s.selected(fi.Path) {
+			fn(lfile, rfile)
+		}
+	}
+
+	localIt := newFileIterator(s.local, s.pageSize)
+	remoteIt := newFileIterator(s.remote, s.pageSize)
+
+	for {
+		lfile, err := localIt.Peek()
+		if err != nil {
+			return fmt.Errorf("could not get local files: %w", err)
+		}
+		rfile, err := remoteIt.Peek()
+		if err != nil {
+			return fmt.Errorf("could not get remote files: %w", err)
+		}
+
+		switch {
+		case lfile == nil && rfile == nil:
+			return nil
+		case rfile == nil || (lfile != nil && lfile.Path < rfile.Path):
+			lf := *lfile
+			localIt.Next()
+			visit(&lf, nil)
+		case lfile == nil || rfile.Path < lfile.Path:
+			rf := *rfile
+			remoteIt.Next()
+			visit(nil, &rf)
+		default:
+			lf, rf := *lfile, *rfile
+			localIt.Next()
+			remoteIt.Next()
+			visit(&lf, &rf)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package syncer
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/c00/buttercup/fileprovider"
+	"github.com/c00/buttercup/logger"
+)
+
+// How often the remote index is persisted during a push.
+const defaultCheckpointInterval = time.Minute
+
+// Keeps a journal of a push in the local provider, so an interrupted push can be resumed.
+// Returns nil if the local or the remote doesn't support it. All methods are no-ops on nil.
+func newPushJournal(local, remote fileprovider.FileProvider, interval time.Duration) *pushJournal {
+	journal, ok := local.(fileprovider.JournalingProvider)
+	if !ok {
+		return nil
+	}
+	checkpointer, ok := remote.(fileprovider.CheckpointingProvider)
+	if !ok {
+		return nil
+	}
+
+	return &pushJournal{
+		local:          local,
+		journal:        journal,
+		remote:         checkpointer,
+		interval:       interval,
+		lastCheckpoint: time.Now(),
+	}
+}
+
+type pushJournal struct {
+	local          fileprovider.FileProvider
+	journal        fileprovider.JournalingProvider
+	remote         fileprovider.CheckpointingProvider
+	interval       time.Duration
+	lastCheckpoint time.Time
+}
+
+// Pick up where an interrupted push left off. Files it pushed get their lastSynced date back, so they are pushed again,
+// and the chunks it uploaded are added back to the remote index, so they don't have to be uploaded again.
+func (j *pushJournal) resume() error {
+	if j == nil {
+		return nil
+	}
+
+	err := restoreLastSynced(j.local)
+	if err != nil {
+		return err
+	}
+
+	journal, err := j.journal.GetJournal()
+	if err != nil {
+		return err
+	}
+	if len(journal.Chunks) == 0 {
+		return nil
+	}
+
+	restored, err := j.remote.RestoreChunks(journal.Chunks)
+	if err != nil {
+		return fmt.Errorf("could not restore chunks: %w", err)
+	}
+	logger.Info("resuming interrupted push, %v of %v uploaded chunks can be reused", restored, len(journal.Chunks))
+
+	return nil
+}
+
+// Record a file before it is pushed.
+func (j *pushJournal) record(fi fileprovider.FileInfo) error {
+	if j == nil {
+		return nil
+	}
+
+	err := j.journal.RecordPush(fileprovider.JournalEntry{Path: fi.Path, LastSynced: fi.LastSynced})
+	if err != nil {
+		return fmt.Errorf("could not record push: %w", err)
+	}
+	return nil
+}
+
+// Record the chunks of a file after it is pushed.
+func (j *pushJournal) recordChunks(fi fileprovider.FileInfo) {
+	if j == nil || fi.Deleted {
+		return
+	}
+
+	chunks, err := j.remote.GetStoredChunks(fi.Path)
+	if err == nil {
+		err = j.journal.RecordChunks(chunks)
+	}
+	if err != nil {
+		//Not fatal, the chunks are uploaded again if the push is interrupted
+		logger.Warn("%v: could not record uploaded chunks: %v", fi.Path, err)
+	}
+}
+
+func (j *pushJournal) checkpointDue() bool {
+	return j != nil && time.Since(j.lastCheckpoint) >= j.interval
+}
+
+// Persist the remote index, after which the journal isn't needed anymore.
+// Only call this while no files are being pushed.
+func (j *pushJournal) checkpoint() {
+	if j == nil {
+		return
+	}
+	j.lastCheckpoint = time.Now()
+
+	err := j.remote.Checkpoint()
+	if err != nil {
+		logger.Warn("could not persist remote index, continuing: %v", err)
+		return
+	}
+	logger.Debug("persisted remote index")
+	j.clear()
+}
+
+// Forget the journal, once the remote index is persisted.
+func (j *pushJournal) clear() {
+	if j == nil {
+		return
+	}
+
+	err := j.journal.ClearJournal()
+	if err != nil {
+		logger.Warn("could not clear push journal: %v", err)
+	}
+}
+
+// Give files that an interrupted push didn't get into the remote index their lastSynced date back.
+// Without it, they would look like they are in sync.
+func restoreLastSynced(local fileprovider.FileProvider) error {
+	journal, ok := local.(fileprovider.JournalingProvider)
+	if !ok {
+		return nil
+	}
+
+	entries, err := journal.GetJournal()
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries.Entries {
+		err = local.SetLastSynced(entry.Path, entry.LastSynced)
+		if err != nil {
+			logger.Warn("%v: could not restore lastSynced date: %v", entry.Path, err)
+		}
+	}
+
+	return journal.ClearJournalEntries()
+}
@@ -0,0 +1,104 @@
+package syncer
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"testing"
+
+	"github.com/c00/buttercup/appconfig"
+	"github.com/c00/buttercup/fileprovider"
+	"github.com/stretchr/testify/assert"
+)
+
+// A remote that dies before it can persist its index.
+type interruptedRemote struct {
+	*fileprovider.EfsProvider
+}
+
+func (r interruptedRemote) Unlock() error {
+	return errors.New("interrupted")
+}
+
+func TestPushResumesAfterInterruption(t *testing.T) {
+	local := fileprovider.NewFsProvider(appconfig.ProviderConfig{ClientName: "client", FsConfig: &appconfig.FsProviderConfig{Path: t.TempDir()}})
+	defer local.Close()
+	remoteConf := appconfig.ProviderConfig{ClientName: "client", EfsConfig: &appconfig.EfsProviderConfig{Path: t.TempDir(), Passphrase: "foo"}}
+
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, setFileContent(local, fileprovider.FileInfo{Path: fmt.Sprintf("/%v.txt", i), Updated: getDate(1)}, fmt.Sprintf("local %v", i)))
+	}
+
+	remote := fileprovider.NewEfsProvider(remoteConf)
+	err := New(local, interruptedRemote{remote}).Push()
+	assert.NotNil(t, err)
+	assert.Nil(t, remote.ForceUnlock())
+	assert.Nil(t, remote.Close())
+	blobs := countFiles(t, remoteConf.EfsConfig.Path)
+	assert.Equal(t, blobs, 3)
+
+	//Nothing made it into the remote index, but the chunks are reused
+	remote = fileprovider.NewEfsProvider(remoteConf)
+	defer remote.Close()
+	for i := 0; i < 3; i++ {
+		_, err = remote.GetFileInfo(fmt.Sprintf("/%v.txt", i))
+		assert.NotNil(t, err)
+	}
+
+	err = New(local, remote).Push()
+	assert.Nil(t, err)
+	assert.Equal(t, countFiles(t, remoteConf.EfsConfig.Path), blobs)
+	for i := 0; i < 3; i++ {
+		assert.True(t, fileHasContent(remote, fmt.Sprintf("/%v.txt", i), fmt.Sprintf("local %v", i)))
+	}
+
+	journal, err := local.GetJournal()
+	assert.Nil(t, err)
+	assert.Equal(t, journal, fileprovider.Journal{})
+}
+
+func TestPushCheckpoints(t *testing.T) {
+	local := fileprovider.NewFsProvider(appconfig.ProviderConfig{ClientName: "client", FsConfig: &appconfig.FsProviderConfig{Path: t.TempDir()}})
+	defer local.Close()
+	remoteConf := appconfig.ProviderConfig{ClientName: "client", EfsConfig: &appconfig.EfsProviderConfig{Path: t.TempDir(), Passphrase: "foo"}}
+
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, setFileContent(local, fileprovider.FileInfo{Path: fmt.Sprintf("/%v.txt", i), Updated: getDate(1)}, fmt.Sprintf("local %v", i)))
+	}
+
+	remote := fileprovider.NewEfsProvider(remoteConf)
+	syncer := New(local, interruptedRemote{remote})
+	syncer.checkpointInterval = 0
+	err := syncer.Push()
+	assert.NotNil(t, err)
+	assert.Nil(t, remote.ForceUnlock())
+	assert.Nil(t, remote.Close())
+
+	//Everything up to the last checkpoint made it
+	remote = fileprovider.NewEfsProvider(remoteConf)
+	defer remote.Close()
+	assert.True(t, fileHasContent(remote, "/0.txt", "local 0"))
+	assert.True(t, fileHasContent(remote, "/1.txt", "local 1"))
+	_, err = remote.GetFileInfo("/2.txt")
+	assert.NotNil(t, err)
+
+	err = New(local, remote).Push()
+	assert.Nil(t, err)
+	assert.True(t, fileHasContent(remote, "/2.txt", "local 2"))
+}
+
+func countFiles(t *testing.T, root string) int {
+	count := 0
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && d.Name() != ".buttercup-index.db" && d.Name() != ".buttercup-key" {
+			count++
+		}
+		return nil
+	})
+	assert.Nil(t, err)
+	return count
+}
@@ -0,0 +1,259 @@
+package syncer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"text/tabwriter"
+
+	"github.com/c00/buttercup/fileprovider"
+	"github.com/c00/buttercup/logger"
+)
+
+type Direction string
+
+const (
+	DirectionPull Direction = "pull"
+	DirectionPush Direction = "push"
+)
+
+type Action string
+
+const (
+	ActionNew      Action = "new"
+	ActionUpdate   Action = "update"
+	ActionDelete   Action = "delete"
+	ActionConflict Action = "conflict"
+	//Same content on both sides, only the lastSynced date is updated
+	ActionInSync Action = "in-sync"
+	//Nothing to do
+	ActionNone Action = ""
+	//A deleted file that doesn't exist on the other side yet. Only the index changes.
+	actionRecord Action = "record"
+)
+
+// What syncing does to a single file.
+type PlanEntry struct {
+	Direction Direction `json:"direction"`
+	Action    Action    `json:"action"`
+	Path      string    `json:"path"`
+	//Where the other version of a conflicting file ends up
+	ConflictPath string `json:"conflictPath,omitempty"`
+	//Bytes to transfer
+	Size int64 `json:"size"`
+
+	//Result of comparing the files, tells which side of a conflict is newer
+	compare int
+}
+
+// What a pull, push or sync would do.
+type Plan struct {
+	Entries []PlanEntry `json:"entries"`
+	//Total bytes to transfer
+	Bytes int64 `json:"bytes"`
+	//Set if the push would be refused, because the remote has changes that aren't pulled yet
+	PullFirst bool `json:"pullFirst,omitempty"`
+}
+
+// Add an entry, unless nothing is transferred for it. Returns whether it was added.
+func (p *Plan) add(entry PlanEntry) bool {
+	if entry.Action == ActionNone || entry.Action == ActionInSync || entry.Action == actionRecord {
+		return false
+	}
+
+	p.Entries = append(p.Entries, entry)
+	p.Bytes += entry.Size
+	return true
+}
+
+// Decide what to do with a remote file. lfile is nil if the file doesn't exist locally.
+func planPull(rfile fileprovider.FileInfo, lfile *fileprovider.FileInfo) (PlanEntry, error) {
+	entry := PlanEntry{Direction: DirectionPull, Path: rfile.Path}
+
+	if lfile == nil {
+		if rfile.Deleted {
+			entry.Action = actionRecord
+			return entry, nil
+		}
+		entry.Action = ActionNew
+		entry.Size = rfile.Size
+		return entry, nil
+	}
+
+	cmpResult, err := rfile.Compare(*lfile, false)
+	if err != nil {
+		return entry, err
+	}
+	entry.compare = cmpResult
+
+	switch cmpResult {
+	case fileprovider.UpToDate:
+		entry.Action = ActionInSync
+	case fileprovider.RemoteNewer:
+		if rfile.Deleted {
+			entry.Action = ActionDelete
+		} else {
+			entry.Action = ActionUpdate
+			entry.Size = rfile.Size
+		}
+	case fileprovider.ConflictLocalNewer, fileprovider.ConflictRemoteNewer:
+		entry.Action = ActionConflict
+		entry.ConflictPath = getConflictName(rfile.Path)
+		entry.Size = rfile.Size
+	}
+
+	return entry, nil
+}
+
+// Decide what to do with a local file. rfile is nil if the file doesn't exist on the remote.
+func planPush(lfile fileprovider.FileInfo, rfile *fileprovider.FileInfo) (PlanEntry, error) {
+	entry := PlanEntry{Direction: DirectionPush, Path: lfile.Path}
+
+	if rfile == nil {
+		if lfile.Deleted {
+			entry.Action = actionRecord
+			return entry, nil
+		}
+		entry.Action = ActionNew
+		entry.Size = lfile.Size
+		return entry, nil
+	}
+
+	cmpResult, err := lfile.Compare(*rfile, true)
+	if err != nil {
+		return entry, err
+	}
+	entry.compare = cmpResult
+
+	switch cmpResult {
+	case fileprovider.UpToDate:
+		entry.Action = ActionInSync
+	case fileprovider.LocalNewer:
+		if lfile.Deleted {
+			entry.Action = ActionDelete
+		} else {
+			entry.Action = ActionUpdate
+			entry.Size = lfile.Size
+		}
+	default:
+		return entry, fmt.Errorf("unexpected compare result: %v", cmpResult)
+	}
+
+	return entry, nil
+}
+
+// Work out what Pull would do, without locking or changing anything.
+func (s *Syncer) PlanPull() (Plan, error) {
+	plan := Plan{Entries: []PlanEntry{}}
+	err := s.walk(DirectionPull, func(rfile fileprovider.FileInfo, lfile *fileprovider.FileInfo) {
+		entry, err := planPull(rfile, lfile)
+		if err != nil {
+			logger.Warn("Skipping %v: %v", rfile.Path, err)
+			return
+		}
+		plan.add(entry)
+	})
+
+	return plan, err
+}
+
+// Work out what Push would do, without locking or changing anything.
+func (s *Syncer) PlanPush() (Plan, error) {
+	canPush, err := s.canPush()
+	if err != nil {
+		return Plan{}, fmt.Errorf("cannot check if we can push: %w", err)
+	}
+
+	plan := Plan{Entries: []PlanEntry{}, PullFirst: !canPush}
+	err = s.walk(DirectionPush, func(lfile fileprovider.FileInfo, rfile *fileprovider.FileInfo) {
+		entry, err := planPush(lfile, rfile)
+		if err != nil {
+			//Files that are newer on the remote, they block the push
+			logger.Debug("Skipping %v: %v", lfile.Path, err)
+			return
+		}
+		plan.add(entry)
+	})
+
+	return plan, err
+}
+
+// Work out what Sync would do, without locking or changing anything.
+// The push is planned as if the pull went through, so files the pull takes care of are left out of it.
+// Both are planned in one pass over the local and remote index, entries are in path order.
+func (s *Syncer) PlanSync() (Plan, error) {
+	plan := Plan{Entries: []PlanEntry{}}
+	err := s.walkAll(func(lfile, rfile *fileprovider.FileInfo) {
+		if rfile != nil {
+			entry, err := planPull(*rfile, lfile)
+			if err != nil {
+				logger.Warn("Skipping %v: %v", rfile.Path, err)
+			} else if plan.add(entry) {
+				return
+			}
+		}
+
+		if lfile == nil {
+			return
+		}
+		entry, err := planPush(*lfile, rfile)
+		if err != nil {
+			logger.Debug("Skipping %v: %v", lfile.Path, err)
+			return
+		}
+		plan.add(entry)
+	})
+
+	return plan, err
+}
+
+// Write the plan in the given format, "text" or "json".
+func (p Plan) Write(out io.Writer, format string) error {
+	switch format {
+	case "text":
+		return p.WriteText(out)
+	case "json":
+		return p.WriteJSON(out)
+	default:
+		return fmt.Errorf("unknown output format: %v", format)
+	}
+}
+
+// Write the plan as a table, followed by a summary.
+func (p Plan) WriteText(out io.Writer) error {
+	if len(p.Entries) > 0 {
+		w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "DIRECTION\tACTION\tPATH\tSIZE")
+		for _, entry := range p.Entries {
+			path := entry.Path
+			if entry.ConflictPath != "" {
+				path = fmt.Sprintf("%v (other version at %v)", entry.Path, entry.ConflictPath)
+			}
+			fmt.Fprintf(w, "%v\t%v\t%v\t%v\n", entry.Direction, entry.Action, path, entry.Size)
+		}
+		err := w.Flush()
+		if err != nil {
+			return err
+		}
+	}
+
+	counts := map[Direction]int{}
+	for _, entry := range p.Entries {
+		counts[entry.Direction]++
+	}
+	_, err := fmt.Fprintf(out, "%v to pull, %v to push, %v bytes to transfer\n", counts[DirectionPull], counts[DirectionPush], p.Bytes)
+	if err != nil {
+		return err
+	}
+
+	if p.PullFirst {
+		_, err = fmt.Fprintln(out, "The push would fail, local is missing updates from remote. Pull first.")
+	}
+	return err
+}
+
+func (p Plan) WriteJSON(out io.Writer) error {
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(p)
+}
@@ -0,0 +1,104 @@
+package syncer
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/c00/buttercup/fileprovider"
+	"github.com/stretchr/testify/assert"
+)
+
+func setupPlan(t *testing.T) (*fileprovider.InMemoryProvider, *fileprovider.InMemoryProvider) {
+	local := fileprovider.NewInMemoryProvider("client")
+	remote := fileprovider.NewInMemoryProvider("client")
+
+	//New on the remote
+	assert.Nil(t, setFileContent(remote, fileprovider.FileInfo{Path: "/a.txt", Updated: getDate(1)}, "remote"))
+	//Updated on the remote
+	assert.Nil(t, setFileContent(local, fileprovider.FileInfo{Path: "/b.txt", Updated: getDate(0), LastSynced: getDate(0)}, "local"))
+	assert.Nil(t, setFileContent(remote, fileprovider.FileInfo{Path: "/b.txt", Updated: getDate(1)}, "remote!"))
+	//Changed on both sides
+	assert.Nil(t, setFileContent(local, fileprovider.FileInfo{Path: "/c.txt", Updated: getDate(2), LastSynced: getDate(0)}, "local"))
+	assert.Nil(t, setFileContent(remote, fileprovider.FileInfo{Path: "/c.txt", Updated: getDate(1)}, "remote"))
+	//New locally
+	assert.Nil(t, setFileContent(local, fileprovider.FileInfo{Path: "/d.txt", Updated: getDate(1)}, "local"))
+	//Same on both sides
+	assert.Nil(t, setFileContent(local, fileprovider.FileInfo{Path: "/e.txt", Updated: getDate(0), LastSynced: getDate(0)}, "same"))
+	assert.Nil(t, setFileContent(remote, fileprovider.FileInfo{Path: "/e.txt", Updated: getDate(0)}, "same"))
+
+	return local, remote
+}
+
+func TestPlanPull(t *testing.T) {
+	local, remote := setupPlan(t)
+
+	plan, err := New(local, remote).PlanPull()
+	assert.Nil(t, err)
+	assert.Equal(t, plan.Entries, []PlanEntry{
+		{Direction: DirectionPull, Action: ActionNew, Path: "/a.txt", Size: 6},
+		{Direction: DirectionPull, Action: ActionUpdate, Path: "/b.txt", Size: 7, compare: fileprovider.RemoteNewer},
+		{Direction: DirectionPull, Action: ActionConflict, Path: "/c.txt", ConflictPath: "/c.conflict.txt", Size: 6, compare: fileprovider.ConflictLocalNewer},
+	})
+	assert.Equal(t, plan.Bytes, int64(19))
+
+	//Nothing changed
+	_, err = local.GetFileInfo("/a.txt")
+	assert.NotNil(t, err)
+	assert.True(t, fileHasContent(local, "/b.txt", "local"))
+	_, locked, err := local.LockStatus()
+	assert.Nil(t, err)
+	assert.False(t, locked)
+}
+
+func TestPlanPush(t *testing.T) {
+	local, remote := setupPlan(t)
+
+	plan, err := New(local, remote).PlanPush()
+	assert.Nil(t, err)
+	assert.True(t, plan.PullFirst)
+	assert.Equal(t, plan.Entries, []PlanEntry{
+		{Direction: DirectionPush, Action: ActionNew, Path: "/d.txt", Size: 5},
+	})
+
+	_, err = remote.GetFileInfo("/d.txt")
+	assert.NotNil(t, err)
+}
+
+func TestPlanSync(t *testing.T) {
+	local, remote := setupPlan(t)
+
+	plan, err := New(local, remote).PlanSync()
+	assert.Nil(t, err)
+	assert.False(t, plan.PullFirst)
+	assert.Equal(t, len(plan.Entries), 4)
+	assert.Equal(t, plan.Entries[3], PlanEntry{Direction: DirectionPush, Action: ActionNew, Path: "/d.txt", Size: 5})
+
+	buf := &bytes.Buffer{}
+	assert.Nil(t, plan.Write(buf, "json"))
+	decoded := Plan{}
+	assert.Nil(t, json.Unmarshal(buf.Bytes(), &decoded))
+	assert.Equal(t, decoded.Bytes, int64(24))
+	assert.Equal(t, decoded.Entries[2].ConflictPath, "/c.conflict.txt")
+
+	buf.Reset()
+	assert.Nil(t, plan.Write(buf, "text"))
+	assert.Contains(t, buf.String(), "3 to pull, 1 to push, 24 bytes to transfer")
+	assert.NotNil(t, plan.Write(buf, "yaml"))
+}
+
+func TestPlanSync_PathOrder(t *testing.T) {
+	local, remote := setupPlan(t)
+	assert.Nil(t, setFileContent(local, fileprovider.FileInfo{Path: "/0.txt", Updated: getDate(1)}, "first"))
+
+	plan, err := New(local, remote).PlanSync()
+	assert.Nil(t, err)
+
+	paths := []string{}
+	for _, entry := range plan.Entries {
+		paths = append(paths, entry.Path)
+	}
+	assert.Equal(t, paths, []string{"/0.txt", "/a.txt", "/b.txt", "/c.txt", "/d.txt"})
+	assert.Equal(t, plan.Entries[0].Direction, DirectionPush)
+	assert.Equal(t, plan.Bytes, int64(29))
+}
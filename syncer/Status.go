@@ -0,0 +1,137 @@
+package syncer
+
+import (
+	"fmt"
+
+	"github.com/c00/buttercup/fileprovider"
+	"github.com/c00/buttercup/logger"
+)
+
+// How a file differs between the local and the remote.
+type FileStatus struct {
+	Path string
+	//Result of comparing the local file to the remote one: fileprovider.LocalNewer, RemoteNewer or one of the conflicts
+	State int
+	//What changed on the newer side: new, update or delete
+	Change Action
+}
+
+// Differences between the local and the remote.
+type Status struct {
+	//Files that are not up-to-date, in path order
+	Files []FileStatus
+	//Amount of files that are the same on both sides
+	UpToDate int
+}
+
+// Files that have the given state.
+func (s Status) Filter(states ...int) []FileStatus {
+	results := []FileStatus{}
+	for _, fs := range s.Files {
+		for _, state := range states {
+			if fs.State == state {
+				results = append(results, fs)
+				break
+			}
+		}
+	}
+	return results
+}
+
+func (s Status) InSync() bool {
+	return len(s.Files) == 0
+}
+
+// Compare every file on the local to the one on the remote, without locking or changing anything.
+func (s *Syncer) Status() (Status, error) {
+	status := Status{Files: []FileStatus{}}
+
+	err := s.walkAll(func(lfile, rfile *fileprovider.FileInfo) {
+		fs, err := getFileStatus(lfile, rfile)
+		if err != nil {
+			logger.Warn("Skipping %v: %v", fs.Path, err)
+			return
+		}
+
+		switch fs.State {
+		case 0:
+			//Deleted on one side, never existed on the other
+		case fileprovider.UpToDate:
+			//Don't count files that are deleted on both sides
+			if !lfile.Deleted {
+				status.UpToDate++
+			}
+		default:
+			status.Files = append(status.Files, fs)
+		}
+	})
+	if err != nil {
+		return Status{}, err
+	}
+
+	return status, nil
+}
+
+func getFileStatus(lfile, rfile *fileprovider.FileInfo) (FileStatus, error) {
+	if rfile == nil {
+		if lfile.Deleted {
+			return FileStatus{Path: lfile.Path}, nil
+		}
+		return FileStatus{Path: lfile.Path, State: fileprovider.LocalNewer, Change: ActionNew}, nil
+	}
+	if lfile == nil {
+		if rfile.Deleted {
+			return FileStatus{Path: rfile.Path}, nil
+		}
+		return FileStatus{Path: rfile.Path, State: fileprovider.RemoteNewer, Change: ActionNew}, nil
+	}
+
+	fs := FileStatus{Path: lfile.Path}
+	cmpResult, err := lfile.Compare(*rfile, true)
+	if err != nil {
+		return fs, err
+	}
+	fs.State = cmpResult
+
+	//The side that changed
+	newer, older := lfile, rfile
+	if cmpResult == fileprovider.RemoteNewer || cmpResult == fileprovider.ConflictRemoteNewer {
+		newer, older = rfile, lfile
+	}
+
+	switch {
+	case cmpResult == fileprovider.UpToDate:
+	case newer.Deleted:
+		fs.Change = ActionDelete
+	case older.Deleted:
+		fs.Change = ActionNew
+	default:
+		fs.Change = ActionUpdate
+	}
+
+	return fs, nil
+}
+
+// Describe a change the way status shows it.
+func describeChange(change Action) string {
+	switch change {
+	case ActionNew:
+		return "new file"
+	case ActionDelete:
+		return "deleted"
+	default:
+		return "modified"
+	}
+}
+
+// Short description of a file status, like "modified" or "both modified, remote is newer".
+func (fs FileStatus) Describe() string {
+	switch fs.State {
+	case fileprovider.ConflictLocalNewer:
+		return fmt.Sprintf("both changed, local is newer (%v)", describeChange(fs.Change))
+	case fileprovider.ConflictRemoteNewer:
+		return fmt.Sprintf("both changed, remote is newer (%v)", describeChange(fs.Change))
+	default:
+		return describeChange(fs.Change)
+	}
+}
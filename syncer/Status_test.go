@@ -0,0 +1,40 @@
+package syncer
+
+import (
+	"testing"
+
+	"github.com/c00/buttercup/fileprovider"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStatus(t *testing.T) {
+	local, remote := setupPlan(t)
+	//Deleted locally
+	assert.Nil(t, setFileContent(local, fileprovider.FileInfo{Path: "/f.txt", Updated: getDate(0), LastSynced: getDate(0)}, "gone"))
+	assert.Nil(t, setFileContent(remote, fileprovider.FileInfo{Path: "/f.txt", Updated: getDate(0)}, "gone"))
+	assert.Nil(t, local.RemoveFile(fileprovider.FileInfo{Path: "/f.txt", Updated: getDate(1)}))
+	//Deleted on both sides
+	assert.Nil(t, local.RemoveFile(fileprovider.FileInfo{Path: "/g.txt", Updated: getDate(0), LastSynced: getDate(0)}))
+	assert.Nil(t, remote.RemoveFile(fileprovider.FileInfo{Path: "/g.txt", Updated: getDate(0)}))
+
+	status, err := New(local, remote).Status()
+	assert.Nil(t, err)
+	assert.False(t, status.InSync())
+	assert.Equal(t, status.UpToDate, 1)
+	assert.Equal(t, status.Files, []FileStatus{
+		{Path: "/a.txt", State: fileprovider.RemoteNewer, Change: ActionNew},
+		{Path: "/b.txt", State: fileprovider.RemoteNewer, Change: ActionUpdate},
+		{Path: "/c.txt", State: fileprovider.ConflictLocalNewer, Change: ActionUpdate},
+		{Path: "/d.txt", State: fileprovider.LocalNewer, Change: ActionNew},
+		{Path: "/f.txt", State: fileprovider.LocalNewer, Change: ActionDelete},
+	})
+	assert.Equal(t, len(status.Filter(fileprovider.RemoteNewer)), 2)
+	assert.Equal(t, status.Files[2].Describe(), "both changed, local is newer (modified)")
+
+	//After syncing, everything is up-to-date
+	syncer := New(local, remote)
+	assert.Nil(t, syncer.Pull())
+	status, err = syncer.Status()
+	assert.Nil(t, err)
+	assert.Equal(t, status.Filter(fileprovider.RemoteNewer), []FileStatus{})
+}
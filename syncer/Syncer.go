@@ -2,8 +2,8 @@ package syncer
 
 import (
 	"fmt"
-
 	"strings"
+	"time"
 
 	"github.com/c00/buttercup/fileprovider"
 	"github.com/c00/buttercup/logger"
@@ -11,10 +11,17 @@ import (
 )
 
 func New(local fileprovider.FileProvider, remote fileprovider.FileProvider) *Syncer {
+	ignorer, _ := local.(fileprovider.IgnoringProvider)
+
 	return &Syncer{
-		source: source.NewSource(local, remote),
-		local:  local,
-		remote: remote,
+		source:   source.NewSource(local, remote),
+		local:    local,
+		remote:   remote,
+		pageSize: defaultPageSize,
+		jobs:     1,
+
+		checkpointInterval: defaultCheckpointInterval,
+		ignorer:            ignorer,
 	}
 }
 
@@ -22,6 +29,34 @@ type Syncer struct {
 	source source.PushPuller
 	remote fileprovider.FileProvider
 	local  fileprovider.FileProvider
+	//Amount of FileInfos to load per page when walking an index
+	pageSize int
+	//Amount of files to transfer at the same time
+	jobs int
+	//How often the remote index is persisted during a push
+	checkpointInterval time.Duration
+	//Only files that match are synced. nil for all files.
+	filter *fileprovider.PathFilter
+	//Files the local ignores are neither pushed nor pulled. nil if it doesn't ignore anything.
+	ignorer fileprovider.IgnoringProvider
+}
+
+// Set how many files are transferred at the same time. Values below 1 mean 1.
+func (s *Syncer) SetJobs(jobs int) {
+	s.jobs = max(jobs, 1)
+}
+
+// Only sync files that match the filter. Other files are left alone, even if they are out of date.
+func (s *Syncer) SetFilter(filter *fileprovider.PathFilter) {
+	s.filter = filter
+}
+
+// Check if a file takes part in syncing.
+func (s *Syncer) selected(path string) bool {
+	if s.ignorer != nil && s.ignorer.Ignores(path) {
+		return false
+	}
+	return s.filter.Match(path)
 }
 
 func (s *Syncer) Pull() error {
@@ -31,102 +66,123 @@ func (s *Syncer) Pull() error {
 	}
 	defer s.local.Unlock()
 
-	//Get remote index
-	//todo introduce paging
-	remoteFiles, err := s.remote.GetFileInfos(0, 0)
+	//Files an interrupted push didn't finish must not look like they are in sync
+	err = restoreLastSynced(s.local)
 	if err != nil {
-		return fmt.Errorf("could not get remote files: %w", err)
+		return fmt.Errorf("cannot restore interrupted push: %w", err)
 	}
 
-	//Compare files, Pull new / updated ones.
-	for _, rfile := range remoteFiles {
-		lfile, err := s.local.GetFileInfo(rfile.Path)
+	pool := newWorkerPool(s.jobs)
+	defer pool.wait()
+
+	//Walk both indexes side by side, pull new / updated files.
+	return s.walk(DirectionPull, func(rfile fileprovider.FileInfo, lfile *fileprovider.FileInfo) {
+		pool.submit(func() { s.pull(rfile, lfile) })
+	})
+}
+
+func (s *Syncer) pull(rfile fileprovider.FileInfo, lfile *fileprovider.FileInfo) {
+	entry, err := planPull(rfile, lfile)
+	if err != nil {
+		logger.Error("Skipping %v: %v", rfile.Path, err)
+		return
+	}
+
+	//Run Action
+	switch entry.Action {
+	case ActionNew, actionRecord:
+		logger.Log("pulling new file: %v", rfile.Path)
+		err := s.source.PullFile(rfile, rfile.Path)
 		if err != nil {
-			logger.Log("pulling new file: %v", rfile.Path)
-			err := s.source.PullFile(rfile, rfile.Path)
-			if err != nil {
-				logger.Error("Error pulling file: %v", err)
-			}
-			continue
+			logger.Error("Error pulling file: %v", err)
+		}
+	case ActionInSync:
+		//don't log deleted files. It's confusing
+		if !rfile.Deleted {
+			logger.Info("%v: up-to-date already", rfile.Path)
+		} else {
+			logger.Debug("%v: up-to-date and deleted", rfile.Path)
 		}
-		cmpResult, err := rfile.Compare(lfile, false)
+		s.markInSync(*lfile, rfile)
+	case ActionUpdate, ActionDelete:
+		logger.Log("%v: pulling new version", rfile.Path)
+		err := s.source.PullFile(rfile, lfile.Path)
 		if err != nil {
-			logger.Error("Skipping %v: %v", lfile.Path, err)
-			continue
+			logger.Error("Error pulling file: %v", err)
 		}
-
-		//Run Action
-		switch cmpResult {
-		case fileprovider.UpToDate:
-			//don't log deleted files. It's confusing
-			if !rfile.Deleted {
-				logger.Info("%v: up-to-date already", rfile.Path)
-			} else {
-				logger.Debug("%v: up-to-date and deleted", rfile.Path)
-			}
-		case fileprovider.RemoteNewer:
-			logger.Log("%v: pulling new version", rfile.Path)
-			err := s.source.PullFile(rfile, lfile.Path)
-			if err != nil {
-				logger.Error("Error pulling file: %v", err)
-			}
-		case fileprovider.ConflictLocalNewer:
+	case ActionConflict:
+		if entry.compare == fileprovider.ConflictLocalNewer {
 			logger.Log("%v: both files changed, local is more recent.\n", rfile.Path)
 			//Keep local, but place the remote file with different name
-			newPath := getConflictName(rfile.Path)
-			err := s.source.PullFile(rfile, newPath)
+			err := s.source.PullFile(rfile, entry.ConflictPath)
 			if err != nil {
 				logger.Error("Error pulling file: %v", err)
 			}
-		case fileprovider.ConflictRemoteNewer:
-			logger.Log("%v: both files changed, remote is more recent.\n", rfile.Path)
-			//Rename local, and download remote file
-			newPath := getConflictName(rfile.Path)
-			err := s.local.MoveFile(rfile.Path, newPath)
-			if err != nil {
-				logger.Error("renaming file failed: %v", err)
-				continue
-			}
+			return
+		}
 
-			//Download the new file
-			err = s.source.PullFile(rfile, rfile.Path)
-			if err != nil {
-				logger.Error("Error fetching file: %v", err)
-			}
+		logger.Log("%v: both files changed, remote is more recent.\n", rfile.Path)
+		//Rename local, and download remote file
+		err := s.local.MoveFile(rfile.Path, entry.ConflictPath)
+		if err != nil {
+			logger.Error("renaming file failed: %v", err)
+			return
 		}
-	}
 
-	return nil
+		//Download the new file
+		err = s.source.PullFile(rfile, rfile.Path)
+		if err != nil {
+			logger.Error("Error fetching file: %v", err)
+		}
+	}
 }
 
 func (s *Syncer) canPush() (bool, error) {
-	//We can pull if no file is newer on the remote than on the local.
-	//Get remote index
-	//todo introduce paging
-	remoteFiles, err := s.remote.GetFileInfos(0, 0)
-	if err != nil {
-		return false, fmt.Errorf("could not get remote files: %w", err)
-	}
+	//We can push if no file is newer on the remote than on the local.
+	remoteIt := newFileIterator(s.remote, s.pageSize)
+	localIt := newFileIterator(s.local, s.pageSize)
 
-	//Compare files, Pull new / updated ones.
-	for _, rfile := range remoteFiles {
-		lfile, err := s.local.GetFileInfo(rfile.Path)
+	for {
+		rfile, err := remoteIt.Peek()
+		if err != nil {
+			return false, fmt.Errorf("could not get remote files: %w", err)
+		}
+		lfile, err := localIt.Peek()
 		if err != nil {
+			return false, fmt.Errorf("could not get local files: %w", err)
+		}
+
+		//Files that only exist on one side don't block pushing
+		if rfile == nil || lfile == nil {
+			return true, nil
+		}
+		if rfile.Path < lfile.Path {
+			remoteIt.Next()
+			continue
+		}
+		if lfile.Path < rfile.Path {
+			localIt.Next()
+			continue
+		}
+		//Files that aren't pushed don't block pushing
+		if !s.selected(lfile.Path) {
+			remoteIt.Next()
+			localIt.Next()
 			continue
 		}
-		cmpResult, err := rfile.Compare(lfile, false)
+
+		cmpResult, err := rfile.Compare(*lfile, false)
 		if err != nil {
 			return false, err
 		}
 
-		if cmpResult == fileprovider.LocalNewer || cmpResult == fileprovider.UpToDate {
-			continue
-		} else {
+		if cmpResult != fileprovider.LocalNewer && cmpResult != fileprovider.UpToDate {
 			return false, nil
 		}
-	}
 
-	return true, nil
+		remoteIt.Next()
+		localIt.Next()
+	}
 }
 
 func (s *Syncer) Push() error {
@@ -134,7 +190,13 @@ func (s *Syncer) Push() error {
 	if err != nil {
 		return fmt.Errorf("cannot lock remote: %w", err)
 	}
-	defer s.remote.Unlock()
+	//Only unlocks here if the push fails halfway, otherwise it is unlocked below.
+	remoteLocked := true
+	defer func() {
+		if remoteLocked {
+			s.remote.Unlock()
+		}
+	}()
 
 	//Also lock local because we want to update the lasSynced dates.
 	err = s.local.Lock()
@@ -143,6 +205,12 @@ func (s *Syncer) Push() error {
 	}
 	defer s.local.Unlock()
 
+	journal := newPushJournal(s.local, s.remote, s.checkpointInterval)
+	err = journal.resume()
+	if err != nil {
+		return fmt.Errorf("cannot resume interrupted push: %w", err)
+	}
+
 	canPull, err := s.canPush()
 	if err != nil {
 		return fmt.Errorf("cannot check if we can pull: %w", err)
@@ -151,47 +219,74 @@ func (s *Syncer) Push() error {
 		return fmt.Errorf("cannot push, local is missing updates from remote. Pull first")
 	}
 
-	//Get localindex
-	//todo introduce paging
-	localFiles, err := s.local.GetFileInfos(0, 0)
+	pool := newWorkerPool(s.jobs)
+	defer pool.wait()
+
+	//Walk both indexes side by side, push new / updated files.
+	err = s.walk(DirectionPush, func(lfile fileprovider.FileInfo, rfile *fileprovider.FileInfo) {
+		if journal.checkpointDue() {
+			pool.drain()
+			journal.checkpoint()
+		}
+		pool.submit(func() { s.push(lfile, rfile, journal) })
+	})
+	if err != nil {
+		return err
+	}
+
+	pool.wait()
+
+	remoteLocked = false
+	err = s.remote.Unlock()
+	if err != nil {
+		return fmt.Errorf("cannot unlock remote: %w", err)
+	}
+	journal.clear()
+
+	return nil
+}
+
+// Push a file, keeping track of it in the journal.
+func (s *Syncer) pushFile(lfile fileprovider.FileInfo, journal *pushJournal) error {
+	err := journal.record(lfile)
+	if err != nil {
+		return err
+	}
+
+	err = s.source.PushFile(lfile)
 	if err != nil {
-		return fmt.Errorf("could not get local files: %w", err)
+		return err
 	}
 
-	//Compare files, Pull new / updated ones.
-	for _, localFi := range localFiles {
-		remoteFi, err := s.remote.GetFileInfo(localFi.Path)
+	journal.recordChunks(lfile)
+	return nil
+}
+
+func (s *Syncer) push(lfile fileprovider.FileInfo, rfile *fileprovider.FileInfo, journal *pushJournal) {
+	entry, err := planPush(lfile, rfile)
+	if err != nil {
+		logger.Error("Skipping %v: %v", lfile.Path, err)
+		return
+	}
+
+	//Run Action
+	switch entry.Action {
+	case ActionNew, actionRecord:
+		logger.Log("pushing new file: %v", lfile.Path)
+		err = s.pushFile(lfile, journal)
 		if err != nil {
-			logger.Log("pushing new file: %v", localFi.Path)
-			err := s.source.PushFile(localFi)
-			if err != nil {
-				logger.Error("Error pushing file: %v", err)
-			}
-			continue
+			logger.Error("Error pushing file: %v", err)
 		}
-		cmpResult, err := localFi.Compare(remoteFi, true)
+	case ActionInSync:
+		logger.Info("%v: up-to-date already", lfile.Path)
+		s.markInSync(lfile, *rfile)
+	case ActionUpdate, ActionDelete:
+		logger.Log("%v: pushing updated file", lfile.Path)
+		err = s.pushFile(lfile, journal)
 		if err != nil {
-			logger.Error("Skipping %v: %v", remoteFi.Path, err)
-			continue
-		}
-
-		//Run Action
-		switch cmpResult {
-		case fileprovider.UpToDate:
-			logger.Info("%v: up-to-date already", localFi.Path)
-		case fileprovider.LocalNewer:
-			logger.Log("%v: pushing updated file", localFi.Path)
-			//Download the new file
-			err = s.source.PushFile(localFi)
-			if err != nil {
-				logger.Error("Error pushing file: %v", err)
-			}
-		default:
-			logger.Error("%v: unexpected compare result: %v\n", localFi.Path, cmpResult)
+			logger.Error("Error pushing file: %v", err)
 		}
 	}
-
-	return nil
 }
 
 func (s *Syncer) Sync() error {
@@ -202,6 +297,24 @@ func (s *Syncer) Sync() error {
 	return s.Push()
 }
 
+// Files with the same content are up-to-date even if their dates say otherwise.
+// Move lastSynced forward so they don't show up as changed (or conflicting) next time.
+func (s *Syncer) markInSync(lfile, rfile fileprovider.FileInfo) {
+	synced := lfile.Updated
+	if rfile.Updated.After(synced) {
+		synced = rfile.Updated
+	}
+
+	if !lfile.LastSynced.Before(synced) {
+		return
+	}
+
+	err := s.local.SetLastSynced(lfile.Path, synced)
+	if err != nil {
+		logger.Error("%v: could not update lastSynced date: %v", lfile.Path, err)
+	}
+}
+
 func getConflictName(path string) string {
 	if path == "" {
 		return path
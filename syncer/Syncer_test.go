@@ -1,11 +1,15 @@
 package syncer
 
 import (
+	"fmt"
 	"io"
+	"os"
+	"path"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/c00/buttercup/appconfig"
 	"github.com/c00/buttercup/fileprovider"
 	"github.com/stretchr/testify/assert"
 )
@@ -119,6 +123,30 @@ func TestDontPullUpToDateFile(t *testing.T) {
 	assert.True(t, fileHasContent(local, path, "source"))
 }
 
+func TestPullIdenticalConflict(t *testing.T) {
+	local := fileprovider.NewInMemoryProvider("client")
+	remote := fileprovider.NewInMemoryProvider("client")
+	syncer := New(local, remote)
+
+	path := "/foo.txt"
+	conflictPath := "/foo.conflict.txt"
+
+	assert.Nil(t, setFileContent(local, fileprovider.FileInfo{Path: path, Updated: getDate(1), LastSynced: getDate(0)}, "same"))
+	assert.Nil(t, setFileContent(remote, fileprovider.FileInfo{Path: path, Updated: getDate(2)}, "same"))
+
+	err := syncer.Pull()
+	assert.Nil(t, err)
+
+	//No conflict file
+	_, err = local.GetFileInfo(conflictPath)
+	assert.NotNil(t, err)
+
+	//Considered synced from now on
+	newFi, err := local.GetFileInfo(path)
+	assert.Nil(t, err)
+	assert.True(t, newFi.LastSynced.Equal(getDate(2)))
+}
+
 func fileHasContent(fp fileprovider.FileProvider, path string, content string) bool {
 	reader, err := fp.RetrieveFile(path)
 	if err != nil {
@@ -166,6 +194,90 @@ func TestPushUpdatedFile(t *testing.T) {
 	assert.True(t, fileHasContent(remote, path, "local"))
 }
 
+func TestPullPaged(t *testing.T) {
+	local := fileprovider.NewInMemoryProvider("client")
+	remote := fileprovider.NewInMemoryProvider("client")
+	syncer := New(local, remote)
+	syncer.pageSize = 2
+
+	assert.Nil(t, setFileContent(local, fileprovider.FileInfo{Path: "/b.txt", Updated: getDate(0), LastSynced: getDate(0)}, "local"))
+	assert.Nil(t, setFileContent(local, fileprovider.FileInfo{Path: "/d.txt", Updated: getDate(1)}, "local"))
+	assert.Nil(t, setFileContent(remote, fileprovider.FileInfo{Path: "/e.txt", Updated: getDate(1)}, "remote"))
+	assert.Nil(t, setFileContent(remote, fileprovider.FileInfo{Path: "/a.txt", Updated: getDate(1)}, "remote"))
+	assert.Nil(t, setFileContent(remote, fileprovider.FileInfo{Path: "/b.txt", Updated: getDate(1)}, "remote"))
+	assert.Nil(t, setFileContent(remote, fileprovider.FileInfo{Path: "/c.txt", Updated: getDate(1)}, "remote"))
+
+	err := syncer.Pull()
+	assert.Nil(t, err)
+
+	assert.True(t, fileHasContent(local, "/a.txt", "remote"))
+	assert.True(t, fileHasContent(local, "/b.txt", "remote"))
+	assert.True(t, fileHasContent(local, "/c.txt", "remote"))
+	assert.True(t, fileHasContent(local, "/d.txt", "local"))
+	assert.True(t, fileHasContent(local, "/e.txt", "remote"))
+}
+
+func TestPushPaged(t *testing.T) {
+	local := fileprovider.NewInMemoryProvider("client")
+	remote := fileprovider.NewInMemoryProvider("client")
+	syncer := New(local, remote)
+	syncer.pageSize = 2
+
+	assert.Nil(t, setFileContent(remote, fileprovider.FileInfo{Path: "/b.txt", Updated: getDate(0)}, "remote"))
+	assert.Nil(t, setFileContent(remote, fileprovider.FileInfo{Path: "/d.txt", Updated: getDate(0)}, "remote"))
+	assert.Nil(t, setFileContent(local, fileprovider.FileInfo{Path: "/e.txt", Updated: getDate(1)}, "local"))
+	assert.Nil(t, setFileContent(local, fileprovider.FileInfo{Path: "/a.txt", Updated: getDate(1)}, "local"))
+	assert.Nil(t, setFileContent(local, fileprovider.FileInfo{Path: "/b.txt", Updated: getDate(1), LastSynced: getDate(0)}, "local"))
+	assert.Nil(t, setFileContent(local, fileprovider.FileInfo{Path: "/c.txt", Updated: getDate(1)}, "local"))
+
+	err := syncer.Push()
+	assert.Nil(t, err)
+
+	assert.True(t, fileHasContent(remote, "/a.txt", "local"))
+	assert.True(t, fileHasContent(remote, "/b.txt", "local"))
+	assert.True(t, fileHasContent(remote, "/c.txt", "local"))
+	assert.True(t, fileHasContent(remote, "/d.txt", "remote"))
+	assert.True(t, fileHasContent(remote, "/e.txt", "local"))
+}
+
+func TestPushParallel(t *testing.T) {
+	local := fileprovider.NewInMemoryProvider("client")
+	remote := fileprovider.NewInMemoryProvider("client")
+	syncer := New(local, remote)
+	syncer.SetJobs(8)
+	syncer.pageSize = 10
+
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, setFileContent(local, fileprovider.FileInfo{Path: fmt.Sprintf("/%03d.txt", i), Updated: getDate(1)}, fmt.Sprintf("local %v", i)))
+	}
+
+	err := syncer.Push()
+	assert.Nil(t, err)
+
+	for i := 0; i < 100; i++ {
+		assert.True(t, fileHasContent(remote, fmt.Sprintf("/%03d.txt", i), fmt.Sprintf("local %v", i)))
+	}
+}
+
+func TestPullParallel(t *testing.T) {
+	local := fileprovider.NewInMemoryProvider("client")
+	remote := fileprovider.NewInMemoryProvider("client")
+	syncer := New(local, remote)
+	syncer.SetJobs(8)
+	syncer.pageSize = 10
+
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, setFileContent(remote, fileprovider.FileInfo{Path: fmt.Sprintf("/%03d.txt", i), Updated: getDate(1)}, fmt.Sprintf("remote %v", i)))
+	}
+
+	err := syncer.Pull()
+	assert.Nil(t, err)
+
+	for i := 0; i < 100; i++ {
+		assert.True(t, fileHasContent(local, fmt.Sprintf("/%03d.txt", i), fmt.Sprintf("remote %v", i)))
+	}
+}
+
 func setFileContent(fp fileprovider.FileProvider, fi fileprovider.FileInfo, content string) error {
 	err := fp.StoreFile(fi, strings.NewReader(content))
 	if err != nil {
@@ -181,3 +293,145 @@ func setFileContent(fp fileprovider.FileProvider, fi fileprovider.FileInfo, cont
 func getDate(hourOffset int) time.Time {
 	return time.Date(2020, 6, 10, 12, 0, 0, 0, time.UTC).Add(time.Hour * time.Duration(hourOffset))
 }
+
+func TestPushSelected(t *testing.T) {
+	local := fileprovider.NewInMemoryProvider("client")
+	remote := fileprovider.NewInMemoryProvider("client")
+	syncer := New(local, remote)
+
+	assert.Nil(t, setFileContent(local, fileprovider.FileInfo{Path: "/docs/a.txt", Updated: getDate(1)}, "local"))
+	assert.Nil(t, setFileContent(local, fileprovider.FileInfo{Path: "/b.txt", Updated: getDate(1)}, "local"))
+	//Newer on the remote, but not selected so it doesn't block the push
+	assert.Nil(t, setFileContent(local, fileprovider.FileInfo{Path: "/c.txt", Updated: getDate(0), LastSynced: getDate(0)}, "local"))
+	assert.Nil(t, setFileContent(remote, fileprovider.FileInfo{Path: "/c.txt", Updated: getDate(1)}, "remote"))
+
+	filter, err := fileprovider.NewPathFilter("", []string{"docs"})
+	assert.Nil(t, err)
+	syncer.SetFilter(filter)
+
+	err = syncer.Push()
+	assert.Nil(t, err)
+
+	assert.True(t, fileHasContent(remote, "/docs/a.txt", "local"))
+	_, err = remote.GetFileInfo("/b.txt")
+	assert.NotNil(t, err)
+
+	fi, err := local.GetFileInfo("/docs/a.txt")
+	assert.Nil(t, err)
+	assert.True(t, fi.LastSynced.Equal(getDate(1)))
+	fi, err = local.GetFileInfo("/b.txt")
+	assert.Nil(t, err)
+	assert.True(t, fi.LastSynced.IsZero())
+}
+
+func TestPullSelected(t *testing.T) {
+	local := fileprovider.NewInMemoryProvider("client")
+	remote := fileprovider.NewInMemoryProvider("client")
+	syncer := New(local, remote)
+
+	assert.Nil(t, setFileContent(remote, fileprovider.FileInfo{Path: "/a.jpg", Updated: getDate(1)}, "remote"))
+	assert.Nil(t, setFileContent(remote, fileprovider.FileInfo{Path: "/sub/b.jpg", Updated: getDate(1)}, "remote"))
+	assert.Nil(t, setFileContent(remote, fileprovider.FileInfo{Path: "/c.txt", Updated: getDate(1)}, "remote"))
+
+	filter, err := fileprovider.NewPathFilter("", []string{"*.jpg"})
+	assert.Nil(t, err)
+	syncer.SetFilter(filter)
+
+	err = syncer.Pull()
+	assert.Nil(t, err)
+
+	assert.True(t, fileHasContent(local, "/a.jpg", "remote"))
+	assert.True(t, fileHasContent(local, "/sub/b.jpg", "remote"))
+	_, err = local.GetFileInfo("/c.txt")
+	assert.NotNil(t, err)
+}
+
+func TestIgnoredFilesAreNotSynced(t *testing.T) {
+	dir := t.TempDir()
+	assert.Nil(t, os.WriteFile(path.Join(dir, ".buttercupignore"), []byte("*.tmp\n"), 0644))
+	assert.Nil(t, os.WriteFile(path.Join(dir, "c.tmp"), []byte("local"), 0644))
+	local := fileprovider.NewFsProvider(appconfig.ProviderConfig{ClientName: "client", FsConfig: &appconfig.FsProviderConfig{Path: dir}})
+	defer local.Close()
+	remote := fileprovider.NewInMemoryProvider("client")
+	syncer := New(local, remote)
+
+	assert.Nil(t, setFileContent(remote, fileprovider.FileInfo{Path: "/a.txt", Updated: getDate(1)}, "remote"))
+	assert.Nil(t, setFileContent(remote, fileprovider.FileInfo{Path: "/b.tmp", Updated: getDate(1)}, "remote"))
+
+	err := syncer.Sync()
+	assert.Nil(t, err)
+
+	assert.True(t, fileHasContent(local, "/a.txt", "remote"))
+	_, err = local.GetFileInfo("/b.tmp")
+	assert.NotNil(t, err)
+	_, err = remote.GetFileInfo("/c.tmp")
+	assert.NotNil(t, err)
+	assert.True(t, fileHasContent(remote, "/.buttercupignore", "*.tmp\n"))
+}
+
+func TestPermissionsAreSynced(t *testing.T) {
+	dirA := t.TempDir()
+	assert.Nil(t, os.WriteFile(path.Join(dirA, "run.sh"), []byte("echo hi"), 0755))
+	localA := fileprovider.NewFsProvider(appconfig.ProviderConfig{ClientName: "a", FsConfig: &appconfig.FsProviderConfig{Path: dirA}})
+	defer localA.Close()
+	dirB := t.TempDir()
+	localB := fileprovider.NewFsProvider(appconfig.ProviderConfig{ClientName: "b", FsConfig: &appconfig.FsProviderConfig{Path: dirB}})
+	defer localB.Close()
+	remote := fileprovider.NewInMemoryProvider("a")
+
+	assert.Nil(t, New(localA, remote).Push())
+	assert.Nil(t, New(localB, remote).Pull())
+	info, err := os.Stat(path.Join(dirB, "run.sh"))
+	assert.Nil(t, err)
+	assert.Equal(t, info.Mode().Perm(), os.FileMode(0755))
+
+	//A chmod on its own is synced as well
+	assert.Nil(t, os.Chmod(path.Join(dirA, "run.sh"), 0700))
+	assert.Nil(t, localA.Rescan())
+	assert.Nil(t, New(localA, remote).Push())
+	assert.Nil(t, New(localB, remote).Pull())
+	info, err = os.Stat(path.Join(dirB, "run.sh"))
+	assert.Nil(t, err)
+	assert.Equal(t, info.Mode().Perm(), os.FileMode(0700))
+}
+
+func TestFoldersAndSymlinksAreSynced(t *testing.T) {
+	dirA := t.TempDir()
+	assert.Nil(t, os.MkdirAll(path.Join(dirA, "empty"), 0700))
+	assert.Nil(t, os.WriteFile(path.Join(dirA, "a.txt"), []byte("a"), 0644))
+	assert.Nil(t, os.Symlink("a.txt", path.Join(dirA, "link")))
+	localA := fileprovider.NewFsProvider(appconfig.ProviderConfig{ClientName: "a", FsConfig: &appconfig.FsProviderConfig{Path: dirA}, Symlinks: fileprovider.SymlinksPreserve})
+	defer localA.Close()
+	dirB := t.TempDir()
+	localB := fileprovider.NewFsProvider(appconfig.ProviderConfig{ClientName: "b", FsConfig: &appconfig.FsProviderConfig{Path: dirB}, Symlinks: fileprovider.SymlinksPreserve})
+	defer localB.Close()
+	remote := fileprovider.NewInMemoryProvider("a")
+
+	assert.Nil(t, New(localA, remote).Push())
+	assert.Nil(t, New(localB, remote).Pull())
+
+	info, err := os.Stat(path.Join(dirB, "empty"))
+	assert.Nil(t, err)
+	assert.True(t, info.IsDir())
+	assert.Equal(t, info.Mode().Perm(), os.FileMode(0700))
+	target, err := os.Readlink(path.Join(dirB, "link"))
+	assert.Nil(t, err)
+	assert.Equal(t, target, "a.txt")
+
+	//Once they're pulled, there's nothing left to push
+	assert.Nil(t, localB.Rescan())
+	plan, err := New(localB, remote).PlanPush()
+	assert.Nil(t, err)
+	assert.Equal(t, len(plan.Entries), 0)
+
+	//Removing them is synced too
+	assert.Nil(t, os.Remove(path.Join(dirA, "empty")))
+	assert.Nil(t, os.Remove(path.Join(dirA, "link")))
+	assert.Nil(t, localA.Rescan())
+	assert.Nil(t, New(localA, remote).Push())
+	assert.Nil(t, New(localB, remote).Pull())
+	_, err = os.Lstat(path.Join(dirB, "empty"))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Lstat(path.Join(dirB, "link"))
+	assert.True(t, os.IsNotExist(err))
+}
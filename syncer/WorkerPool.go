@@ -0,0 +1,58 @@
+package syncer
+
+import "sync"
+
+// Runs transfers on a fixed number of goroutines. With a single job, everything runs in order on the calling goroutine.
+func newWorkerPool(jobs int) *workerPool {
+	pool := &workerPool{}
+	if jobs <= 1 {
+		return pool
+	}
+
+	pool.queue = make(chan func())
+	for i := 0; i < jobs; i++ {
+		pool.wg.Add(1)
+		go func() {
+			defer pool.wg.Done()
+			for task := range pool.queue {
+				task()
+				pool.pending.Done()
+			}
+		}()
+	}
+
+	return pool
+}
+
+type workerPool struct {
+	queue chan func()
+	wg    sync.WaitGroup
+	//Tasks that are submitted but not done yet
+	pending sync.WaitGroup
+	closed  bool
+}
+
+// Run a task, blocks while all workers are busy.
+func (p *workerPool) submit(task func()) {
+	if p.queue == nil {
+		task()
+		return
+	}
+	p.pending.Add(1)
+	p.queue <- task
+}
+
+// Wait for the submitted tasks to finish. The pool can still be used afterwards.
+func (p *workerPool) drain() {
+	p.pending.Wait()
+}
+
+// Wait for all submitted tasks to finish. The pool can't be used afterwards.
+func (p *workerPool) wait() {
+	if p.queue == nil || p.closed {
+		return
+	}
+	p.closed = true
+	close(p.queue)
+	p.wg.Wait()
+}
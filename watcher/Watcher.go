@@ -0,0 +1,230 @@
+package watcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/c00/buttercup/fileprovider"
+	"github.com/c00/buttercup/logger"
+	"github.com/c00/buttercup/syncer"
+	"github.com/fsnotify/fsnotify"
+)
+
+const defaultDebounce = 2 * time.Second
+const defaultMaxDelay = 30 * time.Second
+const defaultPollInterval = time.Minute
+
+// Files buttercup keeps in the folder itself (index, journals, locks). Changes to them don't trigger a sync.
+const internalFilePrefix = ".buttercup-"
+
+// A local provider that can pick up changes made to the folder since it was created.
+type rescanner interface {
+	Rescan() error
+	ScanPaths(paths []string) error
+	IsUnchanged(path string) bool
+}
+
+// Keeps a folder in sync. Syncs when local files change, and polls the remote for changes of other clients.
+// The remote is created fresh for every sync, so its index is never stale.
+func New(path string, local fileprovider.FileProvider, newRemote func() fileprovider.FileProvider) *Watcher {
+	return &Watcher{
+		path:         strings.TrimSuffix(path, "/"),
+		local:        local,
+		newRemote:    newRemote,
+		Debounce:     defaultDebounce,
+		MaxDelay:     defaultMaxDelay,
+		PollInterval: defaultPollInterval,
+		Jobs:         1,
+	}
+}
+
+type Watcher struct {
+	path      string
+	local     fileprovider.FileProvider
+	newRemote func() fileprovider.FileProvider
+	//How long the folder has to be quiet before syncing
+	Debounce time.Duration
+	//Sync at the latest this long after the first change, even if the folder doesn't quiet down
+	MaxDelay time.Duration
+	//How often to check the remote for changes
+	PollInterval time.Duration
+	//Amount of files to transfer at the same time
+	Jobs int
+}
+
+// Watch the folder until the context is cancelled. Syncs once at the start.
+func (w *Watcher) Run(ctx context.Context) error {
+	fsw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("cannot start watching: %w", err)
+	}
+	defer fsw.Close()
+
+	err = w.addRecursive(fsw, w.path)
+	if err != nil {
+		return fmt.Errorf("cannot watch %v: %w", w.path, err)
+	}
+
+	//Changed paths since the last sync. Events can be missed, so the sync after a problem scans everything.
+	//The local provider scanned everything when it was created, the first sync doesn't have to do that again.
+	changed := map[string]bool{}
+	fullScan := false
+	w.sync(changed, &fullScan)
+
+	timer := time.NewTimer(w.Debounce)
+	stopTimer(timer)
+	poll := time.NewTicker(w.PollInterval)
+	defer poll.Stop()
+
+	pending := false
+	var firstChange time.Time
+
+	schedule := func() {
+		now := time.Now()
+		if !pending {
+			pending = true
+			firstChange = now
+		}
+
+		delay := w.Debounce
+		if remaining := firstChange.Add(w.MaxDelay).Sub(now); remaining < delay {
+			delay = max(remaining, 0)
+		}
+
+		stopTimer(timer)
+		timer.Reset(delay)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+
+		case event, ok := <-fsw.Events:
+			if !ok {
+				return nil
+			}
+			if strings.HasPrefix(filepath.Base(event.Name), internalFilePrefix) {
+				continue
+			}
+
+			if event.Has(fsnotify.Create) {
+				//New directories need to be watched as well
+				info, err := os.Stat(event.Name)
+				if err == nil && info.IsDir() {
+					err = w.addRecursive(fsw, event.Name)
+					if err != nil {
+						logger.Warn("cannot watch %v: %v", event.Name, err)
+					}
+				}
+			}
+
+			relativePath := strings.TrimPrefix(event.Name, w.path)
+			//Files the last sync pulled look exactly like the index has them
+			if r, ok := w.local.(rescanner); ok && r.IsUnchanged(relativePath) {
+				logger.Debug("unchanged: %v", event)
+				continue
+			}
+
+			logger.Debug("change: %v", event)
+			changed[relativePath] = true
+			schedule()
+
+		case err, ok := <-fsw.Errors:
+			if !ok {
+				return nil
+			}
+			//Missed events are picked up by the scan before syncing
+			logger.Warn("watch error: %v", err)
+			if errors.Is(err, fsnotify.ErrEventOverflow) {
+				fullScan = true
+				schedule()
+			}
+
+		case <-timer.C:
+			pending = false
+			w.sync(changed, &fullScan)
+
+		case <-poll.C:
+			if !pending {
+				w.sync(changed, &fullScan)
+			}
+		}
+	}
+}
+
+// Scan what changed, pull and push. Errors are logged, the next change or poll tries again.
+// Changed paths are cleared once they are scanned.
+func (w *Watcher) sync(changed map[string]bool, fullScan *bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			logger.Error("sync of %v failed: %v", w.path, r)
+		}
+	}()
+
+	if r, ok := w.local.(rescanner); ok {
+		var err error
+		if *fullScan {
+			err = r.Rescan()
+		} else {
+			paths := make([]string, 0, len(changed))
+			for p := range changed {
+				paths = append(paths, p)
+			}
+			err = r.ScanPaths(paths)
+		}
+		if err != nil {
+			logger.Error("cannot scan %v: %v", w.path, err)
+			*fullScan = true
+			return
+		}
+	}
+	clear(changed)
+	*fullScan = false
+
+	remote := w.newRemote()
+	defer remote.Close()
+
+	s := syncer.New(w.local, remote)
+	s.SetJobs(w.Jobs)
+
+	logger.Info("Pulling changes for %v...", w.path)
+	err := s.Pull()
+	if err != nil {
+		logger.Error("pull of %v failed: %v", w.path, err)
+		return
+	}
+
+	logger.Info("Pushing changes for %v...", w.path)
+	err = s.Push()
+	if err != nil {
+		logger.Error("push of %v failed: %v", w.path, err)
+	}
+}
+
+func (w *Watcher) addRecursive(fsw *fsnotify.Watcher, root string) error {
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		return fsw.Add(path)
+	})
+}
+
+func stopTimer(timer *time.Timer) {
+	if !timer.Stop() {
+		select {
+		case <-timer.C:
+		default:
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package watcher
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/c00/buttercup/appconfig"
+	"github.com/c00/buttercup/fileprovider"
+	"github.com/stretchr/testify/assert"
+)
+
+// The remote is shared with the test, so it is only handed out to one sync at a time.
+type sharedRemote struct {
+	*fileprovider.InMemoryProvider
+	mu *sync.Mutex
+}
+
+func (r sharedRemote) Close() error {
+	r.mu.Unlock()
+	return nil
+}
+
+func setup(t *testing.T) (string, *sharedRemote, *Watcher) {
+	dir := t.TempDir()
+	local := fileprovider.NewFsProvider(appconfig.ProviderConfig{
+		Type:       fileprovider.TypeFs,
+		ClientName: "client",
+		FsConfig:   &appconfig.FsProviderConfig{Path: dir},
+	})
+	t.Cleanup(func() { local.Close() })
+
+	remote := &sharedRemote{InMemoryProvider: fileprovider.NewInMemoryProvider("client"), mu: &sync.Mutex{}}
+	w := New(dir, local, func() fileprovider.FileProvider {
+		remote.mu.Lock()
+		return *remote
+	})
+	w.Debounce = 50 * time.Millisecond
+	w.MaxDelay = time.Second
+
+	return dir, remote, w
+}
+
+func TestWatcher_PushesLocalChanges(t *testing.T) {
+	dir, remote, w := setup(t)
+	w.PollInterval = time.Hour
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- w.Run(ctx) }()
+
+	//Wait for the initial sync to be done, and the watch to be set up
+	time.Sleep(200 * time.Millisecond)
+
+	assert.Nil(t, os.MkdirAll(filepath.Join(dir, "sub"), 0755))
+	time.Sleep(100 * time.Millisecond)
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "sub", "foo.txt"), []byte("foo"), 0644))
+
+	assert.Eventually(t, func() bool {
+		remote.mu.Lock()
+		defer remote.mu.Unlock()
+		_, err := remote.GetFileInfo("/sub/foo.txt")
+		return err == nil
+	}, 5*time.Second, 50*time.Millisecond)
+
+	cancel()
+	assert.Nil(t, <-done)
+}
+
+func TestWatcher_PollsRemote(t *testing.T) {
+	dir, remote, w := setup(t)
+	w.PollInterval = 100 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- w.Run(ctx) }()
+
+	remote.mu.Lock()
+	assert.Nil(t, remote.StoreFile(fileprovider.FileInfo{Path: "/bar.txt", Updated: time.Now()}, strings.NewReader("bar")))
+	remote.mu.Unlock()
+
+	assert.Eventually(t, func() bool {
+		data, err := os.ReadFile(filepath.Join(dir, "bar.txt"))
+		return err == nil && string(data) == "bar"
+	}, 5*time.Second, 50*time.Millisecond)
+
+	cancel()
+	assert.Nil(t, <-done)
+}
+
+func TestWatcher_IgnoresPulledFiles(t *testing.T) {
+	dir, remote, w := setup(t)
+	w.PollInterval = time.Hour
+
+	var syncs atomic.Int32
+	newRemote := w.newRemote
+	w.newRemote = func() fileprovider.FileProvider {
+		syncs.Add(1)
+		return newRemote()
+	}
+
+	assert.Nil(t, remote.StoreFile(fileprovider.FileInfo{Path: "/sub/bar.txt", Updated: time.Now()}, strings.NewReader("bar")))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- w.Run(ctx) }()
+
+	assert.Eventually(t, func() bool {
+		data, err := os.ReadFile(filepath.Join(dir, "sub", "bar.txt"))
+		return err == nil && string(data) == "bar"
+	}, 5*time.Second, 50*time.Millisecond)
+
+	//Pulling doesn't count as a change
+	time.Sleep(500 * time.Millisecond)
+	assert.Equal(t, syncs.Load(), int32(1))
+
+	//Changing the pulled file does
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "sub", "bar.txt"), []byte("changed"), 0644))
+	assert.Eventually(t, func() bool { return syncs.Load() == 2 }, 5*time.Second, 50*time.Millisecond)
+
+	cancel()
+	assert.Nil(t, <-done)
+}